@@ -48,7 +48,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return &be, nil
 }
 
-func (be *AliVpcBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+func (be *AliVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// 1. Parse our configuration
 	cfg := struct {
 		AccessKeyID     string
@@ -145,12 +145,34 @@ func (be *AliVpcBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup,
 	if err := c.WaitForAllRouteEntriesAvailable(vRouterId, rTableId, 60); err != nil {
 		return nil, err
 	}
-	return &backend.SimpleNetwork{
-		SubnetLease: l,
-		ExtIface:    be.extIface,
+	return &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    be.extIface,
+		},
+		client:       c,
+		routeTableID: rTableId,
+		instanceID:   instanceid,
 	}, nil
 }
 
+// network deletes the route entry of its subnet on teardown.
+type network struct {
+	backend.SimpleNetwork
+	client       *ecs.Client
+	routeTableID string
+	instanceID   string
+}
+
+func (n *network) Teardown(ctx context.Context) error {
+	log.Infof("Deleting route entry: rtableid=%s, CIDR=%s, NextHop=%s", n.routeTableID, n.SubnetLease.Subnet, n.instanceID)
+	return n.client.DeleteRouteEntry(&ecs.DeleteRouteEntryArgs{
+		RouteTableId:         n.routeTableID,
+		DestinationCidrBlock: n.SubnetLease.Subnet.String(),
+		NextHopId:            n.instanceID,
+	})
+}
+
 func (be *AliVpcBackend) recreateRoute(c *ecs.Client, table ecs.RouteTableSetType, route *ecs.CreateRouteEntryArgs) error {
 	exist := false
 	for _, e := range table.RouteEntrys.RouteEntry {
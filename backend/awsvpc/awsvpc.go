@@ -80,7 +80,7 @@ func (conf *backendConfig) routeTableConfigured() bool {
 	return configured
 }
 
-func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// Parse our configuration
 	var cfg backendConfig
 
@@ -179,12 +179,49 @@ func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup,
 		}
 	}
 
-	return &backend.SimpleNetwork{
-		SubnetLease: l,
-		ExtIface:    be.extIface,
+	return &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    be.extIface,
+		},
+		be:     be,
+		ec2c:   ec2c,
+		eniID:  eni.NetworkInterfaceId,
+		tables: tables,
 	}, nil
 }
 
+// network deletes the route to its subnet from the route tables on teardown.
+type network struct {
+	backend.SimpleNetwork
+	be     *AwsVpcBackend
+	ec2c   *ec2.EC2
+	eniID  *string
+	tables []string
+}
+
+func (n *network) Teardown(ctx context.Context) error {
+	cidrBlock := n.SubnetLease.Subnet.String()
+	for _, routeTableID := range n.tables {
+		// Leave the route alone if the subnet was handed to another instance
+		found, err := n.be.checkMatchingRoutes(routeTableID, cidrBlock, n.eniID, n.ec2c)
+		if err != nil {
+			return fmt.Errorf("error describing route table %s: %v", routeTableID, err)
+		} else if !found {
+			continue
+		}
+
+		log.Infof("Deleting route %s from table %s", cidrBlock, routeTableID)
+		deleteRouteInput := &ec2.DeleteRouteInput{RouteTableId: aws.String(routeTableID), DestinationCidrBlock: aws.String(cidrBlock)}
+		if _, err := n.ec2c.DeleteRoute(deleteRouteInput); err != nil {
+			if ec2err, ok := err.(awserr.Error); !ok || ec2err.Code() != "InvalidRoute.NotFound" {
+				return fmt.Errorf("error deleting route for %s: %v", cidrBlock, err)
+			}
+		}
+	}
+	return nil
+}
+
 func (be *AwsVpcBackend) cleanupBlackholeRoutes(routeTableID string, network ip.IP4Net, ec2c *ec2.EC2) error {
 	filter := newFilter()
 	filter.Add("route.state", "blackhole")
@@ -0,0 +1,111 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package backend
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// DeleteLinks deletes the devices whose name matches. Deleting a device also
+// removes its addresses, routes and neighbor entries.
+func DeleteLinks(match func(name string) bool) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list devices: %v", err)
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if !match(name) {
+			continue
+		}
+		log.Infof("Deleting device %v", name)
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete device %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// CheckLinks returns an error naming the devices that don't exist.
+func CheckLinks(names ...string) error {
+	var missing []string
+	for _, name := range names {
+		if _, err := netlink.LinkByName(name); err != nil {
+			missing = append(missing, fmt.Sprintf("%v (%v)", name, err))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing devices: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// DeleteRoutes deletes the routes through a gateway to subnets of the network,
+// which host-gw and direct routing add for the leases of other nodes.
+func DeleteRoutes(config *subnet.Config) error {
+	families := []int{netlink.FAMILY_V4}
+	if config.IPv6Enabled() {
+		families = append(families, netlink.FAMILY_V6)
+	}
+
+	for _, family := range families {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return fmt.Errorf("failed to list routes: %v", err)
+		}
+		for _, route := range routes {
+			if !isSubnetRoute(config, route) {
+				continue
+			}
+			log.Infof("Deleting route to %v via %v", route.Dst, route.Gw)
+			if err := netlink.RouteDel(&route); err != nil {
+				return fmt.Errorf("failed to delete route to %v: %v", route.Dst, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isSubnetRoute tells whether the route leads through a gateway to a subnet
+// within the network.
+func isSubnetRoute(config *subnet.Config, route netlink.Route) bool {
+	if route.Dst == nil || route.Gw == nil {
+		return false
+	}
+
+	if route.Dst.IP.To4() != nil {
+		dst := ip.FromIPNet(route.Dst)
+		for _, pool := range config.Pools() {
+			if dst.PrefixLen >= pool.PrefixLen && pool.Contains(dst.IP) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !config.IPv6Enabled() {
+		return false
+	}
+	dst := ip.FromIP6Net(route.Dst)
+	return dst.PrefixLen >= config.IPv6Network.PrefixLen && config.IPv6Network.Contains(dst.IP)
+}
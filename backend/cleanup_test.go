@@ -0,0 +1,56 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+	"github.com/vishvananda/netlink"
+)
+
+func TestIsSubnetRoute(t *testing.T) {
+	config := &subnet.Config{
+		Network:     ip.IP4Net{IP: ip.MustParseIP4("10.1.0.0"), PrefixLen: 16},
+		Networks:    []ip.IP4Net{{IP: ip.MustParseIP4("10.3.0.0"), PrefixLen: 16}},
+		IPv6Network: ip.IP6Net{IP: ip.MustParseIP6("fc00::"), PrefixLen: 48},
+	}
+
+	for _, tc := range []struct {
+		dst, gw string
+		want    bool
+	}{
+		{"10.1.2.0/24", "192.168.0.2", true},
+		{"10.3.7.0/24", "192.168.0.3", true},
+		{"10.2.2.0/24", "192.168.0.2", false},
+		// The route of the whole network is no peer's
+		{"10.0.0.0/8", "192.168.0.2", false},
+		{"10.1.2.0/24", "", false},
+		{"fc00:0:0:1::/64", "fe80::2", true},
+		{"fc01::/64", "fe80::2", false},
+	} {
+		_, dst, err := net.ParseCIDR(tc.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		route := netlink.Route{Dst: dst, Gw: net.ParseIP(tc.gw)}
+		if got := isSubnetRoute(config, route); got != tc.want {
+			t.Errorf("route to %v via %q: got %v, want %v", tc.dst, tc.gw, got, tc.want)
+		}
+	}
+}
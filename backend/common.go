@@ -16,10 +16,12 @@ package backend
 
 import (
 	"net"
+	"sort"
 	"sync"
 
 	"golang.org/x/net/context"
 
+	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -27,6 +29,10 @@ type ExternalInterface struct {
 	Iface     *net.Interface
 	IfaceAddr net.IP
 	ExtAddr   net.IP
+
+	// Only set if the interface has a global IPv6 address or one was given
+	IfaceV6Addr net.IP
+	ExtV6Addr   net.IP
 }
 
 // Besides the entry points in the Backend interface, the backend's New()
@@ -34,14 +40,126 @@ type ExternalInterface struct {
 // external IP addresses, MTU, etc) which it should cache for later use if
 // needed.
 type Backend interface {
-	// Called when the backend should create or begin managing a new network
-	RegisterNetwork(ctx context.Context, wg sync.WaitGroup, config *subnet.Config) (Network, error)
+	// Called when the backend should create or begin managing a new network.
+	// Goroutines that outlive the call, like a helper daemon, are added to wg
+	// and finish once ctx is done.
+	RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (Network, error)
 }
 
 type Network interface {
 	Lease() *subnet.Lease
 	MTU() int
+	// Run manages the network until ctx is done.
 	Run(ctx context.Context)
+	// Teardown removes what the network set up, on the host and in the cloud,
+	// like devices, routes and IKE connections. It's called after Run returned,
+	// unless the network is left in place for the next flanneld to pick up.
+	Teardown(ctx context.Context) error
 }
 
 type BackendCtor func(sm subnet.Manager, ei *ExternalInterface) (Backend, error)
+
+// CleanupFunc removes what a backend has set up on the host for a network, such
+// as its devices and routes. It succeeds when there's nothing left to remove.
+type CleanupFunc func(config *subnet.Config) error
+
+// SplitSubnetEvents turns the events of leases with additional subnets into
+// one event per subnet, so that every subnet gets routed the same way. Only the
+// event of the main subnet carries the IPv6 subnet.
+func SplitSubnetEvents(batch []subnet.Event) []subnet.Event {
+	var events []subnet.Event
+	for _, evt := range batch {
+		events = append(events, evt)
+		for _, sn := range evt.Lease.AdditionalSubnets {
+			extra := evt
+			extra.Lease.Subnet = sn
+			extra.Lease.IPv6Subnet = ip.IP6Net{}
+			extra.Lease.AdditionalSubnets = nil
+			events = append(events, extra)
+		}
+	}
+	return events
+}
+
+// SyncedNetwork is implemented by networks that can tell when they have set up
+// the leases that existed when they started running.
+type SyncedNetwork interface {
+	// Synced returns a channel that is closed once the initial leases have been
+	// set up.
+	Synced() <-chan struct{}
+}
+
+// CheckedNetwork is implemented by networks that can check that the devices
+// they set up on the host are still in place.
+type CheckedNetwork interface {
+	// CheckDevices returns an error naming the devices that are missing.
+	CheckDevices() error
+}
+
+// InspectedNetwork is implemented by networks that can compare the entries
+// they program into the kernel for the other nodes with those the kernel has.
+type InspectedNetwork interface {
+	// Inspect returns a diff for each kind of entry, by EntryRoute, EntryARP
+	// or EntryFDB. config is the config the network runs with.
+	Inspect(config *subnet.Config) (map[string]*EntryDiff, error)
+}
+
+// EntryDiff compares the entries of one kind that a network expects in the
+// kernel with the entries there.
+type EntryDiff struct {
+	// Expected are the entries the network has set up.
+	Expected []string `json:"expected"`
+	// Missing are the expected entries the kernel doesn't have.
+	Missing []string `json:"missing"`
+	// Unexpected are entries the kernel has where the network expects none.
+	Unexpected []string `json:"unexpected"`
+}
+
+// NewEntryDiff compares the expected entries with the actual ones. actual only
+// needs to hold the entries the network is responsible for.
+func NewEntryDiff(expected, actual []string) *EntryDiff {
+	if expected == nil {
+		expected = []string{}
+	}
+	d := &EntryDiff{Expected: expected, Missing: []string{}, Unexpected: []string{}}
+	seen := make(map[string]bool)
+	for _, e := range actual {
+		seen[e] = true
+	}
+	want := make(map[string]bool)
+	for _, e := range expected {
+		want[e] = true
+		if !seen[e] {
+			d.Missing = append(d.Missing, e)
+		}
+	}
+	for _, e := range actual {
+		if !want[e] {
+			d.Unexpected = append(d.Unexpected, e)
+		}
+	}
+	sort.Strings(d.Expected)
+	sort.Strings(d.Missing)
+	sort.Strings(d.Unexpected)
+	return d
+}
+
+// SyncSignal implements SyncedNetwork for the networks embedding it. The zero
+// value is ready to use.
+type SyncSignal struct {
+	init   sync.Once
+	done   sync.Once
+	synced chan struct{}
+}
+
+func (s *SyncSignal) Synced() <-chan struct{} {
+	s.init.Do(func() { s.synced = make(chan struct{}) })
+	return s.synced
+}
+
+// MarkSynced is called once the first batch of subnet.WatchLeases, which brings
+// the network up to date, has been handled.
+func (s *SyncSignal) MarkSynced() {
+	s.Synced()
+	s.done.Do(func() { close(s.synced) })
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -36,6 +37,8 @@ type network struct {
 	postStartupCommand  string
 	subnetAddCommand    string
 	subnetRemoveCommand string
+	// subnets holds the leases of the other nodes that were added.
+	subnets map[ip.IP4Net]subnet.Lease
 }
 
 func (n *network) Lease() *subnet.Lease {
@@ -80,6 +83,7 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				log.Warningf("Ignoring non-extension subnet: type=%v", evt.Lease.Attrs.BackendType)
 				continue
 			}
+			n.subnets[evt.Lease.Subnet] = evt.Lease
 
 			if len(n.subnetAddCommand) > 0 {
 				backendData := ""
@@ -112,30 +116,47 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				continue
 			}
 
-			if len(n.subnetRemoveCommand) > 0 {
-				backendData := ""
-
-				if len(evt.Lease.Attrs.BackendData) > 0 {
-					if err := json.Unmarshal(evt.Lease.Attrs.BackendData, &backendData); err != nil {
-						log.Errorf("failed to unmarshal BackendData: %v", err)
-						continue
-					}
-				}
-				cmd_output, err := runCmd([]string{
-					fmt.Sprintf("SUBNET=%s", evt.Lease.Subnet),
-					fmt.Sprintf("PUBLIC_IP=%s", evt.Lease.Attrs.PublicIP)},
-					backendData,
-					"sh", "-c", n.subnetRemoveCommand)
-
-				if err != nil {
-					log.Errorf("failed to run command: %s Err: %v Output: %s", n.subnetRemoveCommand, err, cmd_output)
-				} else {
-					log.Infof("Ran command: %s\n Output: %s", n.subnetRemoveCommand, cmd_output)
-				}
-			}
+			delete(n.subnets, evt.Lease.Subnet)
+			n.removeSubnet(evt.Lease)
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
 		}
 	}
 }
+
+// removeSubnet runs the SubnetRemoveCommand for a lease.
+func (n *network) removeSubnet(lease subnet.Lease) {
+	if len(n.subnetRemoveCommand) == 0 {
+		return
+	}
+
+	backendData := ""
+	if len(lease.Attrs.BackendData) > 0 {
+		if err := json.Unmarshal(lease.Attrs.BackendData, &backendData); err != nil {
+			log.Errorf("failed to unmarshal BackendData: %v", err)
+			return
+		}
+	}
+	cmd_output, err := runCmd([]string{
+		fmt.Sprintf("SUBNET=%s", lease.Subnet),
+		fmt.Sprintf("PUBLIC_IP=%s", lease.Attrs.PublicIP)},
+		backendData,
+		"sh", "-c", n.subnetRemoveCommand)
+
+	if err != nil {
+		log.Errorf("failed to run command: %s Err: %v Output: %s", n.subnetRemoveCommand, err, cmd_output)
+	} else {
+		log.Infof("Ran command: %s\n Output: %s", n.subnetRemoveCommand, cmd_output)
+	}
+}
+
+// Teardown runs the SubnetRemoveCommand for the subnets of the other nodes that
+// were added.
+func (n *network) Teardown(ctx context.Context) error {
+	for _, lease := range n.subnets {
+		n.removeSubnet(lease)
+	}
+	n.subnets = make(map[ip.IP4Net]subnet.Lease)
+	return nil
+}
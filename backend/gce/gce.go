@@ -82,7 +82,7 @@ func (g *GCEBackend) ensureAPI() error {
 	return err
 }
 
-func (g *GCEBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+func (g *GCEBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	attrs := subnet.LeaseAttrs{
 		PublicIP: ip.FromIP(g.extIface.ExtAddr),
 	}
@@ -119,12 +119,45 @@ func (g *GCEBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup, con
 		}
 	}
 
-	return &backend.SimpleNetwork{
-		SubnetLease: l,
-		ExtIface:    g.extIface,
+	return &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    g.extIface,
+		},
+		api: g.api,
 	}, nil
 }
 
+// network deletes the route to its subnet on teardown.
+type network struct {
+	backend.SimpleNetwork
+	api *gceAPI
+}
+
+func (n *network) Teardown(ctx context.Context) error {
+	subnet := n.SubnetLease.Subnet.String()
+	route, err := n.api.getRoute(subnet)
+	if apiError, ok := err.(*googleapi.Error); ok && apiError.Code == 404 {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting the route: %v", err)
+	}
+	// Leave the route alone if the subnet was handed to another instance
+	if route.NextHopInstance != n.api.gceInstance.SelfLink {
+		return nil
+	}
+
+	log.Infof("Deleting route for subnet: %v", subnet)
+	operation, err := n.api.deleteRoute(subnet)
+	if err != nil {
+		return fmt.Errorf("error deleting route: %v", err)
+	}
+	if err := n.api.pollOperationStatus(operation.Name); err != nil {
+		return fmt.Errorf("delete operation failed: %v", err)
+	}
+	return nil
+}
+
 //returns true if an exact matching rule is found
 func (g *GCEBackend) handleMatchingRoute(subnet string) (bool, error) {
 	matchingRoute, err := g.api.getRoute(subnet)
@@ -31,6 +31,7 @@ import (
 
 func init() {
 	backend.Register("host-gw", New)
+	backend.RegisterCleanup("host-gw", backend.DeleteRoutes)
 }
 
 type HostgwBackend struct {
@@ -43,6 +44,10 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 		return nil, fmt.Errorf("your PublicIP differs from interface IP, meaning that probably you're on a NAT, which is not supported by host-gw backend")
 	}
 
+	if extIface.ExtV6Addr != nil && !extIface.ExtV6Addr.Equal(extIface.IfaceV6Addr) {
+		return nil, fmt.Errorf("your PublicIPv6 differs from interface IPv6, meaning that probably you're on a NAT, which is not supported by host-gw backend")
+	}
+
 	be := &HostgwBackend{
 		sm:       sm,
 		extIface: extIface,
@@ -50,7 +55,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return be, nil
 }
 
-func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	n := &backend.RouteNetwork{
 		SimpleNetwork: backend.SimpleNetwork{
 			ExtIface: be.extIface,
@@ -73,6 +78,22 @@ func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup,
 		BackendType: "host-gw",
 	}
 
+	if config.IPv6Enabled() {
+		if be.extIface.ExtV6Addr == nil {
+			return nil, fmt.Errorf("IPv6Network is configured but interface %s has no IPv6 address", be.extIface.Iface.Name)
+		}
+
+		pip6 := ip.FromIP6(be.extIface.ExtV6Addr)
+		attrs.PublicIPv6 = &pip6
+		n.GetV6Route = func(lease *subnet.Lease) *netlink.Route {
+			return &netlink.Route{
+				Dst:       lease.IPv6Subnet.ToIPNet(),
+				Gw:        lease.Attrs.PublicIPv6.ToIP(),
+				LinkIndex: n.LinkIndex,
+			}
+		}
+	}
+
 	l, err := be.sm.AcquireLease(ctx, &attrs)
 	switch err {
 	case nil:
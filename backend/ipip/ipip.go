@@ -38,6 +38,15 @@ const (
 
 func init() {
 	backend.Register(backendType, New)
+	backend.RegisterCleanup(backendType, cleanup)
+}
+
+// cleanup deletes the tunnel device and the routes of direct routing.
+func cleanup(config *subnet.Config) error {
+	if err := backend.DeleteLinks(func(name string) bool { return name == tunnelName }); err != nil {
+		return err
+	}
+	return backend.DeleteRoutes(config)
 }
 
 type IPIPBackend struct {
@@ -53,7 +62,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return be, nil
 }
 
-func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	cfg := struct {
 		DirectRouting bool
 	}{}
@@ -121,7 +130,24 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup, c
 		return &route
 	}
 
-	return n, nil
+	return &network{n}, nil
+}
+
+// network deletes the tunnel device along with the routes on teardown.
+type network struct {
+	*backend.RouteNetwork
+}
+
+func (n *network) Teardown(ctx context.Context) error {
+	if err := n.RouteNetwork.Teardown(ctx); err != nil {
+		return err
+	}
+	return backend.DeleteLinks(func(name string) bool { return name == tunnelName })
+}
+
+// CheckDevices checks that the tunnel device still exists.
+func (n *network) CheckDevices() error {
+	return backend.CheckLinks(tunnelName)
 }
 
 func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease) (*netlink.Iptun, error) {
@@ -89,3 +89,41 @@ func DeleteXFRMPolicy(localSubnet, remoteSubnet *net.IPNet, localPublicIP, remot
 
 	return nil
 }
+
+// DeleteXFRMReqID deletes all the ipsec policies and states of the given reqID,
+// regardless of the leases they were set up for.
+func DeleteXFRMReqID(reqID int) error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		policies, err := netlink.XfrmPolicyList(family)
+		if err != nil {
+			return fmt.Errorf("error listing policies: %v", err)
+		}
+		for _, policy := range policies {
+			for _, tmpl := range policy.Tmpls {
+				if tmpl.Reqid != reqID {
+					continue
+				}
+				log.Infof("Deleting ipsec policy: %+v", tmpl)
+				if err := netlink.XfrmPolicyDel(&policy); err != nil {
+					return fmt.Errorf("error deleting policy: %+v err: %v", policy, err)
+				}
+				break
+			}
+		}
+
+		states, err := netlink.XfrmStateList(family)
+		if err != nil {
+			return fmt.Errorf("error listing states: %v", err)
+		}
+		for _, state := range states {
+			if state.Reqid != reqID {
+				continue
+			}
+			log.Infof("Deleting ipsec state: %v", state)
+			if err := netlink.XfrmStateDel(&state); err != nil {
+				return fmt.Errorf("error deleting state: %v err: %v", state, err)
+			}
+		}
+	}
+	return nil
+}
@@ -52,6 +52,13 @@ const (
 
 func init() {
 	backend.Register("ipsec", New)
+	backend.RegisterCleanup("ipsec", cleanup)
+}
+
+// cleanup deletes the ipsec policies and states of flannel. The charon spawned
+// by flanneld exits along with it.
+func cleanup(config *subnet.Config) error {
+	return DeleteXFRMReqID(defaultReqID)
 }
 
 type IPSECBackend struct {
@@ -70,7 +77,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (
 }
 
 func (be *IPSECBackend) RegisterNetwork(
-	ctx context.Context, wg sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 
 	cfg := struct {
 		UDPEncap    bool
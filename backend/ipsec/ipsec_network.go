@@ -159,6 +159,12 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 	}
 }
 
+// Teardown deletes the ipsec policies, and the states charon may have left
+// behind. The IKE connections went away with charon once Run returned.
+func (n *network) Teardown(ctx context.Context) error {
+	return DeleteXFRMReqID(defaultReqID)
+}
+
 func (n *network) MTU() int {
 	mtu := n.ExtIface.Iface.MTU - ipsecOverhead
 	if n.UDPEncap {
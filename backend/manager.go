@@ -19,29 +19,34 @@ import (
 	"strings"
 	"sync"
 
-	"golang.org/x/net/context"
+	log "github.com/golang/glog"
 
 	"github.com/coreos/flannel/subnet"
 )
 
-var constructors = make(map[string]BackendCtor)
+var (
+	constructors = make(map[string]BackendCtor)
+	cleanups     = make(map[string]CleanupFunc)
+)
 
 type Manager interface {
+	// GetBackend returns the backend of the type, creating it on first use.
 	GetBackend(backendType string) (Backend, error)
+	// StopBackend forgets the backend of the type, so that the next GetBackend
+	// creates it anew. The networks registered with it have to be stopped and
+	// torn down by then.
+	StopBackend(backendType string)
 }
 
 type manager struct {
-	ctx      context.Context
 	sm       subnet.Manager
 	extIface *ExternalInterface
 	mux      sync.Mutex
 	active   map[string]Backend
-	wg       sync.WaitGroup
 }
 
-func NewManager(ctx context.Context, sm subnet.Manager, extIface *ExternalInterface) Manager {
+func NewManager(sm subnet.Manager, extIface *ExternalInterface) Manager {
 	return &manager{
-		ctx:      ctx,
 		sm:       sm,
 		extIface: extIface,
 		active:   make(map[string]Backend),
@@ -70,25 +75,34 @@ func (bm *manager) GetBackend(backendType string) (Backend, error) {
 	}
 	bm.active[betype] = be
 
-	bm.wg.Add(1)
-	go func() {
-		<-bm.ctx.Done()
-
-		// TODO(eyakubovich): this obviosly introduces a race.
-		// GetBackend() could get called while we are here.
-		// Currently though, all backends' Run exit only
-		// on shutdown
-
-		bm.mux.Lock()
-		delete(bm.active, betype)
-		bm.mux.Unlock()
+	return be, nil
+}
 
-		bm.wg.Done()
-	}()
+func (bm *manager) StopBackend(backendType string) {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
 
-	return be, nil
+	delete(bm.active, strings.ToLower(backendType))
 }
 
 func Register(name string, ctor BackendCtor) {
 	constructors[name] = ctor
 }
+
+// RegisterCleanup registers how to clean up after the backend, see Cleanup.
+func RegisterCleanup(name string, cleanup CleanupFunc) {
+	cleanups[name] = cleanup
+}
+
+// Cleanup removes what the backend of the network config has set up on the
+// host, without it running. Backends that leave nothing behind on the host, or
+// can't tell what they did, don't register a cleanup.
+func Cleanup(config *subnet.Config) error {
+	betype := strings.ToLower(config.BackendType)
+	cleanup, ok := cleanups[betype]
+	if !ok {
+		log.Warningf("Backend type %v has no cleanup, skipping it", betype)
+		return nil
+	}
+	return cleanup(config)
+}
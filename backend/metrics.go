@@ -0,0 +1,67 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of entries the backends program into the kernel for the other nodes
+const (
+	EntryRoute = "route"
+	EntryARP   = "arp"
+	EntryFDB   = "fdb"
+)
+
+// Operations on those entries
+const (
+	OpAdd    = "add"
+	OpDelete = "delete"
+)
+
+var (
+	programmingOps = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "flannel",
+			Subsystem: "backend",
+			Name:      "programming_operations_total",
+			Help:      "Number of routes, ARP and FDB entries added to or deleted from the kernel.",
+		},
+		[]string{"backend", "entry", "op"},
+	)
+	programmingErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "flannel",
+			Subsystem: "backend",
+			Name:      "programming_errors_total",
+			Help:      "Number of failures to add routes, ARP and FDB entries to or delete them from the kernel.",
+		},
+		[]string{"backend", "entry", "op"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(programmingOps, programmingErrors)
+}
+
+// CountProgramming records that a backend added or deleted a route, ARP or
+// FDB entry, and whether that failed. vxlan and the backends built on
+// RouteNetwork call it; udp and ipsec don't.
+func CountProgramming(backendType, entry, op string, err error) {
+	programmingOps.WithLabelValues(backendType, entry, op).Inc()
+	if err != nil {
+		programmingErrors.WithLabelValues(backendType, entry, op).Inc()
+	}
+}
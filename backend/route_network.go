@@ -18,8 +18,10 @@ package backend
 
 import (
 	"bytes"
+	"fmt"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/golang/glog"
@@ -35,12 +37,17 @@ const (
 
 type RouteNetwork struct {
 	SimpleNetwork
+	SyncSignal
 	BackendType string
-	routes      []netlink.Route
-	SM          subnet.Manager
-	GetRoute    func(lease *subnet.Lease) *netlink.Route
-	Mtu         int
-	LinkIndex   int
+	// routesMux guards routes, which are also read by the route check and
+	// Inspect.
+	routesMux  sync.Mutex
+	routes     []netlink.Route
+	SM         subnet.Manager
+	GetRoute   func(lease *subnet.Lease) *netlink.Route
+	GetV6Route func(lease *subnet.Lease) *netlink.Route
+	Mtu        int
+	LinkIndex  int
 }
 
 func (n *RouteNetwork) MTU() int {
@@ -58,7 +65,9 @@ func (n *RouteNetwork) Run(ctx context.Context) {
 		wg.Done()
 	}()
 
+	n.routesMux.Lock()
 	n.routes = make([]netlink.Route, 0, 10)
+	n.routesMux.Unlock()
 	wg.Add(1)
 	go func() {
 		n.routeCheck(ctx)
@@ -71,6 +80,7 @@ func (n *RouteNetwork) Run(ctx context.Context) {
 		select {
 		case evtBatch := <-evts:
 			n.handleSubnetEvents(evtBatch)
+			n.MarkSynced()
 
 		case <-ctx.Done():
 			return
@@ -78,8 +88,23 @@ func (n *RouteNetwork) Run(ctx context.Context) {
 	}
 }
 
+// Teardown deletes the routes to the subnets of the other nodes.
+func (n *RouteNetwork) Teardown(ctx context.Context) error {
+	var err error
+	for _, route := range n.trackedRoutes() {
+		log.Infof("Deleting route to %v via %v", route.Dst, route.Gw)
+		if e := netlink.RouteDel(&route); e != nil && e != syscall.ESRCH && err == nil {
+			err = fmt.Errorf("failed to delete route to %v: %v", route.Dst, e)
+		}
+	}
+	n.routesMux.Lock()
+	n.routes = nil
+	n.routesMux.Unlock()
+	return err
+}
+
 func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
-	for _, evt := range batch {
+	for _, evt := range SplitSubnetEvents(batch) {
 		switch evt.Type {
 		case subnet.EventAdded:
 			log.Infof("Subnet added: %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
@@ -88,31 +113,10 @@ func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 				log.Warningf("Ignoring non-%v subnet: type=%v", n.BackendType, evt.Lease.Attrs.BackendType)
 				continue
 			}
-			route := n.GetRoute(&evt.Lease)
-
-			n.addToRouteList(*route)
-			// Check if route exists before attempting to add it
-			routeList, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
-			if err != nil {
-				log.Warningf("Unable to list routes: %v", err)
-			}
 
-			if len(routeList) > 0 && !routeEqual(routeList[0], *route) {
-				// Same Dst different Gw or different link index. Remove it, correct route will be added below.
-				log.Warningf("Replacing existing route to %v via %v dev index %d with %v via %v dev index %d.", evt.Lease.Subnet, routeList[0].Gw, routeList[0].LinkIndex, evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, route.LinkIndex)
-				if err := netlink.RouteDel(&routeList[0]); err != nil {
-					log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
-					continue
-				}
-				n.removeFromRouteList(routeList[0])
-			}
-
-			if len(routeList) > 0 && routeEqual(routeList[0], *route) {
-				// Same Dst and same Gw, keep it and do not attempt to add it.
-				log.Infof("Route to %v via %v dev index %d already exists, skipping.", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, routeList[0].LinkIndex)
-			} else if err := netlink.RouteAdd(route); err != nil {
-				log.Errorf("Error adding route to %v via %v dev index %d: %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, route.LinkIndex, err)
-				continue
+			n.addRoute(netlink.FAMILY_V4, n.GetRoute(&evt.Lease))
+			if route := n.v6Route(&evt.Lease); route != nil {
+				n.addRoute(netlink.FAMILY_V6, route)
 			}
 
 		case subnet.EventRemoved:
@@ -123,13 +127,9 @@ func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 				continue
 			}
 
-			route := n.GetRoute(&evt.Lease)
-			// Always remove the route from the route list.
-			n.removeFromRouteList(*route)
-
-			if err := netlink.RouteDel(route); err != nil {
-				log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
-				continue
+			n.delRoute(n.GetRoute(&evt.Lease))
+			if route := n.v6Route(&evt.Lease); route != nil {
+				n.delRoute(route)
 			}
 
 		default:
@@ -138,7 +138,62 @@ func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 	}
 }
 
+// v6Route returns the route to the IPv6 subnet of the lease, or nil if either
+// the backend or the lease doesn't do IPv6.
+func (n *RouteNetwork) v6Route(lease *subnet.Lease) *netlink.Route {
+	if n.GetV6Route == nil || lease.IPv6Subnet.Empty() || lease.Attrs.PublicIPv6 == nil {
+		return nil
+	}
+	return n.GetV6Route(lease)
+}
+
+func (n *RouteNetwork) addRoute(family int, route *netlink.Route) {
+	n.addToRouteList(*route)
+	// Check if route exists before attempting to add it
+	routeList, err := netlink.RouteListFiltered(family, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		log.Warningf("Unable to list routes: %v", err)
+	}
+
+	if len(routeList) > 0 && !routeEqual(routeList[0], *route) {
+		// Same Dst different Gw or different link index. Remove it, correct route will be added below.
+		log.Warningf("Replacing existing route to %v via %v dev index %d with %v via %v dev index %d.", route.Dst, routeList[0].Gw, routeList[0].LinkIndex, route.Dst, route.Gw, route.LinkIndex)
+		err := netlink.RouteDel(&routeList[0])
+		CountProgramming(n.BackendType, EntryRoute, OpDelete, err)
+		if err != nil {
+			log.Errorf("Error deleting route to %v: %v", route.Dst, err)
+			return
+		}
+		n.removeFromRouteList(routeList[0])
+	}
+
+	if len(routeList) > 0 && routeEqual(routeList[0], *route) {
+		// Same Dst and same Gw, keep it and do not attempt to add it.
+		log.Infof("Route to %v via %v dev index %d already exists, skipping.", route.Dst, route.Gw, routeList[0].LinkIndex)
+	} else {
+		err := netlink.RouteAdd(route)
+		CountProgramming(n.BackendType, EntryRoute, OpAdd, err)
+		if err != nil {
+			log.Errorf("Error adding route to %v via %v dev index %d: %v", route.Dst, route.Gw, route.LinkIndex, err)
+			subnet.RecordEvent(n.SM, subnet.NodeEventWarning, "RouteFailed", "Failed to add route to %v via %v: %v", route.Dst, route.Gw, err)
+		}
+	}
+}
+
+func (n *RouteNetwork) delRoute(route *netlink.Route) {
+	// Always remove the route from the route list.
+	n.removeFromRouteList(*route)
+
+	err := netlink.RouteDel(route)
+	CountProgramming(n.BackendType, EntryRoute, OpDelete, err)
+	if err != nil {
+		log.Errorf("Error deleting route to %v: %v", route.Dst, err)
+	}
+}
+
 func (n *RouteNetwork) addToRouteList(route netlink.Route) {
+	n.routesMux.Lock()
+	defer n.routesMux.Unlock()
 	for _, r := range n.routes {
 		if routeEqual(r, route) {
 			return
@@ -148,6 +203,8 @@ func (n *RouteNetwork) addToRouteList(route netlink.Route) {
 }
 
 func (n *RouteNetwork) removeFromRouteList(route netlink.Route) {
+	n.routesMux.Lock()
+	defer n.routesMux.Unlock()
 	for index, r := range n.routes {
 		if routeEqual(r, route) {
 			n.routes = append(n.routes[:index], n.routes[index+1:]...)
@@ -156,6 +213,39 @@ func (n *RouteNetwork) removeFromRouteList(route netlink.Route) {
 	}
 }
 
+// trackedRoutes returns a copy of the routes to the other nodes.
+func (n *RouteNetwork) trackedRoutes() []netlink.Route {
+	n.routesMux.Lock()
+	defer n.routesMux.Unlock()
+	return append([]netlink.Route(nil), n.routes...)
+}
+
+// Inspect compares the routes to the other nodes with the routes through a
+// gateway to subnets of the network in the kernel.
+func (n *RouteNetwork) Inspect(config *subnet.Config) (map[string]*EntryDiff, error) {
+	var expected, actual []string
+	for _, route := range n.trackedRoutes() {
+		expected = append(expected, routeString(route))
+	}
+
+	routeList, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, route := range routeList {
+		if isSubnetRoute(config, route) {
+			actual = append(actual, routeString(route))
+		}
+	}
+
+	return map[string]*EntryDiff{EntryRoute: NewEntryDiff(expected, actual)}, nil
+}
+
+// routeString describes a route by what routeEqual compares.
+func routeString(route netlink.Route) string {
+	return fmt.Sprintf("%v via %v ifindex %d", route.Dst, route.Gw, route.LinkIndex)
+}
+
 func (n *RouteNetwork) routeCheck(ctx context.Context) {
 	for {
 		select {
@@ -168,9 +258,9 @@ func (n *RouteNetwork) routeCheck(ctx context.Context) {
 }
 
 func (n *RouteNetwork) checkSubnetExistInRoutes() {
-	routeList, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	routeList, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
 	if err == nil {
-		for _, route := range n.routes {
+		for _, route := range n.trackedRoutes() {
 			exist := false
 			for _, r := range routeList {
 				if r.Dst == nil {
@@ -183,7 +273,9 @@ func (n *RouteNetwork) checkSubnetExistInRoutes() {
 			}
 
 			if !exist {
-				if err := netlink.RouteAdd(&route); err != nil {
+				err := netlink.RouteAdd(&route)
+				CountProgramming(n.BackendType, EntryRoute, OpAdd, err)
+				if err != nil {
 					if nerr, ok := err.(net.Error); !ok {
 						log.Errorf("Error recovering route to %v: %v, %v", route.Dst, route.Gw, nerr)
 					}
@@ -17,6 +17,7 @@ package backend
 
 import (
 	"net"
+	"reflect"
 	"testing"
 
 	"github.com/coreos/flannel/pkg/ip"
@@ -76,3 +77,64 @@ func TestRouteCache(t *testing.T) {
 		t.Fatal(nw.routes[0])
 	}
 }
+
+func TestSplitSubnetEvents(t *testing.T) {
+	subnet1 := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.1.0")), PrefixLen: 24}
+	subnet2 := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.245.1.0")), PrefixLen: 24}
+	subnet3 := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.2.0")), PrefixLen: 24}
+	subnet6 := ip.IP6Net{IP: ip.FromIP6(net.ParseIP("fd00::")), PrefixLen: 64}
+
+	events := SplitSubnetEvents([]subnet.Event{
+		{Type: subnet.EventAdded, Lease: subnet.Lease{Subnet: subnet1, IPv6Subnet: subnet6, AdditionalSubnets: []ip.IP4Net{subnet2}}},
+		{Type: subnet.EventRemoved, Lease: subnet.Lease{Subnet: subnet3}},
+	})
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %v", events)
+	}
+	if !events[0].Lease.Subnet.Equal(subnet1) || events[0].Lease.IPv6Subnet.Empty() {
+		t.Errorf("Unexpected event for the main subnet: %v", events[0])
+	}
+	if events[1].Type != subnet.EventAdded || !events[1].Lease.Subnet.Equal(subnet2) ||
+		!events[1].Lease.IPv6Subnet.Empty() || len(events[1].Lease.AdditionalSubnets) != 0 {
+		t.Errorf("Unexpected event for the additional subnet: %v", events[1])
+	}
+	if events[2].Type != subnet.EventRemoved || !events[2].Lease.Subnet.Equal(subnet3) {
+		t.Errorf("Unexpected event: %v", events[2])
+	}
+}
+
+func TestSyncSignal(t *testing.T) {
+	var nw RouteNetwork
+	synced := nw.Synced()
+	select {
+	case <-synced:
+		t.Fatal("Expected the network not to be synced yet")
+	default:
+	}
+
+	nw.MarkSynced()
+	nw.MarkSynced()
+	select {
+	case <-synced:
+	default:
+		t.Fatal("Expected the network to be synced")
+	}
+}
+
+func TestNewEntryDiff(t *testing.T) {
+	d := NewEntryDiff([]string{"b", "a", "c"}, []string{"c", "d", "a"})
+	if !reflect.DeepEqual(d.Expected, []string{"a", "b", "c"}) {
+		t.Errorf("Expected entries %v", d.Expected)
+	}
+	if !reflect.DeepEqual(d.Missing, []string{"b"}) {
+		t.Errorf("Expected b to be missing, got %v", d.Missing)
+	}
+	if !reflect.DeepEqual(d.Unexpected, []string{"d"}) {
+		t.Errorf("Expected d to be unexpected, got %v", d.Unexpected)
+	}
+
+	d = NewEntryDiff(nil, nil)
+	if d.Expected == nil || d.Missing == nil || d.Unexpected == nil {
+		t.Errorf("Expected empty lists rather than nil: %#v", d)
+	}
+}
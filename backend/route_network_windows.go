@@ -32,6 +32,7 @@ const (
 
 type RouteNetwork struct {
 	SimpleNetwork
+	SyncSignal
 	Name        string
 	BackendType string
 	SM          subnet.Manager
@@ -69,6 +70,7 @@ func (n *RouteNetwork) Run(ctx context.Context) {
 		select {
 		case evtBatch := <-evts:
 			n.handleSubnetEvents(evtBatch)
+			n.MarkSynced()
 
 		case <-ctx.Done():
 			return
@@ -79,7 +81,7 @@ func (n *RouteNetwork) Run(ctx context.Context) {
 func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 	netrouteHelper := netroute.New()
 
-	for _, evt := range batch {
+	for _, evt := range SplitSubnetEvents(batch) {
 		leaseSubnet := evt.Lease.Subnet
 		leaseAttrs := evt.Lease.Attrs
 		if !strings.EqualFold(leaseAttrs.BackendType, n.BackendType) {
@@ -111,6 +113,7 @@ func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 			err := netrouteHelper.NewNetRoute(expectedRoute.LinkIndex, expectedRoute.DestinationSubnet, expectedRoute.GatewayAddress)
 			if err != nil {
 				log.Errorf("Error creating route: %v", err)
+				subnet.RecordEvent(n.SM, subnet.NodeEventWarning, "RouteFailed", "Failed to add route to %v via %v: %v", leaseSubnet, leaseAttrs.PublicIP, err)
 				continue
 			}
 
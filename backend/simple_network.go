@@ -36,3 +36,8 @@ func (n *SimpleNetwork) MTU() int {
 func (_ *SimpleNetwork) Run(ctx context.Context) {
 	<-ctx.Done()
 }
+
+// Teardown has nothing to remove for networks that set nothing up themselves.
+func (_ *SimpleNetwork) Teardown(ctx context.Context) error {
+	return nil
+}
@@ -29,6 +29,7 @@ import (
 
 func init() {
 	backend.Register("udp", New)
+	backend.RegisterCleanup("udp", cleanup)
 }
 
 const (
@@ -48,7 +49,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return &be, nil
 }
 
-func (be *UdpBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+func (be *UdpBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	cfg := struct {
 		Port int
 	}{
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"regexp"
 	"sync"
 	"syscall"
 
@@ -147,6 +148,16 @@ func (n *network) initTun() error {
 	return err
 }
 
+// tunNamePattern matches the names OpenTun picks for "flannel%d".
+var tunNamePattern = regexp.MustCompile(`^flannel[0-9]+$`)
+
+// cleanup deletes TUN devices left behind. The kernel removes them along with
+// the routes through them once flanneld exits, unless another process still
+// holds them open.
+func cleanup(config *subnet.Config) error {
+	return backend.DeleteLinks(tunNamePattern.MatchString)
+}
+
 func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
 	iface, err := netlink.LinkByName(ifname)
 	if err != nil {
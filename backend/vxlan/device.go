@@ -20,11 +20,13 @@ package vxlan
 import (
 	"fmt"
 	"net"
+	"sync"
 	"syscall"
 
 	log "github.com/golang/glog"
 	"github.com/vishvananda/netlink"
 
+	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
 )
 
@@ -41,6 +43,12 @@ type vxlanDeviceAttrs struct {
 type vxlanDevice struct {
 	link          *netlink.Vxlan
 	directRouting bool
+
+	// neighMux guards the ARP and FDB entries added to the device, by the
+	// way neighborString describes them.
+	neighMux sync.Mutex
+	arps     map[string]bool
+	fdbs     map[string]bool
 }
 
 func newVXLANDevice(devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
@@ -62,6 +70,8 @@ func newVXLANDevice(devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
 	}
 	return &vxlanDevice{
 		link: link,
+		arps: make(map[string]bool),
+		fdbs: make(map[string]bool),
 	}, nil
 }
 
@@ -121,6 +131,28 @@ func (dev *vxlanDevice) Configure(ipn ip.IP4Net) error {
 	return nil
 }
 
+func (dev *vxlanDevice) ConfigureIPv6(ipn ip.IP6Net) error {
+	if err := ip.EnsureV6AddressOnLink(ipn, dev.link); err != nil {
+		return fmt.Errorf("failed to ensure v6 address of interface %s: %s", dev.link.Attrs().Name, err)
+	}
+
+	if err := netlink.LinkSetUp(dev.link); err != nil {
+		return fmt.Errorf("failed to set interface %s to UP state: %s", dev.link.Attrs().Name, err)
+	}
+
+	return nil
+}
+
+// Destroy deletes the device, which takes the routes and neighbor entries
+// through it along.
+func (dev *vxlanDevice) Destroy() error {
+	log.Infof("Deleting device %v", dev.link.Attrs().Name)
+	if err := netlink.LinkDel(dev.link); err != nil && err != syscall.ENODEV {
+		return fmt.Errorf("failed to delete interface %s: %v", dev.link.Attrs().Name, err)
+	}
+	return nil
+}
+
 func (dev *vxlanDevice) MACAddr() net.HardwareAddr {
 	return dev.link.HardwareAddr
 }
@@ -128,11 +160,12 @@ func (dev *vxlanDevice) MACAddr() net.HardwareAddr {
 type neighbor struct {
 	MAC net.HardwareAddr
 	IP  ip.IP4
+	IP6 ip.IP6
 }
 
 func (dev *vxlanDevice) AddFDB(n neighbor) error {
 	log.V(4).Infof("calling AddFDB: %v, %v", n.IP, n.MAC)
-	return netlink.NeighSet(&netlink.Neigh{
+	err := netlink.NeighSet(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Family:       syscall.AF_BRIDGE,
@@ -140,39 +173,182 @@ func (dev *vxlanDevice) AddFDB(n neighbor) error {
 		IP:           n.IP.ToIP(),
 		HardwareAddr: n.MAC,
 	})
+	backend.CountProgramming("vxlan", backend.EntryFDB, backend.OpAdd, err)
+	if err == nil {
+		dev.track(backend.EntryFDB, n.IP.ToIP(), n.MAC, true)
+	}
+	return err
 }
 
 func (dev *vxlanDevice) DelFDB(n neighbor) error {
 	log.V(4).Infof("calling DelFDB: %v, %v", n.IP, n.MAC)
-	return netlink.NeighDel(&netlink.Neigh{
+	err := netlink.NeighDel(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		Family:       syscall.AF_BRIDGE,
 		Flags:        netlink.NTF_SELF,
 		IP:           n.IP.ToIP(),
 		HardwareAddr: n.MAC,
 	})
+	backend.CountProgramming("vxlan", backend.EntryFDB, backend.OpDelete, err)
+	dev.track(backend.EntryFDB, n.IP.ToIP(), n.MAC, false)
+	return err
 }
 
 func (dev *vxlanDevice) AddARP(n neighbor) error {
 	log.V(4).Infof("calling AddARP: %v, %v", n.IP, n.MAC)
-	return netlink.NeighSet(&netlink.Neigh{
+	err := netlink.NeighSet(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Type:         syscall.RTN_UNICAST,
 		IP:           n.IP.ToIP(),
 		HardwareAddr: n.MAC,
 	})
+	backend.CountProgramming("vxlan", backend.EntryARP, backend.OpAdd, err)
+	if err == nil {
+		dev.track(backend.EntryARP, n.IP.ToIP(), n.MAC, true)
+	}
+	return err
 }
 
 func (dev *vxlanDevice) DelARP(n neighbor) error {
 	log.V(4).Infof("calling DelARP: %v, %v", n.IP, n.MAC)
-	return netlink.NeighDel(&netlink.Neigh{
+	err := netlink.NeighDel(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Type:         syscall.RTN_UNICAST,
 		IP:           n.IP.ToIP(),
 		HardwareAddr: n.MAC,
 	})
+	backend.CountProgramming("vxlan", backend.EntryARP, backend.OpDelete, err)
+	dev.track(backend.EntryARP, n.IP.ToIP(), n.MAC, false)
+	return err
+}
+
+func (dev *vxlanDevice) AddV6FDB(n neighbor) error {
+	log.V(4).Infof("calling AddV6FDB: %v, %v", n.IP6, n.MAC)
+	err := netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		State:        netlink.NUD_PERMANENT,
+		Family:       syscall.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		IP:           n.IP6.ToIP(),
+		HardwareAddr: n.MAC,
+	})
+	backend.CountProgramming("vxlan", backend.EntryFDB, backend.OpAdd, err)
+	if err == nil {
+		dev.track(backend.EntryFDB, n.IP6.ToIP(), n.MAC, true)
+	}
+	return err
+}
+
+func (dev *vxlanDevice) DelV6FDB(n neighbor) error {
+	log.V(4).Infof("calling DelV6FDB: %v, %v", n.IP6, n.MAC)
+	err := netlink.NeighDel(&netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		Family:       syscall.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		IP:           n.IP6.ToIP(),
+		HardwareAddr: n.MAC,
+	})
+	backend.CountProgramming("vxlan", backend.EntryFDB, backend.OpDelete, err)
+	dev.track(backend.EntryFDB, n.IP6.ToIP(), n.MAC, false)
+	return err
+}
+
+func (dev *vxlanDevice) AddV6ARP(n neighbor) error {
+	log.V(4).Infof("calling AddV6ARP: %v, %v", n.IP6, n.MAC)
+	err := netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		Family:       syscall.AF_INET6,
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           n.IP6.ToIP(),
+		HardwareAddr: n.MAC,
+	})
+	backend.CountProgramming("vxlan", backend.EntryARP, backend.OpAdd, err)
+	if err == nil {
+		dev.track(backend.EntryARP, n.IP6.ToIP(), n.MAC, true)
+	}
+	return err
+}
+
+func (dev *vxlanDevice) DelV6ARP(n neighbor) error {
+	log.V(4).Infof("calling DelV6ARP: %v, %v", n.IP6, n.MAC)
+	err := netlink.NeighDel(&netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		Family:       syscall.AF_INET6,
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           n.IP6.ToIP(),
+		HardwareAddr: n.MAC,
+	})
+	backend.CountProgramming("vxlan", backend.EntryARP, backend.OpDelete, err)
+	dev.track(backend.EntryARP, n.IP6.ToIP(), n.MAC, false)
+	return err
+}
+
+// track records that the ARP or FDB entry for ip and mac was added to the
+// device, or deleted from it when added is false.
+func (dev *vxlanDevice) track(entry string, ip net.IP, mac net.HardwareAddr, added bool) {
+	entries := dev.arps
+	if entry == backend.EntryFDB {
+		entries = dev.fdbs
+	}
+	key := neighborString(entry, ip, mac)
+
+	dev.neighMux.Lock()
+	defer dev.neighMux.Unlock()
+	if added {
+		entries[key] = true
+	} else {
+		delete(entries, key)
+	}
+}
+
+// Inspect compares the ARP and FDB entries added to the device with its
+// permanent entries in the kernel.
+func (dev *vxlanDevice) Inspect() (map[string]*backend.EntryDiff, error) {
+	diffs := make(map[string]*backend.EntryDiff)
+	for _, entry := range []string{backend.EntryARP, backend.EntryFDB} {
+		family := netlink.FAMILY_ALL
+		entries := dev.arps
+		if entry == backend.EntryFDB {
+			family = syscall.AF_BRIDGE
+			entries = dev.fdbs
+		}
+
+		var expected, actual []string
+		dev.neighMux.Lock()
+		for key := range entries {
+			expected = append(expected, key)
+		}
+		dev.neighMux.Unlock()
+
+		neighs, err := netlink.NeighList(dev.link.Index, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s entries of %s: %v", entry, dev.link.Name, err)
+		}
+		for _, neigh := range neighs {
+			if neigh.State&netlink.NUD_PERMANENT == 0 || neigh.IP == nil || neigh.HardwareAddr == nil {
+				continue
+			}
+			if entry == backend.EntryARP && neigh.Family == syscall.AF_BRIDGE {
+				continue
+			}
+			actual = append(actual, neighborString(entry, neigh.IP, neigh.HardwareAddr))
+		}
+		diffs[entry] = backend.NewEntryDiff(expected, actual)
+	}
+	return diffs, nil
+}
+
+// neighborString describes an ARP entry like ip neigh and an FDB entry like
+// bridge fdb do.
+func neighborString(entry string, ip net.IP, mac net.HardwareAddr) string {
+	if entry == backend.EntryFDB {
+		return fmt.Sprintf("%v dst %v", mac, ip)
+	}
+	return fmt.Sprintf("%v lladdr %v", ip, mac)
 }
 
 func vxlanLinksIncompat(l1, l2 netlink.Link) string {
@@ -68,6 +68,7 @@ import (
 
 func init() {
 	backend.Register("vxlan", New)
+	backend.RegisterCleanup("vxlan", cleanup)
 }
 
 const (
@@ -88,6 +89,31 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return backend, nil
 }
 
+// cleanup deletes the VXLAN devices of the network, which takes the routes, ARP
+// and FDB entries through them along, and the routes of direct routing.
+func cleanup(config *subnet.Config) error {
+	cfg := struct {
+		VNI int
+	}{
+		VNI: defaultVNI,
+	}
+
+	if len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return fmt.Errorf("error decoding VXLAN backend config: %v", err)
+		}
+	}
+
+	names := map[string]bool{
+		fmt.Sprintf("flannel.%v", cfg.VNI):    true,
+		fmt.Sprintf("flannel-v6.%v", cfg.VNI): true,
+	}
+	if err := backend.DeleteLinks(func(name string) bool { return names[name] }); err != nil {
+		return err
+	}
+	return backend.DeleteRoutes(config)
+}
+
 func newSubnetAttrs(publicIP net.IP, mac net.HardwareAddr) (*subnet.LeaseAttrs, error) {
 	data, err := json.Marshal(&vxlanLeaseAttrs{hardwareAddr(mac)})
 	if err != nil {
@@ -101,7 +127,21 @@ func newSubnetAttrs(publicIP net.IP, mac net.HardwareAddr) (*subnet.LeaseAttrs,
 	}, nil
 }
 
-func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+// addV6SubnetAttrs fills in the IPv6 half of the lease attributes: the public
+// IPv6 address and the MAC of the IPv6 VTEP.
+func addV6SubnetAttrs(attrs *subnet.LeaseAttrs, publicIPv6 net.IP, mac net.HardwareAddr) error {
+	data, err := json.Marshal(&vxlanLeaseAttrs{hardwareAddr(mac)})
+	if err != nil {
+		return err
+	}
+
+	pip6 := ip.FromIP6(publicIPv6)
+	attrs.PublicIPv6 = &pip6
+	attrs.BackendV6Data = json.RawMessage(data)
+	return nil
+}
+
+func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// Parse our configuration
 	cfg := struct {
 		VNI           int
@@ -141,6 +181,25 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup,
 		return nil, err
 	}
 
+	var v6Dev *vxlanDevice
+	if config.IPv6Enabled() {
+		if be.extIface.IfaceV6Addr == nil || be.extIface.ExtV6Addr == nil {
+			return nil, fmt.Errorf("IPv6Network is configured but interface %s has no IPv6 address", be.extIface.Iface.Name)
+		}
+
+		v6DevAttrs := devAttrs
+		v6DevAttrs.name = fmt.Sprintf("flannel-v6.%v", cfg.VNI)
+		v6DevAttrs.vtepAddr = be.extIface.IfaceV6Addr
+		v6Dev, err = newVXLANDevice(&v6DevAttrs)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := addV6SubnetAttrs(subnetAttrs, be.extIface.ExtV6Addr, v6Dev.MACAddr()); err != nil {
+			return nil, err
+		}
+	}
+
 	lease, err := be.subnetMgr.AcquireLease(ctx, subnetAttrs)
 	switch err {
 	case nil:
@@ -157,7 +216,17 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg sync.WaitGroup,
 		return nil, fmt.Errorf("failed to configure interface %s: %s", dev.link.Attrs().Name, err)
 	}
 
-	return newNetwork(be.subnetMgr, be.extIface, dev, ip.IP4Net{}, lease)
+	if v6Dev != nil {
+		if lease.IPv6Subnet.Empty() {
+			return nil, fmt.Errorf("lease for %s came without an IPv6 subnet", lease.Subnet)
+		}
+		// Same as above, a /128 keeps the kernel from adding any routes for the device
+		if err := v6Dev.ConfigureIPv6(ip.IP6Net{IP: lease.IPv6Subnet.IP, PrefixLen: 128}); err != nil {
+			return nil, fmt.Errorf("failed to configure interface %s: %s", v6Dev.link.Attrs().Name, err)
+		}
+	}
+
+	return newNetwork(be.subnetMgr, be.extIface, dev, v6Dev, ip.IP4Net{}, lease)
 }
 
 // So we can make it JSON (un)marshalable
@@ -17,6 +17,7 @@ package vxlan
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"sync"
 
@@ -33,22 +34,29 @@ import (
 
 type network struct {
 	backend.SimpleNetwork
+	backend.SyncSignal
 	dev       *vxlanDevice
+	v6Dev     *vxlanDevice
 	subnetMgr subnet.Manager
+	// directRoutes holds the routes added for direct routing by destination,
+	// the others go away with the devices.
+	directRoutes map[string]netlink.Route
 }
 
 const (
 	encapOverhead = 50
 )
 
-func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, _ ip.IP4Net, lease *subnet.Lease) (*network, error) {
+func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, dev, v6Dev *vxlanDevice, _ ip.IP4Net, lease *subnet.Lease) (*network, error) {
 	nw := &network{
 		SimpleNetwork: backend.SimpleNetwork{
 			SubnetLease: lease,
 			ExtIface:    extIface,
 		},
-		subnetMgr: subnetMgr,
-		dev:       dev,
+		subnetMgr:    subnetMgr,
+		dev:          dev,
+		v6Dev:        v6Dev,
+		directRoutes: make(map[string]netlink.Route),
 	}
 
 	return nw, nil
@@ -72,6 +80,7 @@ func (nw *network) Run(ctx context.Context) {
 		select {
 		case evtBatch := <-events:
 			nw.handleSubnetEvents(evtBatch)
+			nw.MarkSynced()
 
 		case <-ctx.Done():
 			return
@@ -79,6 +88,63 @@ func (nw *network) Run(ctx context.Context) {
 	}
 }
 
+// Teardown deletes the VXLAN devices and the routes of direct routing.
+func (nw *network) Teardown(ctx context.Context) error {
+	for _, route := range nw.directRoutes {
+		log.Infof("Deleting route to %v via %v", route.Dst, route.Gw)
+		if err := netlink.RouteDel(&route); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to delete route to %v: %v", route.Dst, err)
+		}
+	}
+	nw.directRoutes = make(map[string]netlink.Route)
+
+	for _, dev := range []*vxlanDevice{nw.dev, nw.v6Dev} {
+		if dev == nil {
+			continue
+		}
+		if err := dev.Destroy(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckDevices checks that the VXLAN devices still exist.
+func (nw *network) CheckDevices() error {
+	var names []string
+	for _, dev := range []*vxlanDevice{nw.dev, nw.v6Dev} {
+		if dev != nil {
+			names = append(names, dev.link.Attrs().Name)
+		}
+	}
+	return backend.CheckLinks(names...)
+}
+
+// Inspect compares the ARP and FDB entries flannel added to the VXLAN devices
+// with those in the kernel.
+func (nw *network) Inspect(config *subnet.Config) (map[string]*backend.EntryDiff, error) {
+	var diffs map[string]*backend.EntryDiff
+	for _, dev := range []*vxlanDevice{nw.dev, nw.v6Dev} {
+		if dev == nil {
+			continue
+		}
+		devDiffs, err := dev.Inspect()
+		if err != nil {
+			return nil, err
+		}
+		if diffs == nil {
+			diffs = devDiffs
+			continue
+		}
+		for entry, d := range devDiffs {
+			diffs[entry].Expected = append(diffs[entry].Expected, d.Expected...)
+			diffs[entry].Missing = append(diffs[entry].Missing, d.Missing...)
+			diffs[entry].Unexpected = append(diffs[entry].Unexpected, d.Unexpected...)
+		}
+	}
+	return diffs, nil
+}
+
 func (nw *network) MTU() int {
 	return nw.ExtIface.Iface.MTU - encapOverhead
 }
@@ -96,6 +162,10 @@ func (nw *network) handleSubnetEvents(batch []subnet.Event) {
 			continue
 		}
 
+		if nw.v6Dev != nil && !event.Lease.IPv6Subnet.Empty() && attrs.PublicIPv6 != nil {
+			nw.handleV6SubnetEvent(event)
+		}
+
 		var vxlanAttrs vxlanLeaseAttrs
 		if err := json.Unmarshal(attrs.BackendData, &vxlanAttrs); err != nil {
 			log.Error("error decoding subnet lease JSON: ", err)
@@ -125,24 +195,30 @@ func (nw *network) handleSubnetEvents(batch []subnet.Event) {
 			}
 		}
 
+		extraRoutes := nw.additionalRoutes(&event.Lease, directRoutingOK)
+
 		switch event.Type {
 		case subnet.EventAdded:
 			if directRoutingOK {
 				log.V(2).Infof("Adding direct route to subnet: %s PublicIP: %s", sn, attrs.PublicIP)
 
-				if err := netlink.RouteReplace(&directRoute); err != nil {
+				if err := replaceRoute(&directRoute); err != nil {
 					log.Errorf("Error adding route to %v via %v: %v", sn, attrs.PublicIP, err)
+					subnet.RecordEvent(nw.subnetMgr, subnet.NodeEventWarning, "RouteFailed", "Failed to add route to %v via %v: %v", sn, attrs.PublicIP, err)
 					continue
 				}
+				nw.directRoutes[directRoute.Dst.String()] = directRoute
 			} else {
 				log.V(2).Infof("adding subnet: %s PublicIP: %s VtepMAC: %s", sn, attrs.PublicIP, net.HardwareAddr(vxlanAttrs.VtepMAC))
 				if err := nw.dev.AddARP(neighbor{IP: sn.IP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
 					log.Error("AddARP failed: ", err)
+					subnet.RecordEvent(nw.subnetMgr, subnet.NodeEventWarning, "RouteFailed", "Failed to add ARP entry for %v: %v", sn, err)
 					continue
 				}
 
 				if err := nw.dev.AddFDB(neighbor{IP: attrs.PublicIP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
 					log.Error("AddFDB failed: ", err)
+					subnet.RecordEvent(nw.subnetMgr, subnet.NodeEventWarning, "RouteFailed", "Failed to add FDB entry for %v: %v", attrs.PublicIP, err)
 
 					// Try to clean up the ARP entry then continue
 					if err := nw.dev.DelARP(neighbor{IP: event.Lease.Subnet.IP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
@@ -154,8 +230,9 @@ func (nw *network) handleSubnetEvents(batch []subnet.Event) {
 
 				// Set the route - the kernel would ARP for the Gw IP address if it hadn't already been set above so make sure
 				// this is done last.
-				if err := netlink.RouteReplace(&vxlanRoute); err != nil {
+				if err := replaceRoute(&vxlanRoute); err != nil {
 					log.Errorf("failed to add vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+					subnet.RecordEvent(nw.subnetMgr, subnet.NodeEventWarning, "RouteFailed", "Failed to add route to %v via %v: %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
 
 					// Try to clean up both the ARP and FDB entries then continue
 					if err := nw.dev.DelARP(neighbor{IP: event.Lease.Subnet.IP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
@@ -169,10 +246,27 @@ func (nw *network) handleSubnetEvents(batch []subnet.Event) {
 					continue
 				}
 			}
+
+			for _, route := range extraRoutes {
+				if err := replaceRoute(&route); err != nil {
+					log.Errorf("Error adding route to additional subnet %v via %v: %v", route.Dst, route.Gw, err)
+					subnet.RecordEvent(nw.subnetMgr, subnet.NodeEventWarning, "RouteFailed", "Failed to add route to %v via %v: %v", route.Dst, route.Gw, err)
+				} else if directRoutingOK {
+					nw.directRoutes[route.Dst.String()] = route
+				}
+			}
 		case subnet.EventRemoved:
+			for _, route := range extraRoutes {
+				delete(nw.directRoutes, route.Dst.String())
+				if err := deleteRoute(&route); err != nil {
+					log.Errorf("Error deleting route to additional subnet %v via %v: %v", route.Dst, route.Gw, err)
+				}
+			}
+
 			if directRoutingOK {
 				log.V(2).Infof("Removing direct route to subnet: %s PublicIP: %s", sn, attrs.PublicIP)
-				if err := netlink.RouteDel(&directRoute); err != nil {
+				delete(nw.directRoutes, directRoute.Dst.String())
+				if err := deleteRoute(&directRoute); err != nil {
 					log.Errorf("Error deleting route to %v via %v: %v", sn, attrs.PublicIP, err)
 				}
 			} else {
@@ -187,7 +281,7 @@ func (nw *network) handleSubnetEvents(batch []subnet.Event) {
 					log.Error("DelFDB failed: ", err)
 				}
 
-				if err := netlink.RouteDel(&vxlanRoute); err != nil {
+				if err := deleteRoute(&vxlanRoute); err != nil {
 					log.Errorf("failed to delete vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
 				}
 			}
@@ -196,3 +290,111 @@ func (nw *network) handleSubnetEvents(batch []subnet.Event) {
 		}
 	}
 }
+
+// additionalRoutes returns the routes to the additional subnets of a lease. They
+// go through the VTEP of its main subnet, or straight to its public IP with
+// direct routing.
+func (nw *network) additionalRoutes(lease *subnet.Lease, direct bool) []netlink.Route {
+	var routes []netlink.Route
+	for _, sn := range lease.AdditionalSubnets {
+		if direct {
+			routes = append(routes, netlink.Route{
+				Dst: sn.ToIPNet(),
+				Gw:  lease.Attrs.PublicIP.ToIP(),
+			})
+			continue
+		}
+
+		route := netlink.Route{
+			LinkIndex: nw.dev.link.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       sn.ToIPNet(),
+			Gw:        lease.Subnet.IP.ToIP(),
+		}
+		route.SetFlag(syscall.RTNH_F_ONLINK)
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// handleV6SubnetEvent programs the IPv6 half of a lease on the IPv6 VTEP. It works
+// like the IPv4 path above, minus direct routing.
+func (nw *network) handleV6SubnetEvent(event subnet.Event) {
+	sn6 := event.Lease.IPv6Subnet
+	attrs := event.Lease.Attrs
+
+	var vxlanAttrs vxlanLeaseAttrs
+	if err := json.Unmarshal(attrs.BackendV6Data, &vxlanAttrs); err != nil {
+		log.Error("error decoding subnet lease v6 JSON: ", err)
+		return
+	}
+	mac := net.HardwareAddr(vxlanAttrs.VtepMAC)
+
+	vxlanRoute := netlink.Route{
+		LinkIndex: nw.v6Dev.link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       sn6.ToIPNet(),
+		Gw:        sn6.IP.ToIP(),
+	}
+	vxlanRoute.SetFlag(syscall.RTNH_F_ONLINK)
+
+	switch event.Type {
+	case subnet.EventAdded:
+		log.V(2).Infof("adding v6 subnet: %s PublicIPv6: %s VtepMAC: %s", sn6, attrs.PublicIPv6, mac)
+		if err := nw.v6Dev.AddV6ARP(neighbor{IP6: sn6.IP, MAC: mac}); err != nil {
+			log.Error("AddV6ARP failed: ", err)
+			return
+		}
+
+		if err := nw.v6Dev.AddV6FDB(neighbor{IP6: *attrs.PublicIPv6, MAC: mac}); err != nil {
+			log.Error("AddV6FDB failed: ", err)
+
+			if err := nw.v6Dev.DelV6ARP(neighbor{IP6: sn6.IP, MAC: mac}); err != nil {
+				log.Error("DelV6ARP failed: ", err)
+			}
+			return
+		}
+
+		if err := replaceRoute(&vxlanRoute); err != nil {
+			log.Errorf("failed to add v6 vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+			subnet.RecordEvent(nw.subnetMgr, subnet.NodeEventWarning, "RouteFailed", "Failed to add route to %v via %v: %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+
+			if err := nw.v6Dev.DelV6ARP(neighbor{IP6: sn6.IP, MAC: mac}); err != nil {
+				log.Error("DelV6ARP failed: ", err)
+			}
+
+			if err := nw.v6Dev.DelV6FDB(neighbor{IP6: *attrs.PublicIPv6, MAC: mac}); err != nil {
+				log.Error("DelV6FDB failed: ", err)
+			}
+		}
+
+	case subnet.EventRemoved:
+		log.V(2).Infof("removing v6 subnet: %s PublicIPv6: %s VtepMAC: %s", sn6, attrs.PublicIPv6, mac)
+
+		if err := nw.v6Dev.DelV6ARP(neighbor{IP6: sn6.IP, MAC: mac}); err != nil {
+			log.Error("DelV6ARP failed: ", err)
+		}
+
+		if err := nw.v6Dev.DelV6FDB(neighbor{IP6: *attrs.PublicIPv6, MAC: mac}); err != nil {
+			log.Error("DelV6FDB failed: ", err)
+		}
+
+		if err := deleteRoute(&vxlanRoute); err != nil {
+			log.Errorf("failed to delete v6 vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+		}
+	}
+}
+
+// replaceRoute and deleteRoute program the routes to the other nodes, counting
+// the changes.
+func replaceRoute(route *netlink.Route) error {
+	err := netlink.RouteReplace(route)
+	backend.CountProgramming("vxlan", backend.EntryRoute, backend.OpAdd, err)
+	return err
+}
+
+func deleteRoute(route *netlink.Route) error {
+	err := netlink.RouteDel(route)
+	backend.CountProgramming("vxlan", backend.EntryRoute, backend.OpDelete, err)
+	return err
+}
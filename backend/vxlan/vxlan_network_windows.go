@@ -31,6 +31,7 @@ import (
 
 type network struct {
 	backend.SimpleNetwork
+	backend.SyncSignal
 	dev       *vxlanDevice
 	subnetMgr subnet.Manager
 }
@@ -75,6 +76,7 @@ func (nw *network) Run(ctx context.Context) {
 		select {
 		case evtBatch := <-events:
 			nw.handleSubnetEvents(evtBatch)
+			nw.MarkSynced()
 
 		case <-ctx.Done():
 			return
@@ -87,7 +89,7 @@ func (nw *network) MTU() int {
 }
 
 func (nw *network) handleSubnetEvents(batch []subnet.Event) {
-	for _, event := range batch {
+	for _, event := range backend.SplitSubnetEvents(batch) {
 		leaseSubnet := event.Lease.Subnet
 		leaseAttrs := event.Lease.Attrs
 		if !strings.EqualFold(leaseAttrs.BackendType, "vxlan") {
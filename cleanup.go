@@ -0,0 +1,188 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/network"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const cleanupUsage = `Usage: flanneld [OPTION]... cleanup [--release-lease]
+
+Removes what flanneld set up on this node: the devices, routes and ipsec policies
+of the backend, the iptables rules and the subnet file. With --kube-subnet-mgr the
+flannel annotations are removed from the node as well. Stop flanneld first.
+Running cleanup again, or on a node without flannel state, does no harm.
+
+Options:
+  --release-lease  also release the lease of the node in etcd or its FlannelLease,
+                   so that the subnet is free for other nodes. Reservations are kept.
+
+The same options flanneld runs with select the networks and their backends. The
+routes of the cloud backends (aws-vpc, gce, ali-vpc) and whatever the commands of
+the extension backend did are left alone.`
+
+// cleanupCommand tears down the networks flanneld would run with the same options.
+// All the steps are taken even when some fail.
+func cleanupCommand(w io.Writer, args []string) error {
+	if len(args) > 0 && args[0] == "help" {
+		fmt.Fprintln(w, cleanupUsage)
+		return nil
+	}
+
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	releaseLease := fs.Bool("release-lease", false, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	if opts.nodeID == "" && !opts.kubeSubnetMgr {
+		id, err := defaultNodeID()
+		if err != nil {
+			return fmt.Errorf("failed to determine the node ID, set --node-id: %v", err)
+		}
+		opts.nodeID = id
+	}
+
+	networks := []string{""}
+	if opts.networks != "" {
+		networks = strings.Split(opts.networks, ",")
+	}
+
+	failed := false
+	for _, name := range networks {
+		if err := cleanupNetwork(name, *releaseLease); err != nil {
+			log.Errorf("Cleanup%s failed: %v", networkLabel(name), err)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("cleanup failed, see the log")
+	}
+	return nil
+}
+
+func cleanupNetwork(name string, releaseLease bool) error {
+	subnetFile := subnetFileFor(name)
+	sn := ReadCIDRFromSubnetFile(subnetFile, "FLANNEL_SUBNET").Network()
+
+	sm, err := newSubnetManager(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaseCommandTimeout)
+	defer cancel()
+
+	config, err := sm.GetNetworkConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the network config: %v", err)
+	}
+
+	var errs []string
+	log.Infof("Cleaning up the %v backend", config.BackendType)
+	if err := backend.Cleanup(config); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	log.Info("Deleting iptables rules")
+	rules := network.PoolsMasqRules(config.Pools(), &subnet.Lease{Subnet: sn})
+	for _, n := range config.Pools() {
+		rules = append(rules, network.ForwardRules(n.String())...)
+	}
+	if err := network.DeleteIPTables(rules); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	// The annotations are all there is to a lease of the kube subnet manager
+	if releaseLease || opts.kubeSubnetMgr {
+		if err := releaseNodeLease(ctx, sm, sn); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to release the lease: %v", err))
+		}
+	}
+
+	if err := os.Remove(subnetFile); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err.Error())
+	} else if err == nil {
+		log.Infof("Removed %v", subnetFile)
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// releaseNodeLease releases the lease of this node, looking it up when the subnet
+// file doesn't tell its subnet.
+func releaseNodeLease(ctx context.Context, sm subnet.Manager, sn ip.IP4Net) error {
+	lr, ok := sm.(subnet.LeaseReleaser)
+	if !ok {
+		return fmt.Errorf("%s doesn't support releasing leases", sm.Name())
+	}
+
+	// The kube subnet manager knows its node by name
+	if opts.kubeSubnetMgr {
+		return lr.ReleaseLease(ctx, &subnet.Lease{Subnet: sn})
+	}
+
+	extIface, err := lookupExtIface()
+	if err != nil {
+		return err
+	}
+	lease := &subnet.Lease{
+		Subnet: sn,
+		Attrs: subnet.LeaseAttrs{
+			PublicIP: ip.FromIP(extIface.ExtAddr),
+			NodeID:   opts.nodeID,
+		},
+	}
+
+	if lease.Subnet.Empty() {
+		la, ok := sm.(subnet.LeaseAdmin)
+		if !ok {
+			return errors.New("the subnet file has no subnet")
+		}
+		leases, err := la.ListLeases(ctx)
+		if err != nil {
+			return err
+		}
+		l, _ := subnet.FindLeaseForNode(leases, &lease.Attrs)
+		if l == nil {
+			log.Info("This node holds no lease")
+			return nil
+		}
+		lease.Subnet = l.Subnet
+	}
+
+	return lr.ReleaseLease(ctx, lease)
+}
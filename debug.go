@@ -0,0 +1,285 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/network"
+	"github.com/coreos/flannel/subnet"
+)
+
+// debugTimeout bounds how long the debug endpoints wait for the subnet manager.
+const debugTimeout = 10 * time.Second
+
+// The debug endpoints show what flannel expects for every network, next to
+// what's actually there: the kernel for routes, neighbors and iptables rules,
+// the subnet manager for the config and the leases, which the kernel knows
+// nothing about.
+
+type configReport struct {
+	Network string         `json:"network"`
+	Running *subnet.Config `json:"running"`
+	Stored  *subnet.Config `json:"stored,omitempty"`
+	// Diff lists the settings of the stored config that differ.
+	Diff  []string `json:"diff"`
+	Error string   `json:"error,omitempty"`
+}
+
+type leaseReport struct {
+	Network string        `json:"network"`
+	Lease   *subnet.Lease `json:"lease"`
+	Stored  *subnet.Lease `json:"stored,omitempty"`
+	// Diff lists the fields of the stored lease that differ.
+	Diff  []string `json:"diff"`
+	Error string   `json:"error,omitempty"`
+}
+
+type peersReport struct {
+	Network string         `json:"network"`
+	Leases  []subnet.Lease `json:"leases"`
+	// Diff compares the subnets of the leases with those stored.
+	Diff  *backend.EntryDiff `json:"diff,omitempty"`
+	Error string             `json:"error,omitempty"`
+}
+
+type entriesReport struct {
+	Network string                        `json:"network"`
+	Backend string                        `json:"backend,omitempty"`
+	Entries map[string]*backend.EntryDiff `json:"entries,omitempty"`
+	Error   string                        `json:"error,omitempty"`
+}
+
+type iptablesReport struct {
+	Network string `json:"network"`
+	// Rules are the rules kept in place, and Missing those that don't exist.
+	Rules   []string `json:"rules"`
+	Missing []string `json:"missing"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// handleDebug registers the debug endpoints, which only answer GET requests.
+func (h *healthChecks) handleDebug() {
+	http.Handle("/debug/config", h.debugHandler(inspectConfig))
+	http.Handle("/debug/lease", h.debugHandler(inspectLease))
+	http.Handle("/debug/peers", h.debugHandler(inspectPeers))
+	http.Handle("/debug/routes", h.debugHandler(func(ctx context.Context, n *netRunner) interface{} {
+		return inspectEntries(n, backend.EntryRoute)
+	}))
+	http.Handle("/debug/neighbors", h.debugHandler(func(ctx context.Context, n *netRunner) interface{} {
+		return inspectEntries(n, backend.EntryARP, backend.EntryFDB)
+	}))
+	http.Handle("/debug/iptables", h.debugHandler(func(ctx context.Context, n *netRunner) interface{} {
+		return inspectIPTables(n)
+	}))
+}
+
+// debugHandler serves a list of the reports inspect makes for every network.
+func (h *healthChecks) debugHandler(inspect func(ctx context.Context, n *netRunner) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h.mux.Lock()
+		networks := h.networks
+		h.mux.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), debugTimeout)
+		defer cancel()
+		reports := []interface{}{}
+		for _, n := range networks {
+			reports = append(reports, inspect(ctx, n))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	}
+}
+
+// state returns the network that is up and its config.
+func (n *netRunner) state() (backend.Network, *subnet.Config) {
+	n.stateMux.Lock()
+	defer n.stateMux.Unlock()
+	return n.bn, n.config
+}
+
+func inspectConfig(ctx context.Context, n *netRunner) interface{} {
+	_, config := n.state()
+	report := &configReport{Network: n.name, Running: config, Diff: []string{}}
+	if config == nil {
+		report.Error = "network is not up"
+		return report
+	}
+
+	stored, err := n.sm.GetNetworkConfig(ctx)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to get the stored config: %v", err)
+		return report
+	}
+	report.Stored = stored
+	report.Diff = append(report.Diff, subnet.UnsafeConfigChanges(config, stored)...)
+	if subnet.BackendConfigChanged(config, stored) {
+		report.Diff = append(report.Diff, "Backend")
+	}
+	return report
+}
+
+func inspectLease(ctx context.Context, n *netRunner) interface{} {
+	bn, _ := n.state()
+	report := &leaseReport{Network: n.name, Diff: []string{}}
+	if bn == nil {
+		report.Error = "network is not up"
+		return report
+	}
+	lease := n.leaseSnapshot(bn)
+	report.Lease = lease
+
+	la, ok := n.sm.(subnet.LeaseAdmin)
+	if !ok {
+		report.Error = fmt.Sprintf("%s can't look up leases", n.sm.Name())
+		return report
+	}
+	stored, err := la.GetLease(ctx, lease.Subnet)
+	if err == subnet.ErrNotFound {
+		report.Diff = append(report.Diff, "lease isn't stored")
+		return report
+	} else if err != nil {
+		report.Error = fmt.Sprintf("failed to get the stored lease: %v", err)
+		return report
+	}
+	report.Stored = stored
+
+	if !stored.IPv6Subnet.Equal(lease.IPv6Subnet) {
+		report.Diff = append(report.Diff, "IPv6Subnet")
+	}
+	if !reflect.DeepEqual(stored.AdditionalSubnets, lease.AdditionalSubnets) {
+		report.Diff = append(report.Diff, "AdditionalSubnets")
+	}
+	if !reflect.DeepEqual(stored.Attrs, lease.Attrs) {
+		report.Diff = append(report.Diff, "Attrs")
+	}
+	if stored.Asof != lease.Asof {
+		report.Diff = append(report.Diff, "Asof")
+	}
+	// Both sides work the expiration out from a TTL of their own, so they only
+	// differ if the stored lease expired or only one of them is a reservation.
+	if stored.Expiration.IsZero() != lease.Expiration.IsZero() || (!stored.Expiration.IsZero() && stored.Expiration.Before(time.Now())) {
+		report.Diff = append(report.Diff, "Expiration")
+	}
+	return report
+}
+
+func inspectPeers(ctx context.Context, n *netRunner) interface{} {
+	bn, _ := n.state()
+	report := &peersReport{Network: n.name, Leases: []subnet.Lease{}}
+	leases, ok := subnet.GetWatchedLeases(n.sm)
+	if bn == nil || !ok {
+		report.Error = "backend isn't watching the leases"
+		return report
+	}
+	report.Leases = leases
+
+	la, ok := n.sm.(subnet.LeaseAdmin)
+	if !ok {
+		report.Error = fmt.Sprintf("%s can't list leases", n.sm.Name())
+		return report
+	}
+	stored, err := la.ListLeases(ctx)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to list the stored leases: %v", err)
+		return report
+	}
+
+	var expected, actual []string
+	for _, l := range leases {
+		expected = append(expected, peerString(&l))
+	}
+	own := n.leaseSnapshot(bn).Subnet
+	for _, l := range stored {
+		if !l.Subnet.Equal(own) {
+			actual = append(actual, peerString(&l))
+		}
+	}
+	report.Diff = backend.NewEntryDiff(expected, actual)
+	return report
+}
+
+func peerString(l *subnet.Lease) string {
+	return fmt.Sprintf("%s via %s", l.Subnet, l.Attrs.PublicIP)
+}
+
+// inspectEntries reports on the given kinds of entries the backend programs.
+func inspectEntries(n *netRunner, entries ...string) interface{} {
+	bn, config := n.state()
+	report := &entriesReport{Network: n.name}
+	if bn == nil {
+		report.Error = "network is not up"
+		return report
+	}
+	report.Backend = config.BackendType
+
+	in, ok := bn.(backend.InspectedNetwork)
+	if !ok {
+		report.Error = fmt.Sprintf("the %s backend can't be inspected", config.BackendType)
+		return report
+	}
+	diffs, err := in.Inspect(config)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	report.Entries = make(map[string]*backend.EntryDiff)
+	for _, entry := range entries {
+		if d, ok := diffs[entry]; ok {
+			report.Entries[entry] = d
+		}
+	}
+	return report
+}
+
+func inspectIPTables(n *netRunner) interface{} {
+	n.stateMux.Lock()
+	rules := n.rules
+	n.stateMux.Unlock()
+
+	report := &iptablesReport{Network: n.name, Rules: []string{}, Missing: []string{}}
+	if len(rules) == 0 {
+		return report
+	}
+	for _, rule := range rules {
+		report.Rules = append(report.Rules, rule.String())
+	}
+	missing, err := network.MissingIPTablesRules(rules)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	for _, rule := range missing {
+		report.Missing = append(report.Missing, rule.String())
+	}
+	return report
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/network"
+	"github.com/coreos/flannel/subnet"
+)
+
+// watchStuckAfter is how long the watch of the leases may keep failing, or
+// wait for the backend to take the changes, before it counts as stuck.
+const watchStuckAfter = time.Minute
+
+// checkResult is the outcome of one health check of a network.
+type checkResult struct {
+	Check   string `json:"check"`
+	Network string `json:"network,omitempty"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []checkResult `json:"checks"`
+}
+
+// healthChecks reports on the health of the networks the daemon runs. Liveness
+// covers the lease, the backend loop and the watch of the leases; readiness
+// also requires the backend to have set up the other nodes, and its devices
+// and iptables rules to be in place.
+type healthChecks struct {
+	mux      sync.Mutex
+	networks []*netRunner
+}
+
+func (h *healthChecks) add(n *netRunner) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.networks = append(h.networks, n)
+}
+
+func (h *healthChecks) report(ready bool) healthReport {
+	h.mux.Lock()
+	networks := h.networks
+	h.mux.Unlock()
+
+	report := healthReport{OK: true, Checks: []checkResult{}}
+	for _, n := range networks {
+		for _, r := range n.health(ready) {
+			report.OK = report.OK && r.OK
+			report.Checks = append(report.Checks, r)
+		}
+	}
+	return report
+}
+
+// handler serves the report as JSON, with status 503 when a check failed.
+func (h *healthChecks) handler(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := h.report(ready)
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// health runs the checks of the network, those for readiness if ready is set.
+func (n *netRunner) health(ready bool) []checkResult {
+	n.stateMux.Lock()
+	bn, running, rules := n.bn, n.running, n.rules
+	n.stateMux.Unlock()
+
+	results := []checkResult{
+		n.checkResult("lease", checkLease(n.leaseSnapshot(bn))),
+		n.checkResult("backend", checkBackend(bn, running, ready)),
+		n.checkResult("watch", checkWatch(n.sm)),
+	}
+	if ready {
+		results = append(results,
+			n.checkResult("devices", checkDevices(bn)),
+			n.checkResult("iptables", checkIPTables(rules)))
+	}
+	return results
+}
+
+func (n *netRunner) checkResult(check string, err error) checkResult {
+	r := checkResult{Check: check, Network: n.name, OK: err == nil}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// setNetwork records the network that is up, or nil once it's down, along with
+// its config and the iptables rules kept in place for it.
+func (n *netRunner) setNetwork(bn backend.Network, config *subnet.Config, rules []network.IPTablesRule) {
+	n.stateMux.Lock()
+	defer n.stateMux.Unlock()
+	n.bn, n.config, n.rules = bn, config, rules
+	n.running = false
+}
+
+func (n *netRunner) setRunning(running bool) {
+	n.stateMux.Lock()
+	defer n.stateMux.Unlock()
+	n.running = running
+}
+
+// leaseSnapshot returns a copy of the lease of bn as last renewed, or nil if bn
+// is. It's safe to call while MonitorLease renews the lease.
+func (n *netRunner) leaseSnapshot(bn backend.Network) *subnet.Lease {
+	if bn == nil {
+		return nil
+	}
+	l := n.lease.get()
+	return &l
+}
+
+func checkLease(l *subnet.Lease) error {
+	if l == nil {
+		return errors.New("no lease acquired")
+	}
+	if !l.Expiration.IsZero() && !l.Expiration.After(time.Now()) {
+		return fmt.Errorf("lease for %s expired at %s", l.Subnet, l.Expiration)
+	}
+	return nil
+}
+
+func checkBackend(bn backend.Network, running, ready bool) error {
+	if bn == nil {
+		return errors.New("backend not registered")
+	}
+	if !running {
+		return errors.New("backend is not running")
+	}
+	if sn, ok := bn.(backend.SyncedNetwork); ok && ready {
+		select {
+		case <-sn.Synced():
+		default:
+			return errors.New("backend hasn't set up the leases of the other nodes yet")
+		}
+	}
+	return nil
+}
+
+func checkWatch(sm subnet.Manager) error {
+	s := subnet.GetWatchStatus(sm)
+	if !s.FailingSince.IsZero() && time.Since(s.FailingSince) > watchStuckAfter {
+		return fmt.Errorf("watch of the leases failing since %s: %v", s.FailingSince, s.LastError)
+	}
+	if !s.BlockedSince.IsZero() && time.Since(s.BlockedSince) > watchStuckAfter {
+		return fmt.Errorf("changes to the leases waiting to be taken by the backend since %s", s.BlockedSince)
+	}
+	return nil
+}
+
+func checkDevices(bn backend.Network) error {
+	if cn, ok := bn.(backend.CheckedNetwork); ok {
+		return cn.CheckDevices()
+	}
+	return nil
+}
+
+func checkIPTables(rules []network.IPTablesRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	return network.CheckIPTables(rules)
+}
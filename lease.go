@@ -0,0 +1,239 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const leaseUsage = `Usage: flanneld [OPTION]... lease COMMAND
+
+Commands:
+  list                        list the leases of the network
+  show SUBNET                 show a single lease
+  reserve SUBNET [PUBLIC-IP]  turn a lease into a reservation that never expires, or reserve
+                              a free subnet for the node with PUBLIC-IP (and --node-id and
+                              --node-group, if given)
+  unreserve SUBNET            turn a reservation back into a lease that expires
+  delete SUBNET               delete a lease or reservation
+
+The etcd options select the network. With --networks, exactly one network has to be given.`
+
+const leaseCommandTimeout = time.Minute
+
+// runCommand runs the command given after the options and returns the exit code.
+func runCommand(args []string) int {
+	var err error
+	switch args[0] {
+	case "lease":
+		err = leaseCommand(os.Stdout, args[1:])
+	case "cleanup":
+		err = cleanupCommand(os.Stdout, args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func leaseCommand(w io.Writer, args []string) error {
+	if len(args) == 0 || args[0] == "help" {
+		fmt.Fprintln(w, leaseUsage)
+		return nil
+	}
+
+	if opts.kubeSubnetMgr {
+		return errors.New("leases are managed by kubernetes with --kube-subnet-mgr")
+	}
+
+	var name string
+	if opts.networks != "" {
+		networks := strings.Split(opts.networks, ",")
+		if len(networks) != 1 {
+			return errors.New("lease commands work on a single network, pass only one in --networks")
+		}
+		name = networks[0]
+	}
+
+	sm, err := newSubnetManager(name)
+	if err != nil {
+		return err
+	}
+	la, ok := sm.(subnet.LeaseAdmin)
+	if !ok {
+		return fmt.Errorf("%s doesn't support managing leases", sm.Name())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaseCommandTimeout)
+	defer cancel()
+
+	config, err := sm.GetNetworkConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the network config: %v", err)
+	}
+
+	cmd, args := args[0], args[1:]
+	if cmd == "list" {
+		if len(args) != 0 {
+			return errors.New("list takes no arguments")
+		}
+		leases, err := la.ListLeases(ctx)
+		if err != nil {
+			return err
+		}
+		printLeases(w, config, leases)
+		return nil
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("%s needs a SUBNET", cmd)
+	}
+	var sn ip.IP4Net
+	if err := sn.UnmarshalJSON([]byte(args[0])); err != nil {
+		return fmt.Errorf("invalid subnet %q: %v", args[0], err)
+	}
+	args = args[1:]
+
+	var l *subnet.Lease
+	switch {
+	case cmd == "show" && len(args) == 0:
+		l, err = la.GetLease(ctx, sn)
+
+	case cmd == "reserve" && len(args) <= 1:
+		var attrs *subnet.LeaseAttrs
+		if len(args) == 1 {
+			if attrs, err = reservationAttrs(ctx, la, sn, args[0]); err != nil {
+				return err
+			}
+		}
+		l, err = la.ReserveLease(ctx, sn, attrs)
+
+	case cmd == "unreserve" && len(args) == 0:
+		l, err = la.UnreserveLease(ctx, sn)
+
+	case cmd == "delete" && len(args) == 0:
+		if err = la.DeleteLease(ctx, sn); err == nil {
+			fmt.Fprintf(w, "Deleted lease %s\n", sn)
+		}
+		return err
+
+	default:
+		return fmt.Errorf("invalid lease command, see \"lease help\"")
+	}
+
+	if err != nil {
+		return err
+	}
+	printLease(w, config, l)
+	return nil
+}
+
+// reservationAttrs returns the attributes of a reservation for the node with
+// the given public IP. Those of an existing lease are kept otherwise.
+func reservationAttrs(ctx context.Context, la subnet.LeaseAdmin, sn ip.IP4Net, publicIP string) (*subnet.LeaseAttrs, error) {
+	pubIP, err := ip.ParseIP4(publicIP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public IP %q: %v", publicIP, err)
+	}
+
+	attrs := &subnet.LeaseAttrs{
+		NodeGroup: opts.nodeGroup,
+	}
+	if l, err := la.GetLease(ctx, sn); err == nil {
+		attrs = &l.Attrs
+	} else if err != subnet.ErrNotFound {
+		return nil, err
+	}
+
+	attrs.PublicIP = pubIP
+	if opts.nodeID != "" {
+		attrs.NodeID = opts.nodeID
+	}
+	return attrs, nil
+}
+
+func expiration(l *subnet.Lease) string {
+	if l.Expiration.IsZero() {
+		return "never (reserved)"
+	}
+	return l.Expiration.Format(time.RFC3339)
+}
+
+// configStatus tells whether the lease still fits the network config. Leases
+// that don't get replaced when their node acquires a lease again.
+func configStatus(config *subnet.Config, l *subnet.Lease) string {
+	if config.IsValidSubnet(l.Attrs.NodeGroup, l.Subnet) {
+		return "ok"
+	}
+	return "invalid"
+}
+
+func printLeases(w io.Writer, config *subnet.Config, leases []subnet.Lease) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUBNET\tIPV6 SUBNET\tPUBLIC IP\tBACKEND\tNODE ID\tEXPIRES\tCONFIG")
+	for i := range leases {
+		l := &leases[i]
+		sn6 := "-"
+		if !l.IPv6Subnet.Empty() {
+			sn6 = l.IPv6Subnet.String()
+		}
+		nodeID := "-"
+		if l.Attrs.NodeID != "" {
+			nodeID = l.Attrs.NodeID
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", l.Subnet, sn6, l.Attrs.PublicIP, l.Attrs.BackendType, nodeID, expiration(l), configStatus(config, l))
+	}
+	tw.Flush()
+}
+
+func printLease(w io.Writer, config *subnet.Config, l *subnet.Lease) {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "Subnet:\t%s\n", l.Subnet)
+	if !l.IPv6Subnet.Empty() {
+		fmt.Fprintf(tw, "IPv6 subnet:\t%s\n", l.IPv6Subnet)
+	}
+	fmt.Fprintf(tw, "Public IP:\t%s\n", l.Attrs.PublicIP)
+	if l.Attrs.PublicIPv6 != nil {
+		fmt.Fprintf(tw, "Public IPv6:\t%s\n", l.Attrs.PublicIPv6)
+	}
+	if l.Attrs.NodeID != "" {
+		fmt.Fprintf(tw, "Node ID:\t%s\n", l.Attrs.NodeID)
+	}
+	if l.Attrs.NodeGroup != "" {
+		fmt.Fprintf(tw, "Node group:\t%s\n", l.Attrs.NodeGroup)
+	}
+	fmt.Fprintf(tw, "Backend type:\t%s\n", l.Attrs.BackendType)
+	if len(l.Attrs.BackendData) > 0 {
+		fmt.Fprintf(tw, "Backend data:\t%s\n", l.Attrs.BackendData)
+	}
+	fmt.Fprintf(tw, "Expires:\t%s\n", expiration(l))
+	fmt.Fprintf(tw, "Config:\t%s\n", configStatus(config, l))
+	tw.Flush()
+}
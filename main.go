@@ -15,17 +15,21 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/coreos/pkg/flagutil"
@@ -35,13 +39,17 @@ import (
 	"github.com/coreos/flannel/network"
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/subnet/crd"
 	"github.com/coreos/flannel/subnet/etcdv2"
+	"github.com/coreos/flannel/subnet/etcdv3"
 	"github.com/coreos/flannel/subnet/kube"
+	"github.com/coreos/flannel/subnet/remote"
 	"github.com/coreos/flannel/version"
 
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"sync"
 
@@ -79,18 +87,24 @@ type CmdLineOpts struct {
 	etcdCAFile             string
 	etcdUsername           string
 	etcdPassword           string
+	etcdAPI                string
 	help                   bool
 	version                bool
 	kubeSubnetMgr          bool
 	kubeApiUrl             string
 	kubeAnnotationPrefix   string
 	kubeConfigFile         string
+	kubeIPAM               bool
+	kubeReadinessTaint     string
+	kubeCRDSubnetMgr       bool
 	iface                  flagSlice
 	ifaceRegex             flagSlice
 	ipMasq                 bool
 	subnetFile             string
 	subnetDir              string
+	networks               string
 	publicIP               string
+	publicIPv6             string
 	subnetLeaseRenewMargin int
 	healthzIP              string
 	healthzPort            int
@@ -99,6 +113,19 @@ type CmdLineOpts struct {
 	iptablesResyncSeconds  int
 	iptablesForwardRules   bool
 	netConfPath            string
+	netConfConfigMap       string
+	netConfKey             string
+	configReloadInterval   int
+	teardownOnExit         bool
+	releaseLeaseOnExit     bool
+	onLeaseRevoked         string
+	nodeID                 string
+	nodeGroup              string
+	listen                 string
+	remote                 string
+	remoteKeyfile          string
+	remoteCertfile         string
+	remoteCAFile           string
 }
 
 var (
@@ -116,22 +143,42 @@ func init() {
 	flannelFlags.StringVar(&opts.etcdCAFile, "etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
 	flannelFlags.StringVar(&opts.etcdUsername, "etcd-username", "", "username for BasicAuth to etcd")
 	flannelFlags.StringVar(&opts.etcdPassword, "etcd-password", "", "password for BasicAuth to etcd")
+	flannelFlags.StringVar(&opts.listen, "listen", "", "run as a server serving the subnet managers of the network(s) to flanneld started with --remote, on the given host:port")
+	flannelFlags.StringVar(&opts.remote, "remote", "", "get subnet leases from a flanneld started with --listen at the given host:port, instead of etcd")
+	flannelFlags.StringVar(&opts.remoteKeyfile, "remote-keyfile", "", "SSL key file used to secure the --listen/--remote communication")
+	flannelFlags.StringVar(&opts.remoteCertfile, "remote-certfile", "", "SSL certification file used to secure the --listen/--remote communication")
+	flannelFlags.StringVar(&opts.remoteCAFile, "remote-cafile", "", "SSL Certificate Authority file used to secure the --listen/--remote communication (a server requires client certificates signed by it)")
+	flannelFlags.StringVar(&opts.etcdAPI, "etcd-api", "v2", "etcd API version used to store subnet leases (v2 or v3)")
 	flannelFlags.Var(&opts.iface, "iface", "interface to use (IP or name) for inter-host communication. Can be specified multiple times to check each option in order. Returns the first match found.")
 	flannelFlags.Var(&opts.ifaceRegex, "iface-regex", "regex expression to match the first interface to use (IP or name) for inter-host communication. Can be specified multiple times to check each regex in order. Returns the first match found. Regexes are checked after specific interfaces specified by the iface option have already been checked.")
 	flannelFlags.StringVar(&opts.subnetFile, "subnet-file", "/run/flannel/subnet.env", "filename where env variables (subnet, MTU, ... ) will be written to")
+	flannelFlags.StringVar(&opts.subnetDir, "subnet-dir", "/run/flannel/networks", "directory where the env variables files of the networks listed in --networks are written to")
+	flannelFlags.StringVar(&opts.networks, "networks", "", "comma-delimited list of networks to join, each configured under <etcd-prefix>/<network>/config")
 	flannelFlags.StringVar(&opts.publicIP, "public-ip", "", "IP accessible by other nodes for inter-host communication")
+	flannelFlags.StringVar(&opts.nodeID, "node-id", "", "ID that identifies this node's subnet lease (defaults to the machine ID, or the hostname when there is none)")
+	flannelFlags.StringVar(&opts.nodeGroup, "node-group", "", "node group (from the NodeGroups of the network config) to get a subnet from. With kube-subnet-mgr, label the node with <kube-annotation-prefix>/node-group instead")
+	flannelFlags.StringVar(&opts.publicIPv6, "public-ipv6", "", "IPv6 address accessible by other nodes for inter-host communication")
 	flannelFlags.IntVar(&opts.subnetLeaseRenewMargin, "subnet-lease-renew-margin", 60, "subnet lease renewal margin, in minutes, ranging from 1 to 1439")
 	flannelFlags.BoolVar(&opts.ipMasq, "ip-masq", false, "setup IP masquerade rule for traffic destined outside of overlay network")
 	flannelFlags.BoolVar(&opts.kubeSubnetMgr, "kube-subnet-mgr", false, "contact the Kubernetes API for subnet assignment instead of etcd.")
 	flannelFlags.StringVar(&opts.kubeApiUrl, "kube-api-url", "", "Kubernetes API server URL. Does not need to be specified if flannel is running in a pod.")
 	flannelFlags.StringVar(&opts.kubeAnnotationPrefix, "kube-annotation-prefix", "flannel.alpha.coreos.com", `Kubernetes annotation prefix. Can contain single slash "/", otherwise it will be appended at the end.`)
 	flannelFlags.StringVar(&opts.kubeConfigFile, "kubeconfig-file", "", "kubeconfig file location. Does not need to be specified if flannel is running in a pod.")
+	flannelFlags.BoolVar(&opts.kubeCRDSubnetMgr, "kube-crd-subnet-mgr", false, "store the network config and subnet leases in FlannelNetwork and FlannelLease resources of the Kubernetes API instead of etcd")
+	flannelFlags.StringVar(&opts.kubeReadinessTaint, "kube-readiness-taint", "", "key of a NoSchedule taint to remove from the node once flannel is ready, and to add back if it fails, with kube-subnet-mgr")
+	flannelFlags.BoolVar(&opts.kubeIPAM, "kube-ipam", false, "assign pod CIDRs to nodes from the network config with kube-subnet-mgr, instead of relying on kube-controller-manager --allocate-node-cidrs")
 	flannelFlags.BoolVar(&opts.version, "version", false, "print version and exit")
 	flannelFlags.StringVar(&opts.healthzIP, "healthz-ip", "0.0.0.0", "the IP address for healthz server to listen")
 	flannelFlags.IntVar(&opts.healthzPort, "healthz-port", 0, "the port for healthz server to listen(0 to disable)")
 	flannelFlags.IntVar(&opts.iptablesResyncSeconds, "iptables-resync", 5, "resync period for iptables rules, in seconds")
 	flannelFlags.BoolVar(&opts.iptablesForwardRules, "iptables-forward-rules", true, "add default accept rules to FORWARD chain in iptables")
 	flannelFlags.StringVar(&opts.netConfPath, "net-config-path", "/etc/kube-flannel/net-conf.json", "path to the network configuration file")
+	flannelFlags.StringVar(&opts.netConfConfigMap, "net-config-configmap", "", "namespace/name of a ConfigMap to read the network configuration from with kube-subnet-mgr, instead of --net-config-path")
+	flannelFlags.StringVar(&opts.netConfKey, "net-config-key", "net-conf.json", "key of the network configuration in --net-config-configmap")
+	flannelFlags.BoolVar(&opts.teardownOnExit, "teardown-on-exit", false, "remove the devices, routes and cloud routes of the backend on exit instead of leaving them for the next flanneld")
+	flannelFlags.BoolVar(&opts.releaseLeaseOnExit, "release-lease-on-exit", false, "release the subnet lease when shut down by a signal, instead of keeping it until it expires. The subnet file is kept, so a restart reclaims the same subnet if it's still free")
+	flannelFlags.StringVar(&opts.onLeaseRevoked, "on-lease-revoked", leaseRevokedExit, "what to do when the subnet lease is revoked: exit, reacquire a lease (preferring the same subnet) or reacquire-same-subnet, which exits if the subnet changed")
+	flannelFlags.IntVar(&opts.configReloadInterval, "config-reload-interval", 30, "how often to check the network config for changes, in seconds (0 to disable)")
 
 	// glog will log to tmp files by default. override so all entries
 	// can flow into journald (if running under systemd)
@@ -144,9 +191,6 @@ func init() {
 
 	// Define the usage function
 	flannelFlags.Usage = usage
-
-	// now parse command line args
-	flannelFlags.Parse(os.Args[1:])
 }
 
 func copyFlag(name string) {
@@ -154,33 +198,86 @@ func copyFlag(name string) {
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]... [lease COMMAND | cleanup [--release-lease]]\n", os.Args[0])
 	flannelFlags.PrintDefaults()
 	os.Exit(0)
 }
 
-func newSubnetManager() (subnet.Manager, error) {
+// newSubnetManager creates the subnet manager of a network. Named networks keep
+// their config and leases under <etcd-prefix>/<name>.
+func newSubnetManager(name string) (subnet.Manager, error) {
 	if opts.kubeSubnetMgr {
-		return kube.NewSubnetManager(opts.kubeApiUrl, opts.kubeConfigFile, opts.kubeAnnotationPrefix, opts.netConfPath)
+		return kube.NewSubnetManager(opts.kubeApiUrl, opts.kubeConfigFile, opts.kubeAnnotationPrefix, opts.netConfPath, opts.netConfConfigMap, opts.netConfKey, opts.kubeIPAM)
 	}
 
-	cfg := &etcdv2.EtcdConfig{
-		Endpoints: strings.Split(opts.etcdEndpoints, ","),
-		Keyfile:   opts.etcdKeyfile,
-		Certfile:  opts.etcdCertfile,
-		CAFile:    opts.etcdCAFile,
-		Prefix:    opts.etcdPrefix,
-		Username:  opts.etcdUsername,
-		Password:  opts.etcdPassword,
+	if opts.remote != "" {
+		cfg := &remote.ClientConfig{
+			Addr:     opts.remote,
+			Network:  name,
+			CAFile:   opts.remoteCAFile,
+			CertFile: opts.remoteCertfile,
+			KeyFile:  opts.remoteKeyfile,
+		}
+
+		return remote.NewRemoteManager(cfg, opts.nodeID, opts.nodeGroup)
 	}
 
 	// Attempt to renew the lease for the subnet specified in the subnetFile
-	prevSubnet := ReadCIDRFromSubnetFile(opts.subnetFile, "FLANNEL_SUBNET")
+	subnetFile := subnetFileFor(name)
+	prevSubnet := ReadCIDRFromSubnetFile(subnetFile, "FLANNEL_SUBNET")
+	prevIPv6Subnet := ReadIP6CIDRFromSubnetFile(subnetFile, "FLANNEL_IPV6_SUBNET")
 
-	return etcdv2.NewLocalManager(cfg, prevSubnet)
+	return newLocalSubnetManager(name, prevSubnet, prevIPv6Subnet, opts.nodeID, opts.nodeGroup)
+}
+
+// newLocalSubnetManager creates a subnet manager keeping the leases of the
+// network in etcd, or in FlannelLease resources with --kube-crd-subnet-mgr.
+func newLocalSubnetManager(name string, prevSubnet ip.IP4Net, prevIPv6Subnet ip.IP6Net, nodeID, nodeGroup string) (subnet.Manager, error) {
+	if opts.kubeCRDSubnetMgr {
+		return crd.NewSubnetManager(opts.kubeApiUrl, opts.kubeConfigFile, name, prevSubnet, nodeID, nodeGroup)
+	}
+
+	prefix := opts.etcdPrefix
+	if name != "" {
+		prefix = path.Join(prefix, name)
+	}
+
+	switch opts.etcdAPI {
+	case "v2":
+		cfg := &etcdv2.EtcdConfig{
+			Endpoints: strings.Split(opts.etcdEndpoints, ","),
+			Keyfile:   opts.etcdKeyfile,
+			Certfile:  opts.etcdCertfile,
+			CAFile:    opts.etcdCAFile,
+			Prefix:    prefix,
+			Username:  opts.etcdUsername,
+			Password:  opts.etcdPassword,
+		}
+
+		return etcdv2.NewLocalManager(cfg, prevSubnet, prevIPv6Subnet, nodeID, nodeGroup)
+
+	case "v3":
+		cfg := &etcdv3.EtcdConfig{
+			Endpoints: strings.Split(opts.etcdEndpoints, ","),
+			Keyfile:   opts.etcdKeyfile,
+			Certfile:  opts.etcdCertfile,
+			CAFile:    opts.etcdCAFile,
+			Prefix:    prefix,
+			Username:  opts.etcdUsername,
+			Password:  opts.etcdPassword,
+		}
+
+		return etcdv3.NewLocalManager(cfg, prevSubnet, prevIPv6Subnet, nodeID, nodeGroup)
+
+	default:
+		return nil, fmt.Errorf("unsupported etcd API version %q (must be v2 or v3)", opts.etcdAPI)
+	}
 }
 
 func main() {
+	// Parsed here rather than in init, which also runs for the tests
+	flannelFlags.Parse(os.Args[1:])
+
 	if opts.version {
 		fmt.Fprintln(os.Stderr, version.Version)
 		os.Exit(0)
@@ -188,62 +285,83 @@ func main() {
 
 	flagutil.SetFlagsFromEnv(flannelFlags, "FLANNELD")
 
+	if args := flannelFlags.Args(); len(args) > 0 {
+		os.Exit(runCommand(args))
+	}
+
 	// Validate flags
 	if opts.subnetLeaseRenewMargin >= 24*60 || opts.subnetLeaseRenewMargin <= 0 {
 		log.Error("Invalid subnet-lease-renew-margin option, out of acceptable range")
 		os.Exit(1)
 	}
 
-	// Work out which interface to use
-	var extIface *backend.ExternalInterface
-	var err error
-	// Check the default interface only if no interfaces are specified
-	if len(opts.iface) == 0 && len(opts.ifaceRegex) == 0 {
-		extIface, err = LookupExtIface("", "")
-		if err != nil {
-			log.Error("Failed to find any valid interface to use: ", err)
+	switch opts.onLeaseRevoked {
+	case leaseRevokedExit, leaseRevokedReacquire, leaseRevokedReacquireSameSubnet:
+	default:
+		log.Errorf("Invalid --on-lease-revoked option %q, must be %s, %s or %s", opts.onLeaseRevoked, leaseRevokedExit, leaseRevokedReacquire, leaseRevokedReacquireSameSubnet)
+		os.Exit(1)
+	}
+
+	networks := []string{""}
+	if len(opts.networks) > 0 {
+		if opts.kubeSubnetMgr {
+			log.Error("--networks is not supported together with --kube-subnet-mgr")
 			os.Exit(1)
 		}
-	} else {
-		// Check explicitly specified interfaces
-		for _, iface := range opts.iface {
-			extIface, err = LookupExtIface(iface, "")
-			if err != nil {
-				log.Infof("Could not find valid interface matching %s: %s", iface, err)
-			}
-
-			if extIface != nil {
-				break
+		networks = strings.Split(opts.networks, ",")
+		seen := make(map[string]bool)
+		for _, name := range networks {
+			if name == "" || strings.Contains(name, "/") || seen[name] {
+				log.Errorf("Invalid --networks option: %q is empty, duplicated or contains a slash", name)
+				os.Exit(1)
 			}
+			seen[name] = true
 		}
+	}
 
-		// Check interfaces that match any specified regexes
-		if extIface == nil {
-			for _, ifaceRegex := range opts.ifaceRegex {
-				extIface, err = LookupExtIface("", ifaceRegex)
-				if err != nil {
-					log.Infof("Could not find valid interface matching %s: %s", ifaceRegex, err)
-				}
-
-				if extIface != nil {
-					break
-				}
-			}
+	if opts.listen != "" {
+		// The CRD manager's lease watches can't resume from a client's cursor
+		if opts.kubeSubnetMgr || opts.kubeCRDSubnetMgr || opts.remote != "" {
+			log.Error("--listen can't be used together with --kube-subnet-mgr, --kube-crd-subnet-mgr or --remote")
+			os.Exit(1)
 		}
+		os.Exit(runServer(networks))
+	}
+	if opts.remote != "" && opts.kubeSubnetMgr {
+		log.Error("--remote can't be used together with --kube-subnet-mgr")
+		os.Exit(1)
+	}
+	if opts.kubeCRDSubnetMgr && (opts.kubeSubnetMgr || opts.remote != "") {
+		log.Error("--kube-crd-subnet-mgr can't be used together with --kube-subnet-mgr or --remote")
+		os.Exit(1)
+	}
+	if opts.netConfConfigMap != "" && !opts.kubeSubnetMgr {
+		log.Error("--net-config-configmap requires --kube-subnet-mgr")
+		os.Exit(1)
+	}
+	if opts.kubeReadinessTaint != "" && !opts.kubeSubnetMgr {
+		log.Error("--kube-readiness-taint requires --kube-subnet-mgr")
+		os.Exit(1)
+	}
 
-		if extIface == nil {
-			// Exit if any of the specified interfaces do not match
-			log.Error("Failed to find interface to use that matches the interfaces and/or regexes provided")
+	if opts.nodeID == "" && !opts.kubeSubnetMgr {
+		id, err := defaultNodeID()
+		if err != nil {
+			log.Error("Failed to determine the node ID, set --node-id: ", err)
 			os.Exit(1)
 		}
+		opts.nodeID = id
+	}
+	if opts.nodeID != "" {
+		log.Infof("Using node ID %q", opts.nodeID)
 	}
 
-	sm, err := newSubnetManager()
+	// Work out which interface to use
+	extIface, err := lookupExtIface()
 	if err != nil {
-		log.Error("Failed to create SubnetManager: ", err)
+		log.Error(err)
 		os.Exit(1)
 	}
-	log.Infof("Created subnet manager: %s", sm.Name())
 
 	// Register for SIGINT and SIGTERM
 	log.Info("Installing signal handlers")
@@ -264,46 +382,444 @@ func main() {
 		wg.Done()
 	}()
 
+	health := &healthChecks{}
 	if opts.healthzPort > 0 {
 		// It's not super easy to shutdown the HTTP server so don't attempt to stop it cleanly
-		go mustRunHealthz()
+		go mustRunHealthz(health)
+	}
+
+	// Each network runs on its own: a failure or a revoked lease only stops that network.
+	// The daemon exits once none of them is left running.
+	var failed int32
+	var registered, running sync.WaitGroup
+	for _, name := range networks {
+		sm, err := newSubnetManager(name)
+		if err != nil {
+			log.Errorf("Failed to create SubnetManager%s: %s", networkLabel(name), err)
+			cancel()
+			wg.Wait()
+			os.Exit(1)
+		}
+		log.Infof("Created subnet manager%s: %s", networkLabel(name), sm.Name())
+
+		nw := &netRunner{
+			name:       name,
+			sm:         sm,
+			extIface:   extIface,
+			subnetFile: subnetFileFor(name),
+			bm:         backend.NewManager(sm, extIface),
+		}
+		health.add(nw)
+
+		registered.Add(1)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			if err := nw.run(ctx, registered.Done); err != nil {
+				log.Errorf("Network%s stopped: %s", networkLabel(nw.name), err)
+				atomic.StoreInt32(&failed, 1)
+			}
+		}()
+	}
+
+	registered.Wait()
+	if ctx.Err() == nil {
+		daemon.SdNotify(false, "READY=1")
+	}
+
+	running.Wait()
+	cancel()
+
+	log.Info("Waiting for all goroutines to exit")
+	// Block waiting for all the goroutines to finish.
+	wg.Wait()
+	if atomic.LoadInt32(&failed) != 0 {
+		os.Exit(1)
+	}
+	log.Info("Exiting cleanly...")
+	os.Exit(0)
+}
+
+// runServer serves the subnet managers of the networks to flanneld instances
+// started with --remote, until it gets a signal. It returns the exit code.
+func runServer(networks []string) int {
+	managers := make(map[string]subnet.Manager)
+	for _, name := range networks {
+		// Leases are acquired on behalf of the clients, so the managers have
+		// no previous subnet or node identity of their own.
+		sm, err := newLocalSubnetManager(name, ip.IP4Net{}, ip.IP6Net{}, "", "")
+		if err != nil {
+			log.Errorf("Failed to create SubnetManager%s: %s", networkLabel(name), err)
+			return 1
+		}
+		log.Infof("Created subnet manager%s: %s", networkLabel(name), sm.Name())
+		managers[name] = sm
 	}
 
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	go shutdownHandler(ctx, sigs, cancel)
+
+	if opts.healthzPort > 0 {
+		go mustRunHealthz(&healthChecks{})
+	}
+
+	err := remote.RunServer(ctx, managers, opts.listen, opts.remoteCAFile, opts.remoteCertfile, opts.remoteKeyfile)
+	cancel()
+	if err != nil {
+		log.Error("Failed to serve the subnet managers: ", err)
+		return 1
+	}
+	log.Info("Exiting cleanly...")
+	return 0
+}
+
+const (
+	// teardownTimeout bounds how long removing what a backend set up may take.
+	teardownTimeout = time.Minute
+	// releaseTimeout bounds how long releasing the lease on exit may take, well
+	// within the grace period a SIGTERM usually comes with.
+	releaseTimeout = 10 * time.Second
+	// reacquireRetryInterval is how long to wait before trying again to
+	// acquire a lease after the previous one was revoked.
+	reacquireRetryInterval = 10 * time.Second
+)
+
+// What to do when the lease is revoked, see --on-lease-revoked.
+const (
+	leaseRevokedExit                = "exit"
+	leaseRevokedReacquire           = "reacquire"
+	leaseRevokedReacquireSameSubnet = "reacquire-same-subnet"
+)
+
+// netRunner brings up a single flannel network (its config, lease, backend and
+// subnet file) and keeps it running until its context is done or the lease is lost.
+type netRunner struct {
+	name       string
+	sm         subnet.Manager
+	extIface   *backend.ExternalInterface
+	subnetFile string
+	bm         backend.Manager
+
+	// taintMux keeps the updates of the readiness taint in order.
+	taintMux sync.Mutex
+
+	// stateMux guards the state the health checks and debug endpoints look
+	// at: the network that is up, its config, whether it's running and the
+	// iptables rules kept for it.
+	stateMux sync.Mutex
+	bn       backend.Network
+	config   *subnet.Config
+	running  bool
+	rules    []network.IPTablesRule
+
+	// lease is the lease of the network that is up, as MonitorLease renews it.
+	lease leaseState
+}
+
+// leaseState is a lease that is read while it's being renewed.
+type leaseState struct {
+	mux   sync.Mutex
+	lease subnet.Lease
+}
+
+func (s *leaseState) get() subnet.Lease {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.lease
+}
+
+func (s *leaseState) set(l subnet.Lease) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.lease = l
+}
+
+// nodeTainter is implemented by the kubernetes subnet manager.
+type nodeTainter interface {
+	SetNodeTaint(key string, taint bool) error
+}
+
+// run blocks for as long as the network is up. registered is called once the
+// backend has been set up for the first time, or as soon as that failed.
+func (n *netRunner) run(parent context.Context, registered func()) error {
+	var once sync.Once
+	notify := func() { once.Do(registered) }
+	defer notify()
+
 	// Fetch the network config (i.e. what backend to use etc..).
-	config, err := getConfig(ctx, sm)
-	if err == errCanceled {
-		wg.Wait()
-		os.Exit(0)
+	config, err := getConfig(parent, n.sm)
+	if err != nil {
+		return nil
+	}
+
+	// revoked is the lease that was lost, until a new one is acquired.
+	var revoked *subnet.Lease
+	for {
+		ctx, cancel := context.WithCancel(parent)
+
+		// A config change that can be applied in place restarts the backend
+		// with the new config. The lease is kept.
+		var next *subnet.Config
+		watched := make(chan struct{})
+		go func(current *subnet.Config) {
+			defer close(watched)
+			if next = n.watchConfig(ctx, current); next != nil {
+				cancel()
+			}
+		}(config)
+
+		bn, err := n.runNetwork(ctx, config, revoked, notify)
+		cancel()
+		<-watched
+
+		if parent.Err() != nil {
+			if opts.releaseLeaseOnExit {
+				n.releaseLease(bn)
+			}
+			// The devices and routes are left in place by default, so that
+			// the next flanneld picks them up without disrupting the pods.
+			if opts.teardownOnExit {
+				n.teardown(bn, config)
+			}
+			return nil
+		}
+
+		if err == errInterrupted {
+			if opts.onLeaseRevoked == leaseRevokedExit {
+				return fmt.Errorf("lease for %s was revoked", bn.Lease().Subnet)
+			}
+			// The backend is registered again with a new lease, which
+			// reconfigures its devices and rewrites the subnet file.
+			revoked = bn.Lease()
+			log.Infof("Lease for %s was revoked, acquiring a new one%s", revoked.Subnet, networkLabel(n.name))
+			if p, ok := n.sm.(subnet.SubnetPreferrer); ok {
+				p.PreferSubnet(revoked.Subnet, revoked.IPv6Subnet)
+			}
+			continue
+		}
+		if bn != nil {
+			revoked = nil
+		} else if revoked != nil && next == nil {
+			log.Errorf("Failed to acquire a new lease%s (trying again in %v): %v", networkLabel(n.name), reacquireRetryInterval, err)
+			select {
+			case <-time.After(reacquireRetryInterval):
+				continue
+			case <-parent.Done():
+				return nil
+			}
+		}
+
+		if next == nil {
+			return err
+		}
+		log.Infof("Restarting backend%s to apply the new config", networkLabel(n.name))
+		// Registering again reconfigures the devices of the backend, and
+		// recreates those that don't match the new config. Tearing down would
+		// cut off the pods in the meantime, so only a different backend
+		// type replaces what the running one set up.
+		if next.BackendType != config.BackendType {
+			n.teardown(bn, config)
+		}
+		config = next
 	}
+}
 
-	// Create a backend manager then use it to create the backend and register the network with it.
-	bm := backend.NewManager(ctx, sm, extIface)
-	be, err := bm.GetBackend(config.BackendType)
+// runNetwork brings the network up with the given config and blocks until ctx
+// is done or the lease is lost, in which case it returns errInterrupted. It
+// returns the network once all its goroutines exited, or nil if it couldn't be
+// registered. revoked is the lease lost before, if any, to compare the new one
+// with.
+func (n *netRunner) runNetwork(ctx context.Context, config *subnet.Config, revoked *subnet.Lease, registered func()) (backend.Network, error) {
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	// Stops the goroutines when returning before ctx is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	bn, rules, err := n.register(ctx, config, &wg)
+	registered()
 	if err != nil {
-		log.Errorf("Error fetching backend: %s", err)
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		n.networkDown("BackendInitFailed", fmt.Sprintf("Failed to set up the %s backend: %v", config.BackendType, err))
+		return nil, err
+	}
+	n.lease.set(*bn.Lease())
+	if ctx.Err() != nil {
+		return bn, nil
+	}
+	n.setNetwork(bn, config, rules)
+	defer n.setNetwork(nil, nil, nil)
+	if revoked != nil {
+		if err := n.checkReacquired(revoked, bn); err != nil {
+			return bn, err
+		}
+	}
+	subnet.SetNetworkUnavailable(n.sm, false, "FlannelIsUp", "Flannel is running on this node")
+
+	if err := WriteSubnetFile(n.subnetFile, config.Network, config.IPv6Network, opts.ipMasq, bn); err != nil {
+		// Continue, even though it failed.
+		log.Warningf("Failed to write subnet file: %s", err)
+	} else {
+		log.Infof("Wrote subnet file to %s", n.subnetFile)
+	}
+
+	// Start "Running" the backend network. This will block until the context is done so run in another goroutine.
+	log.Infof("Running backend%s.", networkLabel(n.name))
+	n.setRunning(true)
+	wg.Add(1)
+	go func() {
+		bn.Run(ctx)
+		n.setRunning(false)
+		if ctx.Err() == nil {
+			log.Errorf("Backend%s stopped running", networkLabel(n.name))
+			n.networkDown("BackendStopped", fmt.Sprintf("The %s backend stopped running", config.BackendType))
+		}
+		wg.Done()
+	}()
+
+	if opts.kubeReadinessTaint != "" {
+		wg.Add(1)
+		go func() {
+			n.untaintWhenSynced(ctx, bn)
+			wg.Done()
+		}()
+	}
+
+	err = MonitorLease(ctx, n.name, n.sm, bn, &n.lease, &wg)
+	if err == errInterrupted {
+		n.networkDown("LeaseRevoked", fmt.Sprintf("The lease on %s was revoked", bn.Lease().Subnet))
+		return bn, errInterrupted
+	}
+	return bn, nil
+}
+
+// checkReacquired reports the lease acquired by bn in place of the revoked one.
+// Pods keep the addresses they got from the old subnet, so a different subnet
+// is an error with --on-lease-revoked=reacquire-same-subnet. The new lease is
+// released then.
+func (n *netRunner) checkReacquired(revoked *subnet.Lease, bn backend.Network) error {
+	sn := bn.Lease().Subnet
+	if sn.Equal(revoked.Subnet) {
+		log.Infof("Acquired the revoked lease for %s again", sn)
+		subnet.RecordEvent(n.sm, subnet.NodeEventNormal, "LeaseReacquired", "Acquired the revoked lease on %s again", sn)
+		return nil
+	}
+
+	subnet.RecordEvent(n.sm, subnet.NodeEventWarning, "SubnetChanged", "The lease on %s was revoked, acquired %s instead", revoked.Subnet, sn)
+	if opts.onLeaseRevoked == leaseRevokedReacquireSameSubnet {
+		n.releaseLease(bn)
+		return fmt.Errorf("lease for %s was revoked and %s acquired instead", revoked.Subnet, sn)
+	}
+	log.Warningf("Lease for %s was revoked, acquired %s instead", revoked.Subnet, sn)
+	return nil
+}
+
+// releaseLease gives up the lease of bn on shutdown, so that the other nodes
+// remove their routes to this one right away rather than when the lease expires.
+// The subnet file is kept: a flanneld started again before another node takes
+// the subnet reclaims it. Failures are only logged.
+func (n *netRunner) releaseLease(bn backend.Network) {
+	if bn == nil {
+		return
+	}
+	lr, ok := n.sm.(subnet.LeaseReleaser)
+	if !ok {
+		log.Warningf("%s doesn't support releasing leases, keeping the lease%s", n.sm.Name(), networkLabel(n.name))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	if err := lr.ReleaseLease(ctx, n.leaseSnapshot(bn)); err != nil {
+		log.Errorf("Failed to release the lease%s: %v", networkLabel(n.name), err)
+	}
+}
+
+// teardown removes what bn set up and drops its backend from the manager, so
+// that the next registration starts from a fresh backend. Failures are only
+// logged.
+func (n *netRunner) teardown(bn backend.Network, config *subnet.Config) {
+	if bn != nil {
+		log.Infof("Tearing down backend%s", networkLabel(n.name))
+		ctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+		if err := bn.Teardown(ctx); err != nil {
+			log.Errorf("Failed to tear down backend%s: %v", networkLabel(n.name), err)
+		}
 		cancel()
-		wg.Wait()
-		os.Exit(1)
+	}
+	n.bm.StopBackend(config.BackendType)
+}
+
+// networkDown reports that the network of the node stopped working, as an event
+// and the NetworkUnavailable condition of the node, and taints the node again.
+func (n *netRunner) networkDown(reason, message string) {
+	subnet.RecordEvent(n.sm, subnet.NodeEventWarning, reason, "%s", message)
+	subnet.SetNetworkUnavailable(n.sm, true, reason, message)
+	n.setReadinessTaint(true)
+}
+
+// untaintWhenSynced removes the --kube-readiness-taint from the node once the
+// backend has set up the leases of the other nodes, so that pods only get
+// scheduled to it once they can reach them. Backends that don't tell when
+// they're done count as done right away.
+func (n *netRunner) untaintWhenSynced(ctx context.Context, bn backend.Network) {
+	if sn, ok := bn.(backend.SyncedNetwork); ok {
+		select {
+		case <-sn.Synced():
+		case <-ctx.Done():
+			return
+		}
+	}
+	n.setReadinessTaint(false)
+}
+
+func (n *netRunner) setReadinessTaint(taint bool) {
+	if opts.kubeReadinessTaint == "" {
+		return
+	}
+	t, ok := n.sm.(nodeTainter)
+	if !ok {
+		return
+	}
+
+	n.taintMux.Lock()
+	defer n.taintMux.Unlock()
+	if err := t.SetNodeTaint(opts.kubeReadinessTaint, taint); err != nil {
+		log.Errorf("Failed to update taint %s of the node: %v", opts.kubeReadinessTaint, err)
+	}
+}
+
+// register sets up the backend for the network and the iptables rules, which
+// it returns along with the network.
+func (n *netRunner) register(ctx context.Context, config *subnet.Config, wg *sync.WaitGroup) (backend.Network, []network.IPTablesRule, error) {
+	be, err := n.bm.GetBackend(config.BackendType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error fetching backend: %s", err)
 	}
 
 	bn, err := be.RegisterNetwork(ctx, wg, config)
 	if err != nil {
-		log.Errorf("Error registering network: %s", err)
-		cancel()
-		wg.Wait()
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("error registering network: %s", err)
 	}
 
+	var rules []network.IPTablesRule
 	// Set up ipMasq if needed
 	if opts.ipMasq {
-		if err = recycleIPTables(config.Network, bn.Lease()); err != nil {
-			log.Errorf("Failed to recycle IPTables rules, %v", err)
-			cancel()
-			wg.Wait()
-			os.Exit(1)
+		if err = recycleIPTables(n.subnetFile, config.Network, bn.Lease()); err != nil {
+			return nil, nil, fmt.Errorf("failed to recycle IPTables rules, %v", err)
 		}
 		log.Infof("Setting up masking rules")
-		go network.SetupAndEnsureIPTables(network.MasqRules(config.Network, bn.Lease()), opts.iptablesResyncSeconds)
+		masqRules := network.PoolsMasqRules(config.Pools(), bn.Lease())
+		rules = append(rules, masqRules...)
+		wg.Add(1)
+		go func() {
+			network.SetupAndEnsureIPTables(ctx, masqRules, opts.iptablesResyncSeconds)
+			wg.Done()
+		}()
 	}
 
 	// Always enables forwarding rules. This is needed for Docker versions >1.13 (https://docs.docker.com/engine/userguide/networking/default_network/container-communication/#container-communication-between-hosts)
@@ -311,45 +827,111 @@ func main() {
 	// In Docker 1.13 and later, Docker sets the default policy of the FORWARD chain to DROP.
 	if opts.iptablesForwardRules {
 		log.Infof("Changing default FORWARD chain policy to ACCEPT")
-		go network.SetupAndEnsureIPTables(network.ForwardRules(config.Network.String()), opts.iptablesResyncSeconds)
+		for _, n := range config.Pools() {
+			forwardRules := network.ForwardRules(n.String())
+			rules = append(rules, forwardRules...)
+			wg.Add(1)
+			go func() {
+				network.SetupAndEnsureIPTables(ctx, forwardRules, opts.iptablesResyncSeconds)
+				wg.Done()
+			}()
+		}
 	}
 
-	if err := WriteSubnetFile(opts.subnetFile, config.Network, opts.ipMasq, bn); err != nil {
-		// Continue, even though it failed.
-		log.Warningf("Failed to write subnet file: %s", err)
-	} else {
-		log.Infof("Wrote subnet file to %s", opts.subnetFile)
+	return bn, rules, nil
+}
+
+// watchConfig polls the network config every --config-reload-interval seconds,
+// or waits for the subnet manager to report a change if it watches the config
+// itself, and returns the first config that differs from current and can be
+// applied without a restart. Changes to how subnets are allocated or to the
+// backend type are logged and otherwise ignored. It returns nil once ctx is done.
+func (n *netRunner) watchConfig(ctx context.Context, current *subnet.Config) *subnet.Config {
+	if opts.configReloadInterval <= 0 {
+		return nil
 	}
+	interval := time.Duration(opts.configReloadInterval) * time.Second
 
-	// Start "Running" the backend network. This will block until the context is done so run in another goroutine.
-	log.Info("Running backend.")
-	wg.Add(1)
-	go func() {
-		bn.Run(ctx)
-		wg.Done()
-	}()
+	watcher, _ := n.sm.(subnet.ConfigWatcher)
+	if watcher != nil && watcher.ConfigChanged() == nil {
+		watcher = nil
+	}
+	// Check right away when watching, the config may have changed since it was
+	// read at startup.
+	var next <-chan struct{}
+	if watcher != nil {
+		changed := make(chan struct{})
+		close(changed)
+		next = changed
+	}
+
+	// Only complain once about each rejected config.
+	var rejected string
+	for {
+		if watcher != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-next:
+			}
+			// Pick up the channel before reading the config so that no change
+			// goes unnoticed.
+			next = watcher.ConfigChanged()
+		} else {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(interval):
+			}
+		}
 
-	daemon.SdNotify(false, "READY=1")
+		config, err := n.sm.GetNetworkConfig(ctx)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil || config == nil {
+			log.Warningf("Couldn't reload network config%s, keeping the running one: %v", networkLabel(n.name), err)
+			continue
+		}
 
-	// Kube subnet mgr doesn't lease the subnet for this node - it just uses the podCidr that's already assigned.
-	if !opts.kubeSubnetMgr {
-		err = MonitorLease(ctx, sm, bn, &wg)
-		if err == errInterrupted {
-			// The lease was "revoked" - shut everything down
-			cancel()
+		if changes := subnet.UnsafeConfigChanges(current, config); len(changes) > 0 {
+			key, _ := json.Marshal(config)
+			if string(key) != rejected {
+				rejected = string(key)
+				log.Errorf("Network config%s changed %s: restart flanneld to apply it, keeping the running config until then", networkLabel(n.name), strings.Join(changes, ", "))
+				subnet.RecordEvent(n.sm, subnet.NodeEventWarning, "ConfigChangeRejected", "Network config%s changed %s: restart flanneld to apply it", networkLabel(n.name), strings.Join(changes, ", "))
+			}
+			continue
+		}
+		rejected = ""
+
+		if subnet.BackendConfigChanged(current, config) {
+			log.Infof("Network config%s changed - Backend: %s", networkLabel(n.name), config.Backend)
+			return config
 		}
 	}
+}
 
-	log.Info("Waiting for all goroutines to exit")
-	// Block waiting for all the goroutines to finish.
-	wg.Wait()
-	log.Info("Exiting cleanly...")
-	os.Exit(0)
+// networkLabel is used to tell networks apart in log messages. The unnamed
+// network of a single network setup gets no label at all.
+func networkLabel(name string) string {
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" for network %q", name)
 }
 
-func recycleIPTables(nw ip.IP4Net, lease *subnet.Lease) error {
-	prevNetwork := ReadCIDRFromSubnetFile(opts.subnetFile, "FLANNEL_NETWORK")
-	prevSubnet := ReadCIDRFromSubnetFile(opts.subnetFile, "FLANNEL_SUBNET")
+// subnetFileFor returns where the subnet file of a network is written to: named
+// networks each get a file in --subnet-dir, the unnamed one uses --subnet-file.
+func subnetFileFor(name string) string {
+	if name == "" {
+		return opts.subnetFile
+	}
+	return filepath.Join(opts.subnetDir, name+".env")
+}
+
+func recycleIPTables(subnetFile string, nw ip.IP4Net, lease *subnet.Lease) error {
+	prevNetwork := ReadCIDRFromSubnetFile(subnetFile, "FLANNEL_NETWORK")
+	prevSubnet := ReadCIDRFromSubnetFile(subnetFile, "FLANNEL_SUBNET")
 	// recycle iptables rules only when network configured or subnet leased is not equal to current one.
 	if prevNetwork != nw && prevSubnet != lease.Subnet {
 		log.Infof("Current network or subnet (%v, %v) is not equal to previous one (%v, %v), trying to recycle old iptables rules", nw, lease.Subnet, prevNetwork, prevSubnet)
@@ -363,6 +945,17 @@ func recycleIPTables(nw ip.IP4Net, lease *subnet.Lease) error {
 	return nil
 }
 
+// defaultNodeID identifies this node by its machine ID, which survives changes of
+// its IP address, or by its hostname on systems without one.
+func defaultNodeID() (string, error) {
+	if b, err := ioutil.ReadFile("/etc/machine-id"); err == nil {
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id, nil
+		}
+	}
+	return os.Hostname()
+}
+
 func shutdownHandler(ctx context.Context, sigs chan os.Signal, cancel context.CancelFunc) {
 	// Wait for the context do be Done or for the signal to come in to shutdown.
 	select {
@@ -399,41 +992,84 @@ func getConfig(ctx context.Context, sm subnet.Manager) (*subnet.Config, error) {
 	}
 }
 
-func MonitorLease(ctx context.Context, sm subnet.Manager, bn backend.Network, wg *sync.WaitGroup) error {
+// MonitorLease renews the lease of bn and follows the changes made to it by
+// others until ctx is done, or until the lease is lost, which returns
+// errInterrupted. The lease of bn is left as it was registered, since the
+// backends read it without locking; the lease as renewed is kept in state.
+func MonitorLease(ctx context.Context, network string, sm subnet.Manager, bn backend.Network, state *leaseState, wg *sync.WaitGroup) error {
+	lease := *bn.Lease()
+
 	// Use the subnet manager to start watching leases.
 	evts := make(chan subnet.Event)
 
 	wg.Add(1)
-	go func() {
-		subnet.WatchLease(ctx, sm, bn.Lease().Subnet, evts)
+	go func(sn ip.IP4Net) {
+		subnet.WatchLease(ctx, sm, sn, evts)
 		wg.Done()
-	}()
+	}(lease.Subnet)
 
 	renewMargin := time.Duration(opts.subnetLeaseRenewMargin) * time.Minute
-	dur := bn.Lease().Expiration.Sub(time.Now()) - renewMargin
+	renew := renewAfter(network, &lease, renewMargin)
+	renewFailing := false
 
 	for {
 		select {
-		case <-time.After(dur):
-			err := sm.RenewLease(ctx, bn.Lease())
+		case <-renew:
+			renewed := lease
+			err := sm.RenewLease(ctx, &renewed)
+			if err == subnet.ErrLeaseConflict || err == subnet.ErrNotFound {
+				// The lease was changed or removed by someone else since it
+				// was last seen, so make sure it's still ours before renewing.
+				renewed = lease
+				held, verr := revalidateLease(ctx, sm, &renewed)
+				if verr == nil && !held {
+					log.Errorf("Lease for %s is no longer held by this node", lease.Subnet)
+					return errInterrupted
+				} else if verr == nil {
+					lease = renewed
+					state.set(lease)
+					log.Infof("Lease for %s was changed by someone else, renewing it as it is now", lease.Subnet)
+					renew = renewAfter(network, &lease, renewMargin)
+					continue
+				}
+				err = verr
+			}
+			countRenewal(network, err)
 			if err != nil {
 				log.Error("Error renewing lease (trying again in 1 min): ", err)
-				dur = time.Minute
+				// Only report the first of a series of failures
+				if !renewFailing {
+					subnet.RecordEvent(sm, subnet.NodeEventWarning, "LeaseRenewFailed", "Failed to renew lease on %s: %v", lease.Subnet, err)
+				}
+				renewFailing = true
+				renew = time.After(time.Minute)
 				continue
 			}
+			renewFailing = false
+			lease = renewed
+			state.set(lease)
 
-			log.Info("Lease renewed, new expiration: ", bn.Lease().Expiration)
-			dur = bn.Lease().Expiration.Sub(time.Now()) - renewMargin
+			log.Info("Lease renewed, new expiration: ", lease.Expiration)
+			renew = renewAfter(network, &lease, renewMargin)
 
 		case e := <-evts:
 			switch e.Type {
 			case subnet.EventAdded:
-				bn.Lease().Expiration = e.Lease.Expiration
-				dur = bn.Lease().Expiration.Sub(time.Now()) - renewMargin
-				log.Infof("Waiting for %s to renew lease", dur)
+				if !e.Lease.HeldByNode(&lease.Attrs) {
+					log.Errorf("Lease for %s was taken over by node %q", e.Lease.Subnet, e.Lease.Attrs.NodeID)
+					return errInterrupted
+				}
+				// Keep what was changed, the next renewal writes it back
+				lease.Attrs = e.Lease.Attrs
+				lease.Expiration = e.Lease.Expiration
+				if e.Lease.Asof != 0 {
+					lease.Asof = e.Lease.Asof
+				}
+				state.set(lease)
+				renew = renewAfter(network, &lease, renewMargin)
 
 			case subnet.EventRemoved:
-				log.Error("Lease has been revoked. Shutting down daemon.")
+				log.Error("Lease has been revoked")
 				return errInterrupted
 			}
 
@@ -444,6 +1080,84 @@ func MonitorLease(ctx context.Context, sm subnet.Manager, bn backend.Network, wg
 	}
 }
 
+// renewAfter returns when to renew l, margin before it expires. Reservations
+// don't expire and are never renewed.
+func renewAfter(network string, l *subnet.Lease, margin time.Duration) <-chan time.Time {
+	setLeaseExpiration(network, l)
+	if l.Expiration.IsZero() {
+		log.Infof("Lease for %s is a reservation, not renewing it", l.Subnet)
+		return nil
+	}
+	dur := l.Expiration.Sub(time.Now()) - margin
+	log.Infof("Waiting for %s to renew lease", dur)
+	return time.After(dur)
+}
+
+// revalidateLease looks the lease up as it is now and reports whether it's
+// still held by this node. If it is, lease takes on its attributes, expiration
+// and index, so that renewing it builds on the changes instead of overwriting
+// them. Leases that can't be looked up count as lost.
+func revalidateLease(ctx context.Context, sm subnet.Manager, lease *subnet.Lease) (bool, error) {
+	la, ok := sm.(subnet.LeaseAdmin)
+	if !ok {
+		return false, nil
+	}
+
+	current, err := la.GetLease(ctx, lease.Subnet)
+	if err == subnet.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !current.HeldByNode(&lease.Attrs) {
+		return false, nil
+	}
+
+	lease.Attrs = current.Attrs
+	lease.Expiration = current.Expiration
+	lease.Asof = current.Asof
+	return true, nil
+}
+
+// lookupExtIface works out the interface to use from --iface and --iface-regex,
+// or the interface of the default route if neither is given.
+func lookupExtIface() (*backend.ExternalInterface, error) {
+	// Check the default interface only if no interfaces are specified
+	if len(opts.iface) == 0 && len(opts.ifaceRegex) == 0 {
+		extIface, err := LookupExtIface("", "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to find any valid interface to use: %v", err)
+		}
+		return extIface, nil
+	}
+
+	// Check explicitly specified interfaces
+	for _, iface := range opts.iface {
+		extIface, err := LookupExtIface(iface, "")
+		if err != nil {
+			log.Infof("Could not find valid interface matching %s: %s", iface, err)
+		}
+
+		if extIface != nil {
+			return extIface, nil
+		}
+	}
+
+	// Check interfaces that match any specified regexes
+	for _, ifaceRegex := range opts.ifaceRegex {
+		extIface, err := LookupExtIface("", ifaceRegex)
+		if err != nil {
+			log.Infof("Could not find valid interface matching %s: %s", ifaceRegex, err)
+		}
+
+		if extIface != nil {
+			return extIface, nil
+		}
+	}
+
+	return nil, errors.New("failed to find interface to use that matches the interfaces and/or regexes provided")
+}
+
 func LookupExtIface(ifname string, ifregex string) (*backend.ExternalInterface, error) {
 	var iface *net.Interface
 	var ifaceAddr net.IP
@@ -549,14 +1263,31 @@ func LookupExtIface(ifname string, ifregex string) (*backend.ExternalInterface,
 		extAddr = ifaceAddr
 	}
 
+	// IPv6 is optional, so not finding an address isn't an error
+	ifaceV6Addr, err := ip.GetIfaceIP6Addr(iface)
+	if err == nil {
+		log.Infof("Using interface IPv6 address %s", ifaceV6Addr)
+	}
+
+	extV6Addr := ifaceV6Addr
+	if len(opts.publicIPv6) > 0 {
+		extV6Addr = net.ParseIP(opts.publicIPv6)
+		if extV6Addr == nil || extV6Addr.To4() != nil {
+			return nil, fmt.Errorf("invalid public IPv6 address: %s", opts.publicIPv6)
+		}
+		log.Infof("Using %s as external IPv6 address", extV6Addr)
+	}
+
 	return &backend.ExternalInterface{
-		Iface:     iface,
-		IfaceAddr: ifaceAddr,
-		ExtAddr:   extAddr,
+		Iface:       iface,
+		IfaceAddr:   ifaceAddr,
+		ExtAddr:     extAddr,
+		IfaceV6Addr: ifaceV6Addr,
+		ExtV6Addr:   extV6Addr,
 	}, nil
 }
 
-func WriteSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network) error {
+func WriteSubnetFile(path string, nw ip.IP4Net, nw6 ip.IP6Net, ipMasq bool, bn backend.Network) error {
 	dir, name := filepath.Split(path)
 	os.MkdirAll(dir, 0755)
 
@@ -573,6 +1304,21 @@ func WriteSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network)
 
 	fmt.Fprintf(f, "FLANNEL_NETWORK=%s\n", nw)
 	fmt.Fprintf(f, "FLANNEL_SUBNET=%s\n", sn)
+	if extra := bn.Lease().AdditionalSubnets; len(extra) > 0 {
+		subnets := make([]string, len(extra))
+		for i, sn := range extra {
+			subnets[i] = sn.String()
+		}
+		fmt.Fprintf(f, "FLANNEL_ADDITIONAL_SUBNETS=%s\n", strings.Join(subnets, ","))
+	}
+	if sn6 := bn.Lease().IPv6Subnet; !sn6.Empty() {
+		sn6.IP.Lo += 1
+		fmt.Fprintf(f, "FLANNEL_IPV6_NETWORK=%s\n", nw6)
+		fmt.Fprintf(f, "FLANNEL_IPV6_SUBNET=%s\n", sn6)
+	}
+	if group := bn.Lease().Attrs.NodeGroup; group != "" {
+		fmt.Fprintf(f, "FLANNEL_NODE_GROUP=%s\n", group)
+	}
 	fmt.Fprintf(f, "FLANNEL_MTU=%d\n", bn.MTU())
 	_, err = fmt.Fprintf(f, "FLANNEL_IPMASQ=%v\n", ipMasq)
 	f.Close()
@@ -586,7 +1332,7 @@ func WriteSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network)
 	//TODO - is this safe? What if it's not on the same FS?
 }
 
-func mustRunHealthz() {
+func mustRunHealthz(health *healthChecks) {
 	address := net.JoinHostPort(opts.healthzIP, strconv.Itoa(opts.healthzPort))
 	log.Infof("Start healthz server on %s", address)
 
@@ -594,6 +1340,10 @@ func mustRunHealthz() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("flanneld is running"))
 	})
+	http.Handle("/livez", health.handler(false))
+	http.Handle("/readyz", health.handler(true))
+	http.Handle("/metrics", prometheus.Handler())
+	health.handleDebug()
 
 	if err := http.ListenAndServe(address, nil); err != nil {
 		log.Errorf("Start healthz server error. %v", err)
@@ -616,3 +1366,19 @@ func ReadCIDRFromSubnetFile(path string, CIDRKey string) ip.IP4Net {
 	}
 	return prevCIDR
 }
+
+func ReadIP6CIDRFromSubnetFile(path string, CIDRKey string) ip.IP6Net {
+	var prevCIDR ip.IP6Net
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		prevSubnetVals, err := godotenv.Read(path)
+		if err != nil {
+			log.Errorf("Couldn't fetch previous %s from subnet file at %s: %s", CIDRKey, path, err)
+		} else if prevCIDRString, ok := prevSubnetVals[CIDRKey]; ok {
+			err = prevCIDR.UnmarshalJSON([]byte(prevCIDRString))
+			if err != nil {
+				log.Errorf("Couldn't parse previous %s from subnet file at %s: %s", CIDRKey, path, err)
+			}
+		}
+	}
+	return prevCIDR
+}
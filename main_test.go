@@ -0,0 +1,133 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// renewingManager renews leases right up to now, so that they're renewed over
+// and over, and lists them along with the lease of another node.
+type renewingManager struct {
+	renewals int32
+	other    subnet.Lease
+}
+
+func (m *renewingManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	return &subnet.Config{}, nil
+}
+
+func (m *renewingManager) AcquireLease(ctx context.Context, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	return nil, subnet.ErrNotFound
+}
+
+func (m *renewingManager) RenewLease(ctx context.Context, lease *subnet.Lease) error {
+	lease.Expiration = time.Now()
+	lease.Asof++
+	atomic.AddInt32(&m.renewals, 1)
+	return nil
+}
+
+func (m *renewingManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	<-ctx.Done()
+	return subnet.LeaseWatchResult{}, ctx.Err()
+}
+
+func (m *renewingManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	select {
+	case <-ctx.Done():
+		return subnet.LeaseWatchResult{}, ctx.Err()
+	case <-time.After(time.Millisecond):
+	}
+	return subnet.LeaseWatchResult{Snapshot: []subnet.Lease{m.other}, Cursor: "snapshot"}, nil
+}
+
+func (m *renewingManager) Name() string {
+	return "renewing"
+}
+
+// Run with -race: the backends read the lease of their network while it's
+// being renewed.
+func TestMonitorLeaseRenewsWhileWatching(t *testing.T) {
+	lease := &subnet.Lease{
+		Subnet:     ip.IP4Net{IP: ip.MustParseIP4("10.3.1.0"), PrefixLen: 24},
+		Attrs:      subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")},
+		Expiration: time.Now(),
+	}
+	registered := *lease
+	bn := &backend.SimpleNetwork{SubnetLease: lease}
+	sm := &renewingManager{other: subnet.Lease{
+		Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.2.0"), PrefixLen: 24},
+		Attrs:  subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5")},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := sync.WaitGroup{}
+
+	// What the backends do with the lease of their network
+	receiver := make(chan []subnet.Event)
+	wg.Add(2)
+	go func() {
+		subnet.WatchLeases(ctx, sm, bn.Lease(), receiver)
+		wg.Done()
+	}()
+	go func() {
+		for {
+			select {
+			case <-receiver:
+				_ = bn.Lease().Subnet.String()
+			case <-ctx.Done():
+				wg.Done()
+				return
+			}
+		}
+	}()
+
+	var state leaseState
+	done := make(chan error, 1)
+	go func() {
+		done <- MonitorLease(ctx, "", sm, bn, &state, &wg)
+	}()
+
+	for deadline := time.Now().Add(10 * time.Second); atomic.LoadInt32(&sm.renewals) < 100; {
+		if time.Now().After(deadline) {
+			t.Fatal("Lease wasn't renewed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != errCanceled {
+		t.Fatal("Expected MonitorLease to be canceled, got ", err)
+	}
+	wg.Wait()
+
+	if !reflect.DeepEqual(*bn.Lease(), registered) {
+		t.Fatalf("The lease of the backend was changed to %+v", *bn.Lease())
+	}
+	if renewed := state.get(); renewed.Asof == 0 || !renewed.Expiration.After(registered.Expiration) {
+		t.Fatalf("The renewed lease wasn't kept: %+v", renewed)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+var (
+	leaseExpiration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "flannel",
+			Subsystem: "subnet",
+			Name:      "lease_expiration_timestamp_seconds",
+			Help:      "Time the lease of this node expires at, in seconds since the epoch. 0 for reservations, which don't expire.",
+		},
+		[]string{"network"},
+	)
+	leaseRenewals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "flannel",
+			Subsystem: "subnet",
+			Name:      "lease_renewals_total",
+			Help:      "Number of attempts to renew the lease of this node, by result.",
+		},
+		[]string{"network", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(leaseExpiration, leaseRenewals)
+}
+
+func setLeaseExpiration(network string, l *subnet.Lease) {
+	if l.Expiration.IsZero() {
+		leaseExpiration.WithLabelValues(network).Set(0)
+		return
+	}
+	leaseExpiration.WithLabelValues(network).Set(float64(l.Expiration.Unix()))
+}
+
+func countRenewal(network string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	leaseRenewals.WithLabelValues(network, result).Inc()
+}
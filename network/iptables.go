@@ -26,8 +26,24 @@ import (
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
 )
 
+var iptablesRepairs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "flannel",
+		Subsystem: "iptables",
+		Name:      "repairs_total",
+		Help:      "Number of times iptables rules found missing were set up, the first time included, by result.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(iptablesRepairs)
+}
+
 type IPTables interface {
 	AppendUnique(table string, chain string, rulespec ...string) error
 	Delete(table string, chain string, rulespec ...string) error
@@ -74,6 +90,23 @@ func MasqRules(ipn ip.IP4Net, lease *subnet.Lease) []IPTablesRule {
 	}
 }
 
+// PoolsMasqRules returns the MasqRules of a network made up of several pools.
+// Traffic between the pools isn't NATed either.
+func PoolsMasqRules(pools []ip.IP4Net, lease *subnet.Lease) []IPTablesRule {
+	var rules []IPTablesRule
+	for _, src := range pools {
+		for _, dst := range pools {
+			if src != dst {
+				rules = append(rules, IPTablesRule{"nat", "POSTROUTING", []string{"-s", src.String(), "-d", dst.String(), "-j", "RETURN"}})
+			}
+		}
+	}
+	for _, n := range pools {
+		rules = append(rules, MasqRules(n, lease)...)
+	}
+	return rules
+}
+
 func ForwardRules(flannelNetwork string) []IPTablesRule {
 	return []IPTablesRule{
 		// These rules allow traffic to be forwarded if it is to or from the flannel network range.
@@ -82,6 +115,11 @@ func ForwardRules(flannelNetwork string) []IPTablesRule {
 	}
 }
 
+// String returns the rule as arguments to iptables that append it.
+func (r IPTablesRule) String() string {
+	return fmt.Sprintf("-t %s -A %s %s", r.table, r.chain, strings.Join(r.rulespec, " "))
+}
+
 func ipTablesRulesExist(ipt IPTables, rules []IPTablesRule) (bool, error) {
 	for _, rule := range rules {
 		exists, err := ipt.Exists(rule.table, rule.chain, rule.rulespec...)
@@ -97,7 +135,9 @@ func ipTablesRulesExist(ipt IPTables, rules []IPTablesRule) (bool, error) {
 	return true, nil
 }
 
-func SetupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int) {
+// SetupAndEnsureIPTables keeps the rules in place until ctx is done. The rules are
+// left behind when it returns; use DeleteIPTables to remove them.
+func SetupAndEnsureIPTables(ctx context.Context, rules []IPTablesRule, resyncPeriod int) {
 	ipt, err := iptables.New()
 	if err != nil {
 		// if we can't find iptables, give up and return
@@ -105,18 +145,57 @@ func SetupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int) {
 		return
 	}
 
-	defer func() {
-		teardownIPTables(ipt, rules)
-	}()
-
 	for {
 		// Ensure that all the iptables rules exist every 5 seconds
 		if err := ensureIPTables(ipt, rules); err != nil {
 			log.Errorf("Failed to ensure iptables rules: %v", err)
 		}
 
-		time.Sleep(time.Duration(resyncPeriod) * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(resyncPeriod) * time.Second):
+		}
+	}
+}
+
+// CheckIPTables returns an error listing the rules that are missing.
+func CheckIPTables(rules []IPTablesRule) error {
+	missing, err := MissingIPTablesRules(rules)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		var specs []string
+		for _, rule := range missing {
+			specs = append(specs, rule.String())
+		}
+		return fmt.Errorf("missing iptables rules: %s", strings.Join(specs, "; "))
+	}
+	return nil
+}
+
+// MissingIPTablesRules returns the rules that don't exist.
+func MissingIPTablesRules(rules []IPTablesRule) ([]IPTablesRule, error) {
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, fmt.Errorf("iptables binary was not found: %v", err)
+	}
+	return missingIPTablesRules(ipt, rules)
+}
+
+func missingIPTablesRules(ipt IPTables, rules []IPTablesRule) ([]IPTablesRule, error) {
+	var missing []IPTablesRule
+	for _, rule := range rules {
+		exists, err := ipt.Exists(rule.table, rule.chain, rule.rulespec...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check rule existence: %v", err)
+		}
+		if !exists {
+			missing = append(missing, rule)
+		}
 	}
+	return missing, nil
 }
 
 // DeleteIPTables delete specified iptables rules
@@ -145,8 +224,10 @@ func ensureIPTables(ipt IPTables, rules []IPTablesRule) error {
 	log.Info("Some iptables rules are missing; deleting and recreating rules")
 	teardownIPTables(ipt, rules)
 	if err = setupIPTables(ipt, rules); err != nil {
+		iptablesRepairs.WithLabelValues("failure").Inc()
 		return fmt.Errorf("Error setting up rules: %v", err)
 	}
+	iptablesRepairs.WithLabelValues("success").Inc()
 	return nil
 }
 
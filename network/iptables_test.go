@@ -93,3 +93,18 @@ func TestEnsureRules(t *testing.T) {
 		t.Errorf("iptables masqRules after ensureIPTables are incorrected. Expected: %#v, Actual: %#v", ipt_recreate.rules, ipt_correct.rules)
 	}
 }
+
+func TestMissingRules(t *testing.T) {
+	rules := MasqRules(ip.IP4Net{}, lease())
+	ipt := &MockIPTables{}
+	setupIPTables(ipt, rules)
+	ipt.rules = append(ipt.rules[:1], ipt.rules[2:]...)
+
+	missing, err := missingIPTablesRules(ipt, rules)
+	if err != nil {
+		t.Fatalf("missingIPTablesRules failed: %v", err)
+	}
+	if !reflect.DeepEqual(missing, rules[1:2]) {
+		t.Errorf("Expected missing rules %#v, got %#v", rules[1:2], missing)
+	}
+}
@@ -15,8 +15,12 @@
 package network
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
+	"golang.org/x/net/context"
 )
 
 type IPTables interface {
@@ -35,12 +39,28 @@ func MasqRules(ipn ip.IP4Net, lease *subnet.Lease) []IPTablesRule {
 	return nil
 }
 
+func PoolsMasqRules(pools []ip.IP4Net, lease *subnet.Lease) []IPTablesRule {
+	return nil
+}
+
 func ForwardRules(flannelNetwork string) []IPTablesRule {
 	return nil
 }
 
-func SetupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int) {
+func SetupAndEnsureIPTables(ctx context.Context, rules []IPTablesRule, resyncPeriod int) {
+
+}
+
+func (r IPTablesRule) String() string {
+	return fmt.Sprintf("-t %s -A %s %s", r.table, r.chain, strings.Join(r.rulespec, " "))
+}
+
+func CheckIPTables(rules []IPTablesRule) error {
+	return nil
+}
 
+func MissingIPTablesRules(rules []IPTablesRule) ([]IPTablesRule, error) {
+	return nil, nil
 }
 
 func DeleteIPTables(rules []IPTablesRule) error {
@@ -0,0 +1,287 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AllocStrategy decides which of the free subnets a SubnetAllocator hands out.
+type AllocStrategy string
+
+const (
+	// AllocRandom picks any of the free subnets, so a subnet that was just
+	// released isn't handed out again right away.
+	AllocRandom AllocStrategy = "random"
+	// AllocLowest picks the free subnet with the lowest address.
+	AllocLowest AllocStrategy = "lowest"
+	// AllocHash derives the subnet from a key identifying the node, moving on
+	// to the next free subnet if that one is taken. A node tends to get the
+	// same subnet back after losing its lease.
+	AllocHash AllocStrategy = "hash"
+)
+
+var ErrOutOfSubnets = errors.New("out of subnets")
+
+var (
+	rndMutex sync.Mutex
+	rnd      = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func ParseAllocStrategy(s string) (AllocStrategy, error) {
+	switch AllocStrategy(s) {
+	case "":
+		return AllocRandom, nil
+	case AllocRandom, AllocLowest, AllocHash:
+		return AllocStrategy(s), nil
+	default:
+		return "", fmt.Errorf("unknown subnet allocation strategy %q (must be random, lowest or hash)", s)
+	}
+}
+
+// blockRange is an inclusive range of subnet indexes.
+type blockRange struct {
+	lo, hi uint64
+}
+
+// blockSet keeps track of which of count subnets, indexed from 0, are in use.
+// They are kept as a list of index ranges, so the cost of an allocation depends
+// on the number of subnets in use rather than on the size of the network.
+type blockSet struct {
+	count uint64
+	used  []blockRange
+}
+
+// SubnetAllocator finds free subnets of a fixed size from first to last.
+type SubnetAllocator struct {
+	first     IP4
+	prefixLen uint
+	blockSet
+}
+
+// NewSubnetAllocator returns an allocator for the subnets of length prefixLen
+// starting at first up to and including the one starting at last.
+func NewSubnetAllocator(first, last IP4, prefixLen uint) *SubnetAllocator {
+	a := &SubnetAllocator{
+		first:     first,
+		prefixLen: prefixLen,
+	}
+	if last >= first {
+		a.count = uint64(last-first)>>a.shift() + 1
+	}
+	return a
+}
+
+func (a *SubnetAllocator) shift() uint {
+	return 32 - a.prefixLen
+}
+
+// MarkUsed takes every subnet overlapping n out of the allocation. n doesn't
+// need to have the allocator's prefix length.
+func (a *SubnetAllocator) MarkUsed(n IP4Net) {
+	if a.count == 0 {
+		return
+	}
+
+	start := uint64(n.Network().IP)
+	end := start + uint64(1)<<(32-n.PrefixLen) - 1
+	first := uint64(a.first)
+	last := first + a.count<<a.shift() - 1
+	if end < first || start > last {
+		return
+	}
+
+	if start < first {
+		start = first
+	}
+	if end > last {
+		end = last
+	}
+	a.used = append(a.used, blockRange{(start - first) >> a.shift(), (end - first) >> a.shift()})
+}
+
+// Allocate picks a free subnet with the given strategy and marks it used. key
+// identifies the node for AllocHash; without one a random subnet is picked.
+func (a *SubnetAllocator) Allocate(strategy AllocStrategy, key string) (IP4Net, error) {
+	idx, err := a.allocate(strategy, key)
+	if err != nil {
+		return IP4Net{}, err
+	}
+	return IP4Net{IP: a.first + IP4(idx<<a.shift()), PrefixLen: a.prefixLen}, nil
+}
+
+// freeRanges returns the ranges of free subnets in ascending order.
+func (a *blockSet) freeRanges() []blockRange {
+	sort.Slice(a.used, func(i, j int) bool { return a.used[i].lo < a.used[j].lo })
+
+	var free []blockRange
+	next := uint64(0)
+	for _, r := range a.used {
+		if r.lo > next {
+			free = append(free, blockRange{next, r.lo - 1})
+		}
+		if r.hi+1 > next {
+			next = r.hi + 1
+		}
+	}
+	if next < a.count {
+		free = append(free, blockRange{next, a.count - 1})
+	}
+	return free
+}
+
+// Free returns the number of subnets left to allocate.
+func (a *blockSet) Free() uint64 {
+	n := uint64(0)
+	for _, r := range a.freeRanges() {
+		n += r.hi - r.lo + 1
+	}
+	return n
+}
+
+// allocate picks the index of a free subnet and marks it used.
+func (a *blockSet) allocate(strategy AllocStrategy, key string) (uint64, error) {
+	free := a.freeRanges()
+	if len(free) == 0 {
+		return 0, ErrOutOfSubnets
+	}
+
+	if strategy == AllocHash && key == "" {
+		strategy = AllocRandom
+	}
+
+	var idx uint64
+	switch strategy {
+	case AllocLowest:
+		idx = free[0].lo
+
+	case AllocHash:
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		want := h.Sum64() % a.count
+
+		// The first free subnet at or after the wanted one, wrapping around.
+		idx = free[0].lo
+		for _, r := range free {
+			if r.hi >= want {
+				idx = r.lo
+				if want > idx {
+					idx = want
+				}
+				break
+			}
+		}
+
+	case AllocRandom, "":
+		total := uint64(0)
+		for _, r := range free {
+			total += r.hi - r.lo + 1
+		}
+		rndMutex.Lock()
+		n := uint64(rnd.Int63n(int64(total)))
+		rndMutex.Unlock()
+
+		for _, r := range free {
+			if size := r.hi - r.lo + 1; n >= size {
+				n -= size
+			} else {
+				idx = r.lo + n
+				break
+			}
+		}
+
+	default:
+		return 0, fmt.Errorf("unknown subnet allocation strategy %q", strategy)
+	}
+
+	a.used = append(a.used, blockRange{idx, idx})
+	return idx, nil
+}
+
+// maxIP6Subnets caps the number of subnets an IP6SubnetAllocator picks from,
+// as IPv6 ranges can hold more than an index counts. The random strategy
+// needs the count to fit an int64 too.
+const maxIP6Subnets = math.MaxInt64
+
+// IP6SubnetAllocator is the IPv6 counterpart of SubnetAllocator. Only the
+// first maxIP6Subnets subnets of very large ranges are handed out.
+type IP6SubnetAllocator struct {
+	first     IP6
+	prefixLen uint
+	blockSet
+}
+
+// NewIP6SubnetAllocator returns an allocator for the subnets of length prefixLen
+// starting at first up to and including the one starting at last.
+func NewIP6SubnetAllocator(first, last IP6, prefixLen uint) *IP6SubnetAllocator {
+	a := &IP6SubnetAllocator{
+		first:     first,
+		prefixLen: prefixLen,
+	}
+	if last.Cmp(first) >= 0 {
+		n := last.sub(first).rsh(a.shift())
+		if n.Hi != 0 || n.Lo >= maxIP6Subnets {
+			a.count = maxIP6Subnets
+		} else {
+			a.count = n.Lo + 1
+		}
+	}
+	return a
+}
+
+func (a *IP6SubnetAllocator) shift() uint {
+	return 128 - a.prefixLen
+}
+
+// MarkUsed takes every subnet overlapping n out of the allocation. n doesn't
+// need to have the allocator's prefix length.
+func (a *IP6SubnetAllocator) MarkUsed(n IP6Net) {
+	if a.count == 0 {
+		return
+	}
+
+	one := IP6{Lo: 1}
+	start := n.Network().IP
+	end := start.add(ip6Bit(128 - n.PrefixLen).sub(one))
+	last := a.first.add(IP6{Lo: a.count - 1}.lsh(a.shift())).add(ip6Bit(a.shift()).sub(one))
+	if end.Cmp(a.first) < 0 || start.Cmp(last) > 0 {
+		return
+	}
+
+	if start.Cmp(a.first) < 0 {
+		start = a.first
+	}
+	if end.Cmp(last) > 0 {
+		end = last
+	}
+	a.used = append(a.used, blockRange{start.sub(a.first).rsh(a.shift()).Lo, end.sub(a.first).rsh(a.shift()).Lo})
+}
+
+// Allocate picks a free subnet with the given strategy and marks it used, like
+// SubnetAllocator.Allocate.
+func (a *IP6SubnetAllocator) Allocate(strategy AllocStrategy, key string) (IP6Net, error) {
+	idx, err := a.allocate(strategy, key)
+	if err != nil {
+		return IP6Net{}, err
+	}
+	return IP6Net{IP: a.first.add(IP6{Lo: idx}.lsh(a.shift())), PrefixLen: a.prefixLen}, nil
+}
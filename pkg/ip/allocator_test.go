@@ -0,0 +1,168 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"testing"
+)
+
+func TestSubnetAllocatorLowest(t *testing.T) {
+	a := NewSubnetAllocator(mkIP4("10.3.1.0"), mkIP4("10.3.5.0"), 24)
+	if a.Free() != 5 {
+		t.Fatalf("Expected 5 free subnets, got %d", a.Free())
+	}
+
+	a.MarkUsed(mkIP4Net("10.3.1.0", 24))
+	// a bigger subnet takes out every subnet it overlaps
+	a.MarkUsed(mkIP4Net("10.3.2.0", 23))
+	// subnets outside the range are ignored
+	a.MarkUsed(mkIP4Net("10.4.0.0", 16))
+
+	if a.Free() != 2 {
+		t.Fatalf("Expected 2 free subnets, got %d", a.Free())
+	}
+
+	for _, want := range []string{"10.3.4.0/24", "10.3.5.0/24"} {
+		sn, err := a.Allocate(AllocLowest, "")
+		if err != nil {
+			t.Fatal("Allocate failed: ", err)
+		}
+		if sn.String() != want {
+			t.Errorf("Expected %s, got %s", want, sn)
+		}
+	}
+
+	if _, err := a.Allocate(AllocLowest, ""); err != ErrOutOfSubnets {
+		t.Errorf("Expected ErrOutOfSubnets, got %v", err)
+	}
+}
+
+func TestSubnetAllocatorRandom(t *testing.T) {
+	a := NewSubnetAllocator(mkIP4("10.0.0.64"), mkIP4("10.255.255.192"), 26)
+	a.MarkUsed(mkIP4Net("10.0.0.0", 9))
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		sn, err := a.Allocate(AllocRandom, "")
+		if err != nil {
+			t.Fatal("Allocate failed: ", err)
+		}
+		if sn.PrefixLen != 26 || sn.IP < mkIP4("10.128.0.0") || sn.IP > mkIP4("10.255.255.192") {
+			t.Fatalf("Allocated subnet out of the free range: %s", sn)
+		}
+		if seen[sn.String()] {
+			t.Fatalf("Allocated %s twice", sn)
+		}
+		seen[sn.String()] = true
+	}
+}
+
+func TestSubnetAllocatorHash(t *testing.T) {
+	first, last := mkIP4("10.3.1.0"), mkIP4("10.3.25.0")
+
+	sn, err := NewSubnetAllocator(first, last, 24).Allocate(AllocHash, "node-a")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+
+	// The same key gets the same subnet
+	sn2, err := NewSubnetAllocator(first, last, 24).Allocate(AllocHash, "node-a")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+	if !sn.Equal(sn2) {
+		t.Errorf("Expected %s, got %s", sn, sn2)
+	}
+
+	// If taken, the next free one is used, wrapping around at the end
+	a := NewSubnetAllocator(first, last, 24)
+	a.MarkUsed(sn)
+	sn3, err := a.Allocate(AllocHash, "node-a")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+	want := sn.Next()
+	if sn.IP == last {
+		want = IP4Net{first, 24}
+	}
+	if !sn3.Equal(want) {
+		t.Errorf("Expected %s, got %s", want, sn3)
+	}
+}
+
+func TestIP6SubnetAllocator(t *testing.T) {
+	mkIP6Net := func(s string, prefixLen uint) IP6Net {
+		return IP6Net{MustParseIP6(s), prefixLen}
+	}
+
+	a := NewIP6SubnetAllocator(MustParseIP6("fd00:0:0:1::"), MustParseIP6("fd00:0:0:5::"), 64)
+	if a.Free() != 5 {
+		t.Fatalf("Expected 5 free subnets, got %d", a.Free())
+	}
+
+	a.MarkUsed(mkIP6Net("fd00:0:0:1::", 64))
+	// a bigger subnet takes out every subnet it overlaps
+	a.MarkUsed(mkIP6Net("fd00:0:0:2::", 63))
+	// subnets outside the range are ignored
+	a.MarkUsed(mkIP6Net("fd00:0:1::", 48))
+
+	for _, want := range []string{"fd00:0:0:4::/64", "fd00:0:0:5::/64"} {
+		sn, err := a.Allocate(AllocLowest, "")
+		if err != nil {
+			t.Fatal("Allocate failed: ", err)
+		}
+		if sn.String() != want {
+			t.Errorf("Expected %s, got %s", want, sn)
+		}
+	}
+	if _, err := a.Allocate(AllocLowest, ""); err != ErrOutOfSubnets {
+		t.Errorf("Expected ErrOutOfSubnets, got %v", err)
+	}
+
+	// Ranges with more subnets than can be counted are cut short
+	a = NewIP6SubnetAllocator(MustParseIP6("fd00::"), MustParseIP6("fdff:ffff:ffff:ffff:ffff:ffff:ffff:ff00"), 120)
+	if a.Free() != maxIP6Subnets {
+		t.Fatalf("Expected %d free subnets, got %d", uint64(maxIP6Subnets), a.Free())
+	}
+	a.MarkUsed(mkIP6Net("fd00::", 64))
+	sn, err := a.Allocate(AllocLowest, "")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+	if want := "fd00:0:0:1::/120"; sn.String() != want {
+		t.Errorf("Expected %s, got %s", want, sn)
+	}
+	for i := 0; i < 100; i++ {
+		sn, err := a.Allocate(AllocRandom, "")
+		if err != nil {
+			t.Fatal("Allocate failed: ", err)
+		}
+		if sn.PrefixLen != 120 || !mkIP6Net("fd00::", 8).Contains(sn.IP) {
+			t.Fatalf("Allocated subnet out of the range: %s", sn)
+		}
+	}
+}
+
+func TestParseAllocStrategy(t *testing.T) {
+	if s, err := ParseAllocStrategy(""); err != nil || s != AllocRandom {
+		t.Errorf("Expected the default to be random, got %q: %v", s, err)
+	}
+	if s, err := ParseAllocStrategy("hash"); err != nil || s != AllocHash {
+		t.Errorf("Expected hash, got %q: %v", s, err)
+	}
+	if _, err := ParseAllocStrategy("first"); err == nil {
+		t.Error("ParseAllocStrategy accepted an unknown strategy")
+	}
+}
@@ -67,6 +67,28 @@ func GetIfaceIP4Addr(iface *net.Interface) (net.IP, error) {
 	return nil, errors.New("No IPv4 address found for given interface")
 }
 
+func GetIfaceIP6Addr(iface *net.Interface) (net.IP, error) {
+	link := &netlink.Device{
+		LinkAttrs: netlink.LinkAttrs{
+			Index: iface.Index,
+		},
+	}
+
+	addrs, err := netlink.AddrList(link, syscall.AF_INET6)
+	if err != nil {
+		return nil, err
+	}
+
+	// link-local addresses can't be used to reach other hosts, only take a global one
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil && addr.IP.IsGlobalUnicast() {
+			return addr.IP, nil
+		}
+	}
+
+	return nil, errors.New("No IPv6 address found for given interface")
+}
+
 func GetIfaceIP4AddrMatch(iface *net.Interface, matchAddr net.IP) error {
 	addrs, err := getIfaceAddrs(iface)
 	if err != nil {
@@ -163,3 +185,42 @@ func EnsureV4AddressOnLink(ipn IP4Net, link netlink.Link) error {
 
 	return nil
 }
+
+// EnsureV6AddressOnLink ensures that there is only one global v6 Addr on `link` and it equals `ipn`.
+// Link-local addresses assigned by the kernel are left alone.
+func EnsureV6AddressOnLink(ipn IP6Net, link netlink.Link) error {
+	addr := netlink.Addr{IPNet: ipn.ToIPNet()}
+	allAddrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return err
+	}
+
+	var existingAddrs []netlink.Addr
+	for _, a := range allAddrs {
+		if !a.IP.IsLinkLocalUnicast() {
+			existingAddrs = append(existingAddrs, a)
+		}
+	}
+
+	// flannel will never make this happen. This situation can only be caused by a user, so get them to sort it out.
+	if len(existingAddrs) > 1 {
+		return fmt.Errorf("link has incompatible addresses. Remove additional addresses and try again. %#v", link)
+	}
+
+	// If the device has an incompatible address then delete it. This can happen if the lease changes for example.
+	if len(existingAddrs) == 1 && !existingAddrs[0].Equal(addr) {
+		if err := netlink.AddrDel(link, &existingAddrs[0]); err != nil {
+			return fmt.Errorf("failed to remove IP address %s from %s: %s", ipn.String(), link.Attrs().Name, err)
+		}
+		existingAddrs = []netlink.Addr{}
+	}
+
+	// Actually add the desired address to the interface if needed.
+	if len(existingAddrs) == 0 {
+		if err := netlink.AddrAdd(link, &addr); err != nil {
+			return fmt.Errorf("failed to add IP address %s to %s: %s", ipn.String(), link.Attrs().Name, err)
+		}
+	}
+
+	return nil
+}
@@ -15,8 +15,10 @@
 package ip
 
 import (
-	netsh "github.com/rakelkar/gonetsh/netsh"
+	"errors"
 	"net"
+
+	netsh "github.com/rakelkar/gonetsh/netsh"
 )
 
 func GetIfaceIP4Addr(iface *net.Interface) (net.IP, error) {
@@ -33,6 +35,10 @@ func GetIfaceIP4Addr(iface *net.Interface) (net.IP, error) {
 	return ifAddr, nil
 }
 
+func GetIfaceIP6Addr(iface *net.Interface) (net.IP, error) {
+	return nil, errors.New("IPv6 is not supported on windows")
+}
+
 func GetDefaultGatewayIface() (*net.Interface, error) {
 	netHelper := netsh.New(nil)
 
@@ -0,0 +1,246 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// IP6 is a 128 bit IPv6 address kept as two 64 bit halves so that,
+// like IP4, it is comparable and cheap to do arithmetic on.
+type IP6 struct {
+	Hi uint64
+	Lo uint64
+}
+
+func FromIP6(ip net.IP) IP6 {
+	ip = ip.To16()
+	return IP6{
+		Hi: binary.BigEndian.Uint64(ip[:8]),
+		Lo: binary.BigEndian.Uint64(ip[8:]),
+	}
+}
+
+func ParseIP6(s string) (IP6, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return IP6{}, errors.New("Invalid IPv6 address format")
+	}
+	return FromIP6(ip), nil
+}
+
+func MustParseIP6(s string) IP6 {
+	ip, err := ParseIP6(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip
+}
+
+func (ip IP6) ToIP() net.IP {
+	b := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(b[:8], ip.Hi)
+	binary.BigEndian.PutUint64(b[8:], ip.Lo)
+	return b
+}
+
+func (ip IP6) String() string {
+	return ip.ToIP().String()
+}
+
+func (ip IP6) IsZero() bool {
+	return ip.Hi == 0 && ip.Lo == 0
+}
+
+// Cmp returns -1, 0 or 1 depending on whether ip is lower than, equal to or higher than other.
+func (ip IP6) Cmp(other IP6) int {
+	switch {
+	case ip.Hi < other.Hi || (ip.Hi == other.Hi && ip.Lo < other.Lo):
+		return -1
+	case ip == other:
+		return 0
+	default:
+		return 1
+	}
+}
+
+func (ip IP6) and(other IP6) IP6 {
+	return IP6{ip.Hi & other.Hi, ip.Lo & other.Lo}
+}
+
+func (ip IP6) add(other IP6) IP6 {
+	lo := ip.Lo + other.Lo
+	carry := uint64(0)
+	if lo < ip.Lo {
+		carry = 1
+	}
+	return IP6{ip.Hi + other.Hi + carry, lo}
+}
+
+func (ip IP6) sub(other IP6) IP6 {
+	lo := ip.Lo - other.Lo
+	borrow := uint64(0)
+	if lo > ip.Lo {
+		borrow = 1
+	}
+	return IP6{ip.Hi - other.Hi - borrow, lo}
+}
+
+// lsh shifts ip left by n bits.
+func (ip IP6) lsh(n uint) IP6 {
+	switch {
+	case n >= 128:
+		return IP6{}
+	case n >= 64:
+		return IP6{Hi: ip.Lo << (n - 64)}
+	default:
+		return IP6{ip.Hi<<n | ip.Lo>>(64-n), ip.Lo << n}
+	}
+}
+
+// rsh shifts ip right by n bits.
+func (ip IP6) rsh(n uint) IP6 {
+	switch {
+	case n >= 128:
+		return IP6{}
+	case n >= 64:
+		return IP6{Lo: ip.Hi >> (n - 64)}
+	default:
+		return IP6{ip.Hi >> n, ip.Lo>>n | ip.Hi<<(64-n)}
+	}
+}
+
+// ip6Bit returns an IP6 with only the n-th bit (counting from the least significant) set.
+func ip6Bit(n uint) IP6 {
+	switch {
+	case n >= 128:
+		return IP6{}
+	case n >= 64:
+		return IP6{Hi: 1 << (n - 64)}
+	default:
+		return IP6{Lo: 1 << n}
+	}
+}
+
+// MarshalJSON: json.Marshaler impl
+func (ip IP6) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, ip)), nil
+}
+
+// UnmarshalJSON: json.Unmarshaler impl
+func (ip *IP6) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if val, err := ParseIP6(string(j)); err != nil {
+		return err
+	} else {
+		*ip = val
+		return nil
+	}
+}
+
+// similar to net.IPNet but has integer based representation
+type IP6Net struct {
+	IP        IP6
+	PrefixLen uint
+}
+
+func (n IP6Net) String() string {
+	return fmt.Sprintf("%s/%d", n.IP.String(), n.PrefixLen)
+}
+
+func (n IP6Net) Network() IP6Net {
+	return IP6Net{
+		n.IP.and(n.Mask()),
+		n.PrefixLen,
+	}
+}
+
+func (n IP6Net) Next() IP6Net {
+	return IP6Net{
+		n.IP.add(ip6Bit(128 - n.PrefixLen)),
+		n.PrefixLen,
+	}
+}
+
+func (n IP6Net) Prev() IP6Net {
+	return IP6Net{
+		n.IP.sub(ip6Bit(128 - n.PrefixLen)),
+		n.PrefixLen,
+	}
+}
+
+func FromIP6Net(n *net.IPNet) IP6Net {
+	prefixLen, _ := n.Mask.Size()
+	return IP6Net{
+		FromIP6(n.IP),
+		uint(prefixLen),
+	}
+}
+
+func (n IP6Net) ToIPNet() *net.IPNet {
+	return &net.IPNet{
+		IP:   n.IP.ToIP(),
+		Mask: net.CIDRMask(int(n.PrefixLen), 128),
+	}
+}
+
+func (n IP6Net) Overlaps(other IP6Net) bool {
+	var mask IP6
+	if n.PrefixLen < other.PrefixLen {
+		mask = n.Mask()
+	} else {
+		mask = other.Mask()
+	}
+	return n.IP.and(mask) == other.IP.and(mask)
+}
+
+func (n IP6Net) Equal(other IP6Net) bool {
+	return n.IP == other.IP && n.PrefixLen == other.PrefixLen
+}
+
+func (n IP6Net) Mask() IP6 {
+	// all ones shifted left by (128 - PrefixLen) is 2^128 - 2^(128 - PrefixLen)
+	return IP6{}.sub(ip6Bit(128 - n.PrefixLen))
+}
+
+func (n IP6Net) Contains(ip IP6) bool {
+	return n.IP.and(n.Mask()) == ip.and(n.Mask())
+}
+
+func (n IP6Net) Empty() bool {
+	return n.IP.IsZero() && n.PrefixLen == uint(0)
+}
+
+// MarshalJSON: json.Marshaler impl
+func (n IP6Net) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, n)), nil
+}
+
+// UnmarshalJSON: json.Unmarshaler impl
+func (n *IP6Net) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if _, val, err := net.ParseCIDR(string(j)); err != nil {
+		return err
+	} else if val.IP.To4() != nil {
+		return fmt.Errorf("%s is not an IPv6 network", j)
+	} else {
+		*n = FromIP6Net(val)
+		return nil
+	}
+}
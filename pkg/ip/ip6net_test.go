@@ -0,0 +1,123 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func mkIP6Net(s string, plen uint) IP6Net {
+	return IP6Net{MustParseIP6(s), plen}
+}
+
+func TestIP6(t *testing.T) {
+	ip := FromIP6(net.ParseIP("fc00::1:2"))
+	if ip.Hi != 0xfc00000000000000 || ip.Lo != 0x10002 {
+		t.Error("FromIP6 failed")
+	}
+
+	if _, err := ParseIP6("1.2.3.4"); err == nil {
+		t.Error("ParseIP6 accepted an IPv4 address")
+	}
+
+	if ip.String() != "fc00::1:2" {
+		t.Error("String failed: ", ip.String())
+	}
+
+	if ip.Cmp(MustParseIP6("fc00::1:3")) != -1 || ip.Cmp(ip) != 0 || ip.Cmp(MustParseIP6("fb00::ffff")) != 1 {
+		t.Error("Cmp failed")
+	}
+
+	j, err := json.Marshal(ip)
+	if err != nil {
+		t.Error("Marshal of IP6 failed: ", err)
+	} else if string(j) != `"fc00::1:2"` {
+		t.Error("Marshal of IP6 failed with unexpected value: ", j)
+	}
+
+	var ip2 IP6
+	if err := json.Unmarshal(j, &ip2); err != nil || ip2 != ip {
+		t.Error("Unmarshal of IP6 failed: ", err)
+	}
+}
+
+func TestIP6Net(t *testing.T) {
+	n1 := mkIP6Net("fc00:0:0:1::", 64)
+
+	if n1.ToIPNet().String() != "fc00:0:0:1::/64" {
+		t.Error("ToIPNet failed: ", n1.ToIPNet())
+	}
+
+	if n1.Next().String() != "fc00:0:0:2::/64" {
+		t.Error("Next failed: ", n1.Next())
+	}
+
+	if n1.Prev().String() != "fc00::/64" {
+		t.Error("Prev failed: ", n1.Prev())
+	}
+
+	// crossing the boundary between the two halves
+	if mkIP6Net("fc00::ffff:ffff:ffff:ff00", 120).Next().String() != "fc00:0:0:1::/120" {
+		t.Error("Next failed to carry")
+	}
+
+	if !n1.Overlaps(n1) {
+		t.Errorf("%s does not overlap %s", n1, n1)
+	}
+
+	n2 := mkIP6Net("fc00::", 48)
+	if !n1.Overlaps(n2) || !n2.Overlaps(n1) {
+		t.Errorf("%s does not overlap %s", n1, n2)
+	}
+
+	n2 = mkIP6Net("fc00:0:0:2::", 64)
+	if n1.Overlaps(n2) {
+		t.Errorf("%s overlaps %s", n1, n2)
+	}
+
+	if !n1.Contains(MustParseIP6("fc00:0:0:1:ffff::1")) {
+		t.Error("Contains failed")
+	}
+
+	if n1.Contains(MustParseIP6("fc00:0:0:2::1")) {
+		t.Error("Contains failed")
+	}
+
+	if mkIP6Net("fc00::1:2", 112).Network().String() != "fc00::1:0/112" {
+		t.Error("Network failed")
+	}
+
+	if !(IP6Net{}).Empty() || n1.Empty() {
+		t.Error("Empty failed")
+	}
+
+	j, err := json.Marshal(n1)
+	if err != nil {
+		t.Error("Marshal of IP6Net failed: ", err)
+	} else if string(j) != `"fc00:0:0:1::/64"` {
+		t.Error("Marshal of IP6Net failed with unexpected value: ", j)
+	}
+
+	var n3 IP6Net
+	if err := json.Unmarshal(j, &n3); err != nil || !n3.Equal(n1) {
+		t.Error("Unmarshal of IP6Net failed: ", err)
+	}
+
+	if err := json.Unmarshal([]byte(`"10.0.0.0/8"`), &n3); err == nil {
+		t.Error("Unmarshal of IP6Net accepted an IPv4 network")
+	}
+}
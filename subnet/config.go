@@ -18,6 +18,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 
 	"github.com/coreos/flannel/pkg/ip"
 )
@@ -29,6 +31,39 @@ type Config struct {
 	SubnetLen   uint
 	BackendType string          `json:"-"`
 	Backend     json.RawMessage `json:",omitempty"`
+
+	// Additional pools to hand out subnets from once SubnetMin-SubnetMax is
+	// used up, and subnets that are never handed out.
+	Networks        []ip.IP4Net `json:",omitempty"`
+	ExcludedSubnets []ip.IP4Net `json:",omitempty"`
+
+	// Named pools with a subnet size of their own, for nodes that select
+	// them with --node-group. They have to lie within Network.
+	NodeGroups map[string]*NodeGroup `json:",omitempty"`
+
+	// How a new lease's subnet is picked from the free ones: random (the
+	// default), lowest or hash (of the node's identity).
+	SubnetAllocation ip.AllocStrategy `json:",omitempty"`
+
+	// An optional IPv6 network to hand out a second, v6 subnet to every
+	// lease from. Leases stay keyed by their v4 subnet.
+	IPv6Network   ip.IP6Net
+	IPv6SubnetMin ip.IP6
+	IPv6SubnetMax ip.IP6
+	IPv6SubnetLen uint
+}
+
+// NodeGroup is the pool the nodes of a group get their subnets from.
+type NodeGroup struct {
+	Network   ip.IP4Net
+	SubnetLen uint
+	SubnetMin ip.IP4
+	SubnetMax ip.IP4
+}
+
+// IPv6Enabled returns true if leases should carry a v6 subnet as well.
+func (c *Config) IPv6Enabled() bool {
+	return !c.IPv6Network.Empty()
 }
 
 func parseBackendType(be json.RawMessage) (string, error) {
@@ -108,6 +143,24 @@ func ParseConfig(s string) (*Config, error) {
 		return nil, fmt.Errorf("SubnetMax is not on a SubnetLen boundary: %v", cfg.SubnetMax)
 	}
 
+	if err := parsePools(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := parseNodeGroups(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.SubnetAllocation, err = ip.ParseAllocStrategy(string(cfg.SubnetAllocation)); err != nil {
+		return nil, err
+	}
+
+	if cfg.IPv6Enabled() {
+		if err := parseIPv6Config(cfg); err != nil {
+			return nil, err
+		}
+	}
+
 	bt, err := parseBackendType(cfg.Backend)
 	if err != nil {
 		return nil, err
@@ -116,3 +169,308 @@ func ParseConfig(s string) (*Config, error) {
 
 	return cfg, nil
 }
+
+func parsePools(cfg *Config) error {
+	// Entries with host bits set are taken as the network they're in, like
+	// IPv6Network, so that subnets are carved out on their boundaries.
+	for i := range cfg.Networks {
+		cfg.Networks[i] = cfg.Networks[i].Network()
+	}
+	for i := range cfg.ExcludedSubnets {
+		cfg.ExcludedSubnets[i] = cfg.ExcludedSubnets[i].Network()
+	}
+
+	pools := []ip.IP4Net{cfg.Network}
+	for _, n := range cfg.Networks {
+		if n.PrefixLen > cfg.SubnetLen {
+			return fmt.Errorf("Networks entry %v is smaller than SubnetLen", n)
+		}
+		for _, p := range pools {
+			if n.Overlaps(p) {
+				return fmt.Errorf("Networks entry %v overlaps %v", n, p)
+			}
+		}
+		pools = append(pools, n)
+	}
+
+ExcludedLoop:
+	for _, e := range cfg.ExcludedSubnets {
+		for _, p := range pools {
+			if e.Overlaps(p) {
+				continue ExcludedLoop
+			}
+		}
+		return fmt.Errorf("ExcludedSubnets entry %v is outside of the network", e)
+	}
+
+	return nil
+}
+
+// Pools returns Network followed by the additional Networks.
+func (c *Config) Pools() []ip.IP4Net {
+	return append([]ip.IP4Net{c.Network}, c.Networks...)
+}
+
+func parseNodeGroups(cfg *Config) error {
+	names := make([]string, 0, len(cfg.NodeGroups))
+	for name := range cfg.NodeGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		g := cfg.NodeGroups[name]
+		if name == "" || g == nil {
+			return errors.New("NodeGroups entries need a name and a config")
+		}
+
+		if !cfg.Network.Contains(g.Network.IP) || g.Network.PrefixLen < cfg.Network.PrefixLen {
+			return fmt.Errorf("node group %q: Network must be within the Network of the config", name)
+		}
+		if g.SubnetLen == 0 || g.SubnetLen > 30 || g.SubnetLen < g.Network.PrefixLen {
+			return fmt.Errorf("node group %q: SubnetLen must be set, less than /31 and fit into its Network", name)
+		}
+
+		subnetSize := ip.IP4(1 << (32 - g.SubnetLen))
+		if g.SubnetMin == ip.IP4(0) {
+			// Skip over the first subnet, like for the Network of the config
+			g.SubnetMin = g.Network.IP + subnetSize
+		} else if !g.Network.Contains(g.SubnetMin) {
+			return fmt.Errorf("node group %q: SubnetMin is not in the range of its Network", name)
+		}
+		if g.SubnetMax == ip.IP4(0) {
+			g.SubnetMax = g.Network.Next().IP - subnetSize
+		} else if !g.Network.Contains(g.SubnetMax) {
+			return fmt.Errorf("node group %q: SubnetMax is not in the range of its Network", name)
+		}
+
+		mask := ip.IP4(0xFFFFFFFF << (32 - g.SubnetLen))
+		if g.SubnetMin != g.SubnetMin&mask || g.SubnetMax != g.SubnetMax&mask {
+			return fmt.Errorf("node group %q: SubnetMin and SubnetMax must be on a SubnetLen boundary", name)
+		}
+		if g.SubnetMin > g.SubnetMax {
+			return fmt.Errorf("node group %q: SubnetMin is past SubnetMax", name)
+		}
+
+		// The networks don't overlap, so neither do the ranges within them
+		for _, other := range names[:i] {
+			if g.Network.Overlaps(cfg.NodeGroups[other].Network) {
+				return fmt.Errorf("node group %q overlaps node group %q", name, other)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SubnetAllocators returns the allocators to pick a subnet of the given node
+// group from, in the order they are to be used. Nodes outside of any group use
+// SubnetMin-SubnetMax and then the additional pools, minus the networks of the
+// node groups. Excluded subnets are already taken out.
+func (c *Config) SubnetAllocators(group string) ([]*ip.SubnetAllocator, error) {
+	var allocators []*ip.SubnetAllocator
+	if group != "" {
+		g, ok := c.NodeGroups[group]
+		if !ok {
+			return nil, fmt.Errorf("unknown node group %q", group)
+		}
+		allocators = append(allocators, ip.NewSubnetAllocator(g.SubnetMin, g.SubnetMax, g.SubnetLen))
+	} else {
+		subnetSize := ip.IP4(1 << (32 - c.SubnetLen))
+		allocators = append(allocators, ip.NewSubnetAllocator(c.SubnetMin, c.SubnetMax, c.SubnetLen))
+		for _, n := range c.Networks {
+			allocators = append(allocators, ip.NewSubnetAllocator(n.IP, n.Next().IP-subnetSize, c.SubnetLen))
+		}
+		for _, a := range allocators {
+			for _, g := range c.NodeGroups {
+				a.MarkUsed(g.Network)
+			}
+		}
+	}
+
+	for _, a := range allocators {
+		for _, e := range c.ExcludedSubnets {
+			a.MarkUsed(e)
+		}
+	}
+	return allocators, nil
+}
+
+// AllocateSubnet picks a subnet for a node of the given group that doesn't
+// overlap any of the used ones. key identifies the node for the hash strategy.
+// Pools are used up one after the other.
+func (c *Config) AllocateSubnet(group, key string, used []ip.IP4Net) (ip.IP4Net, error) {
+	allocators, err := c.SubnetAllocators(group)
+	if err != nil {
+		return ip.IP4Net{}, err
+	}
+	for _, a := range allocators {
+		for _, sn := range used {
+			a.MarkUsed(sn)
+		}
+		sn, err := a.Allocate(c.SubnetAllocation, key)
+		if err != ip.ErrOutOfSubnets {
+			return sn, err
+		}
+	}
+	return ip.IP4Net{}, ip.ErrOutOfSubnets
+}
+
+// AllocateIPv6Subnet picks an IPv6 subnet from IPv6SubnetMin to IPv6SubnetMax
+// that doesn't overlap any of the used ones, the same way as AllocateSubnet.
+func (c *Config) AllocateIPv6Subnet(key string, used []ip.IP6Net) (ip.IP6Net, error) {
+	a := ip.NewIP6SubnetAllocator(c.IPv6SubnetMin, c.IPv6SubnetMax, c.IPv6SubnetLen)
+	for _, sn := range used {
+		if !sn.Empty() {
+			a.MarkUsed(sn)
+		}
+	}
+	return a.Allocate(c.SubnetAllocation, key)
+}
+
+// IsValidSubnet reports whether sn could have been allocated to a node of the
+// given group with this config: it has the group's length, is in one of its
+// ranges, and isn't excluded.
+func (c *Config) IsValidSubnet(group string, sn ip.IP4Net) bool {
+	for _, e := range c.ExcludedSubnets {
+		if e.Overlaps(sn) {
+			return false
+		}
+	}
+
+	if group != "" {
+		g, ok := c.NodeGroups[group]
+		return ok && sn.PrefixLen == g.SubnetLen && sn.IP >= g.SubnetMin && sn.IP <= g.SubnetMax
+	}
+
+	if sn.PrefixLen != c.SubnetLen {
+		return false
+	}
+	for _, g := range c.NodeGroups {
+		if g.Network.Overlaps(sn) {
+			return false
+		}
+	}
+
+	if sn.IP >= c.SubnetMin && sn.IP <= c.SubnetMax {
+		return true
+	}
+	for _, n := range c.Networks {
+		if n.Contains(sn.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseIPv6Config(cfg *Config) error {
+	cfg.IPv6Network = cfg.IPv6Network.Network()
+
+	if cfg.IPv6SubnetLen > 0 {
+		if cfg.IPv6SubnetLen > 126 {
+			return errors.New("IPv6SubnetLen must be less than /127")
+		}
+
+		if cfg.IPv6SubnetLen < cfg.IPv6Network.PrefixLen+2 {
+			return errors.New("IPv6Network must be able to accommodate at least four subnets")
+		}
+	} else {
+		if cfg.IPv6Network.PrefixLen > 124 {
+			return errors.New("IPv6Network is too small. Minimum useful network prefix is /124")
+		} else if cfg.IPv6Network.PrefixLen <= 62 {
+			// Network is big enough to give each host a /64
+			cfg.IPv6SubnetLen = 64
+		} else {
+			cfg.IPv6SubnetLen = cfg.IPv6Network.PrefixLen + 2
+		}
+	}
+
+	subnet := ip.IP6Net{IP: cfg.IPv6Network.IP, PrefixLen: cfg.IPv6SubnetLen}
+
+	if cfg.IPv6SubnetMin.IsZero() {
+		// skip over the first subnet, same as for IPv4
+		cfg.IPv6SubnetMin = subnet.Next().IP
+	} else if !cfg.IPv6Network.Contains(cfg.IPv6SubnetMin) {
+		return errors.New("IPv6SubnetMin is not in the range of the IPv6Network")
+	}
+
+	if cfg.IPv6SubnetMax.IsZero() {
+		cfg.IPv6SubnetMax = ip.IP6Net{IP: cfg.IPv6Network.Next().IP, PrefixLen: cfg.IPv6SubnetLen}.Prev().IP
+	} else if !cfg.IPv6Network.Contains(cfg.IPv6SubnetMax) {
+		return errors.New("IPv6SubnetMax is not in the range of the IPv6Network")
+	}
+
+	if min := (ip.IP6Net{IP: cfg.IPv6SubnetMin, PrefixLen: cfg.IPv6SubnetLen}); !min.Network().Equal(min) {
+		return fmt.Errorf("IPv6SubnetMin is not on a IPv6SubnetLen boundary: %v", cfg.IPv6SubnetMin)
+	}
+
+	if max := (ip.IP6Net{IP: cfg.IPv6SubnetMax, PrefixLen: cfg.IPv6SubnetLen}); !max.Network().Equal(max) {
+		return fmt.Errorf("IPv6SubnetMax is not on a IPv6SubnetLen boundary: %v", cfg.IPv6SubnetMax)
+	}
+
+	return nil
+}
+
+// UnsafeConfigChanges lists the settings that differ between two configs and
+// can't be applied to a running network: everything that decides how subnets are
+// carved out, and the backend type.
+func UnsafeConfigChanges(old, new *Config) []string {
+	var changes []string
+	if !old.Network.Equal(new.Network) {
+		changes = append(changes, "Network")
+	}
+	if old.SubnetLen != new.SubnetLen {
+		changes = append(changes, "SubnetLen")
+	}
+	if old.SubnetMin != new.SubnetMin {
+		changes = append(changes, "SubnetMin")
+	}
+	if old.SubnetMax != new.SubnetMax {
+		changes = append(changes, "SubnetMax")
+	}
+	if !old.IPv6Network.Equal(new.IPv6Network) {
+		changes = append(changes, "IPv6Network")
+	}
+	if !reflect.DeepEqual(old.Networks, new.Networks) {
+		changes = append(changes, "Networks")
+	}
+	if old.IPv6SubnetLen != new.IPv6SubnetLen {
+		changes = append(changes, "IPv6SubnetLen")
+	}
+	if old.IPv6SubnetMin != new.IPv6SubnetMin {
+		changes = append(changes, "IPv6SubnetMin")
+	}
+	if old.IPv6SubnetMax != new.IPv6SubnetMax {
+		changes = append(changes, "IPv6SubnetMax")
+	}
+	if old.SubnetAllocation != new.SubnetAllocation {
+		changes = append(changes, "SubnetAllocation")
+	}
+	if !reflect.DeepEqual(old.ExcludedSubnets, new.ExcludedSubnets) {
+		changes = append(changes, "ExcludedSubnets")
+	}
+	if !reflect.DeepEqual(old.NodeGroups, new.NodeGroups) {
+		changes = append(changes, "NodeGroups")
+	}
+	if old.BackendType != new.BackendType {
+		changes = append(changes, "Backend.Type")
+	}
+	return changes
+}
+
+// BackendConfigChanged reports whether the backend options differ. Formatting of
+// the JSON doesn't count as a change.
+func BackendConfigChanged(old, new *Config) bool {
+	var o, n interface{}
+	if len(old.Backend) > 0 {
+		if err := json.Unmarshal(old.Backend, &o); err != nil {
+			return true
+		}
+	}
+	if len(new.Backend) > 0 {
+		if err := json.Unmarshal(new.Backend, &n); err != nil {
+			return true
+		}
+	}
+	return !reflect.DeepEqual(o, n)
+}
@@ -15,7 +15,10 @@
 package subnet
 
 import (
+	"reflect"
 	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
 )
 
 func TestConfigDefaults(t *testing.T) {
@@ -69,3 +72,281 @@ func TestConfigOverrides(t *testing.T) {
 		t.Errorf("SubnetLen mismatch: expected 28, got %d", cfg.SubnetLen)
 	}
 }
+
+func TestIPv6ConfigDefaults(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "IPv6Network": "fc00::/48" }`
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if !cfg.IPv6Enabled() {
+		t.Fatal("IPv6 should be enabled")
+	}
+
+	if cfg.IPv6SubnetLen != 64 {
+		t.Errorf("IPv6SubnetLen mismatch: expected 64, got %d", cfg.IPv6SubnetLen)
+	}
+
+	if cfg.IPv6SubnetMin.String() != "fc00:0:0:1::" {
+		t.Errorf("IPv6SubnetMin mismatch: expected fc00:0:0:1::, got %s", cfg.IPv6SubnetMin)
+	}
+
+	if cfg.IPv6SubnetMax.String() != "fc00:0:0:ffff::" {
+		t.Errorf("IPv6SubnetMax mismatch: expected fc00:0:0:ffff::, got %s", cfg.IPv6SubnetMax)
+	}
+
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "IPv6Network": "fc00::/48", "IPv6SubnetMin": "fc00::1:0:0:1" }`); err == nil {
+		t.Error("ParseConfig accepted an unaligned IPv6SubnetMin")
+	}
+
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.IPv6Enabled() {
+		t.Error("IPv6 should not be enabled without an IPv6Network")
+	}
+}
+
+func TestSubnetAllocation(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.SubnetAllocation != ip.AllocRandom {
+		t.Errorf("SubnetAllocation mismatch, expected random, got %q", cfg.SubnetAllocation)
+	}
+
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetAllocation": "lowest" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.SubnetAllocation != ip.AllocLowest {
+		t.Errorf("SubnetAllocation mismatch, expected lowest, got %q", cfg.SubnetAllocation)
+	}
+
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetAllocation": "first" }`); err == nil {
+		t.Error("ParseConfig accepted an unknown SubnetAllocation")
+	}
+}
+
+func TestPools(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "Networks": [ "10.5.0.0/24", "10.6.0.0/22" ], "SubnetLen": 24, "ExcludedSubnets": [ "10.3.16.0/20", "10.6.1.0/24" ] }`
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if len(cfg.Pools()) != 3 {
+		t.Errorf("Expected 3 pools, got %v", cfg.Pools())
+	}
+
+	allocators, err := cfg.SubnetAllocators("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := []uint64{255 - 16, 1, 3}
+	for i, a := range allocators {
+		if a.Free() != free[i] {
+			t.Errorf("Pool %d: expected %d free subnets, got %d", i, free[i], a.Free())
+		}
+	}
+
+	for sn, valid := range map[string]bool{
+		"10.3.1.0/24":  true,
+		"10.3.17.0/24": false, // excluded
+		"10.3.1.0/25":  false, // wrong length
+		"10.5.0.0/24":  true,
+		"10.6.2.0/24":  true,
+		"10.6.1.0/24":  false, // excluded
+		"10.7.0.0/24":  false, // outside of the pools
+	} {
+		var n ip.IP4Net
+		if err := n.UnmarshalJSON([]byte(`"` + sn + `"`)); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.IsValidSubnet("", n) != valid {
+			t.Errorf("IsValidSubnet(%s) should be %v", sn, valid)
+		}
+	}
+
+	for _, bad := range []string{
+		`{ "Network": "10.3.0.0/16", "Networks": [ "10.3.128.0/17" ] }`,
+		`{ "Network": "10.3.0.0/16", "Networks": [ "10.4.0.0/16", "10.4.1.0/24" ] }`,
+		`{ "Network": "10.3.0.0/16", "Networks": [ "10.4.0.0/25" ] }`,
+		`{ "Network": "10.3.0.0/16", "ExcludedSubnets": [ "10.4.0.0/24" ] }`,
+	} {
+		if _, err := ParseConfig(bad); err == nil {
+			t.Errorf("ParseConfig accepted %s", bad)
+		}
+	}
+}
+
+func TestPoolsNotAligned(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "Networks": [ "10.5.1.0/16" ], "ExcludedSubnets": [ "10.3.16.5/20" ] }`
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if n := (ip.IP4Net{IP: ip.MustParseIP4("10.5.0.0"), PrefixLen: 16}); !cfg.Networks[0].Equal(n) {
+		t.Errorf("Expected Networks entry %v, got %v", n, cfg.Networks[0])
+	}
+	if e := (ip.IP4Net{IP: ip.MustParseIP4("10.3.16.0"), PrefixLen: 20}); !cfg.ExcludedSubnets[0].Equal(e) {
+		t.Errorf("Expected ExcludedSubnets entry %v, got %v", e, cfg.ExcludedSubnets[0])
+	}
+
+	// All subnets of the pool lie on its boundaries
+	allocators, err := cfg.SubnetAllocators("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free := allocators[1].Free(); free != 256 {
+		t.Errorf("Expected 256 free subnets in 10.5.0.0/16, got %d", free)
+	}
+	for i := 0; i < 10; i++ {
+		sn, err := allocators[1].Allocate(ip.AllocRandom, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.Networks[0].Contains(sn.IP) || !sn.Network().Equal(sn) {
+			t.Errorf("Subnet %v isn't aligned in %v", sn, cfg.Networks[0])
+		}
+	}
+}
+
+func TestNodeGroups(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.3.128.0/20", "SubnetLen": 27 }, "metal": { "Network": "10.3.192.0/18", "SubnetLen": 22, "SubnetMin": "10.3.196.0" } } }`
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	edge := cfg.NodeGroups["edge"]
+	if edge.SubnetMin.String() != "10.3.128.32" || edge.SubnetMax.String() != "10.3.143.224" {
+		t.Errorf("Unexpected range of node group edge: %s ... %s", edge.SubnetMin, edge.SubnetMax)
+	}
+
+	allocators, err := cfg.SubnetAllocators("metal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocators) != 1 || allocators[0].Free() != 15 {
+		t.Errorf("Expected 15 free subnets in node group metal")
+	}
+
+	// The node groups are taken out of the default range
+	allocators, err = cfg.SubnetAllocators("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocators[0].Free() != 255-16-64 {
+		t.Errorf("Expected %d free subnets outside of the node groups, got %d", 255-16-64, allocators[0].Free())
+	}
+
+	if _, err := cfg.SubnetAllocators("unknown"); err == nil {
+		t.Error("SubnetAllocators accepted an unknown node group")
+	}
+
+	for _, c := range []struct {
+		group, sn string
+		valid     bool
+	}{
+		{"edge", "10.3.128.32/27", true},
+		{"edge", "10.3.128.0/27", false}, // the first subnet of the group
+		{"edge", "10.3.128.0/24", false},
+		{"", "10.3.128.0/24", false},
+		{"", "10.3.1.0/24", true},
+		{"metal", "10.3.192.0/22", false}, // below SubnetMin
+		{"metal", "10.3.196.0/22", true},
+		{"unknown", "10.3.1.0/24", false},
+	} {
+		var n ip.IP4Net
+		if err := n.UnmarshalJSON([]byte(`"` + c.sn + `"`)); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.IsValidSubnet(c.group, n) != c.valid {
+			t.Errorf("IsValidSubnet(%q, %s) should be %v", c.group, c.sn, c.valid)
+		}
+	}
+
+	for _, bad := range []string{
+		`{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.4.0.0/20", "SubnetLen": 27 } } }`,
+		`{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.3.0.0/20" } } }`,
+		`{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.3.0.0/20", "SubnetLen": 18 } } }`,
+		`{ "Network": "10.3.0.0/16", "NodeGroups": { "a": { "Network": "10.3.0.0/20", "SubnetLen": 24 }, "b": { "Network": "10.3.8.0/21", "SubnetLen": 24 } } }`,
+		`{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.3.128.0/20", "SubnetLen": 27, "SubnetMin": "10.3.192.0" } } }`,
+		`{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.3.128.0/20", "SubnetLen": 27, "SubnetMax": "10.3.144.0" } } }`,
+		`{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.3.128.0/20", "SubnetLen": 27, "SubnetMin": "10.3.130.0", "SubnetMax": "10.3.129.0" } } }`,
+		`{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.3.128.0/27", "SubnetLen": 27 } } }`,
+		`{ "Network": "10.3.0.0/16", "NodeGroups": { "a": { "Network": "10.3.128.0/20", "SubnetLen": 24, "SubnetMin": "10.3.144.0" }, "b": { "Network": "10.3.144.0/20", "SubnetLen": 24 } } }`,
+	} {
+		if _, err := ParseConfig(bad); err == nil {
+			t.Errorf("ParseConfig accepted %s", bad)
+		}
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	old, err := ParseConfig(`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "DirectRouting": false } }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	same, err := ParseConfig(`{"Network":"10.3.0.0/16","Backend":{"DirectRouting":false,"Type":"vxlan"}}`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if changes := UnsafeConfigChanges(old, same); len(changes) != 0 {
+		t.Errorf("Unexpected unsafe changes: %v", changes)
+	}
+	if BackendConfigChanged(old, same) {
+		t.Error("Reformatted backend config counted as a change")
+	}
+
+	backend, err := ParseConfig(`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "DirectRouting": true } }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if changes := UnsafeConfigChanges(old, backend); len(changes) != 0 {
+		t.Errorf("Backend options counted as unsafe: %v", changes)
+	}
+	if !BackendConfigChanged(old, backend) {
+		t.Error("Backend config change not detected")
+	}
+
+	network, err := ParseConfig(`{ "Network": "10.4.0.0/16", "Backend": { "Type": "host-gw" } }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	changes := UnsafeConfigChanges(old, network)
+	if !reflect.DeepEqual(changes, []string{"Network", "SubnetMin", "SubnetMax", "Backend.Type"}) {
+		t.Errorf("Unexpected unsafe changes: %v", changes)
+	}
+
+	nodeGroups, err := ParseConfig(`{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.3.128.0/20", "SubnetLen": 27 } }, "Backend": { "Type": "vxlan" } }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if changes := UnsafeConfigChanges(old, nodeGroups); !reflect.DeepEqual(changes, []string{"NodeGroups"}) {
+		t.Errorf("Unexpected unsafe changes: %v", changes)
+	}
+
+	excludedSubnets, err := ParseConfig(`{ "Network": "10.3.0.0/16", "ExcludedSubnets": [ "10.3.16.0/20" ], "Backend": { "Type": "vxlan" } }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if changes := UnsafeConfigChanges(old, excludedSubnets); !reflect.DeepEqual(changes, []string{"ExcludedSubnets"}) {
+		t.Errorf("Unexpected unsafe changes: %v", changes)
+	}
+
+	subnetAllocation, err := ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetAllocation": "lowest", "Backend": { "Type": "vxlan" } }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if changes := UnsafeConfigChanges(old, subnetAllocation); !reflect.DeepEqual(changes, []string{"SubnetAllocation"}) {
+		t.Errorf("Unexpected unsafe changes: %v", changes)
+	}
+}
@@ -0,0 +1,556 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// DefaultNetwork is the name of the FlannelNetwork used without --networks.
+	DefaultNetwork = "default"
+
+	raceRetries         = 10
+	retryDelay          = 500 * time.Millisecond
+	subnetTTL           = 24 * time.Hour
+	expiryCheckPeriod   = time.Minute
+	informerSyncTimeout = 10 * time.Minute
+)
+
+var (
+	errTryAgain = errors.New("try again")
+
+	// Network names end up in the names of the leases
+	networkNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+type crdSubnetManager struct {
+	registry       registry
+	network        string
+	previousSubnet ip.IP4Net
+	nodeID         string
+	nodeGroup      string
+
+	events chan subnet.Event
+
+	mux sync.Mutex
+	// overflow is set when events had to be dropped, WatchLeases then starts
+	// over with a snapshot.
+	overflow bool
+	// changed is closed and replaced on every change to a lease.
+	changed chan struct{}
+}
+
+// NewSubnetManager returns a manager keeping the config of the network in a
+// FlannelNetwork and its leases in FlannelLeases.
+func NewSubnetManager(apiUrl, kubeconfig, network string, prevSubnet ip.IP4Net, nodeID, nodeGroup string) (subnet.Manager, error) {
+	if network == "" {
+		network = DefaultNetwork
+	}
+	if !networkNameRegex.MatchString(network) {
+		return nil, fmt.Errorf("network name %q is not a valid resource name", network)
+	}
+
+	cfg, err := clientcmd.BuildConfigFromFlags(apiUrl, kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create kubernetes config: %v", err)
+	}
+	client, err := newRESTClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize client: %v", err)
+	}
+
+	m := newSubnetManager(network, prevSubnet, nodeID, nodeGroup)
+	r := newKubeRegistry(client, network, m)
+	m.registry = r
+
+	ctx := context.Background()
+	go r.run(ctx)
+	go m.expireLeases(ctx)
+
+	glog.Infof("Waiting %s for the leases of network %q to sync", informerSyncTimeout, network)
+	err = wait.Poll(time.Second, informerSyncTimeout, func() (bool, error) {
+		return r.controller.HasSynced(), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for the leases to sync: %v", err)
+	}
+
+	return m, nil
+}
+
+func newSubnetManager(network string, prevSubnet ip.IP4Net, nodeID, nodeGroup string) *crdSubnetManager {
+	return &crdSubnetManager{
+		network:        network,
+		previousSubnet: prevSubnet,
+		nodeID:         nodeID,
+		nodeGroup:      nodeGroup,
+		events:         make(chan subnet.Event, 5000),
+		changed:        make(chan struct{}),
+	}
+}
+
+// OnAdd, OnUpdate and OnDelete turn the changes seen by the informer into
+// events. Expired leases only get reported once deleted.
+func (m *crdSubnetManager) OnAdd(obj interface{}) {
+	m.handleLeaseEvent(subnet.EventAdded, obj)
+}
+
+func (m *crdSubnetManager) OnUpdate(oldObj, newObj interface{}) {
+	m.handleLeaseEvent(subnet.EventAdded, newObj)
+}
+
+func (m *crdSubnetManager) OnDelete(obj interface{}) {
+	if deleted, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = deleted.Obj
+	}
+	m.handleLeaseEvent(subnet.EventRemoved, obj)
+}
+
+func (m *crdSubnetManager) handleLeaseEvent(et subnet.EventType, obj interface{}) {
+	fl, ok := obj.(*FlannelLease)
+	if !ok {
+		glog.Infof("Error received unexpected object: %v", obj)
+		return
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+
+	if et == subnet.EventAdded && fl.expired(time.Now()) {
+		return
+	}
+	select {
+	case m.events <- subnet.Event{Type: et, Lease: fl.lease()}:
+	default:
+		m.overflow = true
+	}
+}
+
+func (m *crdSubnetManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	fn, err := m.registry.getNetwork(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FlannelNetwork %q: %v", m.network, err)
+	}
+
+	config, err := subnet.ParseConfig(string(fn.Spec))
+	if err != nil {
+		return nil, err
+	}
+	if config.IPv6Enabled() {
+		return nil, fmt.Errorf("IPv6Network is not supported with FlannelLeases")
+	}
+	return config, nil
+}
+
+// leases returns the leases that haven't expired.
+func (m *crdSubnetManager) leases() []subnet.Lease {
+	now := time.Now()
+	var leases []subnet.Lease
+	for _, fl := range m.registry.leases() {
+		if !fl.expired(now) {
+			leases = append(leases, fl.lease())
+		}
+	}
+	return leases
+}
+
+func (m *crdSubnetManager) getLease(sn ip.IP4Net) *FlannelLease {
+	fl := m.registry.getLease(leaseName(m.network, sn))
+	if fl == nil || fl.expired(time.Now()) {
+		return nil
+	}
+	return fl
+}
+
+func (m *crdSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	config, err := m.GetNetworkConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if attrs.NodeID == "" {
+		attrs.NodeID = m.nodeID
+	}
+	if attrs.NodeGroup == "" {
+		attrs.NodeGroup = m.nodeGroup
+	}
+	if _, err := config.SubnetAllocators(attrs.NodeGroup); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < raceRetries; i++ {
+		subnet.AllocationAttempts.Inc()
+		l, err := m.tryAcquireLease(ctx, config, attrs)
+		switch err {
+		case nil:
+			return l, nil
+		case errTryAgain:
+			subnet.AllocationConflicts.Inc()
+			// Give the cache time to catch up with the change that got in
+			// the way.
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("Max retries reached trying to acquire a subnet")
+}
+
+func (m *crdSubnetManager) tryAcquireLease(ctx context.Context, config *subnet.Config, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	leases := m.leases()
+
+	// Try to reuse a subnet if there's one that matches our node ID or IP
+	l, conflicts := subnet.FindLeaseForNode(leases, attrs)
+	for _, c := range conflicts {
+		glog.Warningf("Node %q holds lease (%v) with the same public IP (%v) as this node (%q), each node needs its own public IP", c.Attrs.NodeID, c.Subnet, attrs.PublicIP, attrs.NodeID)
+	}
+	if l != nil {
+		if config.IsValidSubnet(attrs.NodeGroup, l.Subnet) {
+			glog.Infof("Found lease (%v) for current node (%v), reusing", l.Subnet, attrs.PublicIP)
+			return m.updateLease(ctx, l.Subnet, attrs, !l.Expiration.IsZero())
+		}
+
+		glog.Infof("Found lease (%v) for current node (%v) but not compatible with current config, deleting", l.Subnet, attrs.PublicIP)
+		if err := m.deleteLease(ctx, l.Subnet); err != nil {
+			return nil, err
+		}
+	}
+
+	// no existing match, check if there was a previous subnet to use
+	var sn ip.IP4Net
+	if !m.previousSubnet.Empty() && config.IsValidSubnet(attrs.NodeGroup, m.previousSubnet) {
+		if fl := m.getLease(m.previousSubnet); fl == nil {
+			glog.Infof("Found previously leased subnet (%v), reusing", m.previousSubnet)
+			sn = m.previousSubnet
+		} else if l := fl.lease(); l.OwnedByOtherNode(attrs) {
+			glog.Infof("Previously leased subnet (%v) is now leased by node %q, ignoring", l.Subnet, l.Attrs.NodeID)
+		} else {
+			glog.Infof("Found lease (%v) matching previously leased subnet, reusing", l.Subnet)
+			return m.updateLease(ctx, l.Subnet, attrs, !l.Expiration.IsZero())
+		}
+	}
+
+	if sn.Empty() {
+		used := make([]ip.IP4Net, 0, len(leases))
+		for _, l := range leases {
+			used = append(used, l.Subnet)
+		}
+		// Nodes without an ID hash their public IP instead.
+		key := attrs.NodeID
+		if key == "" {
+			key = attrs.PublicIP.String()
+		}
+		var err error
+		if sn, err = config.AllocateSubnet(attrs.NodeGroup, key, used); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := m.createLease(ctx, sn, attrs, subnetTTL)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Allocated lease (%v) to current node (%v) ", sn, attrs.PublicIP)
+	return l, nil
+}
+
+// createLease creates the lease of a free subnet, taking over the object of an
+// expired lease if there is one.
+func (m *crdSubnetManager) createLease(ctx context.Context, sn ip.IP4Net, attrs *subnet.LeaseAttrs, ttl time.Duration) (*subnet.Lease, error) {
+	fl := newFlannelLease(m.network, sn, attrs)
+	if ttl != 0 {
+		fl.Spec.Expiration = &metav1.Time{Time: time.Now().Add(ttl)}
+	}
+
+	var err error
+	if old := m.registry.getLease(fl.Name); old != nil {
+		if !old.expired(time.Now()) {
+			return nil, errTryAgain
+		}
+		fl.ObjectMeta = old.ObjectMeta
+		err = m.registry.updateLease(ctx, fl)
+	} else {
+		err = m.registry.createLease(ctx, fl)
+	}
+
+	if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) {
+		return nil, errTryAgain
+	} else if err != nil {
+		return nil, err
+	}
+
+	l := fl.lease()
+	return &l, nil
+}
+
+// updateLease sets the attributes of an existing lease and renews it, unless
+// it's a reservation that is to be kept.
+func (m *crdSubnetManager) updateLease(ctx context.Context, sn ip.IP4Net, attrs *subnet.LeaseAttrs, expires bool) (*subnet.Lease, error) {
+	old := m.getLease(sn)
+	if old == nil {
+		return nil, errTryAgain
+	}
+
+	fl := *old
+	fl.Spec.Attrs = *attrs
+	fl.Spec.Expiration = nil
+	if expires {
+		fl.Spec.Expiration = &metav1.Time{Time: time.Now().Add(subnetTTL)}
+	}
+
+	if err := m.registry.updateLease(ctx, &fl); apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		return nil, errTryAgain
+	} else if err != nil {
+		return nil, err
+	}
+
+	l := fl.lease()
+	return &l, nil
+}
+
+func (m *crdSubnetManager) deleteLease(ctx context.Context, sn ip.IP4Net) error {
+	fl := m.getLease(sn)
+	if fl == nil {
+		return subnet.ErrNotFound
+	}
+	if err := m.registry.deleteLease(ctx, fl); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *crdSubnetManager) RenewLease(ctx context.Context, lease *subnet.Lease) error {
+	fl := m.getLease(lease.Subnet)
+	if fl == nil {
+		return fmt.Errorf("lease %v not found", lease.Subnet)
+	}
+	if l := fl.lease(); l.OwnedByOtherNode(&lease.Attrs) {
+		return fmt.Errorf("lease %v is held by node %q", lease.Subnet, l.Attrs.NodeID)
+	}
+
+	l, err := m.updateLease(ctx, lease.Subnet, &lease.Attrs, fl.Spec.Expiration != nil)
+	if err == errTryAgain {
+		return fmt.Errorf("lease %v was changed while renewing it", lease.Subnet)
+	} else if err != nil {
+		return err
+	}
+
+	lease.Expiration = l.Expiration
+	return nil
+}
+
+func (m *crdSubnetManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	m.mux.Lock()
+	reset := cursor == nil || m.overflow
+	m.overflow = false
+	m.mux.Unlock()
+
+	if reset {
+		return subnet.LeaseWatchResult{
+			Snapshot: m.leases(),
+			Cursor:   "events",
+		}, nil
+	}
+
+	select {
+	case event := <-m.events:
+		return subnet.LeaseWatchResult{
+			Events: []subnet.Event{event},
+			Cursor: cursor,
+		}, nil
+	case <-ctx.Done():
+		return subnet.LeaseWatchResult{}, ctx.Err()
+	}
+}
+
+// WatchLease uses the resource version of the lease as cursor, the empty string
+// while there is none.
+func (m *crdSubnetManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	for {
+		m.mux.Lock()
+		changed := m.changed
+		m.mux.Unlock()
+
+		var version string
+		fl := m.getLease(sn)
+		if fl != nil {
+			version = fl.ResourceVersion
+		}
+
+		if cursor == nil || cursor.(string) != version {
+			if fl == nil {
+				return subnet.LeaseWatchResult{
+					Events: []subnet.Event{{Type: subnet.EventRemoved, Lease: subnet.Lease{Subnet: sn}}},
+					Cursor: version,
+				}, nil
+			}
+			return subnet.LeaseWatchResult{
+				Snapshot: []subnet.Lease{fl.lease()},
+				Cursor:   version,
+			}, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return subnet.LeaseWatchResult{}, ctx.Err()
+		}
+	}
+}
+
+// expireLeases deletes expired leases, as etcd would with the TTL.
+func (m *crdSubnetManager) expireLeases(ctx context.Context) {
+	wait.Until(func() {
+		now := time.Now()
+		for _, fl := range m.registry.leases() {
+			if !fl.expired(now) {
+				continue
+			}
+			if err := m.registry.deleteLease(ctx, fl); err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+				glog.Warningf("Failed to delete expired lease %s: %v", fl.Name, err)
+			}
+		}
+	}, expiryCheckPeriod, ctx.Done())
+}
+
+func (m *crdSubnetManager) ListLeases(ctx context.Context) ([]subnet.Lease, error) {
+	return m.leases(), nil
+}
+
+func (m *crdSubnetManager) GetLease(ctx context.Context, sn ip.IP4Net) (*subnet.Lease, error) {
+	fl := m.getLease(sn)
+	if fl == nil {
+		return nil, subnet.ErrNotFound
+	}
+	l := fl.lease()
+	return &l, nil
+}
+
+func (m *crdSubnetManager) ReserveLease(ctx context.Context, sn ip.IP4Net, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	config, err := m.GetNetworkConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fl := m.getLease(sn)
+	if fl == nil {
+		if attrs == nil {
+			return nil, fmt.Errorf("no lease for %v, reserving it needs a public IP", sn)
+		}
+		if !config.IsValidSubnet(attrs.NodeGroup, sn) {
+			return nil, fmt.Errorf("%v is not a subnet of the network config", sn)
+		}
+		for _, o := range m.leases() {
+			if o.Subnet.Overlaps(sn) {
+				return nil, fmt.Errorf("%v overlaps the lease of %v", sn, o.Subnet)
+			}
+		}
+
+		l, err := m.createLease(ctx, sn, attrs, 0)
+		if err == errTryAgain {
+			return nil, fmt.Errorf("%v was leased in the meantime", sn)
+		}
+		return l, err
+	}
+
+	l := fl.lease()
+	if attrs != nil {
+		l.Attrs = *attrs
+	}
+	if !config.IsValidSubnet(l.Attrs.NodeGroup, l.Subnet) {
+		return nil, fmt.Errorf("lease %v doesn't match the network config and would be replaced", l.Subnet)
+	}
+
+	return m.adminUpdateLease(ctx, sn, &l.Attrs, false)
+}
+
+func (m *crdSubnetManager) UnreserveLease(ctx context.Context, sn ip.IP4Net) (*subnet.Lease, error) {
+	fl := m.getLease(sn)
+	if fl == nil {
+		return nil, subnet.ErrNotFound
+	}
+	if fl.Spec.Expiration != nil {
+		return nil, fmt.Errorf("lease %v is not a reservation", sn)
+	}
+
+	return m.adminUpdateLease(ctx, sn, &fl.Spec.Attrs, true)
+}
+
+func (m *crdSubnetManager) adminUpdateLease(ctx context.Context, sn ip.IP4Net, attrs *subnet.LeaseAttrs, expires bool) (*subnet.Lease, error) {
+	l, err := m.updateLease(ctx, sn, attrs, expires)
+	if err == errTryAgain {
+		return nil, fmt.Errorf("lease %v was changed in the meantime", sn)
+	}
+	return l, err
+}
+
+func (m *crdSubnetManager) DeleteLease(ctx context.Context, sn ip.IP4Net) error {
+	return m.deleteLease(ctx, sn)
+}
+
+func (m *crdSubnetManager) ReleaseLease(ctx context.Context, lease *subnet.Lease) error {
+	fl := m.getLease(lease.Subnet)
+	if fl == nil {
+		return nil
+	}
+
+	if l := fl.lease(); !l.HeldByNode(&lease.Attrs) {
+		return fmt.Errorf("lease %v is held by another node", lease.Subnet)
+	}
+	if fl.Spec.Expiration == nil {
+		glog.Infof("Keeping reservation %v", lease.Subnet)
+		return nil
+	}
+
+	glog.Infof("Releasing lease %v", lease.Subnet)
+	if err := m.registry.deleteLease(ctx, fl); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// PreferSubnet implements subnet.SubnetPreferrer. FlannelLeases have no IPv6
+// subnets, so sn6 is ignored.
+func (m *crdSubnetManager) PreferSubnet(sn ip.IP4Net, sn6 ip.IP6Net) {
+	m.previousSubnet = sn
+}
+
+func (m *crdSubnetManager) Name() string {
+	return fmt.Sprintf("FlannelLease subnet manager for network %q", m.network)
+}
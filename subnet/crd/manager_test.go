@@ -0,0 +1,330 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// mockRegistry keeps the leases in memory and reports changes to the handler
+// right away, like an informer that never lags behind.
+type mockRegistry struct {
+	mux     sync.Mutex
+	config  string
+	objects map[string]*FlannelLease
+	version int
+	handler cache.ResourceEventHandler
+}
+
+func newMockManager(config string) (*crdSubnetManager, *mockRegistry) {
+	m := newSubnetManager(DefaultNetwork, ip.IP4Net{}, "", "")
+	r := &mockRegistry{
+		config:  config,
+		objects: make(map[string]*FlannelLease),
+		handler: m,
+	}
+	m.registry = r
+	return m, r
+}
+
+func (r *mockRegistry) getNetwork(ctx context.Context) (*FlannelNetwork, error) {
+	return &FlannelNetwork{Spec: json.RawMessage(r.config)}, nil
+}
+
+func (r *mockRegistry) leases() []*FlannelLease {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var leases []*FlannelLease
+	for _, fl := range r.objects {
+		leases = append(leases, fl)
+	}
+	return leases
+}
+
+func (r *mockRegistry) getLease(name string) *FlannelLease {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.objects[name]
+}
+
+func (r *mockRegistry) store(fl *FlannelLease) *FlannelLease {
+	r.version++
+	stored := *fl
+	stored.ResourceVersion = strconv.Itoa(r.version)
+	r.objects[fl.Name] = &stored
+	return &stored
+}
+
+func (r *mockRegistry) createLease(ctx context.Context, fl *FlannelLease) error {
+	r.mux.Lock()
+	if _, ok := r.objects[fl.Name]; ok {
+		r.mux.Unlock()
+		return apierrors.NewAlreadyExists(SchemeGroupVersion.WithResource(leaseResource).GroupResource(), fl.Name)
+	}
+	fl.UID = types.UID(fmt.Sprintf("uid-%d", r.version))
+	stored := r.store(fl)
+	r.mux.Unlock()
+
+	r.handler.OnAdd(stored)
+	return nil
+}
+
+func (r *mockRegistry) updateLease(ctx context.Context, fl *FlannelLease) error {
+	r.mux.Lock()
+	old, ok := r.objects[fl.Name]
+	if !ok {
+		r.mux.Unlock()
+		return apierrors.NewNotFound(SchemeGroupVersion.WithResource(leaseResource).GroupResource(), fl.Name)
+	}
+	if old.ResourceVersion != fl.ResourceVersion {
+		r.mux.Unlock()
+		return apierrors.NewConflict(SchemeGroupVersion.WithResource(leaseResource).GroupResource(), fl.Name, fmt.Errorf("stale"))
+	}
+	stored := r.store(fl)
+	r.mux.Unlock()
+
+	r.handler.OnUpdate(old, stored)
+	return nil
+}
+
+func (r *mockRegistry) deleteLease(ctx context.Context, fl *FlannelLease) error {
+	r.mux.Lock()
+	old, ok := r.objects[fl.Name]
+	if !ok || old.UID != fl.UID {
+		r.mux.Unlock()
+		return apierrors.NewNotFound(SchemeGroupVersion.WithResource(leaseResource).GroupResource(), fl.Name)
+	}
+	delete(r.objects, fl.Name)
+	r.mux.Unlock()
+
+	r.handler.OnDelete(old)
+	return nil
+}
+
+const testConfig = `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.5.0", "SubnetAllocation": "lowest" }`
+
+func TestAcquireLease(t *testing.T) {
+	m, r := newMockManager(testConfig)
+	ctx := context.Background()
+
+	attrs := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), NodeID: "node-a"}
+	l, err := m.AcquireLease(ctx, &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet.String() != "10.3.1.0/24" || l.Expiration.IsZero() {
+		t.Fatalf("Unexpected lease: %+v", l)
+	}
+
+	fl := r.getLease("default-10.3.1.0-24")
+	if fl == nil || fl.Labels[networkLabel] != DefaultNetwork || fl.Spec.Attrs.NodeID != "node-a" {
+		t.Fatalf("Unexpected FlannelLease: %+v", fl)
+	}
+
+	// The same node gets its lease back, even with a new public IP
+	attrs2 := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5"), NodeID: "node-a"}
+	l2, err := m.AcquireLease(ctx, &attrs2)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l2.Subnet.Equal(l.Subnet) || l2.Attrs.PublicIP != attrs2.PublicIP {
+		t.Fatalf("Expected the lease of %v to be reused, got %+v", l.Subnet, l2)
+	}
+
+	// An expired lease is free to be taken over
+	expired := metav1.NewTime(time.Now().Add(-time.Minute))
+	fl = r.getLease("default-10.3.1.0-24")
+	fl.Spec.Expiration = &expired
+	if _, err := m.GetLease(ctx, l.Subnet); err != subnet.ErrNotFound {
+		t.Fatal("Expected the expired lease to be gone, got ", err)
+	}
+
+	attrs3 := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.6"), NodeID: "node-b"}
+	l3, err := m.AcquireLease(ctx, &attrs3)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l3.Subnet.Equal(l.Subnet) || l3.Attrs.NodeID != "node-b" {
+		t.Fatalf("Expected the expired lease to be taken over, got %+v", l3)
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	m, r := newMockManager(testConfig)
+	ctx := context.Background()
+
+	attrs := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), NodeID: "node-a"}
+	l, err := m.AcquireLease(ctx, &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	exp := time.Now().Add(time.Hour)
+	r.getLease(leaseName(DefaultNetwork, l.Subnet)).Spec.Expiration = &metav1.Time{Time: exp}
+	if err := m.RenewLease(ctx, l); err != nil {
+		t.Fatal("RenewLease failed: ", err)
+	}
+	if !l.Expiration.After(exp) {
+		t.Fatalf("Expected the lease to be renewed past %v, got %v", exp, l.Expiration)
+	}
+
+	// Leases taken over by another node can't be renewed
+	other := *l
+	other.Attrs.NodeID = "node-b"
+	if err := m.RenewLease(ctx, &other); err == nil {
+		t.Fatal("RenewLease succeeded for a lease of another node")
+	}
+}
+
+func TestWatchLease(t *testing.T) {
+	m, r := newMockManager(testConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	attrs := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), NodeID: "node-a"}
+	l, err := m.AcquireLease(ctx, &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	wr, err := m.WatchLease(ctx, l.Subnet, nil)
+	if err != nil {
+		t.Fatal("WatchLease failed: ", err)
+	}
+	if len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Fatalf("Expected a snapshot of the lease, got %+v", wr)
+	}
+
+	result := make(chan subnet.LeaseWatchResult)
+	go func(cursor interface{}) {
+		wr, err := m.WatchLease(ctx, l.Subnet, cursor)
+		if err != nil {
+			t.Error("WatchLease failed: ", err)
+		}
+		result <- wr
+	}(wr.Cursor)
+
+	if err := m.RenewLease(ctx, l); err != nil {
+		t.Fatal("RenewLease failed: ", err)
+	}
+	wr = <-result
+	if len(wr.Snapshot) != 1 || !wr.Snapshot[0].Expiration.Equal(l.Expiration) {
+		t.Fatalf("Expected the renewed lease, got %+v", wr)
+	}
+
+	if err := r.deleteLease(ctx, r.getLease(leaseName(DefaultNetwork, l.Subnet))); err != nil {
+		t.Fatal("deleteLease failed: ", err)
+	}
+	wr, err = m.WatchLease(ctx, l.Subnet, wr.Cursor)
+	if err != nil {
+		t.Fatal("WatchLease failed: ", err)
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Type != subnet.EventRemoved {
+		t.Fatalf("Expected the lease to be removed, got %+v", wr)
+	}
+}
+
+func TestWatchLeases(t *testing.T) {
+	m, _ := newMockManager(testConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	attrs := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), NodeID: "node-a"}
+	l, err := m.AcquireLease(ctx, &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, m, l, events)
+
+	attrs2 := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5"), NodeID: "node-b"}
+	l2, err := m.AcquireLease(ctx, &attrs2)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if err := m.DeleteLease(ctx, l2.Subnet); err != nil {
+		t.Fatal("DeleteLease failed: ", err)
+	}
+
+	var seen []subnet.EventType
+	for len(seen) < 2 {
+		select {
+		case batch := <-events:
+			for _, e := range batch {
+				if !e.Lease.Subnet.Equal(l2.Subnet) {
+					t.Fatalf("Unexpected event: %+v", e)
+				}
+				seen = append(seen, e.Type)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for events, got %v", seen)
+		}
+	}
+	if seen[0] != subnet.EventAdded || seen[len(seen)-1] != subnet.EventRemoved {
+		t.Fatalf("Expected the lease to be added and removed, got %v", seen)
+	}
+}
+
+func TestReserveLease(t *testing.T) {
+	m, _ := newMockManager(testConfig)
+	ctx := context.Background()
+
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.3.3.0"), PrefixLen: 24}
+	attrs := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), NodeID: "node-a"}
+	if _, err := m.ReserveLease(ctx, sn, &attrs); err != nil {
+		t.Fatal("ReserveLease failed: ", err)
+	}
+
+	// The node gets its reservation, which stays one
+	l, err := m.AcquireLease(ctx, &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), NodeID: "node-a"})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Equal(sn) || !l.Expiration.IsZero() {
+		t.Fatalf("Expected the reservation of %v, got %+v", sn, l)
+	}
+
+	l, err = m.UnreserveLease(ctx, sn)
+	if err != nil {
+		t.Fatal("UnreserveLease failed: ", err)
+	}
+	if l.Expiration.IsZero() {
+		t.Fatal("Expected the lease to expire once unreserved")
+	}
+	if _, err := m.UnreserveLease(ctx, sn); err == nil {
+		t.Fatal("UnreserveLease succeeded for a lease that isn't reserved")
+	}
+
+	outside := ip.IP4Net{IP: ip.MustParseIP4("10.4.0.0"), PrefixLen: 24}
+	if _, err := m.ReserveLease(ctx, outside, &attrs); err == nil {
+		t.Fatal("ReserveLease succeeded for a subnet outside the network")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	networkResource = "flannelnetworks"
+	leaseResource   = "flannelleases"
+
+	resyncPeriod = 5 * time.Minute
+)
+
+// registry stores the config and leases of a network.
+type registry interface {
+	getNetwork(ctx context.Context) (*FlannelNetwork, error)
+	// leases returns the cached leases of the network. They must not be
+	// modified.
+	leases() []*FlannelLease
+	getLease(name string) *FlannelLease
+	createLease(ctx context.Context, fl *FlannelLease) error
+	// updateLease fails with a conflict unless fl is based on the latest
+	// version of the lease.
+	updateLease(ctx context.Context, fl *FlannelLease) error
+	deleteLease(ctx context.Context, fl *FlannelLease) error
+}
+
+type kubeRegistry struct {
+	client     rest.Interface
+	network    string
+	store      cache.Store
+	controller cache.Controller
+}
+
+// newKubeRegistry returns a registry keeping the leases of the network in sync
+// with the API. The handler gets called for every change.
+func newKubeRegistry(client rest.Interface, network string, handler cache.ResourceEventHandler) *kubeRegistry {
+	selector := labels.SelectorFromSet(labels.Set{networkLabel: network}).String()
+
+	r := &kubeRegistry{
+		client:  client,
+		network: network,
+	}
+	r.store, r.controller = cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = selector
+				result := &FlannelLeaseList{}
+				err := client.Get().Resource(leaseResource).VersionedParams(&options, metav1.ParameterCodec).Do().Into(result)
+				return result, err
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.Watch = true
+				options.LabelSelector = selector
+				return client.Get().Resource(leaseResource).VersionedParams(&options, metav1.ParameterCodec).Watch()
+			},
+		},
+		&FlannelLease{},
+		resyncPeriod,
+		handler,
+	)
+	return r
+}
+
+func (r *kubeRegistry) run(ctx context.Context) {
+	r.controller.Run(ctx.Done())
+}
+
+func (r *kubeRegistry) getNetwork(ctx context.Context) (*FlannelNetwork, error) {
+	result := &FlannelNetwork{}
+	err := r.client.Get().Context(ctx).Resource(networkResource).Name(r.network).Do().Into(result)
+	return result, err
+}
+
+func (r *kubeRegistry) leases() []*FlannelLease {
+	var leases []*FlannelLease
+	for _, obj := range r.store.List() {
+		leases = append(leases, obj.(*FlannelLease))
+	}
+	return leases
+}
+
+func (r *kubeRegistry) getLease(name string) *FlannelLease {
+	obj, ok, err := r.store.GetByKey(name)
+	if err != nil || !ok {
+		return nil
+	}
+	return obj.(*FlannelLease)
+}
+
+func (r *kubeRegistry) createLease(ctx context.Context, fl *FlannelLease) error {
+	return r.client.Post().Context(ctx).Resource(leaseResource).Body(fl).Do().Error()
+}
+
+func (r *kubeRegistry) updateLease(ctx context.Context, fl *FlannelLease) error {
+	return r.client.Put().Context(ctx).Resource(leaseResource).Name(fl.Name).Body(fl).Do().Error()
+}
+
+func (r *kubeRegistry) deleteLease(ctx context.Context, fl *FlannelLease) error {
+	// Make sure a lease created again in the meantime is left alone
+	options := &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &fl.UID},
+	}
+	return r.client.Delete().Context(ctx).Resource(leaseResource).Name(fl.Name).Body(options).Do().Error()
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	GroupName = "flannel.coreos.com"
+
+	// networkLabel holds the name of the network a FlannelLease belongs to, so
+	// that the leases of one network can be listed and watched.
+	networkLabel = GroupName + "/network"
+)
+
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1"}
+
+// FlannelNetwork holds the config of a network. Its name is the name of the
+// network, "default" for the one used without --networks.
+type FlannelNetwork struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec is the network config, in the format of net-conf.json.
+	Spec json.RawMessage `json:"spec"`
+}
+
+type FlannelNetworkList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []FlannelNetwork `json:"items"`
+}
+
+// FlannelLease is the lease of a subnet of a network, named after both.
+type FlannelLease struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec FlannelLeaseSpec `json:"spec"`
+}
+
+type FlannelLeaseSpec struct {
+	Network string            `json:"network"`
+	Subnet  ip.IP4Net         `json:"subnet"`
+	Attrs   subnet.LeaseAttrs `json:"attrs"`
+	// Expiration is unset for reservations.
+	Expiration *metav1.Time `json:"expiration,omitempty"`
+}
+
+type FlannelLeaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []FlannelLease `json:"items"`
+}
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(SchemeGroupVersion,
+		&FlannelNetwork{},
+		&FlannelNetworkList{},
+		&FlannelLease{},
+		&FlannelLeaseList{},
+	)
+	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
+	return nil
+}
+
+// newRESTClient returns a client for the flannel resources.
+func newRESTClient(cfg *rest.Config) (*rest.RESTClient, error) {
+	scheme := runtime.NewScheme()
+	if err := addKnownTypes(scheme); err != nil {
+		return nil, err
+	}
+
+	config := *cfg
+	config.GroupVersion = &SchemeGroupVersion
+	config.APIPath = "/apis"
+	config.ContentType = runtime.ContentTypeJSON
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: serializer.NewCodecFactory(scheme)}
+
+	return rest.RESTClientFor(&config)
+}
+
+func leaseName(network string, sn ip.IP4Net) string {
+	return network + "-" + subnet.MakeSubnetKey(sn)
+}
+
+func newFlannelLease(network string, sn ip.IP4Net, attrs *subnet.LeaseAttrs) *FlannelLease {
+	return &FlannelLease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   leaseName(network, sn),
+			Labels: map[string]string{networkLabel: network},
+		},
+		Spec: FlannelLeaseSpec{
+			Network: network,
+			Subnet:  sn,
+			Attrs:   *attrs,
+		},
+	}
+}
+
+func (fl *FlannelLease) expired(now time.Time) bool {
+	return fl.Spec.Expiration != nil && !now.Before(fl.Spec.Expiration.Time)
+}
+
+func (fl *FlannelLease) lease() subnet.Lease {
+	l := subnet.Lease{
+		Subnet: fl.Spec.Subnet,
+		Attrs:  fl.Spec.Attrs,
+	}
+	if fl.Spec.Expiration != nil {
+		l.Expiration = fl.Spec.Expiration.Time
+	}
+	return l
+}
@@ -33,8 +33,11 @@ const (
 )
 
 type LocalManager struct {
-	registry       Registry
-	previousSubnet ip.IP4Net
+	registry           Registry
+	previousSubnet     ip.IP4Net
+	previousIPv6Subnet ip.IP6Net
+	nodeID             string
+	nodeGroup          string
 }
 
 type watchCursor struct {
@@ -54,7 +57,7 @@ func isErrEtcdNodeExist(e error) bool {
 		return false
 	}
 	etcdErr, ok := e.(etcd.Error)
-	return ok || etcdErr.Code == etcd.ErrorCodeNodeExist
+	return ok && etcdErr.Code == etcd.ErrorCodeNodeExist
 }
 
 func isErrEtcdKeyNotFound(e error) bool {
@@ -62,25 +65,28 @@ func isErrEtcdKeyNotFound(e error) bool {
 		return false
 	}
 	etcdErr, ok := e.(etcd.Error)
-	return ok || etcdErr.Code == etcd.ErrorCodeKeyNotFound
+	return ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound
 }
 
 func (c watchCursor) String() string {
 	return strconv.FormatUint(c.index, 10)
 }
 
-func NewLocalManager(config *EtcdConfig, prevSubnet ip.IP4Net) (Manager, error) {
+func NewLocalManager(config *EtcdConfig, prevSubnet ip.IP4Net, prevIPv6Subnet ip.IP6Net, nodeID, nodeGroup string) (Manager, error) {
 	r, err := newEtcdSubnetRegistry(config, nil)
 	if err != nil {
 		return nil, err
 	}
-	return newLocalManager(r, prevSubnet), nil
+	return newLocalManager(r, prevSubnet, prevIPv6Subnet, nodeID, nodeGroup), nil
 }
 
-func newLocalManager(r Registry, prevSubnet ip.IP4Net) Manager {
+func newLocalManager(r Registry, prevSubnet ip.IP4Net, prevIPv6Subnet ip.IP6Net, nodeID, nodeGroup string) Manager {
 	return &LocalManager{
-		registry:       r,
-		previousSubnet: prevSubnet,
+		registry:           r,
+		previousSubnet:     prevSubnet,
+		previousIPv6Subnet: prevIPv6Subnet,
+		nodeID:             nodeID,
+		nodeGroup:          nodeGroup,
 	}
 }
 
@@ -99,12 +105,24 @@ func (m *LocalManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Le
 		return nil, err
 	}
 
+	if attrs.NodeID == "" {
+		attrs.NodeID = m.nodeID
+	}
+	if attrs.NodeGroup == "" {
+		attrs.NodeGroup = m.nodeGroup
+	}
+	if _, err := config.SubnetAllocators(attrs.NodeGroup); err != nil {
+		return nil, err
+	}
+
 	for i := 0; i < raceRetries; i++ {
+		AllocationAttempts.Inc()
 		l, err := m.tryAcquireLease(ctx, config, attrs.PublicIP, attrs)
 		switch err {
 		case nil:
 			return l, nil
 		case errTryAgain:
+			AllocationConflicts.Inc()
 			continue
 		default:
 			return nil, err
@@ -114,9 +132,9 @@ func (m *LocalManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Le
 	return nil, errors.New("Max retries reached trying to acquire a subnet")
 }
 
-func findLeaseByIP(leases []Lease, pubIP ip.IP4) *Lease {
+func findLeaseBySubnet(leases []Lease, subnet ip.IP4Net) *Lease {
 	for _, l := range leases {
-		if pubIP == l.Attrs.PublicIP {
+		if subnet.Equal(l.Subnet) {
 			return &l
 		}
 	}
@@ -124,9 +142,9 @@ func findLeaseByIP(leases []Lease, pubIP ip.IP4) *Lease {
 	return nil
 }
 
-func findLeaseBySubnet(leases []Lease, subnet ip.IP4Net) *Lease {
+func findLeaseByIPv6Subnet(leases []Lease, subnet ip.IP6Net) *Lease {
 	for _, l := range leases {
-		if subnet.Equal(l.Subnet) {
+		if subnet.Equal(l.IPv6Subnet) {
 			return &l
 		}
 	}
@@ -140,28 +158,42 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 		return nil, err
 	}
 
-	// Try to reuse a subnet if there's one that matches our IP
-	if l := findLeaseByIP(leases, extIaddr); l != nil {
+	// Try to reuse a subnet if there's one that matches our node ID or IP
+	l, conflicts := FindLeaseForNode(leases, attrs)
+	for _, c := range conflicts {
+		log.Warningf("Node %q holds lease (%v) with the same public IP (%v) as this node (%q), each node needs its own public IP", c.Attrs.NodeID, c.Subnet, extIaddr, attrs.NodeID)
+	}
+	if l != nil {
 		// Make sure the existing subnet is still within the configured network
-		if isSubnetConfigCompat(config, l.Subnet) {
-			log.Infof("Found lease (%v) for current IP (%v), reusing", l.Subnet, extIaddr)
+		if isSubnetConfigCompat(config, attrs, l.Subnet) {
+			log.Infof("Found lease (%v) for current node (%v), reusing", l.Subnet, extIaddr)
 
 			ttl := time.Duration(0)
 			if !l.Expiration.IsZero() {
 				// Not a reservation
 				ttl = subnetTTL
 			}
-			exp, err := m.registry.updateSubnet(ctx, l.Subnet, attrs, ttl, 0)
+			sn6, err := m.ipv6SubnetFor(config, leases, attrs, l.IPv6Subnet)
 			if err != nil {
 				return nil, err
 			}
+			exp, asof, err := m.registry.updateSubnet(ctx, l.Subnet, sn6, l.IPv6Subnet, attrs, ttl, l.Asof)
+			if isErrEtcdTestFailed(err) || isErrEtcdNodeExist(err) {
+				return nil, errTryAgain
+			} else if err != nil {
+				return nil, err
+			}
 
+			l.IPv6Subnet = sn6
 			l.Attrs = *attrs
 			l.Expiration = exp
+			l.Asof = asof
 			return l, nil
 		} else {
-			log.Infof("Found lease (%v) for current IP (%v) but not compatible with current config, deleting", l.Subnet, extIaddr)
-			if err := m.registry.deleteSubnet(ctx, l.Subnet); err != nil {
+			log.Infof("Found lease (%v) for current node (%v) but not compatible with current config, deleting", l.Subnet, extIaddr)
+			if err := m.registry.deleteSubnet(ctx, l.Subnet, l.IPv6Subnet, l.Asof); isErrEtcdTestFailed(err) {
+				return nil, errTryAgain
+			} else if err != nil {
 				return nil, err
 			}
 		}
@@ -173,7 +205,9 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 		// use previous subnet
 		if l := findLeaseBySubnet(leases, m.previousSubnet); l != nil {
 			// Make sure the existing subnet is still within the configured network
-			if isSubnetConfigCompat(config, l.Subnet) {
+			if l.OwnedByOtherNode(attrs) {
+				log.Infof("Previously leased subnet (%v) is now leased by node %q, ignoring", l.Subnet, l.Attrs.NodeID)
+			} else if isSubnetConfigCompat(config, attrs, l.Subnet) {
 				log.Infof("Found lease (%v) matching previously leased subnet, reusing", l.Subnet)
 
 				ttl := time.Duration(0)
@@ -181,23 +215,33 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 					// Not a reservation
 					ttl = subnetTTL
 				}
-				exp, err := m.registry.updateSubnet(ctx, l.Subnet, attrs, ttl, 0)
+				sn6, err := m.ipv6SubnetFor(config, leases, attrs, l.IPv6Subnet)
 				if err != nil {
 					return nil, err
 				}
+				exp, asof, err := m.registry.updateSubnet(ctx, l.Subnet, sn6, l.IPv6Subnet, attrs, ttl, l.Asof)
+				if isErrEtcdTestFailed(err) || isErrEtcdNodeExist(err) {
+					return nil, errTryAgain
+				} else if err != nil {
+					return nil, err
+				}
 
+				l.IPv6Subnet = sn6
 				l.Attrs = *attrs
 				l.Expiration = exp
+				l.Asof = asof
 				return l, nil
 			} else {
 				log.Infof("Found lease (%v) matching previously leased subnet but not compatible with current config, deleting", l.Subnet)
-				if err := m.registry.deleteSubnet(ctx, l.Subnet); err != nil {
+				if err := m.registry.deleteSubnet(ctx, l.Subnet, l.IPv6Subnet, l.Asof); isErrEtcdTestFailed(err) {
+					return nil, errTryAgain
+				} else if err != nil {
 					return nil, err
 				}
 			}
 		} else {
 			// Check if the previous subnet is a part of the network and of the right subnet length
-			if isSubnetConfigCompat(config, m.previousSubnet) {
+			if isSubnetConfigCompat(config, attrs, m.previousSubnet) {
 				log.Infof("Found previously leased subnet (%v), reusing", m.previousSubnet)
 				sn = m.previousSubnet
 			} else {
@@ -208,20 +252,27 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 
 	if sn.Empty() {
 		// no existing match, grab a new one
-		sn, err = m.allocateSubnet(config, leases)
+		sn, err = m.allocateSubnet(config, leases, attrs)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	exp, err := m.registry.createSubnet(ctx, sn, attrs, subnetTTL)
+	sn6, err := m.ipv6SubnetFor(config, leases, attrs, ip.IP6Net{})
+	if err != nil {
+		return nil, err
+	}
+
+	exp, asof, err := m.registry.createSubnet(ctx, sn, sn6, attrs, subnetTTL)
 	switch {
 	case err == nil:
 		log.Infof("Allocated lease (%v) to current node (%v) ", sn, extIaddr)
 		return &Lease{
 			Subnet:     sn,
+			IPv6Subnet: sn6,
 			Attrs:      *attrs,
 			Expiration: exp,
+			Asof:       asof,
 		}, nil
 	case isErrEtcdNodeExist(err):
 		return nil, errTryAgain
@@ -230,37 +281,215 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 	}
 }
 
-func (m *LocalManager) allocateSubnet(config *Config, leases []Lease) (ip.IP4Net, error) {
-	log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
+func (m *LocalManager) allocateSubnet(config *Config, leases []Lease, attrs *LeaseAttrs) (ip.IP4Net, error) {
+	if attrs.NodeGroup != "" {
+		log.Infof("Picking subnet for node group %q", attrs.NodeGroup)
+	} else {
+		log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
+	}
+
+	used := make([]ip.IP4Net, 0, len(leases))
+	for _, l := range leases {
+		used = append(used, l.Subnet)
+	}
+	return config.AllocateSubnet(attrs.NodeGroup, allocationKey(attrs), used)
+}
+
+// allocationKey identifies the node for the hash allocation strategy. Nodes
+// without an ID hash their public IP instead.
+func allocationKey(attrs *LeaseAttrs) string {
+	if attrs.NodeID != "" {
+		return attrs.NodeID
+	}
+	return attrs.PublicIP.String()
+}
+
+// ipv6SubnetFor picks the IPv6 subnet to go with a lease: the current one if it
+// still fits the config, else the previous one if it's free, else a new one.
+func (m *LocalManager) ipv6SubnetFor(config *Config, leases []Lease, attrs *LeaseAttrs, current ip.IP6Net) (ip.IP6Net, error) {
+	if !config.IPv6Enabled() {
+		return ip.IP6Net{}, nil
+	}
+
+	if isIPv6SubnetConfigCompat(config, current) {
+		return current, nil
+	}
+
+	if isIPv6SubnetConfigCompat(config, m.previousIPv6Subnet) && findLeaseByIPv6Subnet(leases, m.previousIPv6Subnet) == nil {
+		log.Infof("Found previously leased IPv6 subnet (%v), reusing", m.previousIPv6Subnet)
+		return m.previousIPv6Subnet, nil
+	}
+
+	return m.allocateIPv6Subnet(config, leases, attrs)
+}
+
+func (m *LocalManager) allocateIPv6Subnet(config *Config, leases []Lease, attrs *LeaseAttrs) (ip.IP6Net, error) {
+	log.Infof("Picking IPv6 subnet in range %s ... %s", config.IPv6SubnetMin, config.IPv6SubnetMax)
+
+	used := make([]ip.IP6Net, 0, len(leases))
+	for _, l := range leases {
+		used = append(used, l.IPv6Subnet)
+	}
+	return config.AllocateIPv6Subnet(allocationKey(attrs), used)
+}
+
+// RenewLease only renews the lease as the node last saw it, going by
+// lease.Asof, so that changes made by someone else in the meantime aren't
+// overwritten. It returns ErrLeaseConflict if there were any.
+func (m *LocalManager) RenewLease(ctx context.Context, lease *Lease) error {
+	exp, asof, err := m.registry.updateSubnet(ctx, lease.Subnet, lease.IPv6Subnet, lease.IPv6Subnet, &lease.Attrs, subnetTTL, lease.Asof)
+	if isErrEtcdTestFailed(err) {
+		return ErrLeaseConflict
+	} else if isErrEtcdKeyNotFound(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
 
-	var bag []ip.IP4
-	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}
+	lease.Expiration = exp
+	lease.Asof = asof
+	return nil
+}
+
+func (m *LocalManager) ListLeases(ctx context.Context) ([]Lease, error) {
+	leases, _, err := m.registry.getSubnets(ctx)
+	return leases, err
+}
+
+func (m *LocalManager) GetLease(ctx context.Context, sn ip.IP4Net) (*Lease, error) {
+	leases, _, err := m.registry.getSubnets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if l := findLeaseBySubnet(leases, sn); l != nil {
+		return l, nil
+	}
+	return nil, ErrNotFound
+}
 
-OuterLoop:
-	for ; sn.IP <= config.SubnetMax && len(bag) < 100; sn = sn.Next() {
-		for _, l := range leases {
-			if sn.Overlaps(l.Subnet) {
-				continue OuterLoop
+func (m *LocalManager) ReserveLease(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs) (*Lease, error) {
+	config, err := m.GetNetworkConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	leases, _, err := m.registry.getSubnets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l := findLeaseBySubnet(leases, sn)
+	if l == nil {
+		if attrs == nil {
+			return nil, fmt.Errorf("no lease for %v, reserving it needs a public IP", sn)
+		}
+		if !isSubnetConfigCompat(config, attrs, sn) {
+			return nil, fmt.Errorf("%v is not a subnet of the network config", sn)
+		}
+		for _, o := range leases {
+			if o.Subnet.Overlaps(sn) {
+				return nil, fmt.Errorf("%v overlaps the lease of %v", sn, o.Subnet)
 			}
 		}
-		bag = append(bag, sn.IP)
+
+		var sn6 ip.IP6Net
+		if config.IPv6Enabled() {
+			if sn6, err = m.allocateIPv6Subnet(config, leases, attrs); err != nil {
+				return nil, err
+			}
+		}
+
+		_, asof, err := m.registry.createSubnet(ctx, sn, sn6, attrs, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &Lease{Subnet: sn, IPv6Subnet: sn6, Attrs: *attrs, Asof: asof}, nil
 	}
 
-	if len(bag) == 0 {
-		return ip.IP4Net{}, errors.New("out of subnets")
-	} else {
-		i := randInt(0, len(bag))
-		return ip.IP4Net{IP: bag[i], PrefixLen: config.SubnetLen}, nil
+	if attrs != nil {
+		l.Attrs = *attrs
+	}
+	if !isSubnetConfigCompat(config, &l.Attrs, l.Subnet) {
+		return nil, fmt.Errorf("lease %v doesn't match the network config and would be replaced", l.Subnet)
 	}
+
+	if err := m.updateLease(ctx, l, 0); err != nil {
+		return nil, err
+	}
+	return l, nil
 }
 
-func (m *LocalManager) RenewLease(ctx context.Context, lease *Lease) error {
-	exp, err := m.registry.updateSubnet(ctx, lease.Subnet, &lease.Attrs, subnetTTL, 0)
+func (m *LocalManager) UnreserveLease(ctx context.Context, sn ip.IP4Net) (*Lease, error) {
+	l, err := m.GetLease(ctx, sn)
+	if err != nil {
+		return nil, err
+	}
+	if !l.Expiration.IsZero() {
+		return nil, fmt.Errorf("lease %v is not a reservation", sn)
+	}
+
+	if err := m.updateLease(ctx, l, subnetTTL); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// updateLease rewrites l with the given TTL, a zero one making it a reservation,
+// unless it changed since it was read.
+func (m *LocalManager) updateLease(ctx context.Context, l *Lease, ttl time.Duration) error {
+	exp, asof, err := m.registry.updateSubnet(ctx, l.Subnet, l.IPv6Subnet, l.IPv6Subnet, &l.Attrs, ttl, l.Asof)
+	if isErrEtcdTestFailed(err) {
+		return fmt.Errorf("lease %v was changed in the meantime, try again", l.Subnet)
+	} else if err != nil {
+		return err
+	}
+	l.Expiration = exp
+	l.Asof = asof
+	return nil
+}
+
+func (m *LocalManager) DeleteLease(ctx context.Context, sn ip.IP4Net) error {
+	l, err := m.GetLease(ctx, sn)
 	if err != nil {
 		return err
 	}
+	// Don't delete it if it was renewed or changed since it was looked up
+	return m.deleteLease(ctx, l)
+}
 
-	lease.Expiration = exp
+// deleteLease deletes l unless it changed since it was read.
+func (m *LocalManager) deleteLease(ctx context.Context, l *Lease) error {
+	err := m.registry.deleteSubnet(ctx, l.Subnet, l.IPv6Subnet, l.Asof)
+	if isErrEtcdTestFailed(err) {
+		return ErrLeaseConflict
+	} else if isErrEtcdKeyNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (m *LocalManager) ReleaseLease(ctx context.Context, lease *Lease) error {
+	l, err := m.GetLease(ctx, lease.Subnet)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !l.HeldByNode(&lease.Attrs) {
+		return fmt.Errorf("lease %v is held by another node", lease.Subnet)
+	}
+	if l.Expiration.IsZero() {
+		log.Infof("Keeping reservation %v", lease.Subnet)
+		return nil
+	}
+
+	log.Infof("Releasing lease %v", lease.Subnet)
+	// Don't release it if it was taken over since it was looked up
+	if err := m.deleteLease(ctx, l); err != ErrNotFound {
+		return err
+	}
 	return nil
 }
 
@@ -369,12 +598,22 @@ func (m *LocalManager) leasesWatchReset(ctx context.Context) (LeaseWatchResult,
 	return wr, nil
 }
 
-func isSubnetConfigCompat(config *Config, sn ip.IP4Net) bool {
-	if sn.IP < config.SubnetMin || sn.IP > config.SubnetMax {
+func isSubnetConfigCompat(config *Config, attrs *LeaseAttrs, sn ip.IP4Net) bool {
+	return config.IsValidSubnet(attrs.NodeGroup, sn)
+}
+
+func isIPv6SubnetConfigCompat(config *Config, sn ip.IP6Net) bool {
+	if sn.Empty() || sn.IP.Cmp(config.IPv6SubnetMin) < 0 || sn.IP.Cmp(config.IPv6SubnetMax) > 0 {
 		return false
 	}
 
-	return sn.PrefixLen == config.SubnetLen
+	return sn.PrefixLen == config.IPv6SubnetLen
+}
+
+// PreferSubnet implements subnet.SubnetPreferrer.
+func (m *LocalManager) PreferSubnet(sn ip.IP4Net, sn6 ip.IP6Net) {
+	m.previousSubnet = sn
+	m.previousIPv6Subnet = sn6
 }
 
 func (m *LocalManager) Name() string {
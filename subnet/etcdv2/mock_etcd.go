@@ -225,7 +225,7 @@ func (me *mockEtcd) set(ctx context.Context, key, value string, opts *etcd.SetOp
 	if err != nil {
 		return nil, err
 	}
-	if opts.PrevExist == etcd.PrevExist && node == nil {
+	if (opts.PrevExist == etcd.PrevExist || opts.PrevIndex > 0) && node == nil {
 		return nil, me.newError(etcd.ErrorCodeKeyNotFound, "Key %s not found", key)
 	} else if opts.PrevExist == etcd.PrevNoExist && node != nil {
 		return nil, me.newError(etcd.ErrorCodeNodeExist, "Key %s already exists", key)
@@ -238,8 +238,8 @@ func (me *mockEtcd) set(ctx context.Context, key, value string, opts *etcd.SetOp
 	var resp *etcd.Response
 
 	if node != nil {
-		if opts.PrevIndex > 0 && opts.PrevIndex < node.ModifiedIndex {
-			return nil, me.newError(etcd.ErrorCodeTestFailed, "Key %s PrevIndex %s less than node ModifiedIndex %d", key, opts.PrevIndex, node.ModifiedIndex)
+		if opts.PrevIndex > 0 && opts.PrevIndex != node.ModifiedIndex {
+			return nil, me.newError(etcd.ErrorCodeTestFailed, "Key %s PrevIndex %d doesn't match node ModifiedIndex %d", key, opts.PrevIndex, node.ModifiedIndex)
 		}
 
 		if opts.Dir != node.Dir {
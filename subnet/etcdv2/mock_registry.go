@@ -116,17 +116,20 @@ func (msr *MockSubnetRegistry) getSubnet(ctx context.Context, sn ip.IP4Net) (*Le
 	return nil, msr.index, fmt.Errorf("subnet %s not found", sn)
 }
 
-func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
+func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, uint64, error) {
 	msr.mux.Lock()
 	defer msr.mux.Unlock()
 
 	// check for existing
 	if _, _, err := msr.network.findSubnet(sn); err == nil {
-		return time.Time{}, etcd.Error{
+		return time.Time{}, 0, etcd.Error{
 			Code:  etcd.ErrorCodeNodeExist,
 			Index: msr.index,
 		}
 	}
+	if err := msr.network.checkIPv6Subnet(sn, sn6, msr.index); err != nil {
+		return time.Time{}, 0, err
+	}
 
 	msr.index += 1
 
@@ -137,6 +140,7 @@ func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, a
 
 	l := Lease{
 		Subnet:     sn,
+		IPv6Subnet: sn6,
 		Attrs:      *attrs,
 		Expiration: exp,
 		Asof:       msr.index,
@@ -150,13 +154,27 @@ func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, a
 
 	msr.network.sendSubnetEvent(sn, event{evt, msr.index})
 
-	return exp, nil
+	return exp, msr.index, nil
 }
 
-func (msr *MockSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
+func (msr *MockSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, sn6, prev6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, uint64, error) {
 	msr.mux.Lock()
 	defer msr.mux.Unlock()
 
+	sub, i, err := msr.network.findSubnet(sn)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if asof != 0 && sub.Asof != asof {
+		return time.Time{}, 0, etcd.Error{
+			Code:  etcd.ErrorCodeTestFailed,
+			Index: msr.index,
+		}
+	}
+	if err := msr.network.checkIPv6Subnet(sn, sn6, msr.index); err != nil {
+		return time.Time{}, 0, err
+	}
+
 	msr.index += 1
 
 	exp := time.Time{}
@@ -164,11 +182,7 @@ func (msr *MockSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, a
 		exp = clock.Now().Add(ttl)
 	}
 
-	sub, i, err := msr.network.findSubnet(sn)
-	if err != nil {
-		return time.Time{}, err
-	}
-
+	sub.IPv6Subnet = sn6
 	sub.Attrs = *attrs
 	sub.Asof = msr.index
 	sub.Expiration = exp
@@ -180,19 +194,25 @@ func (msr *MockSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, a
 		}, msr.index,
 	})
 
-	return sub.Expiration, nil
+	return sub.Expiration, msr.index, nil
 }
 
-func (msr *MockSubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net) error {
+func (msr *MockSubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, asof uint64) error {
 	msr.mux.Lock()
 	defer msr.mux.Unlock()
 
-	msr.index += 1
-
 	sub, i, err := msr.network.findSubnet(sn)
 	if err != nil {
 		return err
 	}
+	if asof != 0 && sub.Asof != asof {
+		return etcd.Error{
+			Code:  etcd.ErrorCodeTestFailed,
+			Index: msr.index,
+		}
+	}
+
+	msr.index += 1
 
 	msr.network.subnets[i] = msr.network.subnets[len(msr.network.subnets)-1]
 	msr.network.subnets = msr.network.subnets[:len(msr.network.subnets)-1]
@@ -288,3 +308,20 @@ func (n *netwk) findSubnet(sn ip.IP4Net) (Lease, int, error) {
 	}
 	return Lease{}, 0, fmt.Errorf("subnet not found")
 }
+
+// checkIPv6Subnet fails like the reservation of sn6 in etcd if a lease other
+// than the one of sn holds it.
+func (n *netwk) checkIPv6Subnet(sn ip.IP4Net, sn6 ip.IP6Net, index uint64) error {
+	if sn6.Empty() {
+		return nil
+	}
+	for _, sub := range n.subnets {
+		if sub.IPv6Subnet.Equal(sn6) && !sub.Subnet.Equal(sn) {
+			return etcd.Error{
+				Code:  etcd.ErrorCodeNodeExist,
+				Index: index,
+			}
+		}
+	}
+	return nil
+}
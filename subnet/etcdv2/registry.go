@@ -40,9 +40,15 @@ type Registry interface {
 	getNetworkConfig(ctx context.Context) (string, error)
 	getSubnets(ctx context.Context) ([]Lease, uint64, error)
 	getSubnet(ctx context.Context, sn ip.IP4Net) (*Lease, uint64, error)
-	createSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error)
-	updateSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error)
-	deleteSubnet(ctx context.Context, sn ip.IP4Net) error
+	// createSubnet and updateSubnet return the expiration of the lease and the
+	// index it was written at. updateSubnet fails if asof is non-zero and the
+	// lease was written since. Both fail if the IPv6 subnet sn6 is new to the
+	// lease and another lease holds it; prev6 is the one it held so far.
+	createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, uint64, error)
+	updateSubnet(ctx context.Context, sn ip.IP4Net, sn6, prev6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, uint64, error)
+	// deleteSubnet fails the same way if asof is non-zero and the lease was
+	// written since. It releases the IPv6 subnet sn6 along with it.
+	deleteSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, asof uint64) error
 	watchSubnets(ctx context.Context, since uint64) (Event, uint64, error)
 	watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) (Event, uint64, error)
 }
@@ -160,11 +166,17 @@ func (esr *etcdSubnetRegistry) getSubnet(ctx context.Context, sn ip.IP4Net) (*Le
 	return l, resp.Index, err
 }
 
-func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
+func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, uint64, error) {
 	key := path.Join(esr.etcdCfg.Prefix, "subnets", MakeSubnetKey(sn))
-	value, err := json.Marshal(attrs)
+	value, err := json.Marshal(NewLeaseValue(sn6, attrs))
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, 0, err
+	}
+
+	if !sn6.Empty() {
+		if err := esr.reserveIPv6Subnet(ctx, sn, sn6, ttl); err != nil {
+			return time.Time{}, 0, err
+		}
 	}
 
 	opts := &etcd.SetOptions{
@@ -174,7 +186,10 @@ func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, a
 
 	resp, err := esr.client().Set(ctx, key, string(value), opts)
 	if err != nil {
-		return time.Time{}, err
+		if !sn6.Empty() {
+			esr.releaseIPv6Subnet(ctx, sn, sn6)
+		}
+		return time.Time{}, 0, err
 	}
 
 	exp := time.Time{}
@@ -182,14 +197,21 @@ func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, a
 		exp = *resp.Node.Expiration
 	}
 
-	return exp, nil
+	return exp, resp.Node.ModifiedIndex, nil
 }
 
-func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
+func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, sn6, prev6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, uint64, error) {
 	key := path.Join(esr.etcdCfg.Prefix, "subnets", MakeSubnetKey(sn))
-	value, err := json.Marshal(attrs)
+	value, err := json.Marshal(NewLeaseValue(sn6, attrs))
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, 0, err
+	}
+
+	moved := !sn6.Empty() && !sn6.Equal(prev6)
+	if moved {
+		if err := esr.reserveIPv6Subnet(ctx, sn, sn6, ttl); err != nil {
+			return time.Time{}, 0, err
+		}
 	}
 
 	resp, err := esr.client().Set(ctx, key, string(value), &etcd.SetOptions{
@@ -197,7 +219,20 @@ func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, a
 		TTL:       ttl,
 	})
 	if err != nil {
-		return time.Time{}, err
+		if moved {
+			esr.releaseIPv6Subnet(ctx, sn, sn6)
+		}
+		return time.Time{}, 0, err
+	}
+
+	if !sn6.Empty() && !moved {
+		// Written after the lease, so that the reservation doesn't expire first
+		if _, err := esr.client().Set(ctx, esr.ipv6SubnetKey(sn6), MakeSubnetKey(sn), &etcd.SetOptions{TTL: ttl}); err != nil {
+			return time.Time{}, 0, err
+		}
+	}
+	if !prev6.Empty() && !prev6.Equal(sn6) {
+		esr.releaseIPv6Subnet(ctx, sn, prev6)
 	}
 
 	exp := time.Time{}
@@ -205,15 +240,46 @@ func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, a
 		exp = *resp.Node.Expiration
 	}
 
-	return exp, nil
+	return exp, resp.Node.ModifiedIndex, nil
 }
 
-func (esr *etcdSubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net) error {
+func (esr *etcdSubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, asof uint64) error {
 	key := path.Join(esr.etcdCfg.Prefix, "subnets", MakeSubnetKey(sn))
-	_, err := esr.client().Delete(ctx, key, nil)
+	if _, err := esr.client().Delete(ctx, key, &etcd.DeleteOptions{PrevIndex: asof}); err != nil {
+		return err
+	}
+
+	if !sn6.Empty() {
+		esr.releaseIPv6Subnet(ctx, sn, sn6)
+	}
+	return nil
+}
+
+// ipv6SubnetKey is the key an IPv6 subnet is reserved under by the lease holding
+// it. It's kept out of the subnets directory so that it doesn't show up as a lease.
+func (esr *etcdSubnetRegistry) ipv6SubnetKey(sn6 ip.IP6Net) string {
+	return path.Join(esr.etcdCfg.Prefix, "ipv6subnets", MakeIPv6SubnetKey(sn6))
+}
+
+// reserveIPv6Subnet reserves sn6 for the lease of sn, failing if another lease
+// holds it. There are no transactions across keys in etcd v2, so it's done before
+// the lease is written, and undone by releaseIPv6Subnet if that fails.
+func (esr *etcdSubnetRegistry) reserveIPv6Subnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, ttl time.Duration) error {
+	_, err := esr.client().Set(ctx, esr.ipv6SubnetKey(sn6), MakeSubnetKey(sn), &etcd.SetOptions{
+		PrevExist: etcd.PrevNoExist,
+		TTL:       ttl,
+	})
 	return err
 }
 
+// releaseIPv6Subnet drops the reservation of sn6, if it's still held by the lease of sn.
+func (esr *etcdSubnetRegistry) releaseIPv6Subnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net) {
+	_, err := esr.client().Delete(ctx, esr.ipv6SubnetKey(sn6), &etcd.DeleteOptions{PrevValue: MakeSubnetKey(sn)})
+	if err != nil && !isErrEtcdKeyNotFound(err) && !isErrEtcdTestFailed(err) {
+		log.Warningf("Failed to release IPv6 subnet %v of lease %v: %v", sn6, sn, err)
+	}
+}
+
 func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, since uint64) (Event, uint64, error) {
 	key := path.Join(esr.etcdCfg.Prefix, "subnets")
 	opts := &etcd.WatcherOptions{
@@ -269,14 +335,22 @@ func parseSubnetWatchResponse(resp *etcd.Response) (Event, error) {
 
 	switch resp.Action {
 	case "delete", "expire":
+		l := Lease{Subnet: *sn}
+		// The IPv6 subnet isn't part of the key, recover it from the old value
+		if resp.PrevNode != nil {
+			v := &LeaseValue{}
+			if err := json.Unmarshal([]byte(resp.PrevNode.Value), v); err == nil {
+				l.IPv6Subnet = v.IPv6SubnetOrEmpty()
+			}
+		}
 		return Event{
 			EventRemoved,
-			Lease{Subnet: *sn},
+			l,
 		}, nil
 
 	default:
-		attrs := &LeaseAttrs{}
-		err := json.Unmarshal([]byte(resp.Node.Value), attrs)
+		v := &LeaseValue{}
+		err := json.Unmarshal([]byte(resp.Node.Value), v)
 		if err != nil {
 			return Event{}, err
 		}
@@ -290,8 +364,10 @@ func parseSubnetWatchResponse(resp *etcd.Response) (Event, error) {
 			EventAdded,
 			Lease{
 				Subnet:     *sn,
-				Attrs:      *attrs,
+				IPv6Subnet: v.IPv6SubnetOrEmpty(),
+				Attrs:      v.LeaseAttrs,
 				Expiration: exp,
+				Asof:       resp.Node.ModifiedIndex,
 			},
 		}
 		return evt, nil
@@ -304,8 +380,8 @@ func nodeToLease(node *etcd.Node) (*Lease, error) {
 		return nil, fmt.Errorf("failed to parse subnet key %s", node.Key)
 	}
 
-	attrs := &LeaseAttrs{}
-	if err := json.Unmarshal([]byte(node.Value), attrs); err != nil {
+	v := &LeaseValue{}
+	if err := json.Unmarshal([]byte(node.Value), v); err != nil {
 		return nil, err
 	}
 
@@ -316,7 +392,8 @@ func nodeToLease(node *etcd.Node) (*Lease, error) {
 
 	lease := Lease{
 		Subnet:     *sn,
-		Attrs:      *attrs,
+		IPv6Subnet: v.IPv6SubnetOrEmpty(),
+		Attrs:      v.LeaseAttrs,
 		Expiration: exp,
 		Asof:       node.ModifiedIndex,
 	}
@@ -72,6 +72,9 @@ func watchSubnets(t *testing.T, r Registry, ctx context.Context, sn ip.IP4Net, n
 				if !evt.Lease.Subnet.Equal(exp.subnet) {
 					result <- fmt.Errorf("Subnet event lease %v mismatch (expected %v)", evt.Lease.Subnet, exp.subnet)
 				}
+				if evt.Type == EventAdded && evt.Lease.Asof != index {
+					result <- fmt.Errorf("Subnet event lease index %d mismatch (expected %d)", evt.Lease.Asof, index)
+				}
 				exp.found = true
 				numFound += 1
 			}
@@ -134,7 +137,7 @@ func TestEtcdRegistry(t *testing.T) {
 	attrs := &LeaseAttrs{
 		PublicIP: ip.MustParseIP4("1.2.3.4"),
 	}
-	exp, err := r.createSubnet(ctx, sn, attrs, 24*time.Hour)
+	exp, _, err := r.createSubnet(ctx, sn, ip.IP6Net{}, attrs, 24*time.Hour)
 	if err != nil {
 		t.Fatal("Failed to create subnet lease")
 	}
@@ -167,7 +170,7 @@ func TestEtcdRegistry(t *testing.T) {
 		t.Fatal("Missing subnet lease")
 	}
 
-	err = r.deleteSubnet(ctx, sn)
+	err = r.deleteSubnet(ctx, sn, ip.IP6Net{}, 0)
 	if err != nil {
 		t.Fatalf("Failed to delete subnet %v: %v", sn, err)
 	}
@@ -188,3 +191,107 @@ func TestEtcdRegistry(t *testing.T) {
 
 	// TODO: watchSubnet and watchNetworks
 }
+
+func TestEtcdRegistryUpdateSubnet(t *testing.T) {
+	r, m := newTestEtcdRegistry(t)
+	ctx := context.Background()
+	m.Create(ctx, "/coreos.com/network/config", `{ "Network": "10.1.0.0/16" }`)
+
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.1.5.0"), PrefixLen: 24}
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	_, asof, err := r.createSubnet(ctx, sn, ip.IP6Net{}, attrs, 24*time.Hour)
+	if err != nil {
+		t.Fatal("Failed to create subnet lease: ", err)
+	}
+
+	if _, _, err := r.updateSubnet(ctx, sn, ip.IP6Net{}, ip.IP6Net{}, attrs, 24*time.Hour, asof-1); !isErrEtcdTestFailed(err) {
+		t.Fatal("Expected a failed test updating with a stale index, got ", err)
+	}
+	_, updated, err := r.updateSubnet(ctx, sn, ip.IP6Net{}, ip.IP6Net{}, attrs, 24*time.Hour, asof)
+	if err != nil {
+		t.Fatal("Failed to update subnet lease: ", err)
+	}
+	if updated <= asof {
+		t.Fatalf("Index %d of the update isn't after %d", updated, asof)
+	}
+
+	if err := r.deleteSubnet(ctx, sn, ip.IP6Net{}, 0); err != nil {
+		t.Fatal("Failed to delete subnet lease: ", err)
+	}
+	if _, _, err := r.updateSubnet(ctx, sn, ip.IP6Net{}, ip.IP6Net{}, attrs, 24*time.Hour, updated); !isErrEtcdKeyNotFound(err) {
+		t.Fatal("Expected key not found updating a deleted lease, got ", err)
+	}
+}
+
+func TestEtcdRegistryIPv6Reservation(t *testing.T) {
+	r, m := newTestEtcdRegistry(t)
+	ctx := context.Background()
+
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.1.5.0"), PrefixLen: 24}
+	other := ip.IP4Net{IP: ip.MustParseIP4("10.1.6.0"), PrefixLen: 24}
+	sn6 := func(s string) ip.IP6Net {
+		return ip.IP6Net{IP: ip.MustParseIP6(s), PrefixLen: 64}
+	}
+
+	// reservedBy returns the key of the subnet holding an IPv6 subnet, if any.
+	reservedBy := func(n ip.IP6Net) string {
+		resp, err := m.Get(ctx, "/coreos.com/network/ipv6subnets/"+MakeIPv6SubnetKey(n), nil)
+		if isErrEtcdKeyNotFound(err) {
+			return ""
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Node.Value
+	}
+
+	_, asof, err := r.createSubnet(ctx, sn, sn6("fd00:0:0:1::"), attrs, 24*time.Hour)
+	if err != nil {
+		t.Fatal("Failed to create subnet lease: ", err)
+	}
+	if got := reservedBy(sn6("fd00:0:0:1::")); got != "10.1.5.0-24" {
+		t.Fatalf("IPv6 subnet is reserved by %q", got)
+	}
+
+	// Another lease can't take the same IPv6 subnet
+	if _, _, err := r.createSubnet(ctx, other, sn6("fd00:0:0:1::"), attrs, 24*time.Hour); !isErrEtcdNodeExist(err) {
+		t.Fatal("Expected a taken IPv6 subnet to fail creating a lease, got ", err)
+	}
+	if _, _, err := r.getSubnet(ctx, other); !isErrEtcdKeyNotFound(err) {
+		t.Fatal("Expected key not found getting the lease that failed, got ", err)
+	}
+	if _, _, err := r.createSubnet(ctx, other, sn6("fd00:0:0:2::"), attrs, 24*time.Hour); err != nil {
+		t.Fatal("Failed to create subnet lease: ", err)
+	}
+
+	// Nor move over to it
+	if _, _, err := r.updateSubnet(ctx, sn, sn6("fd00:0:0:2::"), sn6("fd00:0:0:1::"), attrs, 24*time.Hour, asof); !isErrEtcdNodeExist(err) {
+		t.Fatal("Expected a taken IPv6 subnet to fail updating a lease, got ", err)
+	}
+	if got := reservedBy(sn6("fd00:0:0:2::")); got != "10.1.6.0-24" {
+		t.Fatalf("IPv6 subnet of another lease is reserved by %q", got)
+	}
+
+	// A lease that fails to update leaves the subnet it moves to free
+	if _, _, err := r.updateSubnet(ctx, sn, sn6("fd00:0:0:3::"), sn6("fd00:0:0:1::"), attrs, 24*time.Hour, asof-1); !isErrEtcdTestFailed(err) {
+		t.Fatal("Expected a failed test updating with a stale index, got ", err)
+	}
+	if got := reservedBy(sn6("fd00:0:0:3::")); got != "" {
+		t.Fatalf("IPv6 subnet of a failed update is reserved by %q", got)
+	}
+
+	_, asof, err = r.updateSubnet(ctx, sn, sn6("fd00:0:0:3::"), sn6("fd00:0:0:1::"), attrs, 24*time.Hour, asof)
+	if err != nil {
+		t.Fatal("Failed to move to a free IPv6 subnet: ", err)
+	}
+	if got := reservedBy(sn6("fd00:0:0:1::")); got != "" {
+		t.Fatalf("IPv6 subnet moved away from is still reserved by %q", got)
+	}
+
+	if err := r.deleteSubnet(ctx, sn, sn6("fd00:0:0:3::"), asof); err != nil {
+		t.Fatal("Failed to delete subnet lease: ", err)
+	}
+	if got := reservedBy(sn6("fd00:0:0:3::")); got != "" {
+		t.Fatalf("IPv6 subnet of a deleted lease is still reserved by %q", got)
+	}
+}
@@ -35,13 +35,13 @@ func newDummyRegistry() *MockSubnetRegistry {
 
 	subnets := []Lease{
 		// leases within SubnetMin-SubnetMax range
-		{ip.IP4Net{ip.MustParseIP4("10.3.1.0"), 24}, attrs, exp, 10},
-		{ip.IP4Net{ip.MustParseIP4("10.3.2.0"), 24}, attrs, exp, 11},
-		{ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}, attrs, exp, 12},
-		{ip.IP4Net{ip.MustParseIP4("10.3.5.0"), 24}, attrs, exp, 13},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.1.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 10},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.2.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 11},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 12},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.5.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 13},
 
 		// hand created lease outside the range of subnetMin-SubnetMax for testing removal
-		{ip.IP4Net{ip.MustParseIP4("10.3.31.0"), 24}, attrs, exp, 13},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.31.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 13},
 	}
 
 	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0" }`
@@ -101,6 +101,338 @@ func TestAcquireLease(t *testing.T) {
 	}
 }
 
+func TestAcquireLeaseNodeID(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+		NodeID:   "node-a",
+	}
+	l, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// The node's IP changed, it should keep its subnet
+	moved := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.5"),
+		NodeID:   "node-a",
+	}
+	l2, err := sm.AcquireLease(context.Background(), &moved)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Equal(l2.Subnet) {
+		t.Fatalf("AcquireLease did not reuse subnet of the node; expected %v, got %v", l.Subnet, l2.Subnet)
+	}
+	if l2.Attrs.PublicIP != moved.PublicIP {
+		t.Fatalf("AcquireLease did not update the public IP; got %v", l2.Attrs.PublicIP)
+	}
+
+	// Another node behind the same public IP gets a subnet of its own
+	other := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.5"),
+		NodeID:   "node-b",
+	}
+	l3, err := sm.AcquireLease(context.Background(), &other)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l3.Subnet.Equal(l2.Subnet) {
+		t.Fatalf("AcquireLease handed out the subnet of another node: %v", l3.Subnet)
+	}
+
+	// A previous subnet now leased by another node isn't taken over
+	sm2 := NewMockManagerWithSubnet(msr, l3.Subnet)
+	l4, err := sm2.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.6"), NodeID: "node-c"})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l4.Subnet.Equal(l3.Subnet) {
+		t.Fatalf("AcquireLease took over the previous subnet leased by another node: %v", l4.Subnet)
+	}
+}
+
+func TestAcquireLeasePools(t *testing.T) {
+	subnets := []Lease{
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.1.0"), PrefixLen: 24}, Attrs: LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.1")}},
+	}
+	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.2.0", "ExcludedSubnets": [ "10.3.2.0/24" ], "Networks": [ "10.5.0.0/24" ] }`
+	sm := NewMockManager(NewMockRegistry(config, subnets))
+
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+	l, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet.String() != "10.5.0.0/24" {
+		t.Fatalf("Expected a lease from the second pool, got %v", l.Subnet)
+	}
+
+	// The lease is valid and gets reused
+	l2, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Equal(l2.Subnet) {
+		t.Fatalf("AcquireLease did not reuse subnet; expected %v, got %v", l.Subnet, l2.Subnet)
+	}
+
+	// All pools are used up
+	if _, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5")}); err == nil {
+		t.Fatal("AcquireLease succeeded with all pools used up")
+	}
+}
+
+func TestAcquireLeaseNodeGroup(t *testing.T) {
+	config := `{ "Network": "10.3.0.0/16", "NodeGroups": { "edge": { "Network": "10.3.128.0/20", "SubnetLen": 27 } } }`
+	msr := NewMockRegistry(config, nil)
+	sm := newLocalManager(msr, ip.IP4Net{}, ip.IP6Net{}, "", "edge")
+
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+	l, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet.PrefixLen != 27 || !(ip.IP4Net{IP: ip.MustParseIP4("10.3.128.0"), PrefixLen: 20}).Contains(l.Subnet.IP) {
+		t.Fatalf("Expected a /27 from node group edge, got %v", l.Subnet)
+	}
+	if l.Attrs.NodeGroup != "edge" {
+		t.Fatalf("Expected the lease to be tagged with node group edge, got %q", l.Attrs.NodeGroup)
+	}
+
+	// Leaving the group gets the node a regular subnet
+	sm2 := NewMockManager(msr)
+	l2, err := sm2.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l2.Subnet.PrefixLen != 24 || l2.Subnet.IP >= ip.MustParseIP4("10.3.128.0") && l2.Subnet.IP < ip.MustParseIP4("10.3.144.0") {
+		t.Fatalf("Expected a /24 outside of node group edge, got %v", l2.Subnet)
+	}
+
+	if _, err := newLocalManager(msr, ip.IP4Net{}, ip.IP6Net{}, "", "unknown").AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5")}); err == nil {
+		t.Fatal("AcquireLease accepted an unknown node group")
+	}
+}
+
+func TestLeaseAdmin(t *testing.T) {
+	msr := newDummyRegistry()
+	la := NewMockManager(msr).(LeaseAdmin)
+	ctx := context.Background()
+
+	leases, err := la.ListLeases(ctx)
+	if err != nil {
+		t.Fatal("ListLeases failed: ", err)
+	}
+	if len(leases) != 5 {
+		t.Fatalf("Expected 5 leases, got %d", len(leases))
+	}
+
+	// Reserve a free subnet
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.3.9.0"), PrefixLen: 24}
+	if _, err := la.ReserveLease(ctx, sn, nil); err == nil {
+		t.Fatal("ReserveLease reserved a free subnet without attributes")
+	}
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	l, err := la.ReserveLease(ctx, sn, attrs)
+	if err != nil {
+		t.Fatal("ReserveLease failed: ", err)
+	}
+	if !l.Expiration.IsZero() {
+		t.Fatal("Reservation expires: ", l.Expiration)
+	}
+
+	// Subnets outside of the config or overlapping other leases can't be reserved
+	if _, err := la.ReserveLease(ctx, ip.IP4Net{IP: ip.MustParseIP4("10.3.30.0"), PrefixLen: 24}, attrs); err == nil {
+		t.Fatal("ReserveLease reserved a subnet outside of SubnetMin-SubnetMax")
+	}
+	if _, err := la.ReserveLease(ctx, ip.IP4Net{IP: ip.MustParseIP4("10.3.8.0"), PrefixLen: 23}, attrs); err == nil {
+		t.Fatal("ReserveLease reserved a subnet overlapping a lease")
+	}
+
+	// The node gets its reservation
+	l2, err := NewMockManager(msr).AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l2.Subnet.Equal(sn) || !l2.Expiration.IsZero() {
+		t.Fatalf("AcquireLease did not use the reservation: %v expiring %v", l2.Subnet, l2.Expiration)
+	}
+
+	l, err = la.UnreserveLease(ctx, sn)
+	if err != nil {
+		t.Fatal("UnreserveLease failed: ", err)
+	}
+	if l.Expiration.IsZero() {
+		t.Fatal("Unreserved lease doesn't expire")
+	}
+	if _, err := la.UnreserveLease(ctx, sn); err == nil {
+		t.Fatal("UnreserveLease accepted a lease that isn't reserved")
+	}
+
+	if err := la.DeleteLease(ctx, sn); err != nil {
+		t.Fatal("DeleteLease failed: ", err)
+	}
+	if _, err := la.GetLease(ctx, sn); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound after DeleteLease, got ", err)
+	}
+	if err := la.DeleteLease(ctx, sn); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound deleting a missing lease, got ", err)
+	}
+}
+
+// racingRegistry runs race once, right after the leases were listed, to
+// change them before the manager acts on what it read.
+type racingRegistry struct {
+	*MockSubnetRegistry
+	race func()
+}
+
+func (r *racingRegistry) getSubnets(ctx context.Context) ([]Lease, uint64, error) {
+	leases, index, err := r.MockSubnetRegistry.getSubnets(ctx)
+	if r.race != nil {
+		r.race()
+		r.race = nil
+	}
+	return leases, index, err
+}
+
+func TestDeleteLeaseConflict(t *testing.T) {
+	msr := newDummyRegistry()
+	rr := &racingRegistry{MockSubnetRegistry: msr}
+	la := newLocalManager(rr, ip.IP4Net{}, ip.IP6Net{}, "", "").(LeaseAdmin)
+	ctx := context.Background()
+
+	// The lease is renewed between the lookup and the delete
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.3.1.0"), PrefixLen: 24}
+	rr.race = func() {
+		attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.1")}
+		if _, _, err := msr.updateSubnet(ctx, sn, ip.IP6Net{}, ip.IP6Net{}, attrs, subnetTTL, 0); err != nil {
+			t.Fatal("updateSubnet failed: ", err)
+		}
+	}
+	if err := la.DeleteLease(ctx, sn); err != ErrLeaseConflict {
+		t.Fatal("Expected ErrLeaseConflict deleting a lease changed in the meantime, got ", err)
+	}
+	if _, err := la.GetLease(ctx, sn); err != nil {
+		t.Fatal("The changed lease was deleted: ", err)
+	}
+}
+
+func TestReleaseLease(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+	ctx := context.Background()
+
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	l, err := sm.AcquireLease(ctx, attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	lr := sm.(LeaseReleaser)
+	other := &Lease{Subnet: l.Subnet, Attrs: LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5")}}
+	if err := lr.ReleaseLease(ctx, other); err == nil {
+		t.Fatal("ReleaseLease released the lease of another node")
+	}
+
+	if err := lr.ReleaseLease(ctx, l); err != nil {
+		t.Fatal("ReleaseLease failed: ", err)
+	}
+	if _, err := sm.(LeaseAdmin).GetLease(ctx, l.Subnet); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound after ReleaseLease, got ", err)
+	}
+	if err := lr.ReleaseLease(ctx, l); err != nil {
+		t.Fatal("ReleaseLease failed on a released lease: ", err)
+	}
+}
+
+func TestReleaseLeaseConflict(t *testing.T) {
+	msr := newDummyRegistry()
+	rr := &racingRegistry{MockSubnetRegistry: msr}
+	sm := newLocalManager(rr, ip.IP4Net{}, ip.IP6Net{}, "", "")
+	ctx := context.Background()
+
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	l, err := sm.AcquireLease(ctx, attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// Another node takes the subnet over between the lookup and the delete
+	rr.race = func() {
+		other := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5")}
+		if _, _, err := msr.updateSubnet(ctx, l.Subnet, ip.IP6Net{}, ip.IP6Net{}, other, subnetTTL, 0); err != nil {
+			t.Fatal("updateSubnet failed: ", err)
+		}
+	}
+	if err := sm.(LeaseReleaser).ReleaseLease(ctx, l); err != ErrLeaseConflict {
+		t.Fatal("Expected ErrLeaseConflict releasing a lease taken over in the meantime, got ", err)
+	}
+	r, err := sm.(LeaseAdmin).GetLease(ctx, l.Subnet)
+	if err != nil {
+		t.Fatal("The lease of the other node was deleted: ", err)
+	}
+	if r.Attrs.PublicIP != ip.MustParseIP4("1.2.3.5") {
+		t.Fatalf("Unexpected lease %+v", r)
+	}
+}
+
+func TestReacquireReleasedLease(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+	ctx := context.Background()
+
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	l, err := sm.AcquireLease(ctx, attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if err := sm.(LeaseReleaser).ReleaseLease(ctx, l); err != nil {
+		t.Fatal("ReleaseLease failed: ", err)
+	}
+
+	// A restart with the subnet from the subnet file gets the released subnet back
+	restarted := newLocalManager(msr, l.Subnet, ip.IP6Net{}, "", "")
+	l2, err := restarted.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l2.Subnet.Equal(l.Subnet) {
+		t.Fatalf("Expected the released subnet %v, got %v", l.Subnet, l2.Subnet)
+	}
+}
+
+func TestPreferSubnet(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+	ctx := context.Background()
+
+	l, err := sm.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	// Revoke the lease the way an operator would
+	if err := sm.(LeaseAdmin).DeleteLease(ctx, l.Subnet); err != nil {
+		t.Fatal("DeleteLease failed: ", err)
+	}
+
+	sm.(SubnetPreferrer).PreferSubnet(l.Subnet, ip.IP6Net{})
+	l2, err := sm.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l2.Subnet.Equal(l.Subnet) {
+		t.Fatalf("Expected the revoked subnet %v, got %v", l.Subnet, l2.Subnet)
+	}
+}
+
 func TestConfigChanged(t *testing.T) {
 	msr := newDummyRegistry()
 	sm := NewMockManager(msr)
@@ -133,6 +465,47 @@ func TestConfigChanged(t *testing.T) {
 	}
 }
 
+func TestAcquireLeaseIPv6(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.1.1.1"),
+	}
+
+	// Existing leases are kept and get an IPv6 subnet once IPv6 is enabled
+	msr.setConfig(`{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0", "IPv6Network": "fc00::/48" }`)
+
+	l, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet.String() != "10.3.1.0/24" {
+		t.Fatal("AcquireLease did not reuse the existing IPv4 subnet: ", l.Subnet)
+	}
+	if l.IPv6Subnet.PrefixLen != 64 || !(ip.IP6Net{IP: ip.MustParseIP6("fc00::"), PrefixLen: 48}).Contains(l.IPv6Subnet.IP) {
+		t.Fatal("IPv6 subnet not in allocatable range: ", l.IPv6Subnet)
+	}
+
+	// A fresh lease gets a different IPv6 subnet
+	l2, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l2.IPv6Subnet.Empty() || l2.IPv6Subnet.Overlaps(l.IPv6Subnet) {
+		t.Fatalf("AcquireLease handed out a bad IPv6 subnet %v (other lease has %v)", l2.IPv6Subnet, l.IPv6Subnet)
+	}
+
+	// And reacquiring keeps it
+	l3, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l3.IPv6Subnet.Equal(l.IPv6Subnet) {
+		t.Fatalf("AcquireLease did not reuse IPv6 subnet; expected %v, got %v", l.IPv6Subnet, l3.IPv6Subnet)
+	}
+}
+
 func newIP4Net(ipaddr string, prefix uint) ip.IP4Net {
 	a, err := ip.ParseIP4(ipaddr)
 	if err != nil {
@@ -190,7 +563,7 @@ func TestWatchLeaseAdded(t *testing.T) {
 	attrs := &LeaseAttrs{
 		PublicIP: ip.MustParseIP4("1.1.1.1"),
 	}
-	_, err := msr.createSubnet(ctx, expected, attrs, 0)
+	_, _, err := msr.createSubnet(ctx, expected, ip.IP6Net{}, attrs, 0)
 	if err != nil {
 		t.Fatalf("createSubnet filed: %v", err)
 	}
@@ -322,6 +695,35 @@ func TestRenewLease(t *testing.T) {
 	t.Fatal("Failed to find acquired lease")
 }
 
+func TestRenewLeaseConflict(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+	ctx := context.Background()
+
+	l, err := sm.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	stale := *l
+	if err := sm.RenewLease(ctx, l); err != nil {
+		t.Fatal("RenewLease failed: ", err)
+	}
+	if err := sm.RenewLease(ctx, &stale); err != ErrLeaseConflict {
+		t.Fatal("Expected ErrLeaseConflict renewing a stale lease, got ", err)
+	}
+
+	// A reservation made in the meantime isn't turned back into a lease
+	if _, err := sm.(LeaseAdmin).ReserveLease(ctx, l.Subnet, nil); err != nil {
+		t.Fatal("ReserveLease failed: ", err)
+	}
+	if err := sm.RenewLease(ctx, l); err != ErrLeaseConflict {
+		t.Fatal("Expected ErrLeaseConflict renewing a reserved lease, got ", err)
+	}
+	if r, err := sm.(LeaseAdmin).GetLease(ctx, l.Subnet); err != nil || !r.Expiration.IsZero() {
+		t.Fatalf("Expected the reservation to be kept, got %+v, %v", r, err)
+	}
+}
+
 func inAllocatableRange(ctx context.Context, sm Manager, ipn ip.IP4Net) bool {
 	cfg, err := sm.GetNetworkConfig(ctx)
 	if err != nil {
@@ -330,3 +732,53 @@ func inAllocatableRange(ctx context.Context, sm Manager, ipn ip.IP4Net) bool {
 
 	return ipn.IP >= cfg.SubnetMin || ipn.IP <= cfg.SubnetMax
 }
+
+func TestWatchStatus(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := acquireLease(ctx, t, sm)
+
+	waitFor := func(what string, cond func(WatchStatus) bool) {
+		for i := 0; i < 100; i++ {
+			if cond(GetWatchStatus(sm)) {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for %s, status is %+v", what, GetWatchStatus(sm))
+	}
+
+	events := make(chan []Event)
+	done := make(chan struct{})
+	go func() {
+		WatchLeases(ctx, sm, l, events)
+		close(done)
+	}()
+
+	// Nobody takes the first batch yet
+	waitFor("the watch to block", func(s WatchStatus) bool { return s.Watches == 1 && !s.BlockedSince.IsZero() })
+	<-events
+	waitFor("the watch to unblock", func(s WatchStatus) bool { return s.BlockedSince.IsZero() })
+	peers, ok := GetWatchedLeases(sm)
+	if !ok {
+		t.Fatal("Watched leases not reported")
+	}
+	for _, p := range peers {
+		if p.Subnet.Equal(l.Subnet) {
+			t.Errorf("Watched leases include our own lease")
+		}
+	}
+	if s := GetWatchStatus(sm); !s.FailingSince.IsZero() {
+		t.Errorf("Watch reported as failing: %+v", s)
+	}
+
+	cancel()
+	<-done
+	if s := GetWatchStatus(sm); s.Watches != 0 {
+		t.Errorf("Expected no watches after cancel, got %d", s.Watches)
+	}
+}
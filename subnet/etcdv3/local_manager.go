@@ -0,0 +1,586 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+const (
+	raceRetries = 10
+	subnetTTL   = 24 * time.Hour
+)
+
+// LocalManager is a subnet.Manager backed by the etcd v3 API. Leases are stored
+// as keys attached to etcd leases, so expiry is handled by etcd itself and renewals
+// only refresh the etcd lease instead of rewriting the key.
+type LocalManager struct {
+	registry           Registry
+	previousSubnet     ip.IP4Net
+	previousIPv6Subnet ip.IP6Net
+	nodeID             string
+	nodeGroup          string
+}
+
+type watchCursor struct {
+	rev int64
+}
+
+func (c watchCursor) String() string {
+	return strconv.FormatInt(c.rev, 10)
+}
+
+func NewLocalManager(config *EtcdConfig, prevSubnet ip.IP4Net, prevIPv6Subnet ip.IP6Net, nodeID, nodeGroup string) (Manager, error) {
+	r, err := newEtcdSubnetRegistry(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalManager(r, prevSubnet, prevIPv6Subnet, nodeID, nodeGroup), nil
+}
+
+func newLocalManager(r Registry, prevSubnet ip.IP4Net, prevIPv6Subnet ip.IP6Net, nodeID, nodeGroup string) Manager {
+	return &LocalManager{
+		registry:           r,
+		previousSubnet:     prevSubnet,
+		previousIPv6Subnet: prevIPv6Subnet,
+		nodeID:             nodeID,
+		nodeGroup:          nodeGroup,
+	}
+}
+
+func (m *LocalManager) GetNetworkConfig(ctx context.Context) (*Config, error) {
+	cfg, err := m.registry.getNetworkConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(cfg)
+}
+
+func (m *LocalManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Lease, error) {
+	config, err := m.GetNetworkConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if attrs.NodeID == "" {
+		attrs.NodeID = m.nodeID
+	}
+	if attrs.NodeGroup == "" {
+		attrs.NodeGroup = m.nodeGroup
+	}
+	if _, err := config.SubnetAllocators(attrs.NodeGroup); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < raceRetries; i++ {
+		AllocationAttempts.Inc()
+		l, err := m.tryAcquireLease(ctx, config, attrs.PublicIP, attrs)
+		switch err {
+		case nil:
+			return l, nil
+		case errTryAgain:
+			AllocationConflicts.Inc()
+			continue
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("Max retries reached trying to acquire a subnet")
+}
+
+func findLeaseBySubnet(leases []Lease, subnet ip.IP4Net) *Lease {
+	for _, l := range leases {
+		if subnet.Equal(l.Subnet) {
+			return &l
+		}
+	}
+
+	return nil
+}
+
+func findLeaseByIPv6Subnet(leases []Lease, subnet ip.IP6Net) *Lease {
+	for _, l := range leases {
+		if subnet.Equal(l.IPv6Subnet) {
+			return &l
+		}
+	}
+
+	return nil
+}
+
+// reuseLease takes over an existing lease, keeping reservations free of any TTL.
+func (m *LocalManager) reuseLease(ctx context.Context, config *Config, leases []Lease, l *Lease, attrs *LeaseAttrs) (*Lease, error) {
+	ttl := time.Duration(0)
+	if !l.Expiration.IsZero() {
+		// Not a reservation
+		ttl = subnetTTL
+	}
+	sn6, err := m.ipv6SubnetFor(config, leases, attrs, l.IPv6Subnet)
+	if err != nil {
+		return nil, err
+	}
+	exp, asof, err := m.registry.updateSubnet(ctx, l.Subnet, sn6, l.IPv6Subnet, attrs, ttl, int64(l.Asof))
+	if err == errTestFailed {
+		// Taken over by another node since it was listed
+		return nil, errTryAgain
+	} else if err != nil {
+		return nil, err
+	}
+
+	l.IPv6Subnet = sn6
+	l.Attrs = *attrs
+	l.Expiration = exp
+	l.Asof = uint64(asof)
+	return l, nil
+}
+
+func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extIaddr ip.IP4, attrs *LeaseAttrs) (*Lease, error) {
+	leases, _, err := m.registry.getSubnets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try to reuse a subnet if there's one that matches our node ID or IP
+	l, conflicts := FindLeaseForNode(leases, attrs)
+	for _, c := range conflicts {
+		log.Warningf("Node %q holds lease (%v) with the same public IP (%v) as this node (%q), each node needs its own public IP", c.Attrs.NodeID, c.Subnet, extIaddr, attrs.NodeID)
+	}
+	if l != nil {
+		// Make sure the existing subnet is still within the configured network
+		if isSubnetConfigCompat(config, attrs, l.Subnet) {
+			log.Infof("Found lease (%v) for current node (%v), reusing", l.Subnet, extIaddr)
+			return m.reuseLease(ctx, config, leases, l, attrs)
+		} else {
+			log.Infof("Found lease (%v) for current node (%v) but not compatible with current config, deleting", l.Subnet, extIaddr)
+			if err := m.registry.deleteSubnet(ctx, l.Subnet, l.IPv6Subnet, int64(l.Asof)); err == errTestFailed {
+				return nil, errTryAgain
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// no existing match, check if there was a previous subnet to use
+	var sn ip.IP4Net
+	if !m.previousSubnet.Empty() {
+		// use previous subnet
+		if l := findLeaseBySubnet(leases, m.previousSubnet); l != nil {
+			// Make sure the existing subnet is still within the configured network
+			if l.OwnedByOtherNode(attrs) {
+				log.Infof("Previously leased subnet (%v) is now leased by node %q, ignoring", l.Subnet, l.Attrs.NodeID)
+			} else if isSubnetConfigCompat(config, attrs, l.Subnet) {
+				log.Infof("Found lease (%v) matching previously leased subnet, reusing", l.Subnet)
+				return m.reuseLease(ctx, config, leases, l, attrs)
+			} else {
+				log.Infof("Found lease (%v) matching previously leased subnet but not compatible with current config, deleting", l.Subnet)
+				if err := m.registry.deleteSubnet(ctx, l.Subnet, l.IPv6Subnet, int64(l.Asof)); err == errTestFailed {
+					return nil, errTryAgain
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			// Check if the previous subnet is a part of the network and of the right subnet length
+			if isSubnetConfigCompat(config, attrs, m.previousSubnet) {
+				log.Infof("Found previously leased subnet (%v), reusing", m.previousSubnet)
+				sn = m.previousSubnet
+			} else {
+				log.Errorf("Found previously leased subnet (%v) that is not compatible with the Etcd network config, ignoring", m.previousSubnet)
+			}
+		}
+	}
+
+	if sn.Empty() {
+		// no existing match, grab a new one
+		sn, err = m.allocateSubnet(config, leases, attrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sn6, err := m.ipv6SubnetFor(config, leases, attrs, ip.IP6Net{})
+	if err != nil {
+		return nil, err
+	}
+
+	exp, asof, err := m.registry.createSubnet(ctx, sn, sn6, attrs, subnetTTL)
+	switch {
+	case err == nil:
+		log.Infof("Allocated lease (%v) to current node (%v) ", sn, extIaddr)
+		return &Lease{
+			Subnet:     sn,
+			IPv6Subnet: sn6,
+			Attrs:      *attrs,
+			Expiration: exp,
+			Asof:       uint64(asof),
+		}, nil
+	case err == errNodeExist:
+		return nil, errTryAgain
+	default:
+		return nil, err
+	}
+}
+
+func (m *LocalManager) allocateSubnet(config *Config, leases []Lease, attrs *LeaseAttrs) (ip.IP4Net, error) {
+	if attrs.NodeGroup != "" {
+		log.Infof("Picking subnet for node group %q", attrs.NodeGroup)
+	} else {
+		log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
+	}
+
+	used := make([]ip.IP4Net, 0, len(leases))
+	for _, l := range leases {
+		used = append(used, l.Subnet)
+	}
+	return config.AllocateSubnet(attrs.NodeGroup, allocationKey(attrs), used)
+}
+
+// allocationKey identifies the node for the hash allocation strategy. Nodes
+// without an ID hash their public IP instead.
+func allocationKey(attrs *LeaseAttrs) string {
+	if attrs.NodeID != "" {
+		return attrs.NodeID
+	}
+	return attrs.PublicIP.String()
+}
+
+// ipv6SubnetFor picks the IPv6 subnet to go with a lease: the current one if it
+// still fits the config, else the previous one if it's free, else a new one.
+func (m *LocalManager) ipv6SubnetFor(config *Config, leases []Lease, attrs *LeaseAttrs, current ip.IP6Net) (ip.IP6Net, error) {
+	if !config.IPv6Enabled() {
+		return ip.IP6Net{}, nil
+	}
+
+	if isIPv6SubnetConfigCompat(config, current) {
+		return current, nil
+	}
+
+	if isIPv6SubnetConfigCompat(config, m.previousIPv6Subnet) && findLeaseByIPv6Subnet(leases, m.previousIPv6Subnet) == nil {
+		log.Infof("Found previously leased IPv6 subnet (%v), reusing", m.previousIPv6Subnet)
+		return m.previousIPv6Subnet, nil
+	}
+
+	return m.allocateIPv6Subnet(config, leases, attrs)
+}
+
+func (m *LocalManager) allocateIPv6Subnet(config *Config, leases []Lease, attrs *LeaseAttrs) (ip.IP6Net, error) {
+	log.Infof("Picking IPv6 subnet in range %s ... %s", config.IPv6SubnetMin, config.IPv6SubnetMax)
+
+	used := make([]ip.IP6Net, 0, len(leases))
+	for _, l := range leases {
+		used = append(used, l.IPv6Subnet)
+	}
+	return config.AllocateIPv6Subnet(allocationKey(attrs), used)
+}
+
+// RenewLease refreshes the etcd lease the subnet key is attached to. Unlike the
+// etcd v2 manager the key itself is left untouched, and so is lease.Asof.
+func (m *LocalManager) RenewLease(ctx context.Context, lease *Lease) error {
+	exp, err := m.registry.renewSubnet(ctx, lease.Subnet, int64(lease.Asof))
+	if err == errTestFailed {
+		return ErrLeaseConflict
+	} else if err == errKeyNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	lease.Expiration = exp
+	return nil
+}
+
+func (m *LocalManager) ListLeases(ctx context.Context) ([]Lease, error) {
+	leases, _, err := m.registry.getSubnets(ctx)
+	return leases, err
+}
+
+func (m *LocalManager) GetLease(ctx context.Context, sn ip.IP4Net) (*Lease, error) {
+	l, _, err := m.registry.getSubnet(ctx, sn)
+	if err == errKeyNotFound {
+		return nil, ErrNotFound
+	}
+	return l, err
+}
+
+func (m *LocalManager) ReserveLease(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs) (*Lease, error) {
+	config, err := m.GetNetworkConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	leases, _, err := m.registry.getSubnets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l := findLeaseBySubnet(leases, sn)
+	if l == nil {
+		if attrs == nil {
+			return nil, fmt.Errorf("no lease for %v, reserving it needs a public IP", sn)
+		}
+		if !isSubnetConfigCompat(config, attrs, sn) {
+			return nil, fmt.Errorf("%v is not a subnet of the network config", sn)
+		}
+		for _, o := range leases {
+			if o.Subnet.Overlaps(sn) {
+				return nil, fmt.Errorf("%v overlaps the lease of %v", sn, o.Subnet)
+			}
+		}
+
+		var sn6 ip.IP6Net
+		if config.IPv6Enabled() {
+			if sn6, err = m.allocateIPv6Subnet(config, leases, attrs); err != nil {
+				return nil, err
+			}
+		}
+
+		_, asof, err := m.registry.createSubnet(ctx, sn, sn6, attrs, 0)
+		if err == errNodeExist {
+			return nil, ErrLeaseConflict
+		} else if err != nil {
+			return nil, err
+		}
+		return &Lease{Subnet: sn, IPv6Subnet: sn6, Attrs: *attrs, Asof: uint64(asof)}, nil
+	}
+
+	if attrs != nil {
+		l.Attrs = *attrs
+	}
+	if !isSubnetConfigCompat(config, &l.Attrs, l.Subnet) {
+		return nil, fmt.Errorf("lease %v doesn't match the network config and would be replaced", l.Subnet)
+	}
+
+	_, asof, err := m.registry.updateSubnet(ctx, l.Subnet, l.IPv6Subnet, l.IPv6Subnet, &l.Attrs, 0, int64(l.Asof))
+	if err == errTestFailed {
+		return nil, ErrLeaseConflict
+	} else if err != nil {
+		return nil, err
+	}
+	l.Expiration = time.Time{}
+	l.Asof = uint64(asof)
+	return l, nil
+}
+
+func (m *LocalManager) UnreserveLease(ctx context.Context, sn ip.IP4Net) (*Lease, error) {
+	l, err := m.GetLease(ctx, sn)
+	if err != nil {
+		return nil, err
+	}
+	if !l.Expiration.IsZero() {
+		return nil, fmt.Errorf("lease %v is not a reservation", sn)
+	}
+
+	exp, asof, err := m.registry.updateSubnet(ctx, l.Subnet, l.IPv6Subnet, l.IPv6Subnet, &l.Attrs, subnetTTL, int64(l.Asof))
+	if err == errTestFailed {
+		return nil, ErrLeaseConflict
+	} else if err != nil {
+		return nil, err
+	}
+	l.Expiration = exp
+	l.Asof = uint64(asof)
+	return l, nil
+}
+
+func (m *LocalManager) DeleteLease(ctx context.Context, sn ip.IP4Net) error {
+	l, err := m.GetLease(ctx, sn)
+	if err != nil {
+		return err
+	}
+	if err := m.registry.deleteSubnet(ctx, sn, l.IPv6Subnet, int64(l.Asof)); err == errTestFailed {
+		return ErrLeaseConflict
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *LocalManager) ReleaseLease(ctx context.Context, lease *Lease) error {
+	l, err := m.GetLease(ctx, lease.Subnet)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !l.HeldByNode(&lease.Attrs) {
+		return fmt.Errorf("lease %v is held by another node", lease.Subnet)
+	}
+	if l.Expiration.IsZero() {
+		log.Infof("Keeping reservation %v", lease.Subnet)
+		return nil
+	}
+
+	log.Infof("Releasing lease %v", lease.Subnet)
+	// Don't release it if it was taken over since it was looked up
+	if err := m.registry.deleteSubnet(ctx, lease.Subnet, l.IPv6Subnet, int64(l.Asof)); err == errTestFailed {
+		return ErrLeaseConflict
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func getNextRevision(cursor interface{}) (int64, error) {
+	nextRev := int64(0)
+
+	if wc, ok := cursor.(watchCursor); ok {
+		nextRev = wc.rev
+	} else if s, ok := cursor.(string); ok {
+		var err error
+		nextRev, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse cursor: %v", err)
+		}
+	} else {
+		return 0, fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+
+	return nextRev, nil
+}
+
+func (m *LocalManager) leaseWatchReset(ctx context.Context, sn ip.IP4Net) (LeaseWatchResult, error) {
+	l, rev, err := m.registry.getSubnet(ctx, sn)
+	if err == errKeyNotFound {
+		// Report the lease as gone rather than returning an empty snapshot
+		return LeaseWatchResult{
+			Events: []Event{{Type: EventRemoved, Lease: Lease{Subnet: sn}}},
+			Cursor: watchCursor{rev},
+		}, nil
+	}
+	if err != nil {
+		return LeaseWatchResult{}, err
+	}
+
+	return LeaseWatchResult{
+		Snapshot: []Lease{*l},
+		Cursor:   watchCursor{rev},
+	}, nil
+}
+
+func (m *LocalManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error) {
+	if cursor == nil {
+		return m.leaseWatchReset(ctx, sn)
+	}
+
+	nextRev, err := getNextRevision(cursor)
+	if err != nil {
+		return LeaseWatchResult{}, err
+	}
+
+	evts, rev, err := m.registry.watchSubnet(ctx, nextRev, sn)
+
+	switch {
+	case err == nil:
+		if len(evts) == 0 {
+			return m.leaseWatchReset(ctx, sn)
+		}
+		return LeaseWatchResult{
+			// Only the latest state of a single lease is of interest
+			Events: evts[len(evts)-1:],
+			Cursor: watchCursor{rev},
+		}, nil
+
+	case isErrCompacted(err):
+		log.Warning("Watch of subnet lease failed because etcd revision has been compacted")
+		return m.leaseWatchReset(ctx, sn)
+
+	default:
+		return LeaseWatchResult{}, err
+	}
+}
+
+func (m *LocalManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	if cursor == nil {
+		return m.leasesWatchReset(ctx)
+	}
+
+	nextRev, err := getNextRevision(cursor)
+	if err != nil {
+		return LeaseWatchResult{}, err
+	}
+
+	evts, rev, err := m.registry.watchSubnets(ctx, nextRev)
+
+	switch {
+	case err == nil:
+		if len(evts) == 0 {
+			// Nothing usable in this batch; a snapshot is the only thing that
+			// keeps Events/Snapshot semantics of LeaseWatchResult intact.
+			return m.leasesWatchReset(ctx)
+		}
+		return LeaseWatchResult{
+			Events: evts,
+			Cursor: watchCursor{rev},
+		}, nil
+
+	case isErrCompacted(err):
+		log.Warning("Watch of subnet leases failed because etcd revision has been compacted")
+		return m.leasesWatchReset(ctx)
+
+	default:
+		return LeaseWatchResult{}, err
+	}
+}
+
+// leasesWatchReset is called when incremental lease watch failed and we need to grab a snapshot
+func (m *LocalManager) leasesWatchReset(ctx context.Context) (LeaseWatchResult, error) {
+	wr := LeaseWatchResult{}
+
+	leases, rev, err := m.registry.getSubnets(ctx)
+	if err != nil {
+		return wr, fmt.Errorf("failed to retrieve subnet leases: %v", err)
+	}
+
+	wr.Cursor = watchCursor{rev}
+	wr.Snapshot = leases
+	return wr, nil
+}
+
+func isSubnetConfigCompat(config *Config, attrs *LeaseAttrs, sn ip.IP4Net) bool {
+	return config.IsValidSubnet(attrs.NodeGroup, sn)
+}
+
+func isIPv6SubnetConfigCompat(config *Config, sn ip.IP6Net) bool {
+	if sn.Empty() || sn.IP.Cmp(config.IPv6SubnetMin) < 0 || sn.IP.Cmp(config.IPv6SubnetMax) > 0 {
+		return false
+	}
+
+	return sn.PrefixLen == config.IPv6SubnetLen
+}
+
+// PreferSubnet implements subnet.SubnetPreferrer.
+func (m *LocalManager) PreferSubnet(sn ip.IP4Net, sn6 ip.IP6Net) {
+	m.previousSubnet = sn
+	m.previousIPv6Subnet = sn6
+}
+
+func (m *LocalManager) Name() string {
+	previousSubnet := m.previousSubnet.String()
+	if m.previousSubnet.Empty() {
+		previousSubnet = "None"
+	}
+	return fmt.Sprintf("Etcd v3 Local Manager with Previous Subnet: %s", previousSubnet)
+}
@@ -0,0 +1,234 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3
+
+import (
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+func newTestManager(t *testing.T) (Manager, *etcd.Client, func()) {
+	r, cli, stop := newTestEtcdRegistry(t)
+
+	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0" }`
+	if _, err := cli.Put(context.Background(), testPrefix+"/config", config); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+
+	return newLocalManager(r, ip.IP4Net{}, ip.IP6Net{}, "", ""), cli, stop
+}
+
+func TestAcquireLease(t *testing.T) {
+	sm, cli, stop := newTestManager(t)
+	defer stop()
+
+	ctx := context.Background()
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+
+	l, err := sm.AcquireLease(ctx, &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet.PrefixLen != 24 || l.Subnet.IP < ip.MustParseIP4("10.3.1.0") || l.Subnet.IP > ip.MustParseIP4("10.3.25.0") {
+		t.Fatal("Subnet not in allocatable range: ", l.Subnet)
+	}
+	if !l.Expiration.After(time.Now()) {
+		t.Fatalf("Lease expiration %v not in the future", l.Expiration)
+	}
+
+	// Acquire again, should reuse
+	l2, err := sm.AcquireLease(ctx, &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Equal(l2.Subnet) {
+		t.Fatalf("AcquireLease did not reuse subnet; expected %v, got %v", l.Subnet, l2.Subnet)
+	}
+
+	// A reservation (a key without an etcd lease) is reused and stays a reservation
+	if _, err := cli.Put(ctx, testPrefix+"/subnets/10.3.30.0-24", `{"PublicIP":"5.6.7.8"}`); err != nil {
+		t.Fatal(err)
+	}
+	cfg := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.31.0" }`
+	if _, err := cli.Put(ctx, testPrefix+"/config", cfg); err != nil {
+		t.Fatal(err)
+	}
+	rsv, err := sm.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("5.6.7.8")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if rsv.Subnet.String() != "10.3.30.0/24" || !rsv.Expiration.IsZero() {
+		t.Fatalf("Reservation not honored: %v expiring %v", rsv.Subnet, rsv.Expiration)
+	}
+}
+
+func TestAcquireLeaseIPv6(t *testing.T) {
+	sm, cli, stop := newTestManager(t)
+	defer stop()
+
+	ctx := context.Background()
+	cfg := `{ "Network": "10.3.0.0/16", "IPv6Network": "fd00::/112", "IPv6SubnetLen": 120 }`
+	if _, err := cli.Put(ctx, testPrefix+"/config", cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// An IPv6 subnet reserved by a lease that isn't listed yet is not handed out
+	taken := ip.IP6Net{IP: ip.MustParseIP6("fd00::100"), PrefixLen: 120}
+	if _, err := cli.Put(ctx, testPrefix+"/ipv6subnets/"+MakeIPv6SubnetKey(taken), "10.3.200.0-24"); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[ip.IP6Net]bool{taken: true}
+	for _, pub := range []string{"1.2.3.4", "1.2.3.5", "1.2.3.6"} {
+		l, err := sm.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4(pub)})
+		if err != nil {
+			t.Fatal("AcquireLease failed: ", err)
+		}
+		if l.IPv6Subnet.PrefixLen != 120 || seen[l.IPv6Subnet] {
+			t.Fatalf("Lease %v got a bad or taken IPv6 subnet %v", l.Subnet, l.IPv6Subnet)
+		}
+		seen[l.IPv6Subnet] = true
+
+		resp, err := cli.Get(ctx, testPrefix+"/ipv6subnets/"+MakeIPv6SubnetKey(l.IPv6Subnet))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != MakeSubnetKey(l.Subnet) {
+			t.Fatalf("IPv6 subnet %v of lease %v is not reserved for it", l.IPv6Subnet, l.Subnet)
+		}
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	sm, _, stop := newTestManager(t)
+	defer stop()
+
+	ctx := context.Background()
+	l, err := sm.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	l.Expiration = time.Time{}
+	if err := sm.RenewLease(ctx, l); err != nil {
+		t.Fatal("RenewLease failed: ", err)
+	}
+	if !l.Expiration.After(time.Now().Add(subnetTTL - time.Minute)) {
+		t.Fatalf("Renewed lease expiration %v too early", l.Expiration)
+	}
+
+	// A lease changed by someone else since isn't renewed
+	if l.Asof == 0 {
+		t.Fatal("Acquired lease has no revision")
+	}
+	if _, err := sm.(LeaseAdmin).ReserveLease(ctx, l.Subnet, nil); err != nil {
+		t.Fatal("ReserveLease failed: ", err)
+	}
+	if err := sm.RenewLease(ctx, l); err != ErrLeaseConflict {
+		t.Fatalf("Expected %v renewing a changed lease, got %v", ErrLeaseConflict, err)
+	}
+}
+
+func TestWatchLeases(t *testing.T) {
+	sm, cli, stop := newTestManager(t)
+	defer stop()
+
+	ctx := context.Background()
+
+	res, err := sm.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatal("WatchLeases failed: ", err)
+	}
+	if len(res.Snapshot) != 0 || len(res.Events) != 0 {
+		t.Fatalf("Expected an empty snapshot, got %v", res)
+	}
+	cursor := res.Cursor
+
+	l, err := sm.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	res, err = sm.WatchLeases(ctx, cursor)
+	if err != nil {
+		t.Fatal("WatchLeases failed: ", err)
+	}
+	if len(res.Events) != 1 || res.Events[0].Type != EventAdded || !res.Events[0].Lease.Subnet.Equal(l.Subnet) {
+		t.Fatalf("Expected a single added event for %v, got %v", l.Subnet, res)
+	}
+
+	// The cursor must survive a JSON round trip as a string
+	cursor = res.Cursor.(watchCursor).String()
+
+	// Once the history behind the cursor is compacted, a snapshot is returned instead
+	if _, err := cli.Put(ctx, testPrefix+"/unrelated", "x"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cli.Put(ctx, testPrefix+"/unrelated", "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Compact(ctx, resp.Header.Revision, etcd.WithCompactPhysical()); err != nil {
+		t.Fatal("Failed to compact: ", err)
+	}
+
+	res, err = sm.WatchLeases(ctx, cursor)
+	if err != nil {
+		t.Fatal("WatchLeases failed: ", err)
+	}
+	if len(res.Snapshot) != 1 || !res.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Fatalf("Expected a snapshot holding %v, got %v", l.Subnet, res)
+	}
+}
+
+func TestWatchLease(t *testing.T) {
+	sm, cli, stop := newTestManager(t)
+	defer stop()
+
+	ctx := context.Background()
+	l, err := sm.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	res, err := sm.WatchLease(ctx, l.Subnet, nil)
+	if err != nil {
+		t.Fatal("WatchLease failed: ", err)
+	}
+	if len(res.Snapshot) != 1 || !res.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Fatalf("Expected a snapshot holding %v, got %v", l.Subnet, res)
+	}
+
+	if _, err := cli.Delete(ctx, testPrefix+"/subnets/"+l.Key()); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = sm.WatchLease(ctx, l.Subnet, res.Cursor)
+	if err != nil {
+		t.Fatal("WatchLease failed: ", err)
+	}
+	if len(res.Events) != 1 || res.Events[0].Type != EventRemoved {
+		t.Fatalf("Expected a removed event, got %v", res)
+	}
+}
@@ -0,0 +1,539 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/coreos/etcd/pkg/transport"
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+var (
+	errTryAgain     = errors.New("try again")
+	errKeyNotFound  = errors.New("key not found")
+	errNodeExist    = errors.New("key already exists")
+	errTestFailed   = errors.New("compare failed")
+	errNoNetworkCfg = errors.New("network config not found")
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	// ttlCacheTime is how long the expiration of an etcd lease looked up is
+	// reused, so that listing the subnets doesn't ask etcd for every key.
+	// Renewals don't touch the keys, so it's the only way to learn about them.
+	ttlCacheTime = time.Minute
+)
+
+type Registry interface {
+	getNetworkConfig(ctx context.Context) (string, error)
+	getSubnets(ctx context.Context) ([]Lease, int64, error)
+	getSubnet(ctx context.Context, sn ip.IP4Net) (*Lease, int64, error)
+	createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, int64, error)
+	updateSubnet(ctx context.Context, sn ip.IP4Net, sn6, prev6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof int64) (time.Time, int64, error)
+	renewSubnet(ctx context.Context, sn ip.IP4Net, asof int64) (time.Time, error)
+	deleteSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, asof int64) error
+	watchSubnets(ctx context.Context, since int64) ([]Event, int64, error)
+	watchSubnet(ctx context.Context, since int64, sn ip.IP4Net) ([]Event, int64, error)
+}
+
+type EtcdConfig struct {
+	Endpoints []string
+	Keyfile   string
+	Certfile  string
+	CAFile    string
+	Prefix    string
+	Username  string
+	Password  string
+}
+
+type etcdNewFunc func(c *EtcdConfig) (*etcd.Client, error)
+
+type etcdSubnetRegistry struct {
+	cli     *etcd.Client
+	etcdCfg *EtcdConfig
+
+	// ttlMux guards ttls, the expirations of the etcd leases by ID.
+	ttlMux sync.Mutex
+	ttls   map[etcd.LeaseID]cachedExpiration
+}
+
+type cachedExpiration struct {
+	expiration time.Time
+	fetched    time.Time
+}
+
+func newEtcdClient(c *EtcdConfig) (*etcd.Client, error) {
+	cfg := etcd.Config{
+		Endpoints:   c.Endpoints,
+		DialTimeout: dialTimeout,
+		Username:    c.Username,
+		Password:    c.Password,
+	}
+
+	tlsInfo := transport.TLSInfo{
+		CertFile: c.Certfile,
+		KeyFile:  c.Keyfile,
+		CAFile:   c.CAFile,
+	}
+	if !tlsInfo.Empty() || c.CAFile != "" {
+		tlsCfg, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = tlsCfg
+	}
+
+	return etcd.New(cfg)
+}
+
+func newEtcdSubnetRegistry(config *EtcdConfig, cliNewFunc etcdNewFunc) (Registry, error) {
+	r := &etcdSubnetRegistry{
+		etcdCfg: config,
+		ttls:    make(map[etcd.LeaseID]cachedExpiration),
+	}
+	if cliNewFunc == nil {
+		cliNewFunc = newEtcdClient
+	}
+
+	var err error
+	r.cli, err = cliNewFunc(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (esr *etcdSubnetRegistry) subnetsKey() string {
+	// The trailing slash keeps a prefix query from matching sibling keys such as "subnets-old"
+	return path.Join(esr.etcdCfg.Prefix, "subnets") + "/"
+}
+
+func (esr *etcdSubnetRegistry) subnetKey(sn ip.IP4Net) string {
+	return path.Join(esr.etcdCfg.Prefix, "subnets", MakeSubnetKey(sn))
+}
+
+// ipv6SubnetKey is the key an IPv6 subnet is reserved under by the lease holding
+// it. It's kept out of the subnets directory so that it doesn't show up as a lease.
+func (esr *etcdSubnetRegistry) ipv6SubnetKey(sn6 ip.IP6Net) string {
+	return path.Join(esr.etcdCfg.Prefix, "ipv6subnets", MakeIPv6SubnetKey(sn6))
+}
+
+func (esr *etcdSubnetRegistry) getNetworkConfig(ctx context.Context) (string, error) {
+	key := path.Join(esr.etcdCfg.Prefix, "config")
+	resp, err := esr.cli.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", errNoNetworkCfg
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// getSubnets queries etcd to get a list of currently allocated leases for a given network.
+// It returns the leases along with the store revision that can be used as the starting
+// point for etcd watch.
+func (esr *etcdSubnetRegistry) getSubnets(ctx context.Context) ([]Lease, int64, error) {
+	resp, err := esr.cli.Get(ctx, esr.subnetsKey(), etcd.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	leases := []Lease{}
+	ids := make(map[etcd.LeaseID]bool)
+	for _, kv := range resp.Kvs {
+		ids[etcd.LeaseID(kv.Lease)] = true
+		l, err := esr.kvToLease(ctx, kv)
+		if err != nil {
+			log.Warningf("Ignoring bad subnet node: %v", err)
+			continue
+		}
+
+		leases = append(leases, *l)
+	}
+
+	// Forget about the etcd leases no subnet is attached to anymore
+	esr.ttlMux.Lock()
+	for id := range esr.ttls {
+		if !ids[id] {
+			delete(esr.ttls, id)
+		}
+	}
+	esr.ttlMux.Unlock()
+
+	return leases, resp.Header.Revision, nil
+}
+
+func (esr *etcdSubnetRegistry) getSubnet(ctx context.Context, sn ip.IP4Net) (*Lease, int64, error) {
+	resp, err := esr.cli.Get(ctx, esr.subnetKey(sn))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, errKeyNotFound
+	}
+
+	l, err := esr.kvToLease(ctx, resp.Kvs[0])
+	return l, resp.Header.Revision, err
+}
+
+// grant creates a new etcd lease for ttl. A zero ttl means the key is a reservation
+// and is not bound to any lease.
+func (esr *etcdSubnetRegistry) grant(ctx context.Context, ttl time.Duration) (etcd.LeaseID, time.Time, error) {
+	if ttl == 0 {
+		return etcd.NoLease, time.Time{}, nil
+	}
+
+	resp, err := esr.cli.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return etcd.NoLease, time.Time{}, err
+	}
+
+	exp := time.Now().Add(time.Duration(resp.TTL) * time.Second)
+	esr.cacheExpiration(resp.ID, exp)
+	return resp.ID, exp, nil
+}
+
+// createSubnet creates the key of a subnet, unless it exists already. The IPv6
+// subnet is reserved in the same transaction, unless another lease holds it. It
+// returns the expiration and the revision the key was created at.
+func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, int64, error) {
+	key := esr.subnetKey(sn)
+	value, err := json.Marshal(NewLeaseValue(sn6, attrs))
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	id, exp, err := esr.grant(ctx, ttl)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	cmps := []etcd.Cmp{etcd.Compare(etcd.CreateRevision(key), "=", 0)}
+	ops := []etcd.Op{etcd.OpPut(key, string(value), etcd.WithLease(id))}
+	if !sn6.Empty() {
+		key6 := esr.ipv6SubnetKey(sn6)
+		cmps = append(cmps, etcd.Compare(etcd.CreateRevision(key6), "=", 0))
+		ops = append(ops, etcd.OpPut(key6, MakeSubnetKey(sn), etcd.WithLease(id)))
+	}
+
+	resp, err := esr.cli.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		esr.revoke(id)
+		return time.Time{}, 0, err
+	}
+	if !resp.Succeeded {
+		esr.revoke(id)
+		return time.Time{}, 0, errNodeExist
+	}
+
+	return exp, resp.Header.Revision, nil
+}
+
+// updateSubnet rewrites the attributes of a subnet. If asof is non-zero, the update only
+// succeeds if the key has not been modified since that revision. prev6 is the IPv6 subnet
+// the lease held so far; if sn6 is another one, it's reserved in its place, which fails
+// the same way if another lease holds it. The etcd lease the key was attached to before
+// is revoked. It returns the expiration and the revision of the update.
+func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, sn6, prev6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof int64) (time.Time, int64, error) {
+	key := esr.subnetKey(sn)
+	value, err := json.Marshal(NewLeaseValue(sn6, attrs))
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	id, exp, err := esr.grant(ctx, ttl)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	cmps := []etcd.Cmp{}
+	if asof != 0 {
+		cmps = append(cmps, etcd.Compare(etcd.ModRevision(key), "=", asof))
+	}
+	ops := []etcd.Op{etcd.OpPut(key, string(value), etcd.WithLease(id), etcd.WithPrevKV())}
+	if !sn6.Empty() {
+		// The reservation moves to the new etcd lease along with the subnet
+		key6 := esr.ipv6SubnetKey(sn6)
+		if !sn6.Equal(prev6) {
+			cmps = append(cmps, etcd.Compare(etcd.CreateRevision(key6), "=", 0))
+		}
+		ops = append(ops, etcd.OpPut(key6, MakeSubnetKey(sn), etcd.WithLease(id)))
+	}
+	if !prev6.Empty() && !prev6.Equal(sn6) {
+		ops = append(ops, etcd.OpDelete(esr.ipv6SubnetKey(prev6)))
+	}
+
+	resp, err := esr.cli.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		esr.revoke(id)
+		return time.Time{}, 0, err
+	}
+	if !resp.Succeeded {
+		esr.revoke(id)
+		return time.Time{}, 0, errTestFailed
+	}
+
+	if put := resp.Responses[0].GetResponsePut(); put != nil && put.PrevKv != nil {
+		if prev := etcd.LeaseID(put.PrevKv.Lease); prev != id {
+			esr.revoke(prev)
+		}
+	}
+	return exp, resp.Header.Revision, nil
+}
+
+// renewSubnet refreshes the etcd lease backing the subnet key without rewriting it.
+// If asof is non-zero, it's only renewed if the key has not been modified since that
+// revision, which fails with errTestFailed otherwise.
+func (esr *etcdSubnetRegistry) renewSubnet(ctx context.Context, sn ip.IP4Net, asof int64) (time.Time, error) {
+	key := esr.subnetKey(sn)
+	txn := esr.cli.Txn(ctx)
+	if asof != 0 {
+		txn = txn.If(etcd.Compare(etcd.ModRevision(key), "=", asof))
+	}
+	resp, err := txn.Then(etcd.OpGet(key)).Else(etcd.OpGet(key)).Commit()
+	if err != nil {
+		return time.Time{}, err
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) == 0 {
+		return time.Time{}, errKeyNotFound
+	}
+	if !resp.Succeeded {
+		return time.Time{}, errTestFailed
+	}
+
+	id := etcd.LeaseID(kvs[0].Lease)
+	if id == etcd.NoLease {
+		// Reservations never expire
+		return time.Time{}, nil
+	}
+
+	ka, err := esr.cli.KeepAliveOnce(ctx, id)
+	if err == rpctypes.ErrLeaseNotFound {
+		// The key moved to another etcd lease since it was read
+		return time.Time{}, errTestFailed
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	exp := time.Now().Add(time.Duration(ka.TTL) * time.Second)
+	esr.cacheExpiration(id, exp)
+	return exp, nil
+}
+
+// deleteSubnet deletes a subnet along with the reservation of its IPv6 subnet sn6. If
+// asof is non-zero, it's only deleted if the key has not been modified since that revision.
+func (esr *etcdSubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, asof int64) error {
+	key := esr.subnetKey(sn)
+	txn := esr.cli.Txn(ctx)
+	if asof != 0 {
+		txn = txn.If(etcd.Compare(etcd.ModRevision(key), "=", asof))
+	}
+	ops := []etcd.Op{etcd.OpDelete(key, etcd.WithPrevKV())}
+	if !sn6.Empty() {
+		ops = append(ops, etcd.OpDelete(esr.ipv6SubnetKey(sn6)))
+	}
+	resp, err := txn.Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errTestFailed
+	}
+
+	// The etcd lease would only keep running until its TTL otherwise
+	if del := resp.Responses[0].GetResponseDeleteRange(); del != nil {
+		for _, kv := range del.PrevKvs {
+			esr.revoke(etcd.LeaseID(kv.Lease))
+		}
+	}
+	return nil
+}
+
+func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, since int64) ([]Event, int64, error) {
+	return esr.watch(ctx, since, esr.subnetsKey(), etcd.WithPrefix())
+}
+
+func (esr *etcdSubnetRegistry) watchSubnet(ctx context.Context, since int64, sn ip.IP4Net) ([]Event, int64, error) {
+	return esr.watch(ctx, since, esr.subnetKey(sn))
+}
+
+// watch blocks until the next batch of changes after revision since is available and
+// returns it along with the revision to continue watching from.
+func (esr *etcdSubnetRegistry) watch(ctx context.Context, since int64, key string, opts ...etcd.OpOption) ([]Event, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts = append(opts, etcd.WithRev(since+1), etcd.WithPrevKV())
+	for wr := range esr.cli.Watch(ctx, key, opts...) {
+		if err := wr.Err(); err != nil {
+			return nil, 0, err
+		}
+		if len(wr.Events) == 0 {
+			continue
+		}
+
+		evts := []Event{}
+		for _, e := range wr.Events {
+			evt, err := esr.parseSubnetWatchEvent(ctx, e)
+			if err != nil {
+				log.Warning(err)
+				continue
+			}
+			evts = append(evts, evt)
+		}
+
+		return evts, wr.Header.Revision, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, errors.New("watch channel closed")
+}
+
+func (esr *etcdSubnetRegistry) revoke(id etcd.LeaseID) {
+	if id == etcd.NoLease {
+		return
+	}
+	esr.ttlMux.Lock()
+	delete(esr.ttls, id)
+	esr.ttlMux.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if _, err := esr.cli.Revoke(ctx, id); err != nil && err != rpctypes.ErrLeaseNotFound {
+		log.Warningf("Failed to revoke unused etcd lease %x: %v", id, err)
+	}
+}
+
+func (esr *etcdSubnetRegistry) cacheExpiration(id etcd.LeaseID, exp time.Time) {
+	esr.ttlMux.Lock()
+	defer esr.ttlMux.Unlock()
+	esr.ttls[id] = cachedExpiration{expiration: exp, fetched: time.Now()}
+}
+
+// expiration looks up the remaining TTL of the etcd lease a key is attached to,
+// unless it was looked up within ttlCacheTime.
+func (esr *etcdSubnetRegistry) expiration(ctx context.Context, id int64) (time.Time, error) {
+	lid := etcd.LeaseID(id)
+	if lid == etcd.NoLease {
+		return time.Time{}, nil
+	}
+
+	esr.ttlMux.Lock()
+	cached, ok := esr.ttls[lid]
+	esr.ttlMux.Unlock()
+	if ok && time.Since(cached.fetched) < ttlCacheTime {
+		return cached.expiration, nil
+	}
+
+	resp, err := esr.cli.TimeToLive(ctx, lid)
+	if err == rpctypes.ErrLeaseNotFound {
+		// The lease was revoked since, and the key removed or moved to another
+		return time.Now(), nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	if resp.TTL <= 0 {
+		// The lease has already expired and the key is about to be removed
+		return time.Now(), nil
+	}
+
+	exp := time.Now().Add(time.Duration(resp.TTL) * time.Second)
+	esr.cacheExpiration(lid, exp)
+	return exp, nil
+}
+
+func (esr *etcdSubnetRegistry) parseSubnetWatchEvent(ctx context.Context, e *etcd.Event) (Event, error) {
+	sn := ParseSubnetKey(string(e.Kv.Key))
+	if sn == nil {
+		return Event{}, fmt.Errorf("%v %q: not a subnet, skipping", e.Type, e.Kv.Key)
+	}
+
+	switch e.Type {
+	case mvccpb.DELETE:
+		evt := Event{
+			Type:  EventRemoved,
+			Lease: Lease{Subnet: *sn},
+		}
+		if e.PrevKv != nil {
+			v := &LeaseValue{}
+			if err := json.Unmarshal(e.PrevKv.Value, v); err != nil {
+				log.Warningf("Failed to decode attributes of removed subnet %s: %v", sn, err)
+			} else {
+				evt.Lease.IPv6Subnet = v.IPv6SubnetOrEmpty()
+				evt.Lease.Attrs = v.LeaseAttrs
+			}
+		}
+		return evt, nil
+
+	default:
+		l, err := esr.kvToLease(ctx, e.Kv)
+		if err != nil {
+			return Event{}, err
+		}
+		return Event{
+			Type:  EventAdded,
+			Lease: *l,
+		}, nil
+	}
+}
+
+func (esr *etcdSubnetRegistry) kvToLease(ctx context.Context, kv *mvccpb.KeyValue) (*Lease, error) {
+	sn := ParseSubnetKey(string(kv.Key))
+	if sn == nil {
+		return nil, fmt.Errorf("failed to parse subnet key %s", kv.Key)
+	}
+
+	v := &LeaseValue{}
+	if err := json.Unmarshal(kv.Value, v); err != nil {
+		return nil, err
+	}
+
+	exp, err := esr.expiration(ctx, kv.Lease)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := Lease{
+		Subnet:     *sn,
+		IPv6Subnet: v.IPv6SubnetOrEmpty(),
+		Attrs:      v.LeaseAttrs,
+		Expiration: exp,
+		Asof:       uint64(kv.ModRevision),
+	}
+
+	return &lease, nil
+}
+
+func isErrCompacted(err error) bool {
+	return err == rpctypes.ErrCompacted
+}
@@ -0,0 +1,384 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/etcd/etcdserver/api"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+const testPrefix = "/coreos.com/network"
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer l.Close()
+
+	u, _ := url.Parse(fmt.Sprintf("http://%s", l.Addr()))
+	return *u
+}
+
+// startEmbeddedEtcd runs a single member etcd server in a temporary directory.
+// The returned function stops the server and removes its data.
+func startEmbeddedEtcd(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "flannel-etcdv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e *embed.Etcd
+	var cu url.URL
+	// The free ports may be taken by someone else before etcd listens on them
+	for i := 0; ; i++ {
+		cfg := embed.NewConfig()
+		cfg.Dir = dir
+		var pu url.URL
+		cu, pu = freeURL(t), freeURL(t)
+		cfg.LCUrls, cfg.ACUrls = []url.URL{cu}, []url.URL{cu}
+		cfg.LPUrls, cfg.APUrls = []url.URL{pu}, []url.URL{pu}
+		cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+		e, err = embed.StartEtcd(cfg)
+		if err == nil {
+			break
+		} else if i == 2 {
+			os.RemoveAll(dir)
+			t.Fatalf("Failed to start embedded etcd: %v", err)
+		}
+	}
+
+	// The v3 API is only served once the cluster version is set, which may
+	// come after the server is ready
+	deadline := time.After(30 * time.Second)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-deadline:
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatal("Embedded etcd took too long to start")
+	}
+	for !api.IsCapabilityEnabled(api.V3rpcCapability) {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			e.Close()
+			os.RemoveAll(dir)
+			t.Fatal("Embedded etcd took too long to enable the v3 API")
+		}
+	}
+
+	return cu.String(), func() {
+		e.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestEtcdRegistry(t *testing.T) (Registry, *etcd.Client, func()) {
+	endpoint, stop := startEmbeddedEtcd(t)
+
+	cfg := &EtcdConfig{
+		Endpoints: []string{endpoint},
+		Prefix:    testPrefix,
+	}
+
+	r, err := newEtcdSubnetRegistry(cfg, nil)
+	if err != nil {
+		stop()
+		t.Fatalf("Failed to create etcd subnet registry: %v", err)
+	}
+	cli := r.(*etcdSubnetRegistry).cli
+
+	return r, cli, func() {
+		cli.Close()
+		stop()
+	}
+}
+
+func TestEtcdRegistry(t *testing.T) {
+	r, cli, stop := newTestEtcdRegistry(t)
+	defer stop()
+
+	ctx := context.Background()
+
+	if _, err := r.getNetworkConfig(ctx); err == nil {
+		t.Fatal("Should hit error getting config")
+	}
+
+	// Populate etcd with a network
+	netValue := `{ "Network": "10.1.0.0/16", "Backend": { "Type": "host-gw" } }`
+	if _, err := cli.Put(ctx, testPrefix+"/config", netValue); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := r.getNetworkConfig(ctx)
+	if err != nil {
+		t.Fatal("Failed to get network config", err)
+	}
+	if config != netValue {
+		t.Fatal("Failed to match network config")
+	}
+
+	_, rev, err := r.getSubnets(ctx)
+	if err != nil {
+		t.Fatal("Failed to get subnets: ", err)
+	}
+
+	sn := ip.IP4Net{
+		IP:        ip.MustParseIP4("10.1.5.0"),
+		PrefixLen: 24,
+	}
+
+	// Lease a subnet for the network
+	attrs := &LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+	exp, created, err := r.createSubnet(ctx, sn, ip.IP6Net{}, attrs, 24*time.Hour)
+	if err != nil {
+		t.Fatal("Failed to create subnet lease: ", err)
+	}
+	if !exp.After(time.Now()) {
+		t.Fatalf("Subnet lease duration %v not in the future", exp)
+	}
+
+	if _, _, err := r.createSubnet(ctx, sn, ip.IP6Net{}, attrs, 24*time.Hour); err != errNodeExist {
+		t.Fatalf("Creating an existing subnet should fail with %v, got %v", errNodeExist, err)
+	}
+
+	// Make sure the lease got created and is bound to an etcd lease
+	resp, err := cli.Get(ctx, testPrefix+"/subnets/10.1.5.0-24")
+	if err != nil {
+		t.Fatalf("Failed to verify subnet lease directly in etcd: %v", err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatal("Failed to retrieve key of subnet lease")
+	}
+	if string(resp.Kvs[0].Value) != `{"PublicIP":"1.2.3.4"}` {
+		t.Fatalf("Unexpected subnet lease value %s", resp.Kvs[0].Value)
+	}
+	if resp.Kvs[0].Lease == 0 {
+		t.Fatal("Subnet lease key is not attached to an etcd lease")
+	}
+	if resp.Kvs[0].ModRevision != created {
+		t.Fatalf("Create returned revision %d, the key is at %d", created, resp.Kvs[0].ModRevision)
+	}
+
+	leases, _, err := r.getSubnets(ctx)
+	if err != nil {
+		t.Fatal("Failed to get subnets: ", err)
+	}
+	if len(leases) != 1 {
+		t.Fatalf("Unexpected number of leases %d (expected 1)", len(leases))
+	}
+	if !leases[0].Subnet.Equal(sn) {
+		t.Fatalf("Mismatched subnet %v (expected %v)", leases[0].Subnet, sn)
+	}
+	if leases[0].Expiration.IsZero() {
+		t.Fatal("Lease expiration should be set from the etcd lease TTL")
+	}
+
+	// Renewing must not rewrite the key
+	before := resp.Kvs[0].ModRevision
+	if _, err := r.renewSubnet(ctx, sn, before); err != nil {
+		t.Fatal("Failed to renew subnet: ", err)
+	}
+	resp, err = cli.Get(ctx, testPrefix+"/subnets/10.1.5.0-24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Kvs[0].ModRevision != before {
+		t.Fatalf("Renewal modified the key (revision %d, expected %d)", resp.Kvs[0].ModRevision, before)
+	}
+
+	// A stale revision must not overwrite the lease
+	if _, _, err := r.updateSubnet(ctx, sn, ip.IP6Net{}, ip.IP6Net{}, attrs, 24*time.Hour, before-1); err != errTestFailed {
+		t.Fatalf("Update with stale revision should fail with %v, got %v", errTestFailed, err)
+	}
+
+	// An update takes the key to a new etcd lease and revokes the old one
+	oldLease := etcd.LeaseID(resp.Kvs[0].Lease)
+	if _, _, err := r.updateSubnet(ctx, sn, ip.IP6Net{}, ip.IP6Net{}, attrs, 24*time.Hour, before); err != nil {
+		t.Fatal("Failed to update subnet: ", err)
+	}
+
+	// Nor renew a lease that changed since
+	if _, err := r.renewSubnet(ctx, sn, before); err != errTestFailed {
+		t.Fatalf("Renewal with stale revision should fail with %v, got %v", errTestFailed, err)
+	}
+	if ttl, err := cli.TimeToLive(ctx, oldLease); err == nil && ttl.TTL != -1 {
+		t.Fatalf("Superseded etcd lease %x not revoked, TTL is %d", oldLease, ttl.TTL)
+	} else if err != nil && err != rpctypes.ErrLeaseNotFound {
+		t.Fatal(err)
+	}
+
+	// So does a delete, which fails if the key changed since the given revision
+	if err := r.deleteSubnet(ctx, sn, ip.IP6Net{}, before); err != errTestFailed {
+		t.Fatalf("Delete with stale revision should fail with %v, got %v", errTestFailed, err)
+	}
+	if err := r.deleteSubnet(ctx, sn, ip.IP6Net{}, 0); err != nil {
+		t.Fatalf("Failed to delete subnet %v: %v", sn, err)
+	}
+
+	if _, _, err := r.getSubnet(ctx, sn); err != errKeyNotFound {
+		t.Fatalf("Expected %v getting deleted subnet, got %v", errKeyNotFound, err)
+	}
+
+	// All changes should be visible to a watch started from the original revision
+	var seen []Event
+	for len(seen) < 2 || seen[len(seen)-1].Type != EventRemoved {
+		evts, next, err := r.watchSubnets(ctx, rev)
+		if err != nil {
+			t.Fatal("Failed to watch subnets: ", err)
+		}
+		seen = append(seen, evts...)
+		rev = next
+	}
+
+	if seen[0].Type != EventAdded || !seen[0].Lease.Subnet.Equal(sn) {
+		t.Fatalf("Unexpected first watch event: %v", seen[0])
+	}
+	if last := seen[len(seen)-1]; !last.Lease.Subnet.Equal(sn) || last.Lease.Attrs.PublicIP != attrs.PublicIP {
+		t.Fatalf("Removed lease lost its attributes: %v", last.Lease)
+	}
+}
+
+func TestEtcdRegistryIPv6Reservation(t *testing.T) {
+	r, cli, stop := newTestEtcdRegistry(t)
+	defer stop()
+
+	ctx := context.Background()
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.1.5.0"), PrefixLen: 24}
+	other := ip.IP4Net{IP: ip.MustParseIP4("10.1.6.0"), PrefixLen: 24}
+	sn6 := func(s string) ip.IP6Net {
+		return ip.IP6Net{IP: ip.MustParseIP6(s), PrefixLen: 64}
+	}
+
+	// reservation returns the etcd lease the reservation of an IPv6 subnet is
+	// attached to, or -1 if it's not reserved.
+	reservation := func(n ip.IP6Net) int64 {
+		resp, err := cli.Get(ctx, testPrefix+"/ipv6subnets/"+MakeIPv6SubnetKey(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) == 0 {
+			return -1
+		}
+		return resp.Kvs[0].Lease
+	}
+
+	if _, _, err := r.createSubnet(ctx, sn, sn6("fd00:0:0:1::"), attrs, 24*time.Hour); err != nil {
+		t.Fatal("Failed to create subnet lease: ", err)
+	}
+	l, _, err := r.getSubnet(ctx, sn)
+	if err != nil {
+		t.Fatal("Failed to get subnet: ", err)
+	}
+	resp, err := cli.Get(ctx, testPrefix+"/subnets/10.1.5.0-24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reservation(l.IPv6Subnet); got != resp.Kvs[0].Lease {
+		t.Fatalf("IPv6 subnet is reserved with etcd lease %x, the subnet with %x", got, resp.Kvs[0].Lease)
+	}
+
+	// Another lease can't take the same IPv6 subnet
+	if _, _, err := r.createSubnet(ctx, other, sn6("fd00:0:0:1::"), attrs, 24*time.Hour); err != errNodeExist {
+		t.Fatalf("Creating a lease with a taken IPv6 subnet should fail with %v, got %v", errNodeExist, err)
+	}
+	if _, _, err := r.getSubnet(ctx, other); err != errKeyNotFound {
+		t.Fatalf("Expected %v getting the lease that failed, got %v", errKeyNotFound, err)
+	}
+	if _, _, err := r.createSubnet(ctx, other, sn6("fd00:0:0:2::"), attrs, 24*time.Hour); err != nil {
+		t.Fatal("Failed to create subnet lease: ", err)
+	}
+
+	// Nor move over to it
+	if _, _, err := r.updateSubnet(ctx, sn, sn6("fd00:0:0:2::"), l.IPv6Subnet, attrs, 24*time.Hour, int64(l.Asof)); err != errTestFailed {
+		t.Fatalf("Moving to a taken IPv6 subnet should fail with %v, got %v", errTestFailed, err)
+	}
+	_, asof, err := r.updateSubnet(ctx, sn, sn6("fd00:0:0:3::"), l.IPv6Subnet, attrs, 24*time.Hour, int64(l.Asof))
+	if err != nil {
+		t.Fatal("Failed to move to a free IPv6 subnet: ", err)
+	}
+	if reservation(sn6("fd00:0:0:1::")) != -1 {
+		t.Fatal("IPv6 subnet moved away from is still reserved")
+	}
+
+	// The reservation of a reserved lease doesn't expire either
+	if _, asof, err = r.updateSubnet(ctx, sn, sn6("fd00:0:0:3::"), sn6("fd00:0:0:3::"), attrs, 0, asof); err != nil {
+		t.Fatal("Failed to update subnet: ", err)
+	}
+	if got := reservation(sn6("fd00:0:0:3::")); got != 0 {
+		t.Fatalf("IPv6 subnet of a reserved lease is attached to etcd lease %x", got)
+	}
+
+	if err := r.deleteSubnet(ctx, sn, sn6("fd00:0:0:3::"), asof); err != nil {
+		t.Fatalf("Failed to delete subnet %v: %v", sn, err)
+	}
+	if reservation(sn6("fd00:0:0:3::")) != -1 {
+		t.Fatal("IPv6 subnet of a deleted lease is still reserved")
+	}
+	if reservation(sn6("fd00:0:0:2::")) == -1 {
+		t.Fatal("IPv6 subnet of another lease was released")
+	}
+}
+
+func TestEtcdRegistryCompaction(t *testing.T) {
+	r, cli, stop := newTestEtcdRegistry(t)
+	defer stop()
+
+	ctx := context.Background()
+
+	_, rev, err := r.getSubnets(ctx)
+	if err != nil {
+		t.Fatal("Failed to get subnets: ", err)
+	}
+
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	for i := 1; i <= 3; i++ {
+		sn := ip.IP4Net{IP: ip.MustParseIP4(fmt.Sprintf("10.1.%d.0", i)), PrefixLen: 24}
+		if _, _, err := r.createSubnet(ctx, sn, ip.IP6Net{}, attrs, 24*time.Hour); err != nil {
+			t.Fatal("Failed to create subnet lease: ", err)
+		}
+	}
+
+	_, latest, err := r.getSubnets(ctx)
+	if err != nil {
+		t.Fatal("Failed to get subnets: ", err)
+	}
+	if _, err := cli.Compact(ctx, latest, etcd.WithCompactPhysical()); err != nil {
+		t.Fatal("Failed to compact: ", err)
+	}
+
+	if _, _, err := r.watchSubnets(ctx, rev); !isErrCompacted(err) {
+		t.Fatalf("Watch from compacted revision should fail with compaction error, got %v", err)
+	}
+}
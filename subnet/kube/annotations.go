@@ -26,6 +26,14 @@ type annotations struct {
 	BackendType              string
 	BackendPublicIP          string
 	BackendPublicIPOverwrite string
+	BackendV6Data            string
+	BackendPublicIPv6        string
+	// LeaseRenewTime is refreshed by RenewLease as a heartbeat of the node's lease.
+	LeaseRenewTime string
+	// IPAMLeader holds the leader record on the lock of --kube-ipam.
+	IPAMLeader string
+	// NodeGroup is a node label rather than an annotation.
+	NodeGroup string
 }
 
 func newAnnotations(prefix string) (annotations, error) {
@@ -60,6 +68,11 @@ func newAnnotations(prefix string) (annotations, error) {
 		BackendType:              prefix + "backend-type",
 		BackendPublicIP:          prefix + "public-ip",
 		BackendPublicIPOverwrite: prefix + "public-ip-overwrite",
+		BackendV6Data:            prefix + "backend-v6-data",
+		BackendPublicIPv6:        prefix + "public-ipv6",
+		LeaseRenewTime:           prefix + "lease-renew-time",
+		IPAMLeader:               prefix + "ipam-leader",
+		NodeGroup:                prefix + "node-group",
 	}
 
 	return a, nil
@@ -0,0 +1,295 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// ipamLockName is the ConfigMap the flanneld instances elect the one
+	// assigning pod CIDRs with.
+	ipamLockName = "kube-flannel-ipam"
+
+	ipamLeaseDuration = 15 * time.Second
+	ipamRenewDeadline = 10 * time.Second
+	ipamRetryPeriod   = 2 * time.Second
+	ipamResyncPeriod  = 30 * time.Second
+)
+
+// leaderRecord is kept in the IPAMLeader annotation of the lock ConfigMap.
+type leaderRecord struct {
+	HolderIdentity string    `json:"holderIdentity"`
+	RenewTime      time.Time `json:"renewTime"`
+}
+
+// nodeIPAM assigns pod CIDRs to the nodes in place of the node IPAM of
+// kube-controller-manager, while its flanneld is the elected leader.
+type nodeIPAM struct {
+	ksm       *kubeSubnetManager
+	namespace string
+	queue     chan struct{}
+
+	// The leader record last seen in the lock and when it was first seen.
+	// Expiry is judged by the local clock, so clocks don't need to be in sync.
+	observed     leaderRecord
+	observedTime time.Time
+
+	// Pod CIDRs assigned but not in the node cache yet
+	assigned map[string]ip.IP4Net
+}
+
+func newNodeIPAM(ksm *kubeSubnetManager) *nodeIPAM {
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "kube-system"
+	}
+
+	return &nodeIPAM{
+		ksm:       ksm,
+		namespace: namespace,
+		queue:     make(chan struct{}, 1),
+		assigned:  make(map[string]ip.IP4Net),
+	}
+}
+
+// nodeChanged schedules a pass over the nodes if n might need a pod CIDR or
+// frees one.
+func (ipam *nodeIPAM) nodeChanged(n *v1.Node, deleted bool) {
+	if !deleted && n.Spec.PodCIDR != "" {
+		return
+	}
+	select {
+	case ipam.queue <- struct{}{}:
+	default:
+	}
+}
+
+func (ipam *nodeIPAM) Run(ctx context.Context) {
+	for {
+		glog.Infof("Waiting to become the leader assigning pod CIDRs (lock %s/%s)", ipam.namespace, ipamLockName)
+		wait.PollUntil(ipamRetryPeriod, ipam.tryAcquireOrRenew, ctx.Done())
+		if ctx.Err() != nil {
+			return
+		}
+		glog.Infof("Became the leader assigning pod CIDRs")
+
+		leaderCtx, cancel := context.WithCancel(ctx)
+		go ipam.renew(leaderCtx, cancel)
+		ipam.assignPodCIDRs(leaderCtx)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+		glog.Warningf("Lost the leadership for assigning pod CIDRs")
+	}
+}
+
+// renew keeps renewing the leadership and calls lost once it isn't renewed
+// within the deadline.
+func (ipam *nodeIPAM) renew(ctx context.Context, lost func()) {
+	renewed := time.Now()
+	wait.Until(func() {
+		ok, err := ipam.tryAcquireOrRenew()
+		switch {
+		case ok:
+			renewed = time.Now()
+		case err == nil:
+			// Someone else took over
+			lost()
+		case time.Since(renewed) > ipamRenewDeadline:
+			glog.Errorf("Failed to renew the leadership for assigning pod CIDRs: %v", err)
+			lost()
+		}
+	}, ipamRetryPeriod, ctx.Done())
+}
+
+// tryAcquireOrRenew takes the lock if it is free or expired, or renews it if it
+// is held already. Concurrent updates are caught by the resource version.
+func (ipam *nodeIPAM) tryAcquireOrRenew() (bool, error) {
+	client := ipam.ksm.client.CoreV1().ConfigMaps(ipam.namespace)
+	key := ipam.ksm.annotations.IPAMLeader
+	now := time.Now()
+
+	data, err := json.Marshal(leaderRecord{HolderIdentity: ipam.ksm.nodeName, RenewTime: now})
+	if err != nil {
+		return false, err
+	}
+
+	cm, err := client.Get(ipamLockName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        ipamLockName,
+				Namespace:   ipam.namespace,
+				Annotations: map[string]string{key: string(data)},
+			},
+		})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	} else if err != nil {
+		return false, err
+	}
+
+	var record leaderRecord
+	if v, ok := cm.Annotations[key]; ok {
+		if err := json.Unmarshal([]byte(v), &record); err != nil {
+			glog.Warningf("Ignoring invalid leader record in %s/%s: %v", ipam.namespace, ipamLockName, err)
+		}
+	}
+	if record != ipam.observed {
+		ipam.observed = record
+		ipam.observedTime = now
+	}
+	if record.HolderIdentity != "" && record.HolderIdentity != ipam.ksm.nodeName &&
+		now.Before(ipam.observedTime.Add(ipamLeaseDuration)) {
+		return false, nil
+	}
+
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string)
+	}
+	cm.Annotations[key] = string(data)
+	if _, err := client.Update(cm); apierrors.IsConflict(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// assignPodCIDRs assigns pod CIDRs to the nodes whenever they might need one,
+// until ctx is done.
+func (ipam *nodeIPAM) assignPodCIDRs(ctx context.Context) {
+	ticker := time.NewTicker(ipamResyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		if err := ipam.assignPending(ctx); err != nil {
+			glog.Errorf("Failed to assign pod CIDRs: %v", err)
+		}
+
+		select {
+		case <-ipam.queue:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type podCIDRAssignment struct {
+	node    string
+	podCIDR ip.IP4Net
+}
+
+func (ipam *nodeIPAM) assignPending(ctx context.Context) error {
+	config, err := ipam.ksm.GetNetworkConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if config.IPv6Enabled() {
+		return errors.New("IPv6 pod CIDRs can't be assigned")
+	}
+	nodes, err := ipam.ksm.nodeStore.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, a := range ipam.plan(config, nodes) {
+		patch := fmt.Sprintf(`{"spec":{"podCIDR":%q}}`, a.podCIDR)
+		if _, err := ipam.ksm.client.CoreV1().Nodes().Patch(a.node, types.StrategicMergePatchType, []byte(patch)); err != nil {
+			glog.Errorf("Failed to assign pod CIDR %v to node %q: %v", a.podCIDR, a.node, err)
+			delete(ipam.assigned, a.node)
+			continue
+		}
+		glog.Infof("Assigned pod CIDR %v to node %q", a.podCIDR, a.node)
+	}
+	return nil
+}
+
+// plan picks pod CIDRs for the nodes without one, the way the subnet managers
+// pick subnets for their leases, with the node name as key. The CIDRs of
+// deleted nodes are free to be picked again. The picks are recorded as assigned.
+func (ipam *nodeIPAM) plan(config *subnet.Config, nodes []*v1.Node) []podCIDRAssignment {
+	var used []ip.IP4Net
+	var pending []*v1.Node
+	existing := make(map[string]bool)
+	for _, n := range nodes {
+		existing[n.Name] = true
+		if n.Spec.PodCIDR == "" {
+			if _, ok := ipam.assigned[n.Name]; !ok {
+				pending = append(pending, n)
+			}
+			continue
+		}
+
+		delete(ipam.assigned, n.Name)
+		// Secondary pod CIDRs assigned by others are in use as well
+		for _, s := range podCIDRs(n) {
+			_, cidr, err := net.ParseCIDR(s)
+			if err != nil {
+				glog.Warningf("Ignoring invalid pod CIDR %q of node %q", s, n.Name)
+				continue
+			}
+			if cidr.IP.To4() != nil {
+				used = append(used, ip.FromIPNet(cidr))
+			}
+		}
+	}
+	for name, sn := range ipam.assigned {
+		if !existing[name] {
+			delete(ipam.assigned, name)
+			continue
+		}
+		used = append(used, sn)
+	}
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Name < pending[j].Name })
+
+	var assignments []podCIDRAssignment
+	for _, n := range pending {
+		sn, err := config.AllocateSubnet(n.Labels[ipam.ksm.annotations.NodeGroup], n.Name, used)
+		if err != nil {
+			glog.Errorf("Unable to pick a pod CIDR for node %q: %v", n.Name, err)
+			continue
+		}
+		used = append(used, sn)
+		ipam.assigned[n.Name] = sn
+		assignments = append(assignments, podCIDRAssignment{n.Name, sn})
+	}
+	return assignments
+}
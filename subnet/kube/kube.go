@@ -19,8 +19,9 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/flannel/pkg/ip"
@@ -28,7 +29,9 @@ import (
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
@@ -50,6 +53,8 @@ var (
 const (
 	resyncPeriod              = 5 * time.Minute
 	nodeControllerSyncTimeout = 10 * time.Minute
+	// leaseTTL is how long a lease lasts without a heartbeat from RenewLease.
+	leaseTTL = 24 * time.Hour
 )
 
 type kubeSubnetManager struct {
@@ -59,10 +64,29 @@ type kubeSubnetManager struct {
 	nodeStore      listers.NodeLister
 	nodeController cache.Controller
 	subnetConf     *subnet.Config
+	netConfPath    string
 	events         chan subnet.Event
+
+	// netConf is set if the net conf is read from a ConfigMap through the API.
+	netConf *configMapNetConf
+
+	// ipam assigns pod CIDRs to nodes if enabled, nil otherwise.
+	ipam *nodeIPAM
+
+	// nodeChanged is signalled whenever the informer sees a change to this node.
+	nodeChanged chan struct{}
+
+	mux sync.Mutex
+	// The node UID, flannel annotations and pod CIDRs seen by AcquireLease. A
+	// lease stays valid for as long as they are left untouched.
+	nodeUID          types.UID
+	leaseAnnotations map[string]string
+	leasePodCIDRs    string
 }
 
-func NewSubnetManager(apiUrl, kubeconfig, prefix, netConfPath string) (subnet.Manager, error) {
+// NewSubnetManager creates a subnet manager using the pod CIDRs of the nodes as
+// subnets. With ipam set, the pod CIDRs are assigned by flanneld itself.
+func NewSubnetManager(apiUrl, kubeconfig, prefix, netConfPath, netConfConfigMap, netConfKey string, ipam bool) (subnet.Manager, error) {
 
 	var cfg *rest.Config
 	var err error
@@ -100,20 +124,46 @@ func NewSubnetManager(apiUrl, kubeconfig, prefix, netConfPath string) (subnet.Ma
 		}
 	}
 
-	netConf, err := ioutil.ReadFile(netConfPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read net conf: %v", err)
-	}
+	var netConf *configMapNetConf
+	var sc *subnet.Config
+	if netConfConfigMap != "" {
+		netConf, err = newConfigMapNetConf(c, netConfConfigMap, netConfKey)
+		if err != nil {
+			return nil, err
+		}
+		go netConf.controller.Run(wait.NeverStop)
 
-	sc, err := subnet.ParseConfig(string(netConf))
+		glog.Infof("Waiting %s for ConfigMap %s to sync", nodeControllerSyncTimeout, netConfConfigMap)
+		err = wait.Poll(time.Second, nodeControllerSyncTimeout, func() (bool, error) {
+			return netConf.controller.HasSynced(), nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error waiting for ConfigMap %s to sync: %v", netConfConfigMap, err)
+		}
+		sc, err = netConf.read()
+	} else {
+		sc, err = readNetConf(netConfPath)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error parsing subnet config: %s", err)
+		return nil, err
 	}
 
 	sm, err := newKubeSubnetManager(c, sc, nodeName, prefix)
 	if err != nil {
 		return nil, fmt.Errorf("error creating network manager: %s", err)
 	}
+	if netConf != nil {
+		sm.netConf = netConf
+	} else {
+		sm.netConfPath = netConfPath
+	}
+	if ipam {
+		// Only podCIDR is assigned, nodes would never get an IPv6 pod CIDR
+		if sc.IPv6Enabled() {
+			return nil, errors.New("--kube-ipam doesn't support an IPv6Network")
+		}
+		sm.ipam = newNodeIPAM(sm)
+	}
 	go sm.Run(context.Background())
 
 	glog.Infof("Waiting %s for node controller to sync", nodeControllerSyncTimeout)
@@ -125,6 +175,10 @@ func NewSubnetManager(apiUrl, kubeconfig, prefix, netConfPath string) (subnet.Ma
 	}
 	glog.Infof("Node controller sync successful")
 
+	if sm.ipam != nil {
+		go sm.ipam.Run(context.Background())
+	}
+
 	return sm, nil
 }
 
@@ -139,22 +193,29 @@ func newKubeSubnetManager(c clientset.Interface, sc *subnet.Config, nodeName, pr
 	ksm.nodeName = nodeName
 	ksm.subnetConf = sc
 	ksm.events = make(chan subnet.Event, 5000)
+	ksm.nodeChanged = make(chan struct{}, 1)
 	indexer, controller := cache.NewIndexerInformer(
 		&cache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-				return ksm.client.CoreV1().Nodes().List(options)
+				return listNodes(ksm.client, options)
 			},
 			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-				return ksm.client.CoreV1().Nodes().Watch(options)
+				return watchNodes(ksm.client, options)
 			},
 		},
 		&v1.Node{},
 		resyncPeriod,
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
+				ksm.notifyNodeChanged(obj)
+				ksm.notifyIPAM(obj, false)
 				ksm.handleAddLeaseEvent(subnet.EventAdded, obj)
 			},
-			UpdateFunc: ksm.handleUpdateLeaseEvent,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				ksm.notifyNodeChanged(newObj)
+				ksm.notifyIPAM(newObj, false)
+				ksm.handleUpdateLeaseEvent(oldObj, newObj)
+			},
 			DeleteFunc: func(obj interface{}) {
 				node, isNode := obj.(*v1.Node)
 				// We can get DeletedFinalStateUnknown instead of *api.Node here and we need to handle that correctly.
@@ -171,6 +232,8 @@ func newKubeSubnetManager(c clientset.Interface, sc *subnet.Config, nodeName, pr
 					}
 					obj = node
 				}
+				ksm.notifyNodeChanged(obj)
+				ksm.notifyIPAM(obj, true)
 				ksm.handleAddLeaseEvent(subnet.EventRemoved, obj)
 			},
 		},
@@ -181,6 +244,24 @@ func newKubeSubnetManager(c clientset.Interface, sc *subnet.Config, nodeName, pr
 	return &ksm, nil
 }
 
+// notifyNodeChanged wakes up WatchLease if obj is the node flannel runs on.
+func (ksm *kubeSubnetManager) notifyNodeChanged(obj interface{}) {
+	n, ok := obj.(*v1.Node)
+	if !ok || n.Name != ksm.nodeName {
+		return
+	}
+	select {
+	case ksm.nodeChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (ksm *kubeSubnetManager) notifyIPAM(obj interface{}, deleted bool) {
+	if n, ok := obj.(*v1.Node); ok && ksm.ipam != nil {
+		ksm.ipam.nodeChanged(n, deleted)
+	}
+}
+
 func (ksm *kubeSubnetManager) handleAddLeaseEvent(et subnet.EventType, obj interface{}) {
 	n := obj.(*v1.Node)
 	if s, ok := n.Annotations[ksm.annotations.SubnetKubeManaged]; !ok || s != "true" {
@@ -192,6 +273,9 @@ func (ksm *kubeSubnetManager) handleAddLeaseEvent(et subnet.EventType, obj inter
 		glog.Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
 		return
 	}
+	if et == subnet.EventAdded {
+		ksm.checkPeerConflict(n, l)
+	}
 	ksm.events <- subnet.Event{et, l}
 }
 
@@ -199,11 +283,20 @@ func (ksm *kubeSubnetManager) handleUpdateLeaseEvent(oldObj, newObj interface{})
 	o := oldObj.(*v1.Node)
 	n := newObj.(*v1.Node)
 	if s, ok := n.Annotations[ksm.annotations.SubnetKubeManaged]; !ok || s != "true" {
+		// The lease of the node was released
+		if o.Annotations[ksm.annotations.SubnetKubeManaged] == "true" {
+			if l, err := ksm.nodeToLease(*o); err == nil {
+				ksm.events <- subnet.Event{subnet.EventRemoved, l}
+			}
+		}
 		return
 	}
 	if o.Annotations[ksm.annotations.BackendData] == n.Annotations[ksm.annotations.BackendData] &&
 		o.Annotations[ksm.annotations.BackendType] == n.Annotations[ksm.annotations.BackendType] &&
-		o.Annotations[ksm.annotations.BackendPublicIP] == n.Annotations[ksm.annotations.BackendPublicIP] {
+		o.Annotations[ksm.annotations.BackendPublicIP] == n.Annotations[ksm.annotations.BackendPublicIP] &&
+		o.Annotations[ksm.annotations.BackendV6Data] == n.Annotations[ksm.annotations.BackendV6Data] &&
+		o.Annotations[ksm.annotations.BackendPublicIPv6] == n.Annotations[ksm.annotations.BackendPublicIPv6] &&
+		strings.Join(podCIDRs(o), ",") == strings.Join(podCIDRs(n), ",") {
 		return // No change to lease
 	}
 
@@ -212,14 +305,55 @@ func (ksm *kubeSubnetManager) handleUpdateLeaseEvent(oldObj, newObj interface{})
 		glog.Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
 		return
 	}
+	ksm.checkPeerConflict(n, l)
 	ksm.events <- subnet.Event{subnet.EventAdded, l}
 }
 
+// GetNetworkConfig re-reads the net conf file, or the ConfigMap it's kept in, on
+// every call so that changes to it can be picked up without a restart. The config
+// the manager was created with is left untouched.
 func (ksm *kubeSubnetManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
-	return ksm.subnetConf, nil
+	if ksm.netConf != nil {
+		return ksm.netConf.read()
+	}
+	if ksm.netConfPath == "" {
+		return ksm.subnetConf, nil
+	}
+	return readNetConf(ksm.netConfPath)
+}
+
+// ConfigChanged implements subnet.ConfigWatcher. Changes are only watched when
+// the net conf is read from a ConfigMap.
+func (ksm *kubeSubnetManager) ConfigChanged() <-chan struct{} {
+	if ksm.netConf == nil {
+		return nil
+	}
+	return ksm.netConf.changes()
+}
+
+func readNetConf(netConfPath string) (*subnet.Config, error) {
+	netConf, err := ioutil.ReadFile(netConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read net conf: %v", err)
+	}
+	return parseNetConf(string(netConf))
+}
+
+func parseNetConf(netConf string) (*subnet.Config, error) {
+	sc, err := subnet.ParseConfig(netConf)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing subnet config: %s", err)
+	}
+	return sc, nil
 }
 
 func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if ksm.ipam != nil {
+		if err := ksm.waitForPodCIDR(ctx); err != nil {
+			return nil, err
+		}
+	}
+
 	cachedNode, err := ksm.nodeStore.Get(ksm.nodeName)
 	if err != nil {
 		return nil, err
@@ -230,20 +364,37 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.Le
 	}
 	n := nobj.(*v1.Node)
 
-	if n.Spec.PodCIDR == "" {
+	if len(podCIDRs(n)) == 0 {
 		return nil, fmt.Errorf("node %q pod cidr not assigned", ksm.nodeName)
 	}
 	bd, err := attrs.BackendData.MarshalJSON()
 	if err != nil {
 		return nil, err
 	}
-	_, cidr, err := net.ParseCIDR(n.Spec.PodCIDR)
-	if err != nil {
+	var lease subnet.Lease
+	if err := setLeaseSubnets(&lease, n); err != nil {
 		return nil, err
 	}
+	if ksm.subnetConf.IPv6Enabled() && lease.IPv6Subnet.Empty() {
+		return nil, fmt.Errorf("IPv6Network is configured but node %q has no IPv6 pod cidr", ksm.nodeName)
+	}
+	if group := n.Labels[ksm.annotations.NodeGroup]; group != "" {
+		attrs.NodeGroup = group
+		ksm.checkNodeGroup(ctx, group, lease.Subnet)
+	}
+	var v6bd []byte
+	var publicIPv6 string
+	if attrs.PublicIPv6 != nil {
+		if v6bd, err = attrs.BackendV6Data.MarshalJSON(); err != nil {
+			return nil, err
+		}
+		publicIPv6 = attrs.PublicIPv6.String()
+	}
 	if n.Annotations[ksm.annotations.BackendData] != string(bd) ||
 		n.Annotations[ksm.annotations.BackendType] != attrs.BackendType ||
 		n.Annotations[ksm.annotations.BackendPublicIP] != attrs.PublicIP.String() ||
+		n.Annotations[ksm.annotations.BackendV6Data] != string(v6bd) ||
+		n.Annotations[ksm.annotations.BackendPublicIPv6] != publicIPv6 ||
 		n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" ||
 		(n.Annotations[ksm.annotations.BackendPublicIPOverwrite] != "" && n.Annotations[ksm.annotations.BackendPublicIPOverwrite] != attrs.PublicIP.String()) {
 		n.Annotations[ksm.annotations.BackendType] = attrs.BackendType
@@ -258,48 +409,153 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.Le
 		} else {
 			n.Annotations[ksm.annotations.BackendPublicIP] = attrs.PublicIP.String()
 		}
+		if attrs.PublicIPv6 != nil {
+			n.Annotations[ksm.annotations.BackendV6Data] = string(v6bd)
+			n.Annotations[ksm.annotations.BackendPublicIPv6] = publicIPv6
+		} else {
+			delete(n.Annotations, ksm.annotations.BackendV6Data)
+			delete(n.Annotations, ksm.annotations.BackendPublicIPv6)
+		}
 		n.Annotations[ksm.annotations.SubnetKubeManaged] = "true"
+	}
+	// The renew time changes on every call, so the node always gets patched.
+	now := time.Now()
+	n.Annotations[ksm.annotations.LeaseRenewTime] = now.UTC().Format(time.RFC3339)
 
-		oldData, err := json.Marshal(cachedNode)
-		if err != nil {
-			return nil, err
-		}
+	oldData, err := json.Marshal(cachedNode)
+	if err != nil {
+		return nil, err
+	}
 
-		newData, err := json.Marshal(n)
-		if err != nil {
-			return nil, err
-		}
+	newData, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
 
-		patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, v1.Node{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to create patch for node %q: %v", ksm.nodeName, err)
+	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, v1.Node{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create patch for node %q: %v", ksm.nodeName, err)
+	}
+
+	_, err = ksm.client.CoreV1().Nodes().Patch(ksm.nodeName, types.StrategicMergePatchType, patchBytes, "status")
+	if err != nil {
+		return nil, err
+	}
+
+	ksm.mux.Lock()
+	ksm.nodeUID = n.UID
+	ksm.leaseAnnotations = map[string]string{
+		ksm.annotations.SubnetKubeManaged: n.Annotations[ksm.annotations.SubnetKubeManaged],
+		ksm.annotations.BackendType:       n.Annotations[ksm.annotations.BackendType],
+		ksm.annotations.BackendData:       n.Annotations[ksm.annotations.BackendData],
+		ksm.annotations.BackendPublicIP:   n.Annotations[ksm.annotations.BackendPublicIP],
+		ksm.annotations.BackendV6Data:     n.Annotations[ksm.annotations.BackendV6Data],
+		ksm.annotations.BackendPublicIPv6: n.Annotations[ksm.annotations.BackendPublicIPv6],
+	}
+	ksm.leasePodCIDRs = strings.Join(podCIDRs(n), ",")
+	ksm.mux.Unlock()
+
+	ksm.RecordEvent(subnet.NodeEventNormal, "LeaseAcquired", fmt.Sprintf("Acquired lease on %v", lease.Subnet))
+
+	// Nodes added from now on get checked as they come
+	if nodes, err := ksm.nodeStore.List(labels.Everything()); err == nil {
+		for _, other := range nodes {
+			if other.Annotations[ksm.annotations.SubnetKubeManaged] != "true" {
+				continue
+			}
+			if l, err := ksm.nodeToLease(*other); err == nil {
+				ksm.checkPeerConflict(other, l)
+			}
 		}
+	}
+	lease.Attrs = *attrs
+	lease.Expiration = now.Add(leaseTTL)
+	return &lease, nil
+}
 
-		_, err = ksm.client.CoreV1().Nodes().Patch(ksm.nodeName, types.StrategicMergePatchType, patchBytes, "status")
-		if err != nil {
-			return nil, err
+// waitForPodCIDR waits for the flanneld leading the IPAM, which may be another
+// one, to assign a pod CIDR to the node.
+func (ksm *kubeSubnetManager) waitForPodCIDR(ctx context.Context) error {
+	assigned := func() (bool, error) {
+		n, err := ksm.nodeStore.Get(ksm.nodeName)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return false, err
 		}
+		return n != nil && len(podCIDRs(n)) > 0, nil
+	}
+
+	if ok, err := assigned(); ok || err != nil {
+		return err
 	}
-	err = ksm.setNodeNetworkUnavailableFalse()
+	glog.Infof("Waiting for a pod cidr to be assigned to node %q", ksm.nodeName)
+	return wait.PollUntil(time.Second, assigned, ctx.Done())
+}
+
+// checkNodeGroup warns when the pod CIDR kubernetes assigned to the node doesn't
+// fit the node group it is labeled with. The pod CIDR is used regardless.
+func (ksm *kubeSubnetManager) checkNodeGroup(ctx context.Context, group string, sn ip.IP4Net) {
+	sc, err := ksm.GetNetworkConfig(ctx)
 	if err != nil {
-		glog.Errorf("Unable to set NetworkUnavailable to False for %q: %v", ksm.nodeName, err)
+		glog.Warningf("Unable to check node group %q of %q: %v", group, ksm.nodeName, err)
+		return
+	}
+	if _, ok := sc.NodeGroups[group]; !ok {
+		glog.Warningf("Node %q is labeled with unknown node group %q", ksm.nodeName, group)
+	} else if !sc.IsValidSubnet(group, sn) {
+		glog.Warningf("Pod CIDR %v of node %q doesn't fit its node group %q", sn, ksm.nodeName, group)
 	}
-	return &subnet.Lease{
-		Subnet:     ip.FromIPNet(cidr),
-		Attrs:      *attrs,
-		Expiration: time.Now().Add(24 * time.Hour),
-	}, nil
 }
 
+// WatchLeases starts out with a snapshot of the leases of all nodes, then
+// passes on the changes seen by the node informer one at a time.
 func (ksm *kubeSubnetManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	if cursor == nil {
+		return subnet.LeaseWatchResult{
+			Snapshot: ksm.leases(),
+			Cursor:   "events",
+		}, nil
+	}
+
 	select {
 	case event := <-ksm.events:
 		return subnet.LeaseWatchResult{
 			Events: []subnet.Event{event},
 		}, nil
 	case <-ctx.Done():
-		return subnet.LeaseWatchResult{}, nil
+		return subnet.LeaseWatchResult{}, ctx.Err()
+	}
+}
+
+// leases drops the queued events, then returns the leases of all nodes. The
+// informer updates its cache before it queues an event, so the dropped events
+// are covered by the leases.
+func (ksm *kubeSubnetManager) leases() []subnet.Lease {
+	for drained := false; !drained; {
+		select {
+		case <-ksm.events:
+		default:
+			drained = true
+		}
+	}
+
+	nodes, err := ksm.nodeStore.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("Unable to list nodes: %v", err)
+		return nil
+	}
+	var leases []subnet.Lease
+	for _, n := range nodes {
+		if n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" {
+			continue
+		}
+		l, err := ksm.nodeToLease(*n)
+		if err != nil {
+			glog.Infof("Error turning node %q to lease: %v", n.Name, err)
+			continue
+		}
+		leases = append(leases, l)
 	}
+	return leases
 }
 
 func (ksm *kubeSubnetManager) Run(ctx context.Context) {
@@ -316,44 +572,171 @@ func (ksm *kubeSubnetManager) nodeToLease(n v1.Node) (l subnet.Lease, err error)
 	l.Attrs.BackendType = n.Annotations[ksm.annotations.BackendType]
 	l.Attrs.BackendData = json.RawMessage(n.Annotations[ksm.annotations.BackendData])
 
-	_, cidr, err := net.ParseCIDR(n.Spec.PodCIDR)
+	if s := n.Annotations[ksm.annotations.BackendPublicIPv6]; s != "" {
+		publicIPv6, err := ip.ParseIP6(s)
+		if err != nil {
+			return l, err
+		}
+		l.Attrs.PublicIPv6 = &publicIPv6
+		l.Attrs.BackendV6Data = json.RawMessage(n.Annotations[ksm.annotations.BackendV6Data])
+	}
+
+	err = setLeaseSubnets(&l, &n)
+	return l, err
+}
+
+// ownLease returns the lease node n holds on sn. It fails if the lease was
+// revoked: if the pod CIDRs changed, the flannel annotations set by AcquireLease
+// were overwritten or the node was recreated since.
+func (ksm *kubeSubnetManager) ownLease(n *v1.Node, sn ip.IP4Net) (*subnet.Lease, error) {
+	ksm.mux.Lock()
+	defer ksm.mux.Unlock()
+
+	if ksm.leaseAnnotations == nil {
+		return nil, fmt.Errorf("no lease acquired for node %q", ksm.nodeName)
+	}
+	if n.UID != ksm.nodeUID {
+		return nil, fmt.Errorf("node %q was recreated", ksm.nodeName)
+	}
+	for k, v := range ksm.leaseAnnotations {
+		if n.Annotations[k] != v {
+			return nil, fmt.Errorf("annotation %s of node %q changed to %q", k, ksm.nodeName, n.Annotations[k])
+		}
+	}
+
+	l, err := ksm.nodeToLease(*n)
 	if err != nil {
-		return l, err
+		return nil, err
+	}
+	if cidrs := strings.Join(podCIDRs(n), ","); !l.Subnet.Equal(sn) || cidrs != ksm.leasePodCIDRs {
+		return nil, fmt.Errorf("pod cidrs of node %q changed to %v", ksm.nodeName, cidrs)
 	}
 
-	l.Subnet = ip.FromIPNet(cidr)
-	return l, nil
+	// Without a (valid) renew time the lease counts as expired and gets renewed
+	// right away.
+	if t, err := time.Parse(time.RFC3339, n.Annotations[ksm.annotations.LeaseRenewTime]); err == nil {
+		l.Expiration = t.Add(leaseTTL)
+	}
+	return &l, nil
 }
 
-// RenewLease: unimplemented
+// RenewLease refreshes the renew time annotation of the node, as a heartbeat
+// showing that flannel still runs there. It fails if the lease was revoked in
+// the meantime, which WatchLease reports as well.
 func (ksm *kubeSubnetManager) RenewLease(ctx context.Context, lease *subnet.Lease) error {
-	return ErrUnimplemented
+	n, err := ksm.nodeStore.Get(ksm.nodeName)
+	if err != nil {
+		return err
+	}
+	if _, err := ksm.ownLease(n, lease.Subnet); err != nil {
+		return fmt.Errorf("lease %v was revoked: %v", lease.Subnet, err)
+	}
+
+	now := time.Now()
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			// The UID can't change, so this fails if the node was recreated
+			"uid": n.UID,
+			"annotations": map[string]string{
+				ksm.annotations.LeaseRenewTime: now.UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := ksm.client.CoreV1().Nodes().Patch(ksm.nodeName, types.MergePatchType, patch, "status"); err != nil {
+		return err
+	}
+
+	lease.Expiration = now.Add(leaseTTL)
+	return nil
 }
 
-func (ksm *kubeSubnetManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
-	return subnet.LeaseWatchResult{}, ErrUnimplemented
+// ReleaseLease implements subnet.LeaseReleaser by removing the lease
+// annotations from the node, which stops other nodes routing to its pod CIDR.
+// The pod CIDR itself stays assigned to the node.
+func (ksm *kubeSubnetManager) ReleaseLease(ctx context.Context, lease *subnet.Lease) error {
+	remove := map[string]interface{}{}
+	for _, key := range []string{
+		ksm.annotations.SubnetKubeManaged,
+		ksm.annotations.BackendType,
+		ksm.annotations.BackendData,
+		ksm.annotations.BackendPublicIP,
+		ksm.annotations.BackendV6Data,
+		ksm.annotations.BackendPublicIPv6,
+		ksm.annotations.LeaseRenewTime,
+	} {
+		remove[key] = nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": remove,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := ksm.client.CoreV1().Nodes().Patch(ksm.nodeName, types.MergePatchType, patch, "status"); err != nil {
+		return err
+	}
+
+	ksm.mux.Lock()
+	ksm.leaseAnnotations = nil
+	ksm.mux.Unlock()
+
+	glog.Infof("Released the lease of node %q", ksm.nodeName)
+	return nil
 }
 
-func (ksm *kubeSubnetManager) Name() string {
-	return fmt.Sprintf("Kubernetes Subnet Manager - %s", ksm.nodeName)
+// WatchLease watches the node flannel runs on. The cursor is the resource
+// version of the node last seen. Every change to the node results in an
+// EventAdded with the current expiration of the lease, or EventRemoved once the
+// lease was revoked.
+func (ksm *kubeSubnetManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	for {
+		n, err := ksm.nodeStore.Get(ksm.nodeName)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return subnet.LeaseWatchResult{}, err
+		}
+
+		var version string
+		if n != nil {
+			version = n.ResourceVersion
+		}
+		if cursor == nil || cursor.(string) != version {
+			return ksm.leaseWatchResult(n, sn, version), nil
+		}
+
+		select {
+		case <-ksm.nodeChanged:
+		case <-ctx.Done():
+			return subnet.LeaseWatchResult{}, ctx.Err()
+		}
+	}
 }
 
-// Set Kubernetes NodeNetworkUnavailable to false when starting
-// https://kubernetes.io/docs/concepts/architecture/nodes/#condition
-func (ksm *kubeSubnetManager) setNodeNetworkUnavailableFalse() error {
-	condition := v1.NodeCondition{
-		Type:               v1.NodeNetworkUnavailable,
-		Status:             v1.ConditionFalse,
-		Reason:             "FlannelIsUp",
-		Message:            "Flannel is running on this node",
-		LastTransitionTime: metav1.Now(),
-		LastHeartbeatTime:  metav1.Now(),
-	}
-	raw, err := json.Marshal(&[]v1.NodeCondition{condition})
+func (ksm *kubeSubnetManager) leaseWatchResult(n *v1.Node, sn ip.IP4Net, version string) subnet.LeaseWatchResult {
+	var l *subnet.Lease
+	err := fmt.Errorf("node %q was deleted", ksm.nodeName)
+	if n != nil {
+		l, err = ksm.ownLease(n, sn)
+	}
+
 	if err != nil {
-		return err
+		glog.Warningf("Lease %v was revoked: %v", sn, err)
+		return subnet.LeaseWatchResult{
+			Events: []subnet.Event{{Type: subnet.EventRemoved, Lease: subnet.Lease{Subnet: sn}}},
+			Cursor: version,
+		}
 	}
-	patch := []byte(fmt.Sprintf(`{"status":{"conditions":%s}}`, raw))
-	_, err = ksm.client.CoreV1().Nodes().PatchStatus(ksm.nodeName, patch)
-	return err
+
+	return subnet.LeaseWatchResult{
+		Events: []subnet.Event{{Type: subnet.EventAdded, Lease: *l}},
+		Cursor: version,
+	}
+}
+
+func (ksm *kubeSubnetManager) Name() string {
+	return fmt.Sprintf("Kubernetes Subnet Manager - %s", ksm.nodeName)
 }
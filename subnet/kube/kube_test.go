@@ -0,0 +1,347 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func newTestManager(t *testing.T, n *v1.Node) (*kubeSubnetManager, cache.Indexer) {
+	a, err := newAnnotations("flannel.alpha.coreos.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(n); err != nil {
+		t.Fatal(err)
+	}
+
+	ksm := &kubeSubnetManager{
+		annotations: a,
+		nodeName:    n.Name,
+		nodeStore:   listers.NewNodeLister(indexer),
+		nodeChanged: make(chan struct{}, 1),
+		nodeUID:     n.UID,
+		leaseAnnotations: map[string]string{
+			a.SubnetKubeManaged: "true",
+			a.BackendType:       "vxlan",
+			a.BackendData:       "null",
+			a.BackendPublicIP:   "1.2.3.4",
+		},
+		leasePodCIDRs: n.Spec.PodCIDR,
+	}
+	return ksm, indexer
+}
+
+func newTestNode(renewTime time.Time) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "node-a",
+			UID:             "uid-a",
+			ResourceVersion: "1",
+			Annotations: map[string]string{
+				"flannel.alpha.coreos.com/kube-subnet-manager": "true",
+				"flannel.alpha.coreos.com/backend-type":        "vxlan",
+				"flannel.alpha.coreos.com/backend-data":        "null",
+				"flannel.alpha.coreos.com/public-ip":           "1.2.3.4",
+				"flannel.alpha.coreos.com/lease-renew-time":    renewTime.UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: v1.NodeSpec{PodCIDR: "10.244.1.0/24"},
+	}
+}
+
+func TestOwnLease(t *testing.T) {
+	renewTime := time.Now().Truncate(time.Second)
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.244.1.0"), PrefixLen: 24}
+
+	n := newTestNode(renewTime)
+	ksm, _ := newTestManager(t, n)
+
+	l, err := ksm.ownLease(n, sn)
+	if err != nil {
+		t.Fatal("ownLease failed: ", err)
+	}
+	if !l.Expiration.Equal(renewTime.Add(leaseTTL)) {
+		t.Errorf("Expected the lease to expire at %v, got %v", renewTime.Add(leaseTTL), l.Expiration)
+	}
+
+	for _, modify := range []func(n *v1.Node){
+		func(n *v1.Node) { n.Spec.PodCIDR = "10.244.2.0/24" },
+		func(n *v1.Node) { n.Annotations["flannel.alpha.coreos.com/public-ip"] = "1.2.3.5" },
+		func(n *v1.Node) { delete(n.Annotations, "flannel.alpha.coreos.com/kube-subnet-manager") },
+		func(n *v1.Node) { n.UID = "uid-b" },
+	} {
+		n := newTestNode(renewTime)
+		modify(n)
+		if _, err := ksm.ownLease(n, sn); err == nil {
+			t.Errorf("ownLease succeeded for a changed node: %+v", n)
+		}
+	}
+}
+
+func TestWatchLease(t *testing.T) {
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.244.1.0"), PrefixLen: 24}
+	ksm, indexer := newTestManager(t, newTestNode(time.Now()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wr, err := ksm.WatchLease(ctx, sn, nil)
+	if err != nil {
+		t.Fatal("WatchLease failed: ", err)
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Type != subnet.EventAdded || wr.Cursor != "1" {
+		t.Fatalf("Expected an added event, got %+v", wr)
+	}
+
+	// A heartbeat from another call of RenewLease moves the expiration
+	renewTime := time.Now().Add(time.Hour).Truncate(time.Second)
+	n := newTestNode(renewTime)
+	n.ResourceVersion = "2"
+	indexer.Update(n)
+	ksm.notifyNodeChanged(n)
+
+	wr, err = ksm.WatchLease(ctx, sn, wr.Cursor)
+	if err != nil {
+		t.Fatal("WatchLease failed: ", err)
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Type != subnet.EventAdded || !wr.Events[0].Lease.Expiration.Equal(renewTime.Add(leaseTTL)) {
+		t.Fatalf("Expected an added event with the new expiration, got %+v", wr)
+	}
+
+	// Changes to other nodes don't wake up the watch
+	ksm.notifyNodeChanged(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-b"}})
+	tctx, tcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer tcancel()
+	if _, err := ksm.WatchLease(tctx, sn, wr.Cursor); err != context.DeadlineExceeded {
+		t.Fatal("Expected DeadlineExceeded, got ", err)
+	}
+
+	// Deleting the node revokes the lease
+	indexer.Delete(n)
+	ksm.notifyNodeChanged(n)
+
+	wr, err = ksm.WatchLease(ctx, sn, wr.Cursor)
+	if err != nil {
+		t.Fatal("WatchLease failed: ", err)
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Type != subnet.EventRemoved || !wr.Events[0].Lease.Subnet.Equal(sn) {
+		t.Fatalf("Expected a removed event, got %+v", wr)
+	}
+}
+
+func TestNodeIPAMPlan(t *testing.T) {
+	config, err := subnet.ParseConfig(`{
+		"Network": "10.244.0.0/16",
+		"SubnetMin": "10.244.1.0",
+		"SubnetMax": "10.244.3.0",
+		"SubnetAllocation": "lowest",
+		"NodeGroups": { "edge": { "Network": "10.244.128.0/20", "SubnetLen": 26 } }
+	}`)
+	if err != nil {
+		t.Fatal("ParseConfig failed: ", err)
+	}
+
+	node := func(name, podCIDR, group string) *v1.Node {
+		n := &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{}},
+			Spec:       v1.NodeSpec{PodCIDR: podCIDR},
+		}
+		if group != "" {
+			n.Labels["flannel.alpha.coreos.com/node-group"] = group
+		}
+		return n
+	}
+
+	ksm, _ := newTestManager(t, node("node-a", "10.244.1.0/24", ""))
+	ipam := newNodeIPAM(ksm)
+
+	nodes := []*v1.Node{
+		node("node-a", "10.244.1.0/24", ""),
+		node("node-c", "", "edge"),
+		node("node-b", "", ""),
+	}
+	plan := ipam.plan(config, nodes)
+	expected := []podCIDRAssignment{
+		{"node-b", ip.IP4Net{IP: ip.MustParseIP4("10.244.2.0"), PrefixLen: 24}},
+		{"node-c", ip.IP4Net{IP: ip.MustParseIP4("10.244.128.64"), PrefixLen: 26}},
+	}
+	if len(plan) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, plan)
+	}
+	for i := range plan {
+		if plan[i].node != expected[i].node || !plan[i].podCIDR.Equal(expected[i].podCIDR) {
+			t.Errorf("Expected %v, got %v", expected[i], plan[i])
+		}
+	}
+
+	// Assigned pod CIDRs count as used until the node cache catches up, and
+	// the pod CIDR of a deleted node is free again.
+	nodes = []*v1.Node{
+		node("node-b", "", ""),
+		node("node-c", "10.244.128.64/26", "edge"),
+		node("node-d", "", ""),
+		node("node-e", "", ""),
+	}
+	plan = ipam.plan(config, nodes)
+	if len(plan) != 2 || plan[0].node != "node-d" || plan[0].podCIDR.String() != "10.244.1.0/24" ||
+		plan[1].node != "node-e" || plan[1].podCIDR.String() != "10.244.3.0/24" {
+		t.Fatalf("Unexpected assignments: %v", plan)
+	}
+
+	// Once out of subnets, nodes are left without a pod CIDR
+	if plan = ipam.plan(config, append(nodes, node("node-f", "", ""))); len(plan) != 0 {
+		t.Fatalf("Unexpected assignments: %v", plan)
+	}
+}
+
+func TestConfigMapNetConf(t *testing.T) {
+	nc := &configMapNetConf{
+		namespace: "kube-system",
+		name:      "kube-flannel-cfg",
+		key:       "net-conf.json",
+		store:     cache.NewStore(cache.MetaNamespaceKeyFunc),
+		changed:   make(chan struct{}),
+	}
+	ksm := &kubeSubnetManager{netConf: nc}
+
+	if _, err := ksm.GetNetworkConfig(context.Background()); err == nil {
+		t.Fatal("Expected an error for a missing ConfigMap")
+	}
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kube-flannel-cfg"},
+		Data:       map[string]string{"net-conf.json": `{"Network": "10.244.0.0/16", "Backend": {"Type": "vxlan"}}`},
+	}
+	if err := nc.store.Add(cm); err != nil {
+		t.Fatal(err)
+	}
+	changed := ksm.ConfigChanged()
+	nc.notify()
+	select {
+	case <-changed:
+	default:
+		t.Fatal("Expected the change to be signalled")
+	}
+
+	config, err := ksm.GetNetworkConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Network.String() != "10.244.0.0/16" || config.BackendType != "vxlan" {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+
+	select {
+	case <-ksm.ConfigChanged():
+		t.Fatal("Expected no change to be signalled")
+	default:
+	}
+
+	cm.Data = map[string]string{"other.json": "{}"}
+	if err := nc.store.Update(cm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ksm.GetNetworkConfig(context.Background()); err == nil {
+		t.Fatal("Expected an error for a missing key")
+	}
+
+	// Changes aren't watched with a net conf file
+	if (&kubeSubnetManager{}).ConfigChanged() != nil {
+		t.Error("Expected no change channel without a ConfigMap")
+	}
+}
+
+func TestNodeWatchDecoder(t *testing.T) {
+	stream := `{"type": "ADDED", "object": {"kind": "Node", "apiVersion": "v1", "metadata": {"name": "node-a"},
+		"spec": {"podCIDR": "10.244.1.0/24", "podCIDRs": ["10.244.1.0/24", "fd00:10:244:1::/64", "10.245.1.0/24"]}}}
+{"type": "MODIFIED", "object": {"kind": "Node", "apiVersion": "v1", "metadata": {"name": "node-b"},
+		"spec": {"podCIDR": "10.244.2.0/24"}}}`
+	r := ioutil.NopCloser(strings.NewReader(stream))
+	d := &nodeWatchDecoder{stream: r, decoder: json.NewDecoder(r)}
+
+	et, obj, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, ok := obj.(*v1.Node)
+	if et != watch.Added || !ok || n.Name != "node-a" {
+		t.Fatalf("Unexpected event %v: %#v", et, obj)
+	}
+	var l subnet.Lease
+	if err := setLeaseSubnets(&l, n); err != nil {
+		t.Fatal(err)
+	}
+	if l.Subnet.String() != "10.244.1.0/24" || l.IPv6Subnet.String() != "fd00:10:244:1::/64" ||
+		len(l.AdditionalSubnets) != 1 || l.AdditionalSubnets[0].String() != "10.245.1.0/24" {
+		t.Errorf("Unexpected lease subnets: %v, %v, %v", l.Subnet, l.IPv6Subnet, l.AdditionalSubnets)
+	}
+
+	// Nodes without spec.podCIDRs fall back to spec.podCIDR
+	et, obj, err = d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := obj.(*v1.Node); et != watch.Modified || len(podCIDRs(n)) != 1 || podCIDRs(n)[0] != "10.244.2.0/24" {
+		t.Fatalf("Unexpected event %v: %#v", et, obj)
+	}
+
+	if _, _, err := d.Decode(); err == nil {
+		t.Fatal("Expected an error at the end of the stream")
+	}
+}
+
+func TestUpdateTaints(t *testing.T) {
+	other := v1.Taint{Key: "dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule}
+	notReady := v1.Taint{Key: "flannel.alpha.coreos.com/not-ready", Effect: v1.TaintEffectNoSchedule}
+
+	taints, changed := updateTaints([]v1.Taint{other, notReady}, notReady.Key, false)
+	if !changed || len(taints) != 1 || taints[0] != other {
+		t.Errorf("Expected only %v to be left, got %v", other, taints)
+	}
+	if _, changed := updateTaints(taints, notReady.Key, false); changed {
+		t.Error("Expected no change removing a missing taint")
+	}
+
+	taints, changed = updateTaints(nil, notReady.Key, true)
+	if !changed || len(taints) != 1 || taints[0] != notReady {
+		t.Errorf("Expected %v, got %v", notReady, taints)
+	}
+	if _, changed := updateTaints(taints, notReady.Key, true); changed {
+		t.Error("Expected no change adding an existing taint")
+	}
+
+	// A taint with the same key but another effect is left alone
+	noExecute := v1.Taint{Key: notReady.Key, Effect: v1.TaintEffectNoExecute}
+	if taints, _ := updateTaints([]v1.Taint{noExecute}, notReady.Key, true); len(taints) != 2 {
+		t.Errorf("Expected the NoExecute taint to be kept, got %v", taints)
+	}
+}
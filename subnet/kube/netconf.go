@@ -0,0 +1,113 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coreos/flannel/subnet"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// configMapNetConf keeps the net conf in a key of a ConfigMap up to date
+// through an informer, instead of waiting for the kubelet to refresh the
+// ConfigMap volume.
+type configMapNetConf struct {
+	namespace  string
+	name       string
+	key        string
+	store      cache.Store
+	controller cache.Controller
+
+	mux sync.Mutex
+	// changed is closed and replaced on every change to the ConfigMap.
+	changed chan struct{}
+}
+
+// newConfigMapNetConf watches the key of the ConfigMap given as namespace/name.
+func newConfigMapNetConf(c clientset.Interface, configMap, key string) (*configMapNetConf, error) {
+	parts := strings.Split(configMap, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid ConfigMap %q, must be namespace/name", configMap)
+	}
+
+	nc := &configMapNetConf{
+		namespace: parts[0],
+		name:      parts[1],
+		key:       key,
+		changed:   make(chan struct{}),
+	}
+
+	selector := fields.OneTermEqualSelector("metadata.name", nc.name).String()
+	notify := func(interface{}) { nc.notify() }
+	nc.store, nc.controller = cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = selector
+				return c.CoreV1().ConfigMaps(nc.namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = selector
+				return c.CoreV1().ConfigMaps(nc.namespace).Watch(options)
+			},
+		},
+		&v1.ConfigMap{},
+		resyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    notify,
+			UpdateFunc: func(oldObj, newObj interface{}) { nc.notify() },
+			DeleteFunc: notify,
+		},
+	)
+	return nc, nil
+}
+
+func (nc *configMapNetConf) notify() {
+	nc.mux.Lock()
+	defer nc.mux.Unlock()
+
+	close(nc.changed)
+	nc.changed = make(chan struct{})
+}
+
+func (nc *configMapNetConf) changes() <-chan struct{} {
+	nc.mux.Lock()
+	defer nc.mux.Unlock()
+	return nc.changed
+}
+
+func (nc *configMapNetConf) read() (*subnet.Config, error) {
+	obj, ok, err := nc.store.GetByKey(nc.namespace + "/" + nc.name)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("ConfigMap %s/%s not found", nc.namespace, nc.name)
+	}
+
+	data, ok := obj.(*v1.ConfigMap).Data[nc.key]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s/%s has no key %q", nc.namespace, nc.name, nc.key)
+	}
+	return parseNetConf(data)
+}
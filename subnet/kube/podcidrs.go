@@ -0,0 +1,177 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// The vendored node API predates spec.podCIDRs, which a typed client drops.
+// The nodes are therefore listed and watched raw, and the pod CIDRs copied into
+// this annotation of the cached nodes. It's never written back to the API.
+const podCIDRsAnnotation = "flannel.alpha.coreos.com/internal-pod-cidrs"
+
+// rawNode holds the fields of a node missing from v1.Node.
+type rawNode struct {
+	Spec struct {
+		PodCIDRs []string `json:"podCIDRs"`
+	} `json:"spec"`
+}
+
+func setPodCIDRs(n *v1.Node, raw rawNode) {
+	if len(raw.Spec.PodCIDRs) == 0 {
+		return
+	}
+	if n.Annotations == nil {
+		n.Annotations = map[string]string{}
+	}
+	n.Annotations[podCIDRsAnnotation] = strings.Join(raw.Spec.PodCIDRs, ",")
+}
+
+// podCIDRs returns all the pod CIDRs of the node, the one in spec.podCIDR first.
+func podCIDRs(n *v1.Node) []string {
+	if s := n.Annotations[podCIDRsAnnotation]; s != "" {
+		return strings.Split(s, ",")
+	}
+	if n.Spec.PodCIDR != "" {
+		return []string{n.Spec.PodCIDR}
+	}
+	return nil
+}
+
+// setLeaseSubnets fills in the subnets of a lease from the pod CIDRs of the node:
+// the first IPv4 pod CIDR is the subnet of the lease and the others additional
+// subnets, the first IPv6 one the IPv6 subnet.
+func setLeaseSubnets(l *subnet.Lease, n *v1.Node) error {
+	l.Subnet = ip.IP4Net{}
+	l.AdditionalSubnets = nil
+	l.IPv6Subnet = ip.IP6Net{}
+
+	for _, s := range podCIDRs(n) {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		switch {
+		case cidr.IP.To4() == nil:
+			if l.IPv6Subnet.Empty() {
+				l.IPv6Subnet = ip.FromIP6Net(cidr)
+			}
+		case l.Subnet.Empty():
+			l.Subnet = ip.FromIPNet(cidr)
+		default:
+			l.AdditionalSubnets = append(l.AdditionalSubnets, ip.FromIPNet(cidr))
+		}
+	}
+	if l.Subnet.Empty() {
+		return fmt.Errorf("node %q has no IPv4 pod cidr", n.Name)
+	}
+	return nil
+}
+
+func listNodes(c clientset.Interface, options metav1.ListOptions) (runtime.Object, error) {
+	data, err := c.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		VersionedParams(&options, scheme.ParameterCodec).
+		Do().
+		Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := runtime.Decode(scheme.Codecs.UniversalDeserializer(), data)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.(*v1.NodeList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object listing nodes: %T", obj)
+	}
+
+	var raw struct {
+		Items []rawNode `json:"items"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		if i < len(raw.Items) {
+			setPodCIDRs(&list.Items[i], raw.Items[i])
+		}
+	}
+	return list, nil
+}
+
+func watchNodes(c clientset.Interface, options metav1.ListOptions) (watch.Interface, error) {
+	options.Watch = true
+	stream, err := c.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		VersionedParams(&options, scheme.ParameterCodec).
+		Stream()
+	if err != nil {
+		return nil, err
+	}
+	return watch.NewStreamWatcher(&nodeWatchDecoder{
+		stream:  stream,
+		decoder: json.NewDecoder(stream),
+	}), nil
+}
+
+// nodeWatchDecoder decodes the events of a raw node watch.
+type nodeWatchDecoder struct {
+	stream  io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (d *nodeWatchDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.decoder.Decode(&event); err != nil {
+		return "", nil, err
+	}
+
+	obj, err := runtime.Decode(scheme.Codecs.UniversalDeserializer(), event.Object)
+	if err != nil {
+		return "", nil, err
+	}
+	if n, ok := obj.(*v1.Node); ok {
+		var raw rawNode
+		if err := json.Unmarshal(event.Object, &raw); err != nil {
+			return "", nil, err
+		}
+		setPodCIDRs(n, raw)
+	}
+	return event.Type, obj, nil
+}
+
+func (d *nodeWatchDecoder) Close() {
+	d.stream.Close()
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const eventSource = "flanneld"
+
+// RecordEvent implements subnet.NodeReporter. The event is created in the
+// background, the way the kubelet records its events about the node.
+func (ksm *kubeSubnetManager) RecordEvent(eventType, reason, message string) {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", ksm.nodeName, now.UnixNano()),
+			Namespace: metav1.NamespaceDefault,
+		},
+		// kubectl describe node looks events up by the node name as UID
+		InvolvedObject: v1.ObjectReference{
+			Kind: "Node",
+			Name: ksm.nodeName,
+			UID:  types.UID(ksm.nodeName),
+		},
+		Reason:         reason,
+		Message:        message,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: eventSource, Host: ksm.nodeName},
+	}
+
+	go func() {
+		if _, err := ksm.client.CoreV1().Events(metav1.NamespaceDefault).Create(event); err != nil {
+			glog.Warningf("Unable to record event %s on node %q: %v", reason, ksm.nodeName, err)
+		}
+	}()
+}
+
+// SetNetworkUnavailable implements subnet.NodeReporter by setting the
+// NetworkUnavailable condition of the node.
+func (ksm *kubeSubnetManager) SetNetworkUnavailable(unavailable bool, reason, message string) error {
+	condition := v1.NodeCondition{
+		Type:               v1.NodeNetworkUnavailable,
+		Status:             v1.ConditionFalse,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+		LastHeartbeatTime:  metav1.Now(),
+	}
+	if unavailable {
+		condition.Status = v1.ConditionTrue
+	}
+	// Only move the transition time when the status actually changes
+	if n, err := ksm.nodeStore.Get(ksm.nodeName); err == nil {
+		for _, c := range n.Status.Conditions {
+			if c.Type == condition.Type && c.Status == condition.Status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+		}
+	}
+
+	raw, err := json.Marshal(&[]v1.NodeCondition{condition})
+	if err != nil {
+		return err
+	}
+	patch := []byte(fmt.Sprintf(`{"status":{"conditions":%s}}`, raw))
+	_, err = ksm.client.CoreV1().Nodes().PatchStatus(ksm.nodeName, patch)
+	return err
+}
+
+// checkPeerConflict warns about another node whose lease clashes with the one
+// of this node: an overlapping pod CIDR or the same public IP.
+func (ksm *kubeSubnetManager) checkPeerConflict(n *v1.Node, l subnet.Lease) {
+	if n.Name == ksm.nodeName {
+		return
+	}
+
+	ksm.mux.Lock()
+	publicIP := ksm.leaseAnnotations[ksm.annotations.BackendPublicIP]
+	cidrs := ksm.leasePodCIDRs
+	ksm.mux.Unlock()
+
+	if publicIP != "" && publicIP == l.Attrs.PublicIP.String() {
+		ksm.RecordEvent(subnet.NodeEventWarning, "PeerConflict",
+			fmt.Sprintf("Node %s has the same public IP %s", n.Name, publicIP))
+	}
+
+	theirs := append([]ip.IP4Net{l.Subnet}, l.AdditionalSubnets...)
+	for _, s := range strings.Split(cidrs, ",") {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil || cidr.IP.To4() == nil {
+			continue
+		}
+		ours := ip.FromIPNet(cidr)
+		for _, sn := range theirs {
+			if ours.Overlaps(sn) {
+				ksm.RecordEvent(subnet.NodeEventWarning, "PeerConflict",
+					fmt.Sprintf("Pod CIDR %s of node %s overlaps with pod CIDR %s", sn, n.Name, ours))
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// taintRetries is how often a taint update is retried when the node changed
+// in the meantime.
+const taintRetries = 5
+
+// SetNodeTaint adds a NoSchedule taint with the given key to the node flannel
+// runs on, or removes it, unless the node already is that way.
+func (ksm *kubeSubnetManager) SetNodeTaint(key string, taint bool) error {
+	for attempt := 0; ; attempt++ {
+		n, err := ksm.client.CoreV1().Nodes().Get(ksm.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		taints, changed := updateTaints(n.Spec.Taints, key, taint)
+		if !changed {
+			return nil
+		}
+
+		// The resource version makes the patch fail if the taints were
+		// changed by someone else since.
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": n.ResourceVersion,
+			},
+			"spec": map[string]interface{}{
+				"taints": taints,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = ksm.client.CoreV1().Nodes().Patch(ksm.nodeName, types.MergePatchType, patch)
+		if apierrors.IsConflict(err) && attempt < taintRetries {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if taint {
+			glog.Infof("Added taint %s to node %q", key, ksm.nodeName)
+		} else {
+			glog.Infof("Removed taint %s from node %q", key, ksm.nodeName)
+		}
+		return nil
+	}
+}
+
+// updateTaints adds or removes the NoSchedule taint with the given key. It
+// reports whether that changed the taints.
+func updateTaints(taints []v1.Taint, key string, taint bool) ([]v1.Taint, bool) {
+	updated := []v1.Taint{}
+	found := false
+	for _, t := range taints {
+		if t.Key == key && t.Effect == v1.TaintEffectNoSchedule {
+			found = true
+			if !taint {
+				continue
+			}
+		}
+		updated = append(updated, t)
+	}
+
+	if taint && !found {
+		updated = append(updated, v1.Taint{Key: key, Effect: v1.TaintEffectNoSchedule})
+	}
+	return updated, taint != found
+}
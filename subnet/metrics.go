@@ -0,0 +1,57 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// AllocationAttempts and AllocationConflicts count the attempts of the
+	// subnet managers to acquire a lease, and those that lost a race with
+	// another node and had to be tried again.
+	AllocationAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "flannel",
+		Subsystem: "subnet",
+		Name:      "allocation_attempts_total",
+		Help:      "Number of attempts to acquire a lease.",
+	})
+	AllocationConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "flannel",
+		Subsystem: "subnet",
+		Name:      "allocation_conflicts_total",
+		Help:      "Number of attempts to acquire a lease that conflicted with another node and were retried.",
+	})
+
+	watchResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "flannel",
+			Subsystem: "subnet",
+			Name:      "watch_results_total",
+			Help:      "Number of results of the watch on the leases, by whether it was a batch of events or a snapshot resetting the watch.",
+		},
+		[]string{"type"},
+	)
+	knownPeers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "flannel",
+		Subsystem: "subnet",
+		Name:      "known_peers",
+		Help:      "Number of leases of other nodes known from the watch, over all networks.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(AllocationAttempts, AllocationConflicts, watchResults, knownPeers)
+}
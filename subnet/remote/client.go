@@ -0,0 +1,198 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+type ClientConfig struct {
+	// Address (host:port) of the server
+	Addr     string
+	Network  string
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// RemoteManager is a subnet.Manager that forwards every call to a flanneld
+// serving its subnet managers with RunServer.
+type RemoteManager struct {
+	base      string
+	client    *http.Client
+	nodeID    string
+	nodeGroup string
+}
+
+// NewRemoteManager returns a manager for the network of the config. It uses
+// HTTPS if any of the TLS files are set, presenting the certificate to the
+// server if there is one. Leases are acquired with nodeID and nodeGroup unless
+// the lease attributes say otherwise.
+func NewRemoteManager(config *ClientConfig, nodeID, nodeGroup string) (subnet.Manager, error) {
+	scheme := "http"
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+
+	if config.CAFile != "" || config.CertFile != "" || config.KeyFile != "" {
+		scheme = "https"
+		tlsConfig := &tls.Config{}
+
+		if config.CAFile != "" {
+			pool, err := loadCertPool(config.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		if config.CertFile != "" || config.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("error loading the client certificate: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &RemoteManager{
+		base:      fmt.Sprintf("%s://%s%s", scheme, config.Addr, networkPath(config.Network)),
+		client:    &http.Client{Transport: transport},
+		nodeID:    nodeID,
+		nodeGroup: nodeGroup,
+	}, nil
+}
+
+// do sends a request with an optional JSON body and decodes the JSON response
+// into res. A 409 Conflict stands for subnet.ErrLeaseConflict.
+func (m *RemoteManager) do(ctx context.Context, method, path string, body, res interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, m.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			// Callers check for the context errors themselves
+			return ctx.Err()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusConflict {
+		return subnet.ErrLeaseConflict
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+
+	return json.Unmarshal(data, res)
+}
+
+func (m *RemoteManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	var raw json.RawMessage
+	if err := m.do(ctx, http.MethodGet, "/config", nil, &raw); err != nil {
+		return nil, err
+	}
+
+	// Parsing fills in BackendType, which isn't part of the JSON.
+	return subnet.ParseConfig(string(raw))
+}
+
+func (m *RemoteManager) AcquireLease(ctx context.Context, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if attrs.NodeID == "" {
+		attrs.NodeID = m.nodeID
+	}
+	if attrs.NodeGroup == "" {
+		attrs.NodeGroup = m.nodeGroup
+	}
+
+	lease := &subnet.Lease{}
+	if err := m.do(ctx, http.MethodPost, "/leases", attrs, lease); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (m *RemoteManager) RenewLease(ctx context.Context, lease *subnet.Lease) error {
+	renewed := subnet.Lease{}
+	if err := m.do(ctx, http.MethodPut, "/leases/"+lease.Key(), lease, &renewed); err != nil {
+		return err
+	}
+
+	lease.Expiration = renewed.Expiration
+	lease.Asof = renewed.Asof
+	return nil
+}
+
+// ReleaseLease implements subnet.LeaseReleaser.
+func (m *RemoteManager) ReleaseLease(ctx context.Context, lease *subnet.Lease) error {
+	return m.do(ctx, http.MethodDelete, "/leases/"+lease.Key(), lease, &struct{}{})
+}
+
+func watchQuery(cursor interface{}) string {
+	if cursor == nil {
+		return ""
+	}
+	return "?next=" + url.QueryEscape(fmt.Sprint(cursor))
+}
+
+func (m *RemoteManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	wr := subnet.LeaseWatchResult{}
+	err := m.do(ctx, http.MethodGet, "/leases/"+subnet.MakeSubnetKey(sn)+watchQuery(cursor), nil, &wr)
+	return wr, err
+}
+
+func (m *RemoteManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	wr := subnet.LeaseWatchResult{}
+	err := m.do(ctx, http.MethodGet, "/leases"+watchQuery(cursor), nil, &wr)
+	return wr, err
+}
+
+func (m *RemoteManager) Name() string {
+	return fmt.Sprintf("Remote subnet manager at %s", m.base)
+}
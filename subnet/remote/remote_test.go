@@ -0,0 +1,146 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/subnet/etcdv2"
+)
+
+func newTestServer(t *testing.T, networks map[string]string) (*httptest.Server, func(network, nodeID string) subnet.Manager) {
+	managers := make(map[string]subnet.Manager)
+	for name, config := range networks {
+		managers[name] = etcdv2.NewMockManager(etcdv2.NewMockRegistry(config, nil))
+	}
+	srv := httptest.NewServer(NewHandler(managers))
+
+	client := func(network, nodeID string) subnet.Manager {
+		sm, err := NewRemoteManager(&ClientConfig{Addr: strings.TrimPrefix(srv.URL, "http://"), Network: network}, nodeID, "")
+		if err != nil {
+			t.Fatal("NewRemoteManager failed: ", err)
+		}
+		return sm
+	}
+	return srv, client
+}
+
+func TestRemoteManager(t *testing.T) {
+	srv, client := newTestServer(t, map[string]string{
+		"":      `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "VNI": 2 } }`,
+		"blue":  `{ "Network": "10.4.0.0/16", "IPv6Network": "fc00::/48" }`,
+		"green": `{ "Network": "10.5.0.0/16" }`,
+	})
+	defer srv.Close()
+
+	ctx := context.Background()
+	sm := client("", "node-a")
+
+	config, err := sm.GetNetworkConfig(ctx)
+	if err != nil {
+		t.Fatal("GetNetworkConfig failed: ", err)
+	}
+	if config.Network.String() != "10.3.0.0/16" || config.BackendType != "vxlan" || config.IPv6Enabled() {
+		t.Fatalf("Unexpected config: %+v", config)
+	}
+
+	blue, err := client("blue", "node-a").GetNetworkConfig(ctx)
+	if err != nil {
+		t.Fatal("GetNetworkConfig failed: ", err)
+	}
+	if blue.IPv6Network.String() != "fc00::/48" {
+		t.Fatalf("Unexpected IPv6 network: %v", blue.IPv6Network)
+	}
+
+	if _, err := client("red", "node-a").GetNetworkConfig(ctx); err == nil {
+		t.Fatal("GetNetworkConfig succeeded for an unknown network")
+	}
+
+	lease, err := sm.AcquireLease(ctx, &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !config.Network.Contains(lease.Subnet.IP) || lease.Attrs.NodeID != "node-a" {
+		t.Fatalf("Unexpected lease: %+v", lease)
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeases(wctx, sm, lease, events)
+
+	other, err := client("", "node-b").AcquireLease(ctx, &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// The first batch is empty unless the snapshot already has node-b
+	var evtBatch []subnet.Event
+	for len(evtBatch) == 0 {
+		select {
+		case evtBatch = <-events:
+		case <-wctx.Done():
+			t.Fatal("Timed out waiting for the lease of node-b")
+		}
+	}
+	if len(evtBatch) != 1 || evtBatch[0].Type != subnet.EventAdded || !evtBatch[0].Lease.Subnet.Equal(other.Subnet) || evtBatch[0].Lease.Attrs.NodeID != "node-b" {
+		t.Fatalf("Expected an event for the lease of node-b, got %+v", evtBatch)
+	}
+
+	wr, err := sm.WatchLease(ctx, lease.Subnet, nil)
+	if err != nil {
+		t.Fatal("WatchLease failed: ", err)
+	}
+	if len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(lease.Subnet) {
+		t.Fatalf("Expected a snapshot of the lease, got %+v", wr)
+	}
+
+	expiration := lease.Expiration
+	stale := *lease
+	if err := sm.RenewLease(ctx, lease); err != nil {
+		t.Fatal("RenewLease failed: ", err)
+	}
+	if lease.Expiration.Before(expiration) {
+		t.Fatalf("Lease expiration went back from %v to %v", expiration, lease.Expiration)
+	}
+	if err := sm.RenewLease(ctx, &stale); err != subnet.ErrLeaseConflict {
+		t.Fatal("Expected ErrLeaseConflict renewing a stale lease, got ", err)
+	}
+
+	lr := sm.(subnet.LeaseReleaser)
+	if err := lr.ReleaseLease(ctx, &subnet.Lease{Subnet: other.Subnet, Attrs: lease.Attrs}); err == nil {
+		t.Fatal("ReleaseLease released the lease of another node")
+	}
+	if err := lr.ReleaseLease(ctx, lease); err != nil {
+		t.Fatal("ReleaseLease failed: ", err)
+	}
+	if _, err := sm.WatchLease(ctx, lease.Subnet, nil); err == nil {
+		t.Fatal("WatchLease found the lease after ReleaseLease")
+	}
+
+	// Waiting for events returns the context error once it is done
+	tctx, tcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer tcancel()
+	if _, err := client("green", "node-a").WatchLeases(tctx, "1000"); err != context.DeadlineExceeded {
+		t.Fatal("Expected DeadlineExceeded, got ", err)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// defaultNetwork stands in for the name of the unnamed network in URLs.
+const defaultNetwork = "_"
+
+// The API is laid out as follows, with the long polls taking the cursor of the
+// previous result in the "next" query parameter:
+//
+//	GET    /v1/<network>/config          GetNetworkConfig
+//	POST   /v1/<network>/leases          AcquireLease
+//	GET    /v1/<network>/leases          WatchLeases (long poll)
+//	PUT    /v1/<network>/leases/<subnet> RenewLease
+//	GET    /v1/<network>/leases/<subnet> WatchLease (long poll)
+//	DELETE /v1/<network>/leases/<subnet> ReleaseLease
+const apiPrefix = "/v1/"
+
+func networkPath(network string) string {
+	if network == "" {
+		network = defaultNetwork
+	}
+	return apiPrefix + network
+}
+
+type handler struct {
+	managers map[string]subnet.Manager
+}
+
+// NewHandler returns an http.Handler serving the subnet managers, keyed by the
+// name of their network.
+func NewHandler(managers map[string]subnet.Manager) http.Handler {
+	return &handler{managers}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) || len(parts) < 2 || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	network := parts[0]
+	if network == defaultNetwork {
+		network = ""
+	}
+	sm, ok := h.managers[network]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown network %q", parts[0]), http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	switch {
+	case len(parts) == 2 && parts[1] == "config" && r.Method == http.MethodGet:
+		handleGetNetworkConfig(ctx, w, sm)
+	case len(parts) == 2 && parts[1] == "leases" && r.Method == http.MethodPost:
+		handleAcquireLease(ctx, w, r, sm)
+	case len(parts) == 2 && parts[1] == "leases" && r.Method == http.MethodGet:
+		handleWatchLeases(ctx, w, r, sm)
+	case len(parts) == 3 && parts[1] == "leases" && r.Method == http.MethodPut:
+		handleRenewLease(ctx, w, r, sm, parts[2])
+	case len(parts) == 3 && parts[1] == "leases" && r.Method == http.MethodGet:
+		handleWatchLease(ctx, w, r, sm, parts[2])
+	case len(parts) == 3 && parts[1] == "leases" && r.Method == http.MethodDelete:
+		handleReleaseLease(ctx, w, r, sm, parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func jsonResponse(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if _, err := w.Write(data); err != nil {
+		log.Warning("Error writing response body: ", err)
+	}
+}
+
+func handleGetNetworkConfig(ctx context.Context, w http.ResponseWriter, sm subnet.Manager) {
+	c, err := sm.GetNetworkConfig(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, c)
+}
+
+func handleAcquireLease(ctx context.Context, w http.ResponseWriter, r *http.Request, sm subnet.Manager) {
+	attrs := subnet.LeaseAttrs{}
+	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+		http.Error(w, "JSON decoding error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lease, err := sm.AcquireLease(ctx, &attrs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, lease)
+}
+
+func handleRenewLease(ctx context.Context, w http.ResponseWriter, r *http.Request, sm subnet.Manager, key string) {
+	sn := subnet.ParseSubnetKey(key)
+	if sn == nil {
+		http.Error(w, fmt.Sprintf("invalid subnet %q", key), http.StatusBadRequest)
+		return
+	}
+
+	lease := subnet.Lease{}
+	if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+		http.Error(w, "JSON decoding error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !lease.Subnet.Equal(*sn) {
+		http.Error(w, "subnet of the lease doesn't match the URL", http.StatusBadRequest)
+		return
+	}
+
+	if err := sm.RenewLease(ctx, &lease); err == subnet.ErrLeaseConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, lease)
+}
+
+func handleReleaseLease(ctx context.Context, w http.ResponseWriter, r *http.Request, sm subnet.Manager, key string) {
+	lr, ok := sm.(subnet.LeaseReleaser)
+	if !ok {
+		http.Error(w, "releasing leases is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	sn := subnet.ParseSubnetKey(key)
+	if sn == nil {
+		http.Error(w, fmt.Sprintf("invalid subnet %q", key), http.StatusBadRequest)
+		return
+	}
+
+	// The attributes of the lease tell which node releases it
+	lease := subnet.Lease{}
+	if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+		http.Error(w, "JSON decoding error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !lease.Subnet.Equal(*sn) {
+		http.Error(w, "subnet of the lease doesn't match the URL", http.StatusBadRequest)
+		return
+	}
+
+	if err := lr.ReleaseLease(ctx, &lease); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, struct{}{})
+}
+
+// cursor returns the cursor a long poll continues from. Managers accept the
+// string form of the cursors they hand out.
+func cursor(r *http.Request) interface{} {
+	if next := r.URL.Query().Get("next"); next != "" {
+		return next
+	}
+	return nil
+}
+
+func watchResponse(w http.ResponseWriter, wr subnet.LeaseWatchResult) {
+	if wr.Cursor != nil {
+		wr.Cursor = fmt.Sprint(wr.Cursor)
+	}
+	jsonResponse(w, http.StatusOK, wr)
+}
+
+func handleWatchLeases(ctx context.Context, w http.ResponseWriter, r *http.Request, sm subnet.Manager) {
+	wr, err := sm.WatchLeases(ctx, cursor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	watchResponse(w, wr)
+}
+
+func handleWatchLease(ctx context.Context, w http.ResponseWriter, r *http.Request, sm subnet.Manager, key string) {
+	sn := subnet.ParseSubnetKey(key)
+	if sn == nil {
+		http.Error(w, fmt.Sprintf("invalid subnet %q", key), http.StatusBadRequest)
+		return
+	}
+
+	wr, err := sm.WatchLease(ctx, *sn, cursor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	watchResponse(w, wr)
+}
+
+// RunServer serves the subnet managers on listenAddr until ctx is done. If
+// certfile and keyfile are set, it serves HTTPS; with a cafile as well,
+// clients have to present a certificate signed by that CA.
+func RunServer(ctx context.Context, managers map[string]subnet.Manager, listenAddr, cafile, certfile, keyfile string) error {
+	srv := &http.Server{
+		Addr:    listenAddr,
+		Handler: NewHandler(managers),
+	}
+
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("error listening on %v: %v", listenAddr, err)
+	}
+
+	if certfile != "" && keyfile != "" {
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("error loading the server certificate: %v", err)
+		}
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+
+		if cafile != "" {
+			pool, err := loadCertPool(cafile)
+			if err != nil {
+				l.Close()
+				return err
+			}
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		l = tls.NewListener(l, tlsConfig)
+	} else if cafile != "" {
+		l.Close()
+		return fmt.Errorf("client certificates can only be checked with a server certificate and key")
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Infof("Serving subnet managers on %s", listenAddr)
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func loadCertPool(cafile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(cafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", cafile)
+	}
+	return pool, nil
+}
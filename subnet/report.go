@@ -0,0 +1,58 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+)
+
+// Types of node events
+const (
+	NodeEventNormal  = "Normal"
+	NodeEventWarning = "Warning"
+)
+
+// NodeReporter is implemented by subnet managers that can tell the cluster about
+// the state of the network on the node flannel runs on, like the kubernetes one
+// does with events and the NetworkUnavailable condition of the node.
+type NodeReporter interface {
+	// RecordEvent publishes an event about the node without blocking.
+	RecordEvent(eventType, reason, message string)
+	// SetNetworkUnavailable updates whether the network of the node is
+	// unavailable and why.
+	SetNetworkUnavailable(unavailable bool, reason, message string) error
+}
+
+// RecordEvent publishes an event about the node through sm, if it's a
+// NodeReporter.
+func RecordEvent(sm Manager, eventType, reason, format string, args ...interface{}) {
+	if r, ok := sm.(NodeReporter); ok {
+		r.RecordEvent(eventType, reason, fmt.Sprintf(format, args...))
+	}
+}
+
+// SetNetworkUnavailable reports whether the network of the node is available
+// through sm, if it's a NodeReporter. Failures are only logged.
+func SetNetworkUnavailable(sm Manager, unavailable bool, reason, message string) {
+	r, ok := sm.(NodeReporter)
+	if !ok {
+		return
+	}
+	if err := r.SetNetworkUnavailable(unavailable, reason, message); err != nil {
+		log.Errorf("Unable to set NetworkUnavailable to %v: %v", unavailable, err)
+	}
+}
@@ -30,23 +30,106 @@ import (
 var (
 	ErrLeaseTaken  = errors.New("subnet: lease already taken")
 	ErrNoMoreTries = errors.New("subnet: no more tries")
+	ErrNotFound    = errors.New("subnet: lease not found")
 	subnetRegex    = regexp.MustCompile(`(\d+\.\d+.\d+.\d+)-(\d+)`)
+
+	// ErrLeaseConflict is returned when renewing a lease that was written by
+	// someone else since the node last saw it. The node may not hold it anymore.
+	ErrLeaseConflict = errors.New("subnet: lease was modified by someone else")
 )
 
 type LeaseAttrs struct {
 	PublicIP    ip.IP4
+	NodeID      string          `json:",omitempty"`
+	NodeGroup   string          `json:",omitempty"`
 	BackendType string          `json:",omitempty"`
 	BackendData json.RawMessage `json:",omitempty"`
+
+	PublicIPv6    *ip.IP6         `json:",omitempty"`
+	BackendV6Data json.RawMessage `json:",omitempty"`
 }
 
 type Lease struct {
 	Subnet     ip.IP4Net
-	Attrs      LeaseAttrs
-	Expiration time.Time
+	IPv6Subnet ip.IP6Net
+	// AdditionalSubnets are further IPv4 subnets routed to the node along with
+	// Subnet. Only the kubernetes subnet manager sets them, from the secondary
+	// pod CIDRs of a node.
+	AdditionalSubnets []ip.IP4Net `json:",omitempty"`
+	Attrs             LeaseAttrs
+	Expiration        time.Time
 
 	Asof uint64
 }
 
+// LeaseValue is what gets stored under a lease key. Leases are keyed by their
+// IPv4 subnet, so the IPv6 subnet is kept next to the attributes.
+type LeaseValue struct {
+	LeaseAttrs
+	IPv6Subnet *ip.IP6Net `json:",omitempty"`
+}
+
+func NewLeaseValue(sn6 ip.IP6Net, attrs *LeaseAttrs) *LeaseValue {
+	v := &LeaseValue{LeaseAttrs: *attrs}
+	if !sn6.Empty() {
+		v.IPv6Subnet = &sn6
+	}
+	return v
+}
+
+// IPv6SubnetOrEmpty returns the stored IPv6 subnet, if any.
+func (v *LeaseValue) IPv6SubnetOrEmpty() ip.IP6Net {
+	if v.IPv6Subnet == nil {
+		return ip.IP6Net{}
+	}
+	return *v.IPv6Subnet
+}
+
+// FindLeaseForNode looks for the lease of the node described by attrs. Leases
+// are matched by node ID; leases without one (and nodes without one) fall back
+// to matching by public IP. It also returns the leases of other nodes that claim
+// the same public IP.
+func FindLeaseForNode(leases []Lease, attrs *LeaseAttrs) (*Lease, []Lease) {
+	var byID, byIP *Lease
+	var conflicts []Lease
+	for i := range leases {
+		l := &leases[i]
+		switch {
+		case attrs.NodeID != "" && l.Attrs.NodeID == attrs.NodeID:
+			if byID == nil {
+				byID = l
+			}
+		case l.Attrs.PublicIP != attrs.PublicIP:
+		case attrs.NodeID == "" || l.Attrs.NodeID == "":
+			if byIP == nil {
+				byIP = l
+			}
+		default:
+			conflicts = append(conflicts, *l)
+		}
+	}
+
+	if byID != nil {
+		return byID, conflicts
+	}
+	return byIP, conflicts
+}
+
+// OwnedByOtherNode reports whether the lease was taken by a node other than
+// the one described by attrs.
+func (l *Lease) OwnedByOtherNode(attrs *LeaseAttrs) bool {
+	return l.Attrs.NodeID != "" && attrs.NodeID != "" && l.Attrs.NodeID != attrs.NodeID
+}
+
+// HeldByNode reports whether the lease belongs to the node described by attrs,
+// going by node ID and else by public IP like FindLeaseForNode.
+func (l *Lease) HeldByNode(attrs *LeaseAttrs) bool {
+	if attrs.NodeID != "" && l.Attrs.NodeID == attrs.NodeID {
+		return true
+	}
+	return !l.OwnedByOtherNode(attrs) && l.Attrs.PublicIP == attrs.PublicIP
+}
+
 func (l *Lease) Key() string {
 	return MakeSubnetKey(l.Subnet)
 }
@@ -118,6 +201,12 @@ func MakeSubnetKey(sn ip.IP4Net) string {
 	return sn.StringSep(".", "-")
 }
 
+// MakeIPv6SubnetKey returns the key the IPv6 subnet of a lease is reserved
+// under, next to the key of its IPv4 subnet.
+func MakeIPv6SubnetKey(sn ip.IP6Net) string {
+	return fmt.Sprintf("%s-%d", sn.IP, sn.PrefixLen)
+}
+
 type Manager interface {
 	GetNetworkConfig(ctx context.Context) (*Config, error)
 	AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Lease, error)
@@ -127,3 +216,42 @@ type Manager interface {
 
 	Name() string
 }
+
+// LeaseAdmin manages the leases of a network by hand, e.g. to reserve a subnet
+// for a node. It's implemented by the etcd subnet managers.
+type LeaseAdmin interface {
+	ListLeases(ctx context.Context) ([]Lease, error)
+	GetLease(ctx context.Context, sn ip.IP4Net) (*Lease, error)
+	// ReserveLease turns a lease into a reservation, which never expires, or
+	// reserves a free subnet. attrs replace the attributes of an existing
+	// lease unless nil, and are required to reserve a free subnet.
+	ReserveLease(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs) (*Lease, error)
+	// UnreserveLease turns a reservation back into a lease that expires.
+	UnreserveLease(ctx context.Context, sn ip.IP4Net) (*Lease, error)
+	DeleteLease(ctx context.Context, sn ip.IP4Net) error
+}
+
+// LeaseReleaser is implemented by subnet managers that can give up the lease of
+// the node before it expires, so that its subnet is free for other nodes.
+type LeaseReleaser interface {
+	// ReleaseLease releases the lease of lease.Subnet if it's held by the node
+	// described by lease.Attrs. Reservations are kept, and a lease that's gone
+	// already isn't an error.
+	ReleaseLease(ctx context.Context, lease *Lease) error
+}
+
+// SubnetPreferrer is implemented by subnet managers that reuse the subnet the
+// node had before, like the one read from the subnet file, as long as it's free.
+type SubnetPreferrer interface {
+	// PreferSubnet makes the next AcquireLease reuse sn and sn6 if possible.
+	// It must not be called concurrently with AcquireLease.
+	PreferSubnet(sn ip.IP4Net, sn6 ip.IP6Net)
+}
+
+// ConfigWatcher is implemented by subnet managers that notice changes to the
+// network config themselves, sparing the caller from polling GetNetworkConfig.
+type ConfigWatcher interface {
+	// ConfigChanged returns a channel that is closed on the next change to the
+	// network config, or nil if changes aren't watched.
+	ConfigChanged() <-chan struct{}
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func TestFindLeaseForNode(t *testing.T) {
+	mkLease := func(sn, pubIP, nodeID string) Lease {
+		return Lease{
+			Subnet: ip.IP4Net{IP: ip.MustParseIP4(sn), PrefixLen: 24},
+			Attrs:  LeaseAttrs{PublicIP: ip.MustParseIP4(pubIP), NodeID: nodeID},
+		}
+	}
+	leases := []Lease{
+		mkLease("10.3.1.0", "1.1.1.1", ""),
+		mkLease("10.3.2.0", "1.1.1.2", "node-a"),
+		mkLease("10.3.3.0", "1.1.1.2", "node-b"),
+	}
+
+	// Node IDs win over public IPs
+	l, conflicts := FindLeaseForNode(leases, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.1"), NodeID: "node-b"})
+	if l == nil || l.Subnet.String() != "10.3.3.0/24" {
+		t.Errorf("Expected the lease of node-b, got %v", l)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("Unexpected conflicts: %v", conflicts)
+	}
+
+	// Leases without a node ID match by public IP
+	l, _ = FindLeaseForNode(leases, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.1"), NodeID: "node-c"})
+	if l == nil || l.Subnet.String() != "10.3.1.0/24" {
+		t.Errorf("Expected the lease without a node ID, got %v", l)
+	}
+
+	// Leases of other nodes on the same public IP are conflicts, not matches
+	l, conflicts = FindLeaseForNode(leases, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.2"), NodeID: "node-a"})
+	if l == nil || l.Subnet.String() != "10.3.2.0/24" {
+		t.Errorf("Expected the lease of node-a, got %v", l)
+	}
+	if len(conflicts) != 1 || conflicts[0].Attrs.NodeID != "node-b" {
+		t.Errorf("Expected a conflict with node-b, got %v", conflicts)
+	}
+
+	l, conflicts = FindLeaseForNode(leases, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.2"), NodeID: "node-c"})
+	if l != nil {
+		t.Errorf("Unexpected match: %v", l)
+	}
+	if len(conflicts) != 2 {
+		t.Errorf("Expected two conflicts, got %v", conflicts)
+	}
+}
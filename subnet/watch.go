@@ -15,6 +15,7 @@
 package subnet
 
 import (
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
@@ -26,12 +27,22 @@ import (
 // WatchLeases performs a long term watch of the given network's subnet leases
 // and communicates addition/deletion events on receiver channel. It takes care
 // of handling "fall-behind" logic where the history window has advanced too far
-// and it needs to diff the latest snapshot with its saved state and generate events
+// and it needs to diff the latest snapshot with its saved state and generate events.
+// The first batch is sent even if it's empty, to tell the receiver that it has
+// been brought up to date with the leases that existed when the watch started.
 func WatchLeases(ctx context.Context, sm Manager, ownLease *Lease, receiver chan []Event) {
 	lw := &leaseWatcher{
 		ownLease: ownLease,
 	}
 	var cursor interface{}
+	started := false
+
+	ws := trackWatch(sm)
+	defer untrackWatch(sm, ws)
+
+	// The peers this watch knows about are taken back when it ends
+	peers := 0
+	defer func() { knownPeers.Sub(float64(peers)) }()
 
 	for {
 		res, err := sm.WatchLeases(ctx, cursor)
@@ -41,23 +52,38 @@ func WatchLeases(ctx context.Context, sm Manager, ownLease *Lease, receiver chan
 			}
 
 			log.Errorf("Watch subnets: %v", err)
+			ws.failed(err)
 			time.Sleep(time.Second)
 			continue
 		}
+		ws.failed(nil)
 
 		cursor = res.Cursor
 
 		var batch []Event
 
 		if len(res.Events) > 0 {
+			watchResults.WithLabelValues("events").Inc()
 			batch = lw.update(res.Events)
 		} else {
+			watchResults.WithLabelValues("snapshot").Inc()
 			batch = lw.reset(res.Snapshot)
 		}
-
-		if len(batch) > 0 {
-			receiver <- batch
+		n := lw.peers()
+		knownPeers.Add(float64(n - peers))
+		peers = n
+		ws.setPeers(lw)
+
+		if len(batch) > 0 || !started {
+			ws.blocked(true)
+			select {
+			case receiver <- batch:
+			case <-ctx.Done():
+				return
+			}
+			ws.blocked(false)
 		}
+		started = true
 	}
 }
 
@@ -66,6 +92,17 @@ type leaseWatcher struct {
 	leases   []Lease
 }
 
+// peers returns the number of leases of other nodes.
+func (lw *leaseWatcher) peers() int {
+	n := 0
+	for _, l := range lw.leases {
+		if lw.ownLease == nil || !l.Subnet.Equal(lw.ownLease.Subnet) {
+			n++
+		}
+	}
+	return n
+}
+
 func (lw *leaseWatcher) reset(leases []Lease) []Event {
 	batch := []Event{}
 
@@ -161,6 +198,9 @@ func deleteLease(l []Lease, i int) []Lease {
 func WatchLease(ctx context.Context, sm Manager, sn ip.IP4Net, receiver chan Event) {
 	var cursor interface{}
 
+	ws := trackWatch(sm)
+	defer untrackWatch(sm, ws)
+
 	for {
 		wr, err := sm.WatchLease(ctx, sn, cursor)
 		if err != nil {
@@ -169,19 +209,149 @@ func WatchLease(ctx context.Context, sm Manager, sn ip.IP4Net, receiver chan Eve
 			}
 
 			log.Errorf("Subnet watch failed: %v", err)
+			ws.failed(err)
 			time.Sleep(time.Second)
 			continue
 		}
+		ws.failed(nil)
 
+		event := Event{Type: EventAdded}
 		if len(wr.Snapshot) > 0 {
-			receiver <- Event{
-				Type:  EventAdded,
-				Lease: wr.Snapshot[0],
-			}
+			event.Lease = wr.Snapshot[0]
 		} else {
-			receiver <- wr.Events[0]
+			event = wr.Events[0]
+		}
+		ws.blocked(true)
+		select {
+		case receiver <- event:
+		case <-ctx.Done():
+			return
 		}
+		ws.blocked(false)
 
 		cursor = wr.Cursor
 	}
 }
+
+// WatchStatus tells how the watches of the leases of a subnet manager are
+// doing. The watches block until something changes, so one that doesn't return
+// isn't stuck; one that keeps failing, or whose receiver doesn't take the
+// changes, is.
+type WatchStatus struct {
+	// Watches is the number of watches running.
+	Watches int
+	// FailingSince is when the longest failing watch started to fail, zero
+	// if none is.
+	FailingSince time.Time
+	// LastError is the last error of that watch.
+	LastError error
+	// BlockedSince is when the longest waiting watch started to wait for its
+	// receiver to take the changes, zero if none is.
+	BlockedSince time.Time
+}
+
+type watchState struct {
+	failingSince time.Time
+	lastErr      error
+	blockedSince time.Time
+	// peers are the leases of the other nodes known to a watch of all the
+	// leases, nil until it got them.
+	peers []Lease
+}
+
+var (
+	watchesMux sync.Mutex
+	watches    = make(map[Manager][]*watchState)
+)
+
+func trackWatch(sm Manager) *watchState {
+	ws := &watchState{}
+	watchesMux.Lock()
+	watches[sm] = append(watches[sm], ws)
+	watchesMux.Unlock()
+	return ws
+}
+
+func untrackWatch(sm Manager, ws *watchState) {
+	watchesMux.Lock()
+	defer watchesMux.Unlock()
+	list := watches[sm]
+	for i := range list {
+		if list[i] == ws {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(watches, sm)
+	} else {
+		watches[sm] = list
+	}
+}
+
+// failed records the result of a call to the watch, err is nil on success.
+func (ws *watchState) failed(err error) {
+	watchesMux.Lock()
+	defer watchesMux.Unlock()
+	if err == nil {
+		ws.failingSince = time.Time{}
+	} else if ws.failingSince.IsZero() {
+		ws.failingSince = time.Now()
+	}
+	ws.lastErr = err
+}
+
+func (ws *watchState) blocked(b bool) {
+	watchesMux.Lock()
+	defer watchesMux.Unlock()
+	if b {
+		ws.blockedSince = time.Now()
+	} else {
+		ws.blockedSince = time.Time{}
+	}
+}
+
+// setPeers records a copy of the leases of the other nodes lw knows of.
+func (ws *watchState) setPeers(lw *leaseWatcher) {
+	peers := []Lease{}
+	for _, l := range lw.leases {
+		if lw.ownLease == nil || !l.Subnet.Equal(lw.ownLease.Subnet) {
+			peers = append(peers, l)
+		}
+	}
+
+	watchesMux.Lock()
+	defer watchesMux.Unlock()
+	ws.peers = peers
+}
+
+// GetWatchedLeases returns the leases of the other nodes known to the watch
+// WatchLeases runs on sm, and false if there's no such watch that got them.
+func GetWatchedLeases(sm Manager) ([]Lease, bool) {
+	watchesMux.Lock()
+	defer watchesMux.Unlock()
+	for _, ws := range watches[sm] {
+		if ws.peers != nil {
+			return ws.peers, true
+		}
+	}
+	return nil, false
+}
+
+// GetWatchStatus returns the status of the watches WatchLeases and WatchLease
+// run on sm.
+func GetWatchStatus(sm Manager) WatchStatus {
+	watchesMux.Lock()
+	defer watchesMux.Unlock()
+	status := WatchStatus{Watches: len(watches[sm])}
+	for _, ws := range watches[sm] {
+		if !ws.failingSince.IsZero() && (status.FailingSince.IsZero() || ws.failingSince.Before(status.FailingSince)) {
+			status.FailingSince = ws.failingSince
+			status.LastError = ws.lastErr
+		}
+		if !ws.blockedSince.IsZero() && (status.BlockedSince.IsZero() || ws.blockedSince.Before(status.BlockedSince)) {
+			status.BlockedSince = ws.blockedSince
+		}
+	}
+	return status
+}